@@ -0,0 +1,381 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive records the messages published to an MQTT server to segment files
+// on disk, and replays them. An Archiver is a service.Hook, registered with
+// Server.Hooks, so it records the messages published by clients as they arrive.
+//
+// Each segment file starts with a header, followed by the records. The name of a
+// segment is the time of its first record, in Unix nanoseconds, so the segments
+// sort in time order. A record is:
+//
+//	uint32 length of the rest of the record
+//	uint32 CRC-32 (IEEE) of the rest of the record
+//	int64  time, in Unix nanoseconds
+//	uint8  QoS
+//	uint8  flags, 0x01 if retained
+//	uint16 length of the client ID, then the client ID
+//	uint16 length of the topic, then the topic
+//	uint32 length of the payload, then the payload
+//
+// All the integers are big endian.
+package archive
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/surge/glog"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/topics"
+)
+
+const (
+	DefaultMaxSegmentSize  = 64 * 1024 * 1024
+	DefaultSegmentDuration = time.Hour
+	DefaultFlushInterval   = time.Second
+
+	// The suffix of the segment files
+	segmentExt = ".seg"
+
+	// The size of the fixed part of a record, before the client ID
+	recordHeaderSize = 4 + 4 + 8 + 1 + 1
+)
+
+var (
+	ErrNoDir          = errors.New("archive: No directory")
+	ErrArchiverClosed = errors.New("archive: Archiver closed")
+	ErrCorrupted      = errors.New("archive: Corrupted record")
+	ErrInvalidSegment = errors.New("archive: Invalid segment")
+
+	// The header of the segment files, with the version of the format
+	segmentHeader = []byte("SURGEMQ-ARCHIVE-1\n")
+)
+
+// Record is a message recorded in the archive.
+type Record struct {
+	// When the message was published
+	Time time.Time
+
+	// The client ID of the publisher
+	ClientId string
+
+	Topic   []byte
+	QoS     byte
+	Retain  bool
+	Payload []byte
+}
+
+// Config configures an Archiver.
+type Config struct {
+	// Dir is the directory of the segment files. It's created if needed.
+	Dir string
+
+	// Topics are the topic filters of the messages recorded. If not set then default
+	// to all the messages.
+	Topics []string
+
+	// A new segment is started once the current one is larger than MaxSegmentSize
+	// bytes, or older than SegmentDuration. If not set then default to 64MB and 1
+	// hour.
+	MaxSegmentSize  int64
+	SegmentDuration time.Duration
+
+	// MaxSegments is the number of segments kept. The oldest segments beyond that are
+	// deleted. If not set then all the segments are kept.
+	MaxSegments int
+
+	// FlushInterval is how often the records are written out to the segment file.
+	// Records not written out yet are lost if the process crashes. If not set then
+	// default to 1 second.
+	FlushInterval time.Duration
+}
+
+// Archiver appends the messages published to the topics it records to the current
+// segment.
+type Archiver struct {
+	service.NopHook
+
+	config Config
+	topics [][]byte
+
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+	started time.Time
+	closed  bool
+	buf     []byte
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+var _ service.Hook = (*Archiver)(nil)
+
+// New creates an Archiver, which starts a new segment with the first record.
+func New(config Config) (*Archiver, error) {
+	if config.Dir == "" {
+		return nil, ErrNoDir
+	}
+
+	if config.MaxSegmentSize <= 0 {
+		config.MaxSegmentSize = DefaultMaxSegmentSize
+	}
+
+	if config.SegmentDuration <= 0 {
+		config.SegmentDuration = DefaultSegmentDuration
+	}
+
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = DefaultFlushInterval
+	}
+
+	if len(config.Topics) == 0 {
+		config.Topics = []string{"#"}
+	}
+
+	this := &Archiver{
+		config: config,
+		quit:   make(chan struct{}),
+	}
+
+	var v topics.Validator
+	for _, t := range config.Topics {
+		if err := v.ValidateFilter([]byte(t)); err != nil {
+			return nil, fmt.Errorf("%v: %q", err, t)
+		}
+
+		this.topics = append(this.topics, []byte(t))
+	}
+
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	this.wg.Add(1)
+	go this.flusher()
+
+	return this, nil
+}
+
+// OnPublish records the message, if its topic matches the Topics.
+func (this *Archiver) OnPublish(client service.ClientInfo, msg *message.PublishMessage) error {
+	if !matchesAny(this.topics, msg.Topic()) {
+		return nil
+	}
+
+	err := this.Append(Record{
+		Time:     time.Now(),
+		ClientId: client.ClientId,
+		Topic:    msg.Topic(),
+		QoS:      msg.QoS(),
+		Retain:   msg.Retain(),
+		Payload:  msg.Payload(),
+	})
+	if err != nil {
+		glog.Errorf("archive/OnPublish: Error recording message to %q: %v", msg.Topic(), err)
+	}
+
+	// The message is published even if it couldn't be recorded
+	return nil
+}
+
+// Append adds a record to the current segment, regardless of the Topics.
+func (this *Archiver) Append(r Record) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return ErrArchiverClosed
+	}
+
+	if this.file != nil && (this.size >= this.config.MaxSegmentSize || r.Time.Sub(this.started) >= this.config.SegmentDuration) {
+		if err := this.closeSegment(); err != nil {
+			return err
+		}
+	}
+
+	if this.file == nil {
+		if err := this.openSegment(r.Time); err != nil {
+			return err
+		}
+	}
+
+	this.buf = encodeRecord(this.buf[:0], r)
+
+	n, err := this.w.Write(this.buf)
+	this.size += int64(n)
+
+	return err
+}
+
+// Flush writes out the records appended so far to the segment file.
+func (this *Archiver) Flush() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.w == nil {
+		return nil
+	}
+
+	return this.w.Flush()
+}
+
+// Close writes out the records appended so far, and closes the current segment.
+func (this *Archiver) Close() error {
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return nil
+	}
+
+	this.closed = true
+	err := this.closeSegment()
+	this.mu.Unlock()
+
+	close(this.quit)
+	this.wg.Wait()
+
+	return err
+}
+
+// openSegment() starts a new segment for the records from t on, and deletes the
+// oldest segments beyond MaxSegments. this.mu must be held.
+func (this *Archiver) openSegment(t time.Time) error {
+	path := filepath.Join(this.config.Dir, segmentName(t))
+
+	// A segment with the same name would be overwritten, which only happens if the
+	// clock goes backwards.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	this.file = f
+	this.w = bufio.NewWriter(f)
+	this.started = t
+
+	n, err := this.w.Write(segmentHeader)
+	this.size = int64(n)
+	if err != nil {
+		return err
+	}
+
+	if this.config.MaxSegments > 0 {
+		segs, err := segments(this.config.Dir)
+		if err != nil {
+			return err
+		}
+
+		for len(segs) > this.config.MaxSegments {
+			if err := os.Remove(segs[0].path); err != nil {
+				glog.Errorf("archive/openSegment: Error deleting segment: %v", err)
+			}
+			segs = segs[1:]
+		}
+	}
+
+	return nil
+}
+
+// closeSegment() writes out and closes the current segment. this.mu must be held.
+func (this *Archiver) closeSegment() error {
+	if this.file == nil {
+		return nil
+	}
+
+	err := this.w.Flush()
+	if err2 := this.file.Close(); err == nil {
+		err = err2
+	}
+
+	this.file = nil
+	this.w = nil
+
+	return err
+}
+
+// flusher() writes out the records every FlushInterval.
+func (this *Archiver) flusher() {
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(this.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.quit:
+			return
+
+		case <-ticker.C:
+			if err := this.Flush(); err != nil {
+				glog.Errorf("archive/flusher: Error writing records: %v", err)
+			}
+		}
+	}
+}
+
+func segmentName(t time.Time) string {
+	return fmt.Sprintf("%020d%s", t.UnixNano(), segmentExt)
+}
+
+// encodeRecord() appends the encoded record to b. The client ID and topic are cut
+// at 64KB, which MQTT doesn't allow anyway.
+func encodeRecord(b []byte, r Record) []byte {
+	cid := r.ClientId
+	if len(cid) > 0xffff {
+		cid = cid[:0xffff]
+	}
+
+	topic := r.Topic
+	if len(topic) > 0xffff {
+		topic = topic[:0xffff]
+	}
+
+	n := recordHeaderSize + 2 + len(cid) + 2 + len(topic) + 4 + len(r.Payload)
+
+	if cap(b) < n {
+		b = make([]byte, 0, n)
+	}
+	b = b[:n]
+
+	binary.BigEndian.PutUint32(b[0:], uint32(n-4))
+	binary.BigEndian.PutUint64(b[8:], uint64(r.Time.UnixNano()))
+	b[16] = r.QoS
+	b[17] = 0
+	if r.Retain {
+		b[17] = 0x01
+	}
+
+	off := recordHeaderSize
+	binary.BigEndian.PutUint16(b[off:], uint16(len(cid)))
+	off += 2 + copy(b[off+2:], cid)
+	binary.BigEndian.PutUint16(b[off:], uint16(len(topic)))
+	off += 2 + copy(b[off+2:], topic)
+	binary.BigEndian.PutUint32(b[off:], uint32(len(r.Payload)))
+	copy(b[off+4:], r.Payload)
+
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(b[8:]))
+
+	return b
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+)
+
+func TestArchiveReadWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	a, err := New(Config{Dir: dir, Topics: []string{"sensors/#"}})
+	require.NoError(t, err)
+
+	// Only the messages published to the topics are recorded
+	for _, topic := range []string{"sensors/1", "other", "sensors/2"} {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(topic))
+		msg.SetPayload([]byte("payload " + topic))
+		msg.SetQoS(1)
+		msg.SetRetain(topic == "sensors/2")
+
+		require.NoError(t, a.OnPublish(service.ClientInfo{ClientId: "c1"}, msg))
+	}
+
+	require.NoError(t, a.Close())
+	require.Equal(t, ErrArchiverClosed, a.Append(Record{Time: time.Now()}))
+
+	recs := readAll(t, dir, time.Time{}, time.Time{})
+	require.Len(t, recs, 2)
+
+	require.Equal(t, "c1", recs[0].ClientId)
+	require.Equal(t, "sensors/1", string(recs[0].Topic))
+	require.Equal(t, "payload sensors/1", string(recs[0].Payload))
+	require.Equal(t, byte(1), recs[0].QoS)
+	require.False(t, recs[0].Retain)
+
+	require.Equal(t, "sensors/2", string(recs[1].Topic))
+	require.True(t, recs[1].Retain)
+	require.False(t, recs[1].Time.Before(recs[0].Time))
+}
+
+func TestArchiveSegments(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	a, err := New(Config{Dir: dir, SegmentDuration: 10 * time.Second, MaxSegments: 3})
+	require.NoError(t, err)
+
+	// 10 records, 5 seconds apart, make 5 segments of which the last 3 are kept
+	base := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, a.Append(record(base.Add(time.Duration(i)*5*time.Second), i)))
+	}
+
+	require.NoError(t, a.Close())
+
+	segs, err := segments(dir)
+	require.NoError(t, err)
+	require.Len(t, segs, 3)
+
+	require.Equal(t, []string{"4", "5", "6", "7", "8", "9"}, payloads(readAll(t, dir, time.Time{}, time.Time{})))
+
+	// The range is inclusive, and crosses segments
+	from, to := base.Add(25*time.Second), base.Add(40*time.Second)
+	require.Equal(t, []string{"5", "6", "7", "8"}, payloads(readAll(t, dir, from, to)))
+
+	require.Len(t, readAll(t, dir, base.Add(time.Hour), time.Time{}), 0)
+}
+
+func TestArchiveSegmentSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	a, err := New(Config{Dir: dir, MaxSegmentSize: 80})
+	require.NoError(t, err)
+
+	base := time.Unix(1000, 0)
+	for i := 0; i < 6; i++ {
+		require.NoError(t, a.Append(record(base.Add(time.Duration(i)), i)))
+	}
+
+	require.NoError(t, a.Close())
+
+	// The header of 18 bytes and two records of 37 bytes each fill a segment
+	segs, err := segments(dir)
+	require.NoError(t, err)
+	require.Len(t, segs, 3)
+
+	require.Equal(t, []string{"0", "1", "2", "3", "4", "5"}, payloads(readAll(t, dir, time.Time{}, time.Time{})))
+}
+
+func TestArchiveDamaged(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	a, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+
+	base := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, a.Append(record(base.Add(time.Duration(i)), i)))
+	}
+
+	require.NoError(t, a.Close())
+
+	segs, err := segments(dir)
+	require.NoError(t, err)
+	require.Len(t, segs, 1)
+
+	b, err := ioutil.ReadFile(segs[0].path)
+	require.NoError(t, err)
+
+	// A record cut short ends the segment
+	require.NoError(t, ioutil.WriteFile(segs[0].path, b[:len(b)-3], 0644))
+	require.Equal(t, []string{"0", "1"}, payloads(readAll(t, dir, time.Time{}, time.Time{})))
+
+	// A damaged record fails
+	b[len(b)-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(segs[0].path, b, 0644))
+	require.Equal(t, ErrCorrupted, Read(dir, time.Time{}, time.Time{}, func(r Record) error { return nil }))
+}
+
+type testPublisher struct {
+	mu   sync.Mutex
+	msgs []*message.PublishMessage
+	at   []time.Time
+}
+
+func (this *testPublisher) Publish(msg *message.PublishMessage, onComplete service.OnCompleteFunc) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.msgs = append(this.msgs, msg)
+	this.at = append(this.at, time.Now())
+
+	return nil
+}
+
+func TestReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	a, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+
+	base := time.Unix(1000, 0)
+	for i := 0; i < 4; i++ {
+		r := record(base.Add(time.Duration(i)*50*time.Millisecond), i)
+		r.Retain = true
+		if i == 3 {
+			r.Topic = []byte("other")
+		}
+
+		require.NoError(t, a.Append(r))
+	}
+
+	require.NoError(t, a.Close())
+
+	// As fast as possible, from the second record on, without the other topic
+	pub := &testPublisher{}
+	n, err := Replay(context.Background(), dir, pub, ReplayOptions{
+		From:   base.Add(50 * time.Millisecond),
+		Topics: []string{"sensors/+"},
+		Retain: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, "sensors/1", string(pub.msgs[0].Topic()))
+	require.Equal(t, "1", string(pub.msgs[0].Payload()))
+	require.Equal(t, "2", string(pub.msgs[1].Payload()))
+	require.True(t, pub.msgs[0].Retain())
+
+	// At the original speed, without the retain flag
+	pub = &testPublisher{}
+	n, err = Replay(context.Background(), dir, pub, ReplayOptions{RealTime: true})
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+	require.False(t, pub.msgs[0].Retain())
+	require.True(t, pub.at[3].Sub(pub.at[0]) >= 150*time.Millisecond)
+
+	// Cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	n, err = Replay(ctx, dir, &testPublisher{}, ReplayOptions{})
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, 0, n)
+}
+
+func record(t time.Time, i int) Record {
+	return Record{
+		Time:     t,
+		ClientId: "c",
+		Topic:    []byte(fmt.Sprintf("sensors/%d", i)),
+		QoS:      1,
+		Payload:  []byte(fmt.Sprint(i)),
+	}
+}
+
+func readAll(t *testing.T, dir string, from, to time.Time) []Record {
+	var recs []Record
+
+	err := Read(dir, from, to, func(r Record) error {
+		r.Topic = append([]byte(nil), r.Topic...)
+		r.Payload = append([]byte(nil), r.Payload...)
+		recs = append(recs, r)
+		return nil
+	})
+	require.NoError(t, err)
+
+	return recs
+}
+
+func payloads(recs []Record) []string {
+	var p []string
+	for _, r := range recs {
+		p = append(p, string(r.Payload))
+	}
+
+	return p
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "archive")
+	require.NoError(t, err)
+
+	return filepath.Clean(dir)
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// segment is a segment file, and the time of its first record.
+type segment struct {
+	path  string
+	start int64
+}
+
+// segments() returns the segments in the directory, oldest first.
+func segments(dir string) ([]segment, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+
+	var segs []segment
+	for _, p := range paths {
+		start, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(p), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segs = append(segs, segment{path: p, start: start})
+	}
+
+	sort.Slice(segs, func(i, j int) bool { return segs[i].start < segs[j].start })
+
+	return segs, nil
+}
+
+// Read calls fn, in order, for the records in the archive in dir from the time from
+// to the time to, both included. A zero time means no bound. Reading stops at the
+// first error returned by fn, which Read returns. A record cut short at the end of a
+// segment, as left by a crash, ends the segment, but a record that fails its
+// checksum returns ErrCorrupted.
+func Read(dir string, from, to time.Time, fn func(Record) error) error {
+	segs, err := segments(dir)
+	if err != nil {
+		return err
+	}
+
+	for i, s := range segs {
+		// The records of a segment are older than the start of the next one
+		if !from.IsZero() && i+1 < len(segs) && segs[i+1].start <= from.UnixNano() {
+			continue
+		}
+
+		if !to.IsZero() && s.start > to.UnixNano() {
+			break
+		}
+
+		if err := readSegment(s.path, from, to, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readSegment(path string, from, to time.Time, fn func(Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	header := make([]byte, len(segmentHeader))
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header, segmentHeader) {
+		return ErrInvalidSegment
+	}
+
+	var buf []byte
+
+	for {
+		var rec Record
+
+		rec, buf, err = decodeRecord(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if (!from.IsZero() && rec.Time.Before(from)) || (!to.IsZero() && rec.Time.After(to)) {
+			continue
+		}
+
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeRecord() reads the next record, using buf if it's large enough. The topic and
+// payload of the record point into the buffer returned, which is reused by the next
+// call.
+func decodeRecord(r io.Reader, buf []byte) (Record, []byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return Record{}, buf, err
+	}
+
+	n := int(binary.BigEndian.Uint32(size[:]))
+	if n < recordHeaderSize-4+2+2+4 {
+		return Record{}, buf, ErrCorrupted
+	}
+
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	b := buf[:n]
+
+	if _, err := io.ReadFull(r, b); err != nil {
+		return Record{}, buf, io.ErrUnexpectedEOF
+	}
+
+	if binary.BigEndian.Uint32(b) != crc32.ChecksumIEEE(b[4:]) {
+		return Record{}, buf, ErrCorrupted
+	}
+
+	rec := Record{
+		Time:   time.Unix(0, int64(binary.BigEndian.Uint64(b[4:]))),
+		QoS:    b[12],
+		Retain: b[13]&0x01 != 0,
+	}
+
+	// The lengths are covered by the checksum, but are still checked so a bug can't
+	// cause a panic.
+	off := recordHeaderSize - 4
+
+	field := func(lsize int) ([]byte, bool) {
+		if off+lsize > len(b) {
+			return nil, false
+		}
+
+		var l int
+		if lsize == 2 {
+			l = int(binary.BigEndian.Uint16(b[off:]))
+		} else {
+			l = int(binary.BigEndian.Uint32(b[off:]))
+		}
+
+		off += lsize
+		if off+l > len(b) {
+			return nil, false
+		}
+
+		f := b[off : off+l]
+		off += l
+
+		return f, true
+	}
+
+	cid, ok1 := field(2)
+	topic, ok2 := field(2)
+	payload, ok3 := field(4)
+	if !ok1 || !ok2 || !ok3 {
+		return Record{}, buf, ErrCorrupted
+	}
+
+	rec.ClientId = string(cid)
+	rec.Topic = topic
+	rec.Payload = payload
+
+	return rec, buf, nil
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// Publisher publishes messages, like service.Client and service.Server do.
+type Publisher interface {
+	Publish(msg *message.PublishMessage, onComplete service.OnCompleteFunc) error
+}
+
+// ReplayOptions selects the records replayed, and how.
+type ReplayOptions struct {
+	// From and To bound the time range of the records, both included. A zero time
+	// means no bound.
+	From time.Time
+	To   time.Time
+
+	// Topics are the topic filters of the records replayed. If not set then all the
+	// records are replayed.
+	Topics []string
+
+	// RealTime waits between the messages as long as there was between the original
+	// messages. If not set then the messages are published as fast as possible.
+	RealTime bool
+
+	// Retain publishes the messages that were retained as retained. If not set then
+	// no message is retained, so a replay doesn't replace the retained messages.
+	Retain bool
+}
+
+// Replay publishes the records of the archive in dir with pub, with their original
+// topic, QoS and payload. It returns the number of messages published. It stops at
+// the first error, or when ctx is done.
+func Replay(ctx context.Context, dir string, pub Publisher, opts ReplayOptions) (int, error) {
+	var (
+		filters [][]byte
+		v       topics.Validator
+	)
+
+	for _, t := range opts.Topics {
+		if err := v.ValidateFilter([]byte(t)); err != nil {
+			return 0, fmt.Errorf("%v: %q", err, t)
+		}
+
+		filters = append(filters, []byte(t))
+	}
+
+	var (
+		n     int
+		first time.Time
+		start time.Time
+	)
+
+	err := Read(dir, opts.From, opts.To, func(r Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if len(filters) > 0 && !matchesAny(filters, r.Topic) {
+			return nil
+		}
+
+		if opts.RealTime {
+			if first.IsZero() {
+				first, start = r.Time, time.Now()
+			} else if d := r.Time.Sub(first) - time.Since(start); d > 0 {
+				t := time.NewTimer(d)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return ctx.Err()
+
+				case <-t.C:
+				}
+			}
+		}
+
+		// The record points into a buffer that's reused for the next one, while the
+		// publisher may hold on to the message.
+		msg := message.NewPublishMessage()
+		msg.SetTopic(append([]byte(nil), r.Topic...))
+		msg.SetPayload(append([]byte(nil), r.Payload...))
+		msg.SetQoS(r.QoS)
+		msg.SetRetain(opts.Retain && r.Retain)
+
+		if err := pub.Publish(msg, nil); err != nil {
+			return err
+		}
+
+		n++
+		return nil
+	})
+
+	return n, err
+}
+
+func matchesAny(filters [][]byte, topic []byte) bool {
+	for _, f := range filters {
+		if topics.Match(f, topic) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -30,6 +30,12 @@ type Authenticator interface {
 	Authenticate(id string, cred interface{}) error
 }
 
+// Attributer is implemented by authenticators that keep extra attributes for each
+// user, such as rate limits.
+type Attributer interface {
+	Attributes(id string) (map[string]string, error)
+}
+
 func Register(name string, provider Authenticator) {
 	if provider == nil {
 		panic("auth: Register provide is nil")
@@ -62,3 +68,13 @@ func NewManager(providerName string) (*Manager, error) {
 func (this *Manager) Authenticate(id string, cred interface{}) error {
 	return this.p.Authenticate(id, cred)
 }
+
+// Attributes returns the attributes of the user if the provider is an Attributer.
+// Otherwise it returns nil.
+func (this *Manager) Attributes(id string) (map[string]string, error) {
+	if a, ok := this.p.(Attributer); ok {
+		return a.Attributes(id)
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,338 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surge/glog"
+)
+
+const (
+	// DefaultReloadInterval is how often the file authenticator checks whether the
+	// password file changed, if no interval is given.
+	DefaultReloadInterval = 5 * time.Second
+)
+
+var _ Authenticator = (*fileAuthenticator)(nil)
+
+// PasswordFile is a password file in the format of mosquitto, with a "user:hash"
+// line for each user, where the hash is in one of the formats of CheckPassword.
+// Blank lines and lines starting with '#' are kept as they are.
+type PasswordFile struct {
+	lines []string
+
+	// The line of each user
+	users map[string]int
+}
+
+// ReadPasswordFile reads the password file at path. If the file doesn't exist, it
+// returns an empty PasswordFile along with the error.
+func ReadPasswordFile(path string) (*PasswordFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return &PasswordFile{users: make(map[string]int)}, err
+	}
+	defer f.Close()
+
+	return ParsePasswordFile(f)
+}
+
+// ParsePasswordFile reads a password file from r.
+func ParsePasswordFile(r io.Reader) (*PasswordFile, error) {
+	this := &PasswordFile{users: make(map[string]int)}
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimRight(s.Text(), "\r")
+
+		if t := strings.TrimSpace(line); t == "" || t[0] == '#' {
+			this.lines = append(this.lines, line)
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i <= 0 || i == len(line)-1 {
+			return nil, fmt.Errorf("auth: Invalid password file line %d", n)
+		}
+
+		user := line[:i]
+		if _, ok := this.users[user]; ok {
+			return nil, fmt.Errorf("auth: Duplicate user %q in password file line %d", user, n)
+		}
+
+		this.users[user] = len(this.lines)
+		this.lines = append(this.lines, line)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// Hash returns the password hash of the user, and false if the user is not in the
+// file.
+func (this *PasswordFile) Hash(user string) (string, bool) {
+	i, ok := this.users[user]
+	if !ok {
+		return "", false
+	}
+
+	return this.lines[i][len(user)+1:], true
+}
+
+// Set sets the password hash of the user, adding the user at the end of the file if
+// it's not there yet.
+func (this *PasswordFile) Set(user, hash string) error {
+	if user == "" || strings.ContainsAny(user, ":\r\n") || strings.HasPrefix(user, "#") {
+		return fmt.Errorf("auth: Invalid user name %q", user)
+	}
+
+	if hash == "" || strings.ContainsAny(hash, "\r\n") {
+		return fmt.Errorf("auth: Invalid password hash for user %q", user)
+	}
+
+	if i, ok := this.users[user]; ok {
+		this.lines[i] = user + ":" + hash
+		return nil
+	}
+
+	this.users[user] = len(this.lines)
+	this.lines = append(this.lines, user+":"+hash)
+
+	return nil
+}
+
+// Remove removes the user from the file. It returns false if the user is not in the
+// file.
+func (this *PasswordFile) Remove(user string) bool {
+	i, ok := this.users[user]
+	if !ok {
+		return false
+	}
+
+	this.lines = append(this.lines[:i], this.lines[i+1:]...)
+	delete(this.users, user)
+
+	for u, j := range this.users {
+		if j > i {
+			this.users[u] = j - 1
+		}
+	}
+
+	return true
+}
+
+// Users returns the users in the order of the file.
+func (this *PasswordFile) Users() []string {
+	users := make([]string, 0, len(this.users))
+
+	for _, line := range this.lines {
+		if i := strings.Index(line, ":"); i > 0 {
+			if _, ok := this.users[line[:i]]; ok {
+				users = append(users, line[:i])
+			}
+		}
+	}
+
+	return users
+}
+
+// Write writes the password file to path, readable by its owner only. The file is
+// replaced at once, so the file authenticator never reads it half written.
+func (this *PasswordFile) Write(path string) error {
+	var buf bytes.Buffer
+	for _, line := range this.lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// TempFile already makes the file readable by its owner only
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// fileAuthenticator authenticates the users of a password file, which is read again
+// when it changes. Register it to use it, e.g.
+// auth.Register("file", auth.NewFileAuthenticator(path, 0)).
+type fileAuthenticator struct {
+	path string
+
+	mu      sync.RWMutex
+	file    *PasswordFile
+	modTime time.Time
+	size    int64
+
+	quit  chan struct{}
+	qonce sync.Once
+}
+
+// NewFileAuthenticator returns an authenticator for the users of the password file
+// at path. The file is checked for changes every interval, and read again once it
+// changed and then stayed the same for an interval. If the new content is invalid,
+// the users read before are kept. If interval is 0 then default to 5 seconds, and
+// if it's negative then the file is only read again by Reload.
+func NewFileAuthenticator(path string, interval time.Duration) (*fileAuthenticator, error) {
+	this := &fileAuthenticator{
+		path: path,
+		quit: make(chan struct{}),
+	}
+
+	if err := this.Reload(); err != nil {
+		return nil, err
+	}
+
+	if interval == 0 {
+		interval = DefaultReloadInterval
+	}
+
+	if interval > 0 {
+		go this.watch(interval)
+	}
+
+	return this, nil
+}
+
+// Authenticate checks the password, which is the cred string, against the hash of
+// the user. It returns ErrAuthFailure if the user is not in the file, or the password
+// doesn't match.
+func (this *fileAuthenticator) Authenticate(id string, cred interface{}) error {
+	password, ok := cred.(string)
+	if !ok {
+		return ErrAuthFailure
+	}
+
+	this.mu.RLock()
+	hash, ok := this.file.Hash(id)
+	this.mu.RUnlock()
+
+	if !ok {
+		return ErrAuthFailure
+	}
+
+	return CheckPassword(hash, password)
+}
+
+// Reload reads the password file again.
+func (this *fileAuthenticator) Reload() error {
+	fi, err := os.Stat(this.path)
+	if err != nil {
+		return err
+	}
+
+	f, err := ReadPasswordFile(this.path)
+	if err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.file = f
+	this.modTime = fi.ModTime()
+	this.size = fi.Size()
+
+	return nil
+}
+
+// Close stops checking the password file for changes.
+func (this *fileAuthenticator) Close() error {
+	this.qonce.Do(func() {
+		close(this.quit)
+	})
+
+	return nil
+}
+
+// watch() reads the password file again whenever its modification time or size
+// changes, until Close is called. The file is only read once it has stayed the same
+// for an interval, so a file that's being written, e.g. truncated by an editor, is
+// not read half way.
+func (this *fileAuthenticator) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// The modification time and size seen at the previous tick
+	var (
+		seenTime time.Time
+		seenSize int64 = -1
+	)
+
+	for {
+		select {
+		case <-this.quit:
+			return
+
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(this.path)
+		if err != nil {
+			glog.Errorf("auth/watch: Error checking password file: %v", err)
+			continue
+		}
+
+		this.mu.RLock()
+		changed := !fi.ModTime().Equal(this.modTime) || fi.Size() != this.size
+		this.mu.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		if !fi.ModTime().Equal(seenTime) || fi.Size() != seenSize {
+			seenTime, seenSize = fi.ModTime(), fi.Size()
+			continue
+		}
+
+		if err := this.Reload(); err != nil {
+			glog.Errorf("auth/watch: Error reading password file, keeping the users read before: %v", err)
+			continue
+		}
+
+		glog.Infof("auth/watch: Password file %s reloaded", this.path)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordFile(t *testing.T) {
+	f, err := ParsePasswordFile(strings.NewReader("# users\nalice:$2a$04$abc\n\nbob:pbkdf2_sha256$1000$salt$abc\r\ncarol:$argon2id$abc\n"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice", "bob", "carol"}, f.Users())
+
+	h, ok := f.Hash("bob")
+	require.True(t, ok)
+	require.Equal(t, "pbkdf2_sha256$1000$salt$abc", h)
+
+	_, ok = f.Hash("dave")
+	require.False(t, ok)
+
+	require.True(t, f.Remove("bob"))
+	require.False(t, f.Remove("bob"))
+	require.NoError(t, f.Set("dave", "$2a$04$def"))
+	require.NoError(t, f.Set("alice", "$2a$04$ghi"))
+	require.Equal(t, []string{"alice", "carol", "dave"}, f.Users())
+
+	h, ok = f.Hash("carol")
+	require.True(t, ok)
+	require.Equal(t, "$argon2id$abc", h)
+
+	for _, user := range []string{"", "a:b", "#a", "a\nb"} {
+		require.Error(t, f.Set(user, "$2a$04$def"), user)
+	}
+	require.Error(t, f.Set("erin", ""))
+
+	path := filepath.Join(t.TempDir(), "passwords")
+	require.NoError(t, f.Write(path))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "# users\nalice:$2a$04$ghi\n\ncarol:$argon2id$abc\ndave:$2a$04$def\n", string(data))
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	for _, content := range []string{"alice", "alice:", ":hash", "alice:a\nalice:b"} {
+		_, err := ParsePasswordFile(strings.NewReader(content))
+		require.Error(t, err, content)
+	}
+
+	f, err = ReadPasswordFile(filepath.Join(t.TempDir(), "missing"))
+	require.True(t, os.IsNotExist(err))
+	require.Empty(t, f.Users())
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwords")
+
+	f, _ := ReadPasswordFile(path)
+	h, err := HashBcrypt("alicepass", 4)
+	require.NoError(t, err)
+	require.NoError(t, f.Set("alice", h))
+	require.NoError(t, f.Write(path))
+
+	a, err := NewFileAuthenticator(path, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer a.Close()
+
+	require.NoError(t, a.Authenticate("alice", "alicepass"))
+	require.Equal(t, ErrAuthFailure, a.Authenticate("alice", "wrong"))
+	require.Equal(t, ErrAuthFailure, a.Authenticate("bob", "bobpass"))
+	require.Equal(t, ErrAuthFailure, a.Authenticate("alice", nil))
+
+	// The changes are picked up without a restart
+	h, err = HashPBKDF2("bobpass", 1000)
+	require.NoError(t, err)
+	require.NoError(t, f.Set("bob", h))
+	f.Remove("alice")
+	require.NoError(t, f.Write(path))
+
+	waitFor := func(user, password string, want error) {
+		for i := 0; i < 100 && a.Authenticate(user, password) != want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.Equal(t, want, a.Authenticate(user, password))
+	}
+
+	waitFor("bob", "bobpass", nil)
+	waitFor("alice", "alicepass", ErrAuthFailure)
+
+	// An invalid file keeps the users read before
+	require.NoError(t, ioutil.WriteFile(path, []byte("garbage\n"), 0600))
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, a.Authenticate("bob", "bobpass"))
+	require.Error(t, a.Reload())
+
+	_, err = NewFileAuthenticator(filepath.Join(t.TempDir(), "missing"), -1)
+	require.Error(t, err)
+}
@@ -39,3 +39,32 @@ func TestMockFailureAuthenticator(t *testing.T) {
 	require.NoError(t, err)
 	require.Error(t, mgr.Authenticate("", ""))
 }
+
+type attrAuthenticator map[string]map[string]string
+
+func (this attrAuthenticator) Authenticate(id string, cred interface{}) error {
+	return nil
+}
+
+func (this attrAuthenticator) Attributes(id string) (map[string]string, error) {
+	return this[id], nil
+}
+
+func TestManagerAttributes(t *testing.T) {
+	mgr, err := NewManager("mockSuccess")
+	require.NoError(t, err)
+
+	attrs, err := mgr.Attributes("surgemq")
+	require.NoError(t, err)
+	require.Nil(t, attrs)
+
+	Register("attrs", attrAuthenticator{"surgemq": {"msgrate": "10"}})
+	defer Unregister("attrs")
+
+	mgr, err = NewManager("attrs")
+	require.NoError(t, err)
+
+	attrs, err = mgr.Attributes("surgemq")
+	require.NoError(t, err)
+	require.Equal(t, "10", attrs["msgrate"])
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// DefaultPBKDF2Iterations is the number of iterations of the hashes made by
+	// HashPBKDF2 if none is given.
+	DefaultPBKDF2Iterations = 260000
+)
+
+var (
+	// ErrUnknownHash is returned by CheckPassword if the format of the hash is not
+	// known.
+	ErrUnknownHash = errors.New("auth: Unknown password hash format")
+)
+
+// CheckPassword checks the password against a salted hash, which is either a
+// bcrypt hash, e.g. "$2a$10$...", an Argon2 hash in the PHC format, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=4$...", or a PBKDF2 hash in the format used by
+// Django, "pbkdf2_<digest>$<iterations>$<salt>$<base64 hash>", where the digest is
+// sha1, sha256 or sha512. It returns ErrAuthFailure if the password doesn't match.
+func CheckPassword(hashed, password string) error {
+	switch {
+	case strings.HasPrefix(hashed, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrAuthFailure
+		}
+		return err
+
+	case strings.HasPrefix(hashed, "$argon2"):
+		return checkArgon2(hashed, password)
+
+	case strings.HasPrefix(hashed, "pbkdf2_"):
+		return checkPBKDF2(hashed, password)
+	}
+
+	return ErrUnknownHash
+}
+
+// HashBcrypt returns the bcrypt hash of the password. If cost is 0 then default to
+// bcrypt.DefaultCost.
+func HashBcrypt(password string, cost int) (string, error) {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+
+	h, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(h), nil
+}
+
+// HashArgon2 returns the Argon2id hash of the password, with a random salt, in the
+// PHC format, using 64MB of memory, 3 passes and 4 threads.
+func HashArgon2(password string) (string, error) {
+	const (
+		memory  = 64 * 1024
+		time    = 3
+		threads = 4
+	)
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, 32)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// HashPBKDF2 returns the PBKDF2-SHA256 hash of the password, with a random salt, in
+// the format checked by CheckPassword. If iterations is 0 then default to 260000.
+func HashPBKDF2(password string, iterations int) (string, error) {
+	if iterations == 0 {
+		iterations = DefaultPBKDF2Iterations
+	}
+
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	salt := base64.RawURLEncoding.EncodeToString(b)
+
+	key := pbkdf2.Key([]byte(password), []byte(salt), iterations, sha256.Size, sha256.New)
+
+	return fmt.Sprintf("pbkdf2_sha256$%d$%s$%s", iterations, salt, base64.StdEncoding.EncodeToString(key)), nil
+}
+
+func checkPBKDF2(hashed, password string) error {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 4 {
+		return ErrUnknownHash
+	}
+
+	var h func() hash.Hash
+
+	switch parts[0] {
+	case "pbkdf2_sha1":
+		h = sha1.New
+	case "pbkdf2_sha256":
+		h = sha256.New
+	case "pbkdf2_sha512":
+		h = sha512.New
+	default:
+		return ErrUnknownHash
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return ErrUnknownHash
+	}
+
+	want, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return ErrUnknownHash
+	}
+
+	got := pbkdf2.Key([]byte(password), []byte(parts[2]), iterations, len(want), h)
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return ErrAuthFailure
+	}
+
+	return nil
+}
+
+func checkArgon2(hashed, password string) error {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=4", salt, hash
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 {
+		return ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return ErrUnknownHash
+	}
+
+	var (
+		memory, time uint32
+		threads      uint8
+	)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time == 0 || threads == 0 {
+		return ErrUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return ErrUnknownHash
+	}
+
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return ErrUnknownHash
+	}
+
+	var got []byte
+
+	switch parts[1] {
+	case "argon2id":
+		got = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	case "argon2i":
+		got = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	default:
+		return ErrUnknownHash
+	}
+
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return ErrAuthFailure
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPassword(t *testing.T) {
+	h, err := HashBcrypt("verysecret", 4)
+	require.NoError(t, err)
+	require.NoError(t, CheckPassword(h, "verysecret"))
+	require.Equal(t, ErrAuthFailure, CheckPassword(h, "wrong"))
+
+	h, err = HashPBKDF2("verysecret", 1000)
+	require.NoError(t, err)
+	require.NoError(t, CheckPassword(h, "verysecret"))
+	require.Equal(t, ErrAuthFailure, CheckPassword(h, "wrong"))
+
+	h, err = HashArgon2("verysecret")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(h, "$argon2id$v=19$m=65536,t=3,p=4$"))
+	require.NoError(t, CheckPassword(h, "verysecret"))
+	require.Equal(t, ErrAuthFailure, CheckPassword(h, "wrong"))
+
+	// The example of the Argon2 reference implementation
+	ref := "$argon2i$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG"
+	require.NoError(t, CheckPassword(ref, "password"))
+	require.Equal(t, ErrAuthFailure, CheckPassword(ref, "verysecret"))
+
+	h2, err := HashPBKDF2("verysecret", 1000)
+	require.NoError(t, err)
+	require.NotEqual(t, h, h2)
+
+	// A hash of "verysecret" made by Django
+	django := "pbkdf2_sha256$1000$saltysalt$C+aA+czHCsxnQWKo6U7uS0NP/dC1/Beb54BsGB2axgQ="
+	require.NoError(t, CheckPassword(django, "verysecret"))
+
+	for _, h := range []string{"", "verysecret", "md5$abc", "$argon2d$v=19$m=4096,t=3,p=1$c2FsdA$aGFzaA", "$argon2id$v=16$m=4096,t=3,p=1$c2FsdA$aGFzaA", "$argon2id$v=19$m=4096$c2FsdA$aGFzaA", "pbkdf2_md5$1000$salt$abcd", "pbkdf2_sha256$x$salt$abcd", "pbkdf2_sha256$1000$salt", "pbkdf2_sha256$1000$salt$!!"} {
+		require.Equal(t, ErrUnknownHash, CheckPassword(h, "verysecret"), h)
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSQLQuery is the query of the SQL authenticator if none is set.
+	DefaultSQLQuery = "SELECT password FROM mqtt_users WHERE username = ?"
+
+	// DefaultSQLCacheTTL is how long the SQL authenticator caches the users if no
+	// TTL is set.
+	DefaultSQLCacheTTL = time.Minute
+)
+
+var (
+	// MaxCachedUsers is the maximum number of users cached by each SQL
+	// authenticator. When the cache is full, it's emptied.
+	MaxCachedUsers = 4096
+)
+
+var (
+	_ Authenticator = (*sqlAuthenticator)(nil)
+	_ Attributer    = (*sqlAuthenticator)(nil)
+)
+
+// SQLConfig configures the authenticator created by NewSQLAuthenticator.
+type SQLConfig struct {
+	// DB is the database of the users.
+	DB *sql.DB
+
+	// Query selects the salted password hash of the user, whose username is the
+	// only argument, as the first column, in a format known to CheckPassword. The
+	// other columns are the attributes of the user, named after the columns, unless
+	// they are NULL. For example "SELECT password, clientids, maxconns FROM users
+	// WHERE username = ?", where the placeholder depends on the database driver. If
+	// not set then default to "SELECT password FROM mqtt_users WHERE username = ?".
+	Query string
+
+	// CacheTTL is how long the users, including the unknown ones, are cached before
+	// they are selected again. Cached users that already authenticated with the same
+	// password are not checked against the hash again. If negative then the users
+	// are not cached. If not set then default to 1 minute.
+	CacheTTL time.Duration
+}
+
+// sqlAuthenticator authenticates the users found in a SQL database, and provides
+// their attributes. Register it to use it, e.g.
+// auth.Register("sql", auth.NewSQLAuthenticator(config)).
+type sqlAuthenticator struct {
+	db    *sql.DB
+	query string
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*sqlUser
+
+	// The random key of the HMACs of the verified passwords. If nil, the verified
+	// passwords are not cached.
+	key []byte
+
+	// now returns the current time, replaced by tests
+	now func() time.Time
+}
+
+// sqlUser is a user as selected from the database, or a user that doesn't exist if
+// found is false.
+type sqlUser struct {
+	found   bool
+	hash    string
+	attrs   map[string]string
+	expires time.Time
+
+	// The HMAC of the last password that matched the hash, protected by mu. It's
+	// keyed with sqlAuthenticator.key, so it's no faster to guess passwords from
+	// than the hash itself.
+	verified []byte
+}
+
+// NewSQLAuthenticator returns an authenticator for the users of a SQL database. It
+// also provides the attributes of the users, see Attributer.
+func NewSQLAuthenticator(config SQLConfig) *sqlAuthenticator {
+	if config.Query == "" {
+		config.Query = DefaultSQLQuery
+	}
+
+	if config.CacheTTL == 0 {
+		config.CacheTTL = DefaultSQLCacheTTL
+	}
+
+	this := &sqlAuthenticator{
+		db:    config.DB,
+		query: config.Query,
+		ttl:   config.CacheTTL,
+		cache: make(map[string]*sqlUser),
+		now:   time.Now,
+	}
+
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err == nil {
+		this.key = key
+	}
+
+	return this
+}
+
+// Authenticate checks the password, which is the cred string, against the hash of
+// the user. It returns ErrAuthFailure if the user doesn't exist or the password
+// doesn't match, and the error of the database if the user can't be selected.
+func (this *sqlAuthenticator) Authenticate(id string, cred interface{}) error {
+	password, ok := cred.(string)
+	if !ok {
+		return ErrAuthFailure
+	}
+
+	u, err := this.user(id)
+	if err != nil {
+		return err
+	}
+
+	if !u.found {
+		return ErrAuthFailure
+	}
+
+	if this.key == nil {
+		return CheckPassword(u.hash, password)
+	}
+
+	mac := hmac.New(sha256.New, this.key)
+	mac.Write([]byte(password))
+	sum := mac.Sum(nil)
+
+	this.mu.Lock()
+	verified := u.verified != nil && subtle.ConstantTimeCompare(u.verified, sum) == 1
+	this.mu.Unlock()
+
+	if verified {
+		return nil
+	}
+
+	if err := CheckPassword(u.hash, password); err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	u.verified = sum
+	this.mu.Unlock()
+
+	return nil
+}
+
+// Attributes returns the attributes of the user, or nil if the user doesn't exist.
+func (this *sqlAuthenticator) Attributes(id string) (map[string]string, error) {
+	u, err := this.user(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.attrs, nil
+}
+
+// Invalidate removes the user from the cache, e.g. after the password changed. If id
+// is empty then all the users are removed.
+func (this *sqlAuthenticator) Invalidate(id string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if id == "" {
+		this.cache = make(map[string]*sqlUser)
+		return
+	}
+
+	delete(this.cache, id)
+}
+
+// user() returns the user from the cache, or from the database if it's not cached or
+// has expired.
+func (this *sqlAuthenticator) user(id string) (*sqlUser, error) {
+	now := this.now()
+
+	this.mu.Lock()
+	u, ok := this.cache[id]
+	this.mu.Unlock()
+
+	if ok && now.Before(u.expires) {
+		return u, nil
+	}
+
+	u, err := this.selectUser(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if this.ttl > 0 {
+		u.expires = now.Add(this.ttl)
+
+		this.mu.Lock()
+		if len(this.cache) >= MaxCachedUsers {
+			this.cache = make(map[string]*sqlUser)
+		}
+		this.cache[id] = u
+		this.mu.Unlock()
+	}
+
+	return u, nil
+}
+
+// selectUser() selects the user from the database.
+func (this *sqlAuthenticator) selectUser(id string) (*sqlUser, error) {
+	rows, err := this.db.Query(this.query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return &sqlUser{}, rows.Err()
+	}
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	vals := make([]sql.NullString, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+
+	u := &sqlUser{
+		found: vals[0].Valid,
+		hash:  vals[0].String,
+	}
+
+	for i, col := range cols[1:] {
+		if v := vals[i+1]; v.Valid {
+			if u.attrs == nil {
+				u.attrs = make(map[string]string)
+			}
+			u.attrs[col] = v.String
+		}
+	}
+
+	return u, nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+)
+
+func newSQLDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "users.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`CREATE TABLE mqtt_users (
+		username TEXT PRIMARY KEY,
+		password TEXT,
+		clientids TEXT,
+		maxconns INTEGER
+	)`)
+	require.NoError(t, err)
+
+	bc, err := HashBcrypt("bcryptpass", 4)
+	require.NoError(t, err)
+
+	pb, err := HashPBKDF2("pbkdf2pass", 1000)
+	require.NoError(t, err)
+
+	_, err = db.Exec(`INSERT INTO mqtt_users VALUES (?, ?, ?, ?), (?, ?, NULL, NULL), (?, NULL, NULL, NULL)`,
+		"alice", bc, "sensor-*", 2, "bob", pb, "nopass")
+	require.NoError(t, err)
+
+	return db
+}
+
+func TestSQLAuthenticator(t *testing.T) {
+	db := newSQLDB(t)
+
+	a := NewSQLAuthenticator(SQLConfig{DB: db})
+
+	require.NoError(t, a.Authenticate("alice", "bcryptpass"))
+	require.NoError(t, a.Authenticate("bob", "pbkdf2pass"))
+	require.Equal(t, ErrAuthFailure, a.Authenticate("alice", "pbkdf2pass"))
+	require.Equal(t, ErrAuthFailure, a.Authenticate("carol", "bcryptpass"))
+	require.Equal(t, ErrAuthFailure, a.Authenticate("nopass", ""))
+	require.Equal(t, ErrAuthFailure, a.Authenticate("alice", []byte("bcryptpass")))
+
+	// Only the default query's columns are there
+	attrs, err := a.Attributes("alice")
+	require.NoError(t, err)
+	require.Nil(t, attrs)
+
+	Register("sql", NewSQLAuthenticator(SQLConfig{
+		DB:    db,
+		Query: "SELECT password, clientids, maxconns FROM mqtt_users WHERE username = ?",
+	}))
+	defer Unregister("sql")
+
+	mgr, err := NewManager("sql")
+	require.NoError(t, err)
+	require.NoError(t, mgr.Authenticate("alice", "bcryptpass"))
+
+	attrs, err = mgr.Attributes("alice")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"clientids": "sensor-*", "maxconns": "2"}, attrs)
+
+	attrs, err = mgr.Attributes("bob")
+	require.NoError(t, err)
+	require.Nil(t, attrs)
+
+	attrs, err = mgr.Attributes("carol")
+	require.NoError(t, err)
+	require.Nil(t, attrs)
+
+	a = NewSQLAuthenticator(SQLConfig{DB: db, Query: "SELECT nothing FROM nowhere WHERE username = ?"})
+	require.Error(t, a.Authenticate("alice", "bcryptpass"))
+	require.NotEqual(t, ErrAuthFailure, a.Authenticate("alice", "bcryptpass"))
+}
+
+func TestSQLAuthenticatorCache(t *testing.T) {
+	db := newSQLDB(t)
+
+	a := NewSQLAuthenticator(SQLConfig{DB: db, CacheTTL: time.Minute})
+
+	now := time.Unix(1400000000, 0)
+	a.now = func() time.Time { return now }
+
+	require.NoError(t, a.Authenticate("alice", "bcryptpass"))
+	require.Equal(t, ErrAuthFailure, a.Authenticate("carol", "carolpass"))
+
+	// The cache doesn't keep a plain hash of the password
+	sum := sha256.Sum256([]byte("bcryptpass"))
+	require.Len(t, a.cache["alice"].verified, sha256.Size)
+	require.NotEqual(t, sum[:], a.cache["alice"].verified)
+
+	// The changes are seen once the cache expires
+	h, err := HashBcrypt("newpass", 4)
+	require.NoError(t, err)
+	_, err = db.Exec("UPDATE mqtt_users SET password = ? WHERE username = ?", h, "alice")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO mqtt_users (username, password) VALUES (?, ?)", "carol", h)
+	require.NoError(t, err)
+
+	require.NoError(t, a.Authenticate("alice", "bcryptpass"))
+	require.Equal(t, ErrAuthFailure, a.Authenticate("alice", "newpass"))
+	require.Equal(t, ErrAuthFailure, a.Authenticate("carol", "newpass"))
+
+	now = now.Add(time.Minute)
+	require.Equal(t, ErrAuthFailure, a.Authenticate("alice", "bcryptpass"))
+	require.NoError(t, a.Authenticate("alice", "newpass"))
+	require.NoError(t, a.Authenticate("carol", "newpass"))
+
+	// Or right away once invalidated
+	_, err = db.Exec("DELETE FROM mqtt_users WHERE username = ?", "carol")
+	require.NoError(t, err)
+	require.NoError(t, a.Authenticate("carol", "newpass"))
+
+	a.Invalidate("carol")
+	require.Equal(t, ErrAuthFailure, a.Authenticate("carol", "newpass"))
+
+	// Without caching, every change is seen
+	a = NewSQLAuthenticator(SQLConfig{DB: db, CacheTTL: -1})
+	require.NoError(t, a.Authenticate("alice", "newpass"))
+	_, err = db.Exec("DELETE FROM mqtt_users WHERE username = ?", "alice")
+	require.NoError(t, err)
+	require.Equal(t, ErrAuthFailure, a.Authenticate("alice", "newpass"))
+}
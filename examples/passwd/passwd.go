@@ -0,0 +1,150 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// passwd manages the users of a password file read by the "file" authenticator, see
+// auth.NewFileAuthenticator. The server picks up the changes without a restart.
+//
+//	passwd [options] file add|update user [password]
+//	passwd file remove user
+//	passwd file list
+//
+// If the password is not given, it's read from the first line of the standard input.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/surgemq/surgemq/auth"
+)
+
+var (
+	hash string
+	cost int
+)
+
+func init() {
+	flag.StringVar(&hash, "hash", "bcrypt", "Password hash, bcrypt, argon2 or pbkdf2")
+	flag.IntVar(&cost, "cost", 0, "Cost of the bcrypt hashes, or iterations of the PBKDF2 hashes (default if 0)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] file add|update|remove|list [user] [password]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+}
+
+func main() {
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	path, cmd, args := args[0], args[1], args[2:]
+
+	f, err := auth.ReadPasswordFile(path)
+	if err != nil && !(os.IsNotExist(err) && cmd == "add") {
+		log.Fatal(err)
+	}
+
+	switch cmd {
+	case "add", "update":
+		if len(args) < 1 || len(args) > 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		user := args[0]
+
+		if _, ok := f.Hash(user); ok && cmd == "add" {
+			log.Fatalf("passwd: User %q already exists", user)
+		} else if !ok && cmd == "update" {
+			log.Fatalf("passwd: User %q not found", user)
+		}
+
+		var password string
+		if len(args) == 2 {
+			password = args[1]
+		} else if password, err = readPassword(); err != nil {
+			log.Fatal(err)
+		}
+
+		h, err := hashPassword(password)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := f.Set(user, h); err != nil {
+			log.Fatal(err)
+		}
+
+	case "remove":
+		if len(args) != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		if !f.Remove(args[0]) {
+			log.Fatalf("passwd: User %q not found", args[0])
+		}
+
+	case "list":
+		for _, user := range f.Users() {
+			fmt.Println(user)
+		}
+		return
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := f.Write(path); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readPassword() reads the password from the first line of the standard input.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("passwd: Empty password")
+	}
+
+	return password, nil
+}
+
+func hashPassword(password string) (string, error) {
+	switch hash {
+	case "bcrypt":
+		return auth.HashBcrypt(password, cost)
+	case "argon2":
+		return auth.HashArgon2(password)
+	case "pbkdf2":
+		return auth.HashPBKDF2(password, cost)
+	}
+
+	return "", fmt.Errorf("passwd: Unknown hash %q", hash)
+}
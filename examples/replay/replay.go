@@ -0,0 +1,127 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// replay publishes the messages recorded by the archive of a SurgeMQ server, see
+// package archive, to a server again. It connects as an MQTT client, so the server
+// can be any MQTT server.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/archive"
+	"github.com/surgemq/surgemq/service"
+)
+
+var (
+	dir      string
+	server   string
+	clientId string
+	username string
+	password string
+	from     string
+	to       string
+	topics   string
+	realTime bool
+	retain   bool
+)
+
+func init() {
+	flag.StringVar(&dir, "dir", "", "Directory of the archive")
+	flag.StringVar(&server, "server", "tcp://127.0.0.1:1883", "URI of the server to publish to")
+	flag.StringVar(&clientId, "clientid", fmt.Sprintf("replay%d", os.Getpid()), "Client ID")
+	flag.StringVar(&username, "username", "", "Username")
+	flag.StringVar(&password, "password", "", "Password")
+	flag.StringVar(&from, "from", "", "Start of the time range replayed, in RFC 3339 format, e.g. 2016-01-02T15:04:05Z")
+	flag.StringVar(&to, "to", "", "End of the time range replayed, in RFC 3339 format")
+	flag.StringVar(&topics, "topics", "", "Comma separated topic filters of the messages replayed (all if not set)")
+	flag.BoolVar(&realTime, "realtime", false, "Replay at the original speed, instead of as fast as possible")
+	flag.BoolVar(&retain, "retain", false, "Keep the retain flag of the messages")
+	flag.Parse()
+}
+
+func main() {
+	if dir == "" {
+		log.Fatal("replay: -dir is required")
+	}
+
+	opts := archive.ReplayOptions{
+		RealTime: realTime,
+		Retain:   retain,
+	}
+
+	var err error
+
+	if from != "" {
+		if opts.From, err = time.Parse(time.RFC3339, from); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if to != "" {
+		if opts.To, err = time.Parse(time.RFC3339, to); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if topics != "" {
+		opts.Topics = strings.Split(topics, ",")
+	}
+
+	msg := message.NewConnectMessage()
+	msg.SetVersion(4)
+	msg.SetCleanSession(true)
+	msg.SetClientId([]byte(clientId))
+	msg.SetKeepAlive(300)
+
+	if username != "" {
+		msg.SetUsername([]byte(username))
+	}
+
+	if password != "" {
+		msg.SetPassword([]byte(password))
+	}
+
+	c := &service.Client{}
+	if err := c.Connect(server, msg); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt)
+	go func() {
+		<-sigchan
+		cancel()
+	}()
+
+	n, err := archive.Replay(ctx, dir, c, opts)
+	log.Printf("replay: Published %d messages", n)
+
+	c.Disconnect()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -16,13 +16,26 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/surge/glog"
+	"github.com/surgemq/surgemq/archive"
+	"github.com/surgemq/surgemq/auth"
+	"github.com/surgemq/surgemq/rules"
+	"github.com/surgemq/surgemq/schema"
 	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+	"github.com/surgemq/surgemq/webhook"
 )
 
 var (
@@ -31,8 +44,28 @@ var (
 	ackTimeout       int
 	timeoutRetries   int
 	authenticator    string
+	passwordFile     string
 	sessionsProvider string
 	topicsProvider   string
+	redisAddr        string
+	maxConns         int
+	maxConnsPerIP    int
+	connectRatePerIP int
+	maxConnsPerUser  int
+	eventLoops       int
+	retainTTL        time.Duration
+	maxRetained      int
+	maxRetainedBytes int64
+	evictRetained    bool
+	webhookURL       string
+	webhookSecret    string
+	webhookTopics    string
+	rulesFile        string
+	schemas          string
+	quarantine       bool
+	archiveDir       string
+	archiveTopics    string
+	history          string
 	cpuprofile       string
 	wsAddr           string // HTTPS websocket address eg. :8080
 	wssAddr          string // HTTPS websocket address, eg. :8081
@@ -46,8 +79,28 @@ func init() {
 	flag.IntVar(&ackTimeout, "acktimeout", service.DefaultAckTimeout, "Ack Timeout (sec)")
 	flag.IntVar(&timeoutRetries, "retries", service.DefaultTimeoutRetries, "Timeout Retries")
 	flag.StringVar(&authenticator, "auth", service.DefaultAuthenticator, "Authenticator Type")
+	flag.StringVar(&passwordFile, "passwordfile", "", "Password file of the \"file\" authenticator, reloaded when it changes, eg. -auth file -passwordfile passwords")
 	flag.StringVar(&sessionsProvider, "sessions", service.DefaultSessionsProvider, "Session Provider Type")
 	flag.StringVar(&topicsProvider, "topics", service.DefaultTopicsProvider, "Topics Provider Type")
+	flag.StringVar(&redisAddr, "redis", "", "Address of the Redis server of the \"redis\" sessions and topics providers, eg. 'localhost:6379'")
+	flag.IntVar(&maxConns, "maxconns", 0, "Maximum number of connections (0 for no limit)")
+	flag.IntVar(&maxConnsPerIP, "maxconnsperip", 0, "Maximum number of connections per IP address (0 for no limit)")
+	flag.IntVar(&connectRatePerIP, "connectrate", 0, "New connections per second per IP address (0 for no limit)")
+	flag.IntVar(&maxConnsPerUser, "maxconnsperuser", 0, "Maximum number of connections per username (0 for no limit)")
+	flag.IntVar(&eventLoops, "eventloops", 0, "Number of epoll event loops for network I/O, Linux only (0 for a goroutine per connection)")
+	flag.DurationVar(&retainTTL, "retainttl", 0, "How long retained messages are kept (0 for ever)")
+	flag.IntVar(&maxRetained, "maxretained", 0, "Maximum number of retained messages (0 for no limit)")
+	flag.Int64Var(&maxRetainedBytes, "maxretainedbytes", 0, "Maximum total size of retained messages (0 for no limit)")
+	flag.BoolVar(&evictRetained, "evictretained", false, "Evict the oldest retained messages when a limit is reached, instead of rejecting new ones")
+	flag.StringVar(&webhookURL, "webhook", "", "URL to POST the client and message events to")
+	flag.StringVar(&webhookSecret, "webhooksecret", "", "Key of the HMAC-SHA256 signature of the webhook requests")
+	flag.StringVar(&webhookTopics, "webhooktopics", "", "Comma separated topic filters of the messages sent to the webhook")
+	flag.StringVar(&rulesFile, "rules", "", "JSON file of the rules republishing messages, reloaded on SIGHUP")
+	flag.StringVar(&schemas, "schemas", "", "Comma separated schemas of the payloads, as filter=file.json for JSON Schemas, or filter=file.pb#package.Message for protobuf descriptor sets")
+	flag.BoolVar(&quarantine, "quarantine", false, "Publish the invalid payloads to quarantine/<topic>, instead of dropping them")
+	flag.StringVar(&archiveDir, "archive", "", "Directory to record the published messages to")
+	flag.StringVar(&archiveTopics, "archivetopics", "", "Comma separated topic filters of the messages recorded (all if not set)")
+	flag.StringVar(&history, "history", "", "Comma separated topic histories sent to the $history/ subscriptions, as filter=count, filter=maxage or filter=count/maxage, e.g. sensors/#=100/10m")
 	flag.StringVar(&cpuprofile, "cpuprofile", "", "CPU Profile Filename")
 	flag.StringVar(&wsAddr, "wsaddr", "", "HTTP websocket address, eg. ':8080'")
 	flag.StringVar(&wssAddr, "wssaddr", "", "HTTPS websocket address, eg. ':8081'")
@@ -57,13 +110,141 @@ func init() {
 }
 
 func main() {
+	if retainTTL > 0 || maxRetained > 0 || maxRetainedBytes > 0 {
+		config := topics.RetainConfig{
+			TTL:              retainTTL,
+			MaxRetained:      maxRetained,
+			MaxRetainedBytes: maxRetainedBytes,
+		}
+
+		if evictRetained {
+			config.Policy = topics.RetainEvictOldest
+		}
+
+		p := topics.NewMemProvider()
+		if err := p.SetRetainConfig(config); err != nil {
+			log.Fatal(err)
+		}
+
+		topics.Unregister("mem")
+		topics.Register("mem", p)
+	}
+
+	if redisAddr != "" {
+		pool := &redis.Pool{
+			MaxIdle:     16,
+			IdleTimeout: time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", redisAddr)
+			},
+		}
+
+		sessions.Register("redis", sessions.NewRedisProvider(pool, ""))
+		topics.Register("redis", topics.NewRedisProvider(pool, ""))
+	}
+
+	if passwordFile != "" {
+		a, err := auth.NewFileAuthenticator(passwordFile, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		auth.Register("file", a)
+	}
+
 	svr := &service.Server{
 		KeepAlive:        keepAlive,
 		ConnectTimeout:   connectTimeout,
 		AckTimeout:       ackTimeout,
 		TimeoutRetries:   timeoutRetries,
+		Authenticator:    authenticator,
 		SessionsProvider: sessionsProvider,
 		TopicsProvider:   topicsProvider,
+
+		MaxConnections:        maxConns,
+		MaxConnectionsPerIP:   maxConnsPerIP,
+		ConnectRatePerIP:      connectRatePerIP,
+		MaxConnectionsPerUser: maxConnsPerUser,
+
+		EventLoops: eventLoops,
+	}
+
+	if webhookURL != "" {
+		config := webhook.Config{
+			URL:    webhookURL,
+			Secret: webhookSecret,
+		}
+
+		if webhookTopics != "" {
+			config.Topics = strings.Split(webhookTopics, ",")
+		}
+
+		hook, err := webhook.New(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		svr.Hooks = append(svr.Hooks, hook)
+	}
+
+	var arc *archive.Archiver
+
+	if archiveDir != "" {
+		config := archive.Config{Dir: archiveDir}
+
+		if archiveTopics != "" {
+			config.Topics = strings.Split(archiveTopics, ",")
+		}
+
+		var err error
+		if arc, err = archive.New(config); err != nil {
+			log.Fatal(err)
+		}
+
+		svr.Hooks = append(svr.Hooks, arc)
+	}
+
+	if history != "" {
+		limits, err := parseHistory(history)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		svr.History = limits
+	}
+
+	if schemas != "" {
+		set, err := loadSchemas(schemas)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		svr.Schemas = set
+
+		if quarantine {
+			svr.SchemaPolicy = service.SchemaQuarantine
+		}
+	}
+
+	if rulesFile != "" {
+		engine, err := rules.Load(rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		svr.Rules = engine
+
+		hupchan := make(chan os.Signal, 1)
+		signal.Notify(hupchan, syscall.SIGHUP)
+		go func() {
+			for range hupchan {
+				if err := engine.Reload(); err != nil {
+					glog.Errorf("surgemq/main: Error reloading rules: %v", err)
+				} else {
+					glog.Infof("surgemq/main: Reloaded %d rules", len(engine.Rules()))
+				}
+			}
+		}()
 	}
 
 	var f *os.File
@@ -92,6 +273,10 @@ func main() {
 
 		svr.Close()
 
+		if arc != nil {
+			arc.Close()
+		}
+
 		os.Exit(0)
 	}()
 
@@ -116,3 +301,66 @@ func main() {
 		glog.Errorf("surgemq/main: %v", err)
 	}
 }
+
+// parseHistory() parses the topic histories listed in the -history flag.
+func parseHistory(list string) (map[string]topics.HistoryLimit, error) {
+	limits := make(map[string]topics.HistoryLimit)
+
+	for _, h := range strings.Split(list, ",") {
+		i := strings.LastIndex(h, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("surgemq/main: Invalid history %q", h)
+		}
+
+		var limit topics.HistoryLimit
+
+		for _, v := range strings.Split(h[i+1:], "/") {
+			if n, err := strconv.Atoi(v); err == nil {
+				limit.Count = n
+			} else if d, err := time.ParseDuration(v); err == nil {
+				limit.MaxAge = d
+			} else {
+				return nil, fmt.Errorf("surgemq/main: Invalid history %q", h)
+			}
+		}
+
+		limits[h[:i]] = limit
+	}
+
+	return limits, nil
+}
+
+// loadSchemas() loads the schemas listed in the -schemas flag.
+func loadSchemas(list string) (*schema.Set, error) {
+	set := schema.NewSet()
+
+	for _, s := range strings.Split(list, ",") {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("surgemq/main: Invalid schema %q", s)
+		}
+
+		filter, path := s[:i], s[i+1:]
+
+		var (
+			v   schema.Validator
+			err error
+		)
+
+		if j := strings.LastIndex(path, "#"); j >= 0 {
+			v, err = schema.LoadProtoSchema(path[:j], path[j+1:])
+		} else {
+			v, err = schema.LoadJSONSchema(path)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := set.Bind(filter, v); err != nil {
+			return nil, err
+		}
+	}
+
+	return set, nil
+}
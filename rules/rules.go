@@ -0,0 +1,465 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rules routes and transforms the messages published to an MQTT server. A
+// rule matches the messages published to a topic filter, optionally only those with
+// JSON payloads that meet some conditions, and republishes them to another topic,
+// with the same payload or a new one made from a template.
+//
+// The rules are usually loaded from a JSON file, e.g.:
+//
+//	{
+//	  "rules": [{
+//	    "name": "overheat",
+//	    "topic": "sensors/+/temperature",
+//	    "where": [{"field": "celsius", "op": ">", "value": 80}],
+//	    "republish": {
+//	      "topic": "alerts/{{topic.1}}",
+//	      "qos": 1,
+//	      "payload": "{\"sensor\": \"{{topic.1}}\", \"celsius\": {{payload.celsius}}}"
+//	    }
+//	  }]
+//	}
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surgemq/surgemq/topics"
+)
+
+var (
+	ErrInvalidRule     = errors.New("rules: Invalid rule")
+	ErrInvalidTemplate = errors.New("rules: Invalid template")
+	ErrNoFile          = errors.New("rules: Rules not loaded from a file")
+)
+
+// Rule republishes the messages published to Topic that meet all the conditions in
+// Where.
+type Rule struct {
+	// Name identifies the rule in logs and errors.
+	Name string `json:"name"`
+
+	// Topic is the topic filter of the messages the rule applies to.
+	Topic string `json:"topic"`
+
+	// Where are the conditions on the fields of JSON payloads. If not set then the
+	// rule applies to all the messages, JSON or not.
+	Where []Condition `json:"where,omitempty"`
+
+	Republish Republish `json:"republish"`
+}
+
+// Condition compares a field of a JSON payload with a value. Numbers compare as
+// numbers, strings as strings, and values of different types are never equal.
+type Condition struct {
+	// Field is the path of the field, e.g. "data.celsius", with array elements found
+	// by index, e.g. "readings.0".
+	Field string `json:"field"`
+
+	// Op is one of "==", "!=", ">", ">=", "<", "<=", "exists", which ignores Value,
+	// and "contains", for strings containing Value.
+	Op string `json:"op"`
+
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Republish is the message published for the messages a rule applies to. The topic
+// and payload are templates, where "{{topic}}", "{{topic.N}}", "{{clientid}}",
+// "{{timestamp}}", "{{payload}}" and "{{payload.path}}" are replaced by the topic of
+// the message, its Nth level from 0, the client ID of the publisher, the time in Unix
+// milliseconds, the payload, and a field of a JSON payload. If a placeholder has no
+// value, e.g. the field is missing, the message isn't republished.
+type Republish struct {
+	Topic  string `json:"topic"`
+	QoS    byte   `json:"qos"`
+	Retain bool   `json:"retain,omitempty"`
+
+	// Select lists the fields of a JSON payload to copy into a new JSON object,
+	// keyed by their paths. Select and Payload can't be both set. If neither is set
+	// then the payload is republished as is.
+	Select []string `json:"select,omitempty"`
+
+	// Payload is the template of the payload. In JSON payloads, string values are
+	// escaped but not quoted, so "{{payload.name}}" goes between quotes.
+	Payload string `json:"payload,omitempty"`
+}
+
+// Message is a message to republish.
+type Message struct {
+	// The name of the rule that produced it
+	Rule string
+
+	Topic   []byte
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// Engine applies a set of rules, which can be replaced at any time.
+type Engine struct {
+	mu    sync.RWMutex
+	rules []*rule
+	path  string
+}
+
+// rule is a Rule ready to be applied.
+type rule struct {
+	Rule
+
+	filter  []byte
+	topic   *template
+	payload *template
+	selects [][]string
+}
+
+type ruleFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+// New creates an Engine with the rules.
+func New(rules []Rule) (*Engine, error) {
+	this := &Engine{}
+
+	if err := this.Set(rules); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// Load creates an Engine with the rules in a JSON file. See Reload.
+func Load(path string) (*Engine, error) {
+	this := &Engine{path: path}
+
+	if err := this.Reload(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// Reload reads the rules from the file they were loaded from again, and replaces the
+// rules with them. If the file has invalid rules, the current rules are kept.
+func (this *Engine) Reload() error {
+	if this.path == "" {
+		return ErrNoFile
+	}
+
+	b, err := ioutil.ReadFile(this.path)
+	if err != nil {
+		return err
+	}
+
+	var f ruleFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("rules: %s: %v", this.path, err)
+	}
+
+	return this.Set(f.Rules)
+}
+
+// Set replaces the rules. If one of them is invalid, the current rules are kept.
+func (this *Engine) Set(rules []Rule) error {
+	compiled := make([]*rule, 0, len(rules))
+
+	for _, r := range rules {
+		cr, err := compile(r)
+		if err != nil {
+			return err
+		}
+
+		compiled = append(compiled, cr)
+	}
+
+	this.mu.Lock()
+	this.rules = compiled
+	this.mu.Unlock()
+
+	return nil
+}
+
+// Rules returns the rules being applied.
+func (this *Engine) Rules() []Rule {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	rules := make([]Rule, 0, len(this.rules))
+	for _, r := range this.rules {
+		rules = append(rules, r.Rule)
+	}
+
+	return rules
+}
+
+// Apply returns the messages to republish for a message published by a client, one
+// for each rule that applies to it, in the order of the rules.
+func (this *Engine) Apply(clientId string, topic, payload []byte) []Message {
+	this.mu.RLock()
+	rules := this.rules
+	this.mu.RUnlock()
+
+	var (
+		msgs []Message
+		in   *input
+	)
+
+	for _, r := range rules {
+		if !topics.Match(r.filter, topic) {
+			continue
+		}
+
+		if in == nil {
+			in = &input{
+				topic:     topic,
+				levels:    bytes.Split(topic, []byte("/")),
+				clientId:  clientId,
+				timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+				payload:   payload,
+			}
+		}
+
+		if msg, ok := r.apply(in); ok {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs
+}
+
+func (this *rule) apply(in *input) (Message, bool) {
+	for _, c := range this.Where {
+		if !in.json() {
+			return Message{}, false
+		}
+
+		v, ok := lookup(in.doc, strings.Split(c.Field, "."))
+		if !c.eval(v, ok) {
+			return Message{}, false
+		}
+	}
+
+	topic, ok := this.topic.render(in, false)
+	if !ok {
+		return Message{}, false
+	}
+
+	msg := Message{
+		Rule:   this.Name,
+		Topic:  topic,
+		QoS:    this.Republish.QoS,
+		Retain: this.Republish.Retain,
+	}
+
+	switch {
+	case this.payload != nil:
+		if msg.Payload, ok = this.payload.render(in, in.json()); !ok {
+			return Message{}, false
+		}
+
+	case len(this.selects) > 0:
+		if !in.json() {
+			return Message{}, false
+		}
+
+		obj := make(map[string]interface{}, len(this.selects))
+		for i, path := range this.selects {
+			if v, ok := lookup(in.doc, path); ok {
+				obj[this.Republish.Select[i]] = v
+			}
+		}
+
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return Message{}, false
+		}
+		msg.Payload = b
+
+	default:
+		msg.Payload = append([]byte(nil), in.payload...)
+	}
+
+	return msg, true
+}
+
+func compile(r Rule) (*rule, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%v %q: %s", ErrInvalidRule, r.Name, fmt.Sprintf(format, args...))
+	}
+
+	var v topics.Validator
+	if err := v.ValidateFilter([]byte(r.Topic)); err != nil {
+		return nil, invalid("%v %q", err, r.Topic)
+	}
+
+	for _, c := range r.Where {
+		if c.Field == "" {
+			return nil, invalid("condition without a field")
+		}
+
+		switch c.Op {
+		case "==", "!=", "exists":
+
+		case ">", ">=", "<", "<=":
+			if _, ok := ordered(c.Value); !ok {
+				return nil, invalid("%q needs a number or a string", c.Op)
+			}
+
+		case "contains":
+			if _, ok := c.Value.(string); !ok {
+				return nil, invalid("%q needs a string", c.Op)
+			}
+
+		default:
+			return nil, invalid("unknown operator %q", c.Op)
+		}
+	}
+
+	if r.Republish.Topic == "" {
+		return nil, invalid("no republish topic")
+	}
+
+	if r.Republish.QoS > 2 {
+		return nil, invalid("invalid QoS %d", r.Republish.QoS)
+	}
+
+	if r.Republish.Payload != "" && len(r.Republish.Select) > 0 {
+		return nil, invalid("both payload and select are set")
+	}
+
+	cr := &rule{Rule: r, filter: []byte(r.Topic)}
+
+	var err error
+	if cr.topic, err = parseTemplate(r.Republish.Topic); err != nil {
+		return nil, invalid("%v", err)
+	}
+
+	if r.Republish.Payload != "" {
+		if cr.payload, err = parseTemplate(r.Republish.Payload); err != nil {
+			return nil, invalid("%v", err)
+		}
+	}
+
+	for _, s := range r.Republish.Select {
+		cr.selects = append(cr.selects, strings.Split(s, "."))
+	}
+
+	return cr, nil
+}
+
+// eval() returns true if the value of the field, if it exists, meets the condition.
+func (this Condition) eval(v interface{}, exists bool) bool {
+	if this.Op == "exists" {
+		return exists
+	}
+
+	if !exists {
+		return this.Op == "!="
+	}
+
+	switch this.Op {
+	case "==":
+		return equal(v, this.Value)
+
+	case "!=":
+		return !equal(v, this.Value)
+
+	case "contains":
+		s, ok := v.(string)
+		return ok && strings.Contains(s, this.Value.(string))
+	}
+
+	a, ok := ordered(v)
+	if !ok {
+		return false
+	}
+
+	b, _ := ordered(this.Value)
+
+	var c int
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return false
+		}
+
+		switch {
+		case a < b:
+			c = -1
+		case a > b:
+			c = 1
+		}
+
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return false
+		}
+
+		c = strings.Compare(a, b)
+	}
+
+	switch this.Op {
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	}
+
+	return false
+}
+
+// ordered() returns the value as a float64 or a string, which can be ordered.
+func ordered(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case float64, string:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+
+	return nil, false
+}
+
+func equal(a, b interface{}) bool {
+	if x, ok := ordered(a); ok {
+		y, ok := ordered(b)
+		return ok && x == y
+	}
+
+	switch a := a.(type) {
+	case bool:
+		b, ok := b.(bool)
+		return ok && a == b
+
+	case nil:
+		return b == nil
+	}
+
+	return false
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngineApply(t *testing.T) {
+	e, err := New([]Rule{
+		{
+			Name:  "overheat",
+			Topic: "sensors/+/temperature",
+			Where: []Condition{
+				{Field: "celsius", Op: ">", Value: 80},
+				{Field: "unit.name", Op: "exists"},
+			},
+			Republish: Republish{
+				Topic:   "alerts/{{topic.1}}",
+				QoS:     1,
+				Payload: `{"sensor": "{{topic.1}}", "celsius": {{payload.celsius}}, "from": "{{clientid}}"}`,
+			},
+		},
+		{
+			Name:  "project",
+			Topic: "sensors/#",
+			Where: []Condition{{Field: "tags.0", Op: "==", Value: "lab"}},
+			Republish: Republish{
+				Topic:  "lab/{{topic}}",
+				Retain: true,
+				Select: []string{"celsius", "unit.name", "missing"},
+			},
+		},
+		{
+			Name:      "mirror",
+			Topic:     "raw/+",
+			Republish: Republish{Topic: "mirror/{{topic.1}}"},
+		},
+	})
+	require.NoError(t, err)
+
+	payload := []byte(`{"celsius": 85.5, "unit": {"name": "C\"x"}, "tags": ["lab", "east"]}`)
+
+	msgs := e.Apply("dev1", []byte("sensors/s1/temperature"), payload)
+	require.Len(t, msgs, 2)
+
+	require.Equal(t, "overheat", msgs[0].Rule)
+	require.Equal(t, "alerts/s1", string(msgs[0].Topic))
+	require.Equal(t, byte(1), msgs[0].QoS)
+	require.JSONEq(t, `{"sensor": "s1", "celsius": 85.5, "from": "dev1"}`, string(msgs[0].Payload))
+
+	require.Equal(t, "project", msgs[1].Rule)
+	require.Equal(t, "lab/sensors/s1/temperature", string(msgs[1].Topic))
+	require.True(t, msgs[1].Retain)
+	require.JSONEq(t, `{"celsius": 85.5, "unit.name": "C\"x"}`, string(msgs[1].Payload))
+
+	// Too cold, and not from the lab
+	msgs = e.Apply("dev1", []byte("sensors/s1/temperature"), []byte(`{"celsius": 20, "unit": {"name": "C"}}`))
+	require.Len(t, msgs, 0)
+
+	// Conditions never match payloads that aren't JSON
+	msgs = e.Apply("dev1", []byte("sensors/s1/temperature"), []byte("85"))
+	require.Len(t, msgs, 0)
+
+	// Without conditions, any payload is republished as is
+	msgs = e.Apply("dev1", []byte("raw/1"), []byte("\x00\x01"))
+	require.Len(t, msgs, 1)
+	require.Equal(t, "mirror/1", string(msgs[0].Topic))
+	require.Equal(t, []byte("\x00\x01"), msgs[0].Payload)
+
+	msgs = e.Apply("dev1", []byte("other"), payload)
+	require.Len(t, msgs, 0)
+}
+
+func TestConditionEval(t *testing.T) {
+	var doc interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{"n": 5, "s": "hello", "b": true, "z": null}`), &doc))
+
+	conds := []struct {
+		c     Condition
+		match bool
+	}{
+		{Condition{Field: "n", Op: "==", Value: 5}, true},
+		{Condition{Field: "n", Op: "==", Value: "5"}, false},
+		{Condition{Field: "n", Op: "!=", Value: 4}, true},
+		{Condition{Field: "n", Op: ">=", Value: 5}, true},
+		{Condition{Field: "n", Op: "<", Value: 5}, false},
+		{Condition{Field: "s", Op: ">", Value: "abc"}, true},
+		{Condition{Field: "s", Op: ">", Value: 1}, false},
+		{Condition{Field: "s", Op: "contains", Value: "ell"}, true},
+		{Condition{Field: "n", Op: "contains", Value: "5"}, false},
+		{Condition{Field: "b", Op: "==", Value: true}, true},
+		{Condition{Field: "z", Op: "==", Value: nil}, true},
+		{Condition{Field: "x", Op: "exists"}, false},
+		{Condition{Field: "x", Op: "!=", Value: 1}, true},
+		{Condition{Field: "x", Op: "==", Value: 1}, false},
+	}
+
+	for _, c := range conds {
+		v, ok := lookup(doc, []string{c.c.Field})
+		require.Equal(t, c.match, c.c.eval(v, ok), "%v", c.c)
+	}
+}
+
+func TestEngineInvalidRules(t *testing.T) {
+	invalid := []Rule{
+		{Name: "filter", Topic: "a/#/b", Republish: Republish{Topic: "b"}},
+		{Name: "notopic", Topic: "a"},
+		{Name: "qos", Topic: "a", Republish: Republish{Topic: "b", QoS: 3}},
+		{Name: "op", Topic: "a", Where: []Condition{{Field: "x", Op: "~"}}, Republish: Republish{Topic: "b"}},
+		{Name: "order", Topic: "a", Where: []Condition{{Field: "x", Op: ">", Value: true}}, Republish: Republish{Topic: "b"}},
+		{Name: "placeholder", Topic: "a", Republish: Republish{Topic: "{{unknown}}"}},
+		{Name: "unclosed", Topic: "a", Republish: Republish{Topic: "b", Payload: "{{payload"}},
+		{Name: "both", Topic: "a", Republish: Republish{Topic: "b", Payload: "x", Select: []string{"x"}}},
+	}
+
+	for _, r := range invalid {
+		_, err := New([]Rule{r})
+		require.Error(t, err, r.Name)
+	}
+}
+
+func TestEngineReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules.json")
+
+	write := func(s string) {
+		require.NoError(t, ioutil.WriteFile(path, []byte(s), 0600))
+	}
+
+	write(`{"rules": [{"name": "a", "topic": "a", "republish": {"topic": "b"}}]}`)
+
+	e, err := Load(path)
+	require.NoError(t, err)
+	require.Len(t, e.Apply("c", []byte("a"), nil), 1)
+
+	write(`{"rules": [{"name": "x", "topic": "x", "republish": {"topic": "y"}}]}`)
+	require.NoError(t, e.Reload())
+	require.Len(t, e.Apply("c", []byte("a"), nil), 0)
+	require.Len(t, e.Apply("c", []byte("x"), nil), 1)
+
+	// Invalid rules keep the current ones
+	write(`{"rules": [{"name": "x", "topic": "x/#/y", "republish": {"topic": "y"}}]}`)
+	require.Error(t, e.Reload())
+	require.Equal(t, "x", e.Rules()[0].Name)
+
+	e, err = New(nil)
+	require.NoError(t, err)
+	require.Equal(t, ErrNoFile, e.Reload())
+}
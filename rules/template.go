@@ -0,0 +1,231 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// template is a topic or payload template, split into literal text and the fields
+// found between "{{" and "}}".
+type template struct {
+	parts []part
+}
+
+type part struct {
+	text  string
+	field *field
+}
+
+// field is what a placeholder refers to:
+//   - "topic" is the topic of the message, "topic.N" its Nth level, from 0.
+//   - "clientid" is the client ID of the publisher.
+//   - "timestamp" is the time of the publish, in Unix milliseconds.
+//   - "payload" is the payload, "payload.a.b" a field in a JSON payload.
+type field struct {
+	kind  string
+	level int
+	path  []string
+}
+
+// input is what the templates and conditions are applied to.
+type input struct {
+	topic     []byte
+	levels    [][]byte
+	clientId  string
+	timestamp int64
+	payload   []byte
+
+	// The decoded JSON payload, decoded on first use
+	doc     interface{}
+	decoded bool
+	isJSON  bool
+}
+
+func parseTemplate(s string) (*template, error) {
+	t := &template{}
+
+	for len(s) > 0 {
+		i := strings.Index(s, "{{")
+		if i < 0 {
+			t.parts = append(t.parts, part{text: s})
+			break
+		}
+
+		if i > 0 {
+			t.parts = append(t.parts, part{text: s[:i]})
+		}
+
+		j := strings.Index(s[i:], "}}")
+		if j < 0 {
+			return nil, fmt.Errorf("%v: unclosed placeholder in %q", ErrInvalidTemplate, s)
+		}
+
+		f, err := parseField(strings.TrimSpace(s[i+2 : i+j]))
+		if err != nil {
+			return nil, err
+		}
+
+		t.parts = append(t.parts, part{field: f})
+		s = s[i+j+2:]
+	}
+
+	return t, nil
+}
+
+func parseField(s string) (*field, error) {
+	path := strings.Split(s, ".")
+
+	switch path[0] {
+	case "topic":
+		if len(path) == 1 {
+			return &field{kind: "topic", level: -1}, nil
+		}
+
+		if len(path) == 2 {
+			if n, err := strconv.Atoi(path[1]); err == nil && n >= 0 {
+				return &field{kind: "topic", level: n}, nil
+			}
+		}
+
+	case "clientid", "timestamp":
+		if len(path) == 1 {
+			return &field{kind: path[0]}, nil
+		}
+
+	case "payload":
+		return &field{kind: "payload", path: path[1:]}, nil
+	}
+
+	return nil, fmt.Errorf("%v: unknown placeholder %q", ErrInvalidTemplate, s)
+}
+
+// render() fills in the template. In JSON payloads, the string values are escaped, but
+// not quoted, so they can be placed between quotes in the template, and the other
+// values are inserted as JSON. Elsewhere, the strings are inserted as is.
+func (this *template) render(in *input, escape bool) ([]byte, bool) {
+	var buf bytes.Buffer
+
+	for _, p := range this.parts {
+		if p.field == nil {
+			buf.WriteString(p.text)
+			continue
+		}
+
+		v, ok := in.value(p.field)
+		if !ok {
+			return nil, false
+		}
+
+		switch v := v.(type) {
+		case string:
+			if escape {
+				b, _ := json.Marshal(v)
+				buf.Write(b[1 : len(b)-1])
+			} else {
+				buf.WriteString(v)
+			}
+
+		case []byte:
+			buf.Write(v)
+
+		default:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, false
+			}
+			buf.Write(b)
+		}
+	}
+
+	return buf.Bytes(), true
+}
+
+// value() returns the value of the field, and false if there's no such value.
+func (this *input) value(f *field) (interface{}, bool) {
+	switch f.kind {
+	case "topic":
+		if f.level < 0 {
+			return string(this.topic), true
+		}
+
+		if f.level >= len(this.levels) {
+			return nil, false
+		}
+
+		return string(this.levels[f.level]), true
+
+	case "clientid":
+		return this.clientId, true
+
+	case "timestamp":
+		return this.timestamp, true
+	}
+
+	if len(f.path) == 0 {
+		if this.json() {
+			return this.doc, true
+		}
+
+		return string(this.payload), true
+	}
+
+	if !this.json() {
+		return nil, false
+	}
+
+	return lookup(this.doc, f.path)
+}
+
+// json() decodes the payload as JSON, and returns false if it's not JSON.
+func (this *input) json() bool {
+	if !this.decoded {
+		this.decoded = true
+		this.isJSON = json.Unmarshal(this.payload, &this.doc) == nil
+	}
+
+	return this.isJSON
+}
+
+// lookup() returns the value at path in a decoded JSON document. The elements of
+// arrays are found by index.
+func lookup(doc interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[key]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+
+		case []interface{}:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(d) {
+				return nil, false
+			}
+			doc = d[n]
+
+		default:
+			return nil, false
+		}
+	}
+
+	return doc, true
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// jsonSchema validates JSON payloads against a JSON Schema.
+type jsonSchema struct {
+	schema *gojsonschema.Schema
+}
+
+// NewJSONSchema creates a Validator for the JSON Schema, drafts 4, 6 and 7. Payloads
+// that are not JSON are invalid.
+func NewJSONSchema(schema []byte) (Validator, error) {
+	s, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrInvalidSchema, err)
+	}
+
+	return &jsonSchema{schema: s}, nil
+}
+
+// LoadJSONSchema creates a Validator for the JSON Schema in a file.
+func LoadJSONSchema(path string) (Validator, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewJSONSchema(b)
+}
+
+func (this *jsonSchema) Validate(payload []byte) error {
+	res, err := this.schema.Validate(gojsonschema.NewBytesLoader(payload))
+	if err != nil {
+		return fmt.Errorf("%v: %v", ErrInvalidPayload, err)
+	}
+
+	if res.Valid() {
+		return nil
+	}
+
+	var details []string
+	for _, e := range res.Errors() {
+		details = append(details, e.String())
+	}
+
+	return fmt.Errorf("%v: %s", ErrInvalidPayload, strings.Join(details, "; "))
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoSchema validates protobuf payloads against a message type.
+type protoSchema struct {
+	desc protoreflect.MessageDescriptor
+}
+
+// NewProtoSchema creates a Validator for the message type with the full name, e.g.
+// "sensors.Reading", in a serialized FileDescriptorSet, as written by "protoc
+// --include_imports --descriptor_set_out". Payloads are invalid if they don't decode
+// to the message type, miss required fields, or have fields the type doesn't have.
+func NewProtoSchema(descriptorSet []byte, name string) (Validator, error) {
+	var fds descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(descriptorSet, &fds); err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrInvalidSchema, err)
+	}
+
+	files, err := protodesc.NewFiles(&fds)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrInvalidSchema, err)
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s: %v", ErrInvalidSchema, name, err)
+	}
+
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%v: %s is not a message", ErrInvalidSchema, name)
+	}
+
+	return &protoSchema{desc: md}, nil
+}
+
+// LoadProtoSchema creates a Validator for the message type in the FileDescriptorSet
+// in a file.
+func LoadProtoSchema(path, name string) (Validator, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewProtoSchema(b, name)
+}
+
+func (this *protoSchema) Validate(payload []byte) error {
+	m := dynamicpb.NewMessage(this.desc)
+
+	if err := proto.Unmarshal(payload, m); err != nil {
+		return fmt.Errorf("%v: %v", ErrInvalidPayload, err)
+	}
+
+	if err := hasUnknown(m); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// hasUnknown() returns an error if the message, or one of the messages in its fields,
+// has unknown fields.
+func hasUnknown(m protoreflect.Message) error {
+	if len(m.GetUnknown()) > 0 {
+		return fmt.Errorf("%v: unknown fields in %s", ErrInvalidPayload, m.Descriptor().FullName())
+	}
+
+	var err error
+
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			l := v.List()
+			for i := 0; i < l.Len() && err == nil; i++ {
+				err = hasUnknown(l.Get(i).Message())
+			}
+
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+				err = hasUnknown(mv.Message())
+				return err == nil
+			})
+
+		case !fd.IsList() && !fd.IsMap() && fd.Message() != nil:
+			err = hasUnknown(v.Message())
+		}
+
+		return err == nil
+	})
+
+	return err
+}
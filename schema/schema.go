@@ -0,0 +1,113 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package schema checks the payloads of PUBLISH messages against schemas, such as
+// JSON Schemas or protobuf message types, bound to topic filters.
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/surgemq/surgemq/topics"
+)
+
+var (
+	ErrInvalidPayload = errors.New("schema: Invalid payload")
+	ErrInvalidSchema  = errors.New("schema: Invalid schema")
+)
+
+// Validator checks payloads against a schema. It must be safe for concurrent use.
+type Validator interface {
+	// Validate returns an error that wraps ErrInvalidPayload, with the details, if
+	// the payload doesn't match the schema.
+	Validate(payload []byte) error
+}
+
+// Set binds validators to topic filters. The payloads published to a topic must
+// pass every validator bound to a filter matching the topic. Bindings can be added
+// and removed at any time.
+type Set struct {
+	mu       sync.RWMutex
+	bindings []binding
+}
+
+type binding struct {
+	filter    []byte
+	validator Validator
+}
+
+// NewSet creates an empty Set.
+func NewSet() *Set {
+	return &Set{}
+}
+
+// Bind binds the validator to the topic filter, e.g. "sensors/+/readings".
+func (this *Set) Bind(filter string, v Validator) error {
+	var tv topics.Validator
+	if err := tv.ValidateFilter([]byte(filter)); err != nil {
+		return fmt.Errorf("%v %q", err, filter)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.bindings = append(this.bindings, binding{filter: []byte(filter), validator: v})
+
+	return nil
+}
+
+// Unbind removes the validators bound to the topic filter.
+func (this *Set) Unbind(filter string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	bindings := this.bindings[:0:0]
+	for _, b := range this.bindings {
+		if string(b.filter) != filter {
+			bindings = append(bindings, b)
+		}
+	}
+
+	this.bindings = bindings
+}
+
+// Validate checks the payload published to the topic against the validators bound
+// to the filters matching the topic. It returns nil if there are none.
+func (this *Set) Validate(topic, payload []byte) error {
+	this.mu.RLock()
+	bindings := this.bindings
+	this.mu.RUnlock()
+
+	for _, b := range bindings {
+		if !topics.Match(b.filter, topic) {
+			continue
+		}
+
+		if err := b.validator.Validate(payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Len returns the number of bindings.
+func (this *Set) Len() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return len(this.bindings)
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const readingSchema = `{
+	"type": "object",
+	"properties": {
+		"celsius": {"type": "number"},
+		"sensor": {"type": "string"}
+	},
+	"required": ["celsius"]
+}`
+
+func TestJSONSchema(t *testing.T) {
+	v, err := NewJSONSchema([]byte(readingSchema))
+	require.NoError(t, err)
+
+	require.NoError(t, v.Validate([]byte(`{"celsius": 21.5, "sensor": "s1"}`)))
+
+	for _, payload := range []string{`{"sensor": "s1"}`, `{"celsius": "hot"}`, `not json`, ``} {
+		err := v.Validate([]byte(payload))
+		require.Error(t, err, payload)
+		require.True(t, strings.HasPrefix(err.Error(), ErrInvalidPayload.Error()), err.Error())
+	}
+
+	_, err = NewJSONSchema([]byte(`{"type": 1}`))
+	require.Error(t, err)
+}
+
+func TestProtoSchema(t *testing.T) {
+	b, err := proto.Marshal(readingDescriptors())
+	require.NoError(t, err)
+
+	v, err := NewProtoSchema(b, "sensors.Reading")
+	require.NoError(t, err)
+
+	// sensor = "s1", celsius = 21.5, location = {zone: 3}
+	var valid []byte
+	valid = protowire.AppendTag(valid, 1, protowire.BytesType)
+	valid = protowire.AppendString(valid, "s1")
+	valid = protowire.AppendTag(valid, 2, protowire.Fixed64Type)
+	valid = protowire.AppendFixed64(valid, 0x4035800000000000)
+
+	var loc []byte
+	loc = protowire.AppendTag(loc, 1, protowire.VarintType)
+	loc = protowire.AppendVarint(loc, 3)
+	valid = protowire.AppendTag(valid, 3, protowire.BytesType)
+	valid = protowire.AppendBytes(valid, loc)
+
+	require.NoError(t, v.Validate(valid))
+
+	// An unknown field
+	unknown := protowire.AppendTag(append([]byte(nil), valid...), 9, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, 1)
+	require.Error(t, v.Validate(unknown))
+
+	// An unknown field in the nested message
+	var badloc []byte
+	badloc = protowire.AppendTag(badloc, 7, protowire.VarintType)
+	badloc = protowire.AppendVarint(badloc, 1)
+	nested := protowire.AppendTag(nil, 3, protowire.BytesType)
+	nested = protowire.AppendBytes(nested, badloc)
+	require.Error(t, v.Validate(nested))
+
+	// The wrong wire type, and garbage
+	wrong := protowire.AppendTag(nil, 1, protowire.VarintType)
+	wrong = protowire.AppendVarint(wrong, 1)
+	require.Error(t, v.Validate(wrong))
+	require.Error(t, v.Validate([]byte{0xff, 0xff, 0xff}))
+
+	_, err = NewProtoSchema(b, "sensors.Missing")
+	require.Error(t, err)
+
+	_, err = NewProtoSchema([]byte("garbage"), "sensors.Reading")
+	require.Error(t, err)
+}
+
+func TestSet(t *testing.T) {
+	v, err := NewJSONSchema([]byte(readingSchema))
+	require.NoError(t, err)
+
+	s := NewSet()
+	require.NoError(t, s.Bind("sensors/+/readings", v))
+	require.Error(t, s.Bind("sensors/#/readings", v))
+	require.Equal(t, 1, s.Len())
+
+	require.NoError(t, s.Validate([]byte("sensors/1/readings"), []byte(`{"celsius": 1}`)))
+	require.Error(t, s.Validate([]byte("sensors/1/readings"), []byte(`{}`)))
+
+	// No schema for the topic
+	require.NoError(t, s.Validate([]byte("sensors/1/status"), []byte(`{}`)))
+
+	s.Unbind("sensors/+/readings")
+	require.Equal(t, 0, s.Len())
+	require.NoError(t, s.Validate([]byte("sensors/1/readings"), []byte(`{}`)))
+}
+
+// readingDescriptors() returns the descriptors of:
+//
+//	package sensors;
+//	message Location { int32 zone = 1; }
+//	message Reading { string sensor = 1; double celsius = 2; Location location = 3; }
+func readingDescriptors() *descriptorpb.FileDescriptorSet {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+
+		return f
+	}
+
+	return &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{{
+			Name:    proto.String("sensors.proto"),
+			Package: proto.String("sensors"),
+			Syntax:  proto.String("proto3"),
+			MessageType: []*descriptorpb.DescriptorProto{
+				{
+					Name: proto.String("Location"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("zone", 1, descriptorpb.FieldDescriptorProto_TYPE_INT32, ""),
+					},
+				},
+				{
+					Name: proto.String("Reading"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("sensor", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+						field("celsius", 2, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, ""),
+						field("location", 3, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".sensors.Location"),
+					},
+				},
+			},
+		}},
+	}
+}
@@ -18,16 +18,29 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"math/bits"
 	"sync"
 	"sync/atomic"
 )
 
 var (
 	bufcnt int64
+
+	// Pools of rings, one per power of two size
+	ringPools [64]sync.Pool
+
+	// Pool of the blocks that idle connections read into
+	blockPool = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, defaultReadBlockSize)
+			return &b
+		},
+	}
 )
 
 const (
 	defaultBufferSize     = 1024 * 256
+	defaultMinBufferSize  = 2 * defaultReadBlockSize
 	defaultReadBlockSize  = 8192
 	defaultWriteBlockSize = 8192
 )
@@ -55,14 +68,53 @@ func (this *sequence) set(seq int64) {
 	atomic.StoreInt64(&this.cursor, seq)
 }
 
+// ring is the memory of a buffer. A buffer may switch to a larger ring as it fills
+// up, and may let go of its ring while it's empty.
+type ring struct {
+	buf []byte
+
+	size int64
+	mask int64
+}
+
+func newRing(size int64) *ring {
+	if r, ok := ringPools[bits.TrailingZeros64(uint64(size))].Get().(*ring); ok {
+		return r
+	}
+
+	return &ring{
+		buf:  make([]byte, size),
+		size: size,
+		mask: size - 1,
+	}
+}
+
+func putRing(r *ring) {
+	ringPools[bits.TrailingZeros64(uint64(r.size))].Put(r)
+}
+
+// buffer is a ring buffer with a single consumer, and a single producer at a time.
+// It starts with a ring of min bytes, and the producer doubles it, up to max bytes,
+// instead of waiting for the consumer when it runs out of room. Once the consumer
+// has read everything, it gives the ring back to the pool, unless min and max are
+// the same, so idle connections don't hold on to memory.
+//
+// The consumer must load the producer position before the ring, so it never sees data
+// that's not in the ring it's reading from.
 type buffer struct {
 	id int64
 
-	buf []byte
+	r   atomic.Value // *ring
 	tmp []byte
 
-	size int64
-	mask int64
+	min int64
+	max int64
+
+	// plock is held by the producer while writing, so the consumer can give back the
+	// ring without pulling it from under the producer. ReadFrom() uses pmu. If there
+	// are other producers, they must set plock to the lock they already write under.
+	plock *sync.Mutex
+	pmu   sync.Mutex
 
 	done int64
 
@@ -76,35 +128,54 @@ type buffer struct {
 	pwait int64
 }
 
+// newBuffer() returns a buffer of a fixed size.
 func newBuffer(size int64) (*buffer, error) {
-	if size < 0 {
-		return nil, bufio.ErrNegativeCount
-	}
-
 	if size == 0 {
 		size = defaultBufferSize
 	}
 
-	if !powerOfTwo64(size) {
-		return nil, fmt.Errorf("Size must be power of two. Try %d.", roundUpPowerOfTwo64(size))
+	return newAdaptiveBuffer(size, size)
+}
+
+// newAdaptiveBuffer() returns a buffer that starts with min bytes and grows up to max
+// bytes as needed. Unless min and max are the same, the buffer lets go of its memory
+// whenever it's empty and waiting for more data in ReadFrom(), i.e., when the
+// connection is idle.
+func newAdaptiveBuffer(min, max int64) (*buffer, error) {
+	for _, size := range []int64{min, max} {
+		if size < 0 {
+			return nil, bufio.ErrNegativeCount
+		}
+
+		if !powerOfTwo64(size) {
+			return nil, fmt.Errorf("Size must be power of two. Try %d.", roundUpPowerOfTwo64(size))
+		}
+
+		if size < 2*defaultReadBlockSize {
+			return nil, fmt.Errorf("Size must at least be %d. Try %d.", 2*defaultReadBlockSize, 2*defaultReadBlockSize)
+		}
 	}
 
-	if size < 2*defaultReadBlockSize {
-		return nil, fmt.Errorf("Size must at least be %d. Try %d.", 2*defaultReadBlockSize, 2*defaultReadBlockSize)
+	if min > max {
+		return nil, fmt.Errorf("Minimum size %d is larger than maximum size %d.", min, max)
 	}
 
-	return &buffer{
+	this := &buffer{
 		id:    atomic.AddInt64(&bufcnt, 1),
-		buf:   make([]byte, size),
-		size:  size,
-		mask:  size - 1,
+		min:   min,
+		max:   max,
 		pseq:  newSequence(),
 		cseq:  newSequence(),
 		pcond: sync.NewCond(new(sync.Mutex)),
 		ccond: sync.NewCond(new(sync.Mutex)),
 		cwait: 0,
 		pwait: 0,
-	}, nil
+	}
+
+	this.r.Store((*ring)(nil))
+	this.plock = &this.pmu
+
+	return this, nil
 }
 
 func (this *buffer) ID() int64 {
@@ -131,6 +202,97 @@ func (this *buffer) Len() int {
 	return int(ppos - cpos)
 }
 
+// Cap() returns the size of the current ring, which is 0 if the buffer has let go
+// of it.
+func (this *buffer) Cap() int {
+	if r := this.ring(); r != nil {
+		return int(r.size)
+	}
+
+	return 0
+}
+
+// ring() returns the current ring, which may be nil if the buffer is empty.
+func (this *buffer) ring() *ring {
+	return this.r.Load().(*ring)
+}
+
+// grow() switches to a ring of at least n bytes, up to max, with the unread data
+// copied over. The old ring is left to the GC, since the consumer may still be
+// holding on to slices of it. Only the producer may call grow().
+func (this *buffer) grow(old *ring, n int64) *ring {
+	size := old.size
+	for size < n && size < this.max {
+		size <<= 1
+	}
+
+	r := newRing(size)
+
+	cpos := this.cseq.get()
+	ppos := this.pseq.get()
+
+	for pos := cpos; pos < ppos; {
+		i, j := pos&old.mask, pos&r.mask
+
+		end := i + ppos - pos
+		if end > old.size {
+			end = old.size
+		}
+
+		pos += int64(copy(r.buf[j:], old.buf[i:end]))
+	}
+
+	this.r.Store(r)
+
+	return r
+}
+
+// release() gives back the ring if the buffer is empty. It's called by the consumer
+// after it consumes data, so slices of the ring must not be used after they are
+// consumed. If the producer is busy writing, the ring is kept.
+func (this *buffer) release() {
+	if this.min == this.max || this.Len() > 0 || !this.plock.TryLock() {
+		return
+	}
+
+	defer this.plock.Unlock()
+
+	if r := this.ring(); r != nil && this.Len() == 0 {
+		this.r.Store((*ring)(nil))
+		putRing(r)
+	}
+}
+
+// free() puts the ring back to the pool. It's called once both the producer and the
+// consumer are gone.
+func (this *buffer) free() {
+	if r := this.ring(); r != nil {
+		this.r.Store((*ring)(nil))
+		putRing(r)
+	}
+}
+
+// readBlock() reads from r into a block from the pool, and then writes what's read
+// into the buffer. This way the ring is not held while waiting for data, and the
+// consumer can give it back once it's done.
+func (this *buffer) readBlock(r io.Reader) (int, error) {
+	b := blockPool.Get().(*[]byte)
+	defer blockPool.Put(b)
+
+	n, err := r.Read(*b)
+	if n > 0 {
+		this.plock.Lock()
+		_, werr := this.Write((*b)[:n])
+		this.plock.Unlock()
+
+		if werr != nil {
+			return 0, werr
+		}
+	}
+
+	return n, err
+}
+
 func (this *buffer) ReadFrom(r io.Reader) (int64, error) {
 	defer this.Close()
 
@@ -141,18 +303,30 @@ func (this *buffer) ReadFrom(r io.Reader) (int64, error) {
 			return total, io.EOF
 		}
 
+		if this.min < this.max {
+			n, err := this.readBlock(r)
+			total += int64(n)
+
+			if err != nil {
+				return total, err
+			}
+
+			continue
+		}
+
 		start, cnt, err := this.waitForWriteSpace(defaultReadBlockSize)
 		if err != nil {
 			return 0, err
 		}
 
-		pstart := start & this.mask
+		rb := this.ring()
+		pstart := start & rb.mask
 		pend := pstart + int64(cnt)
-		if pend > this.size {
-			pend = this.size
+		if pend > rb.size {
+			pend = rb.size
 		}
 
-		n, err := r.Read(this.buf[pstart:pend])
+		n, err := r.Read(rb.buf[pstart:pend])
 
 		if n > 0 {
 			total += int64(n)
@@ -213,7 +387,7 @@ func (this *buffer) Read(p []byte) (int, error) {
 	for {
 		cpos := this.cseq.get()
 		ppos := this.pseq.get()
-		cindex := cpos & this.mask
+		r := this.ring()
 
 		// If consumer position is at least len(p) less than producer position, that means
 		// we have enough data to fill p. There are two scenarios that could happen:
@@ -225,12 +399,13 @@ func (this *buffer) Read(p []byte) (int, error) {
 		//    buffer to p, and copy will just copy until the end of the buffer and stop.
 		//    The number of bytes will NOT be len(p) but less than that.
 		if cpos+pl < ppos {
-			n := copy(p, this.buf[cindex:])
+			n := copy(p, r.buf[cpos&r.mask:])
 
 			this.cseq.set(cpos + int64(n))
 			this.pcond.L.Lock()
 			this.pcond.Broadcast()
 			this.pcond.L.Unlock()
+			this.release()
 
 			return n, nil
 		}
@@ -241,6 +416,8 @@ func (this *buffer) Read(p []byte) (int, error) {
 		// If cpos < ppos, that means there's at least ppos-cpos bytes to read. Let's just
 		// send that back for now.
 		if cpos < ppos {
+			cindex := cpos & r.mask
+
 			// n bytes available
 			b := ppos - cpos
 
@@ -249,17 +426,18 @@ func (this *buffer) Read(p []byte) (int, error) {
 
 			// if cindex+n < size, that means we can copy all n bytes into p.
 			// No wrapping in this case.
-			if cindex+b < this.size {
-				n = copy(p, this.buf[cindex:cindex+b])
+			if cindex+b < r.size {
+				n = copy(p, r.buf[cindex:cindex+b])
 			} else {
 				// If cindex+n >= size, that means we can copy to the end of buffer
-				n = copy(p, this.buf[cindex:])
+				n = copy(p, r.buf[cindex:])
 			}
 
 			this.cseq.set(cpos + int64(n))
 			this.pcond.L.Lock()
 			this.pcond.Broadcast()
 			this.pcond.L.Unlock()
+			this.release()
 			return n, nil
 		}
 
@@ -290,8 +468,9 @@ func (this *buffer) Write(p []byte) (int, error) {
 	}
 
 	// If we are here that means we now have enough space to write the full p.
-	// Let's copy from p into this.buf, starting at position ppos&this.mask.
-	total := ringCopy(this.buf, p, int64(start)&this.mask)
+	// Let's copy from p into the ring, starting at position ppos&mask.
+	r := this.ring()
+	total := ringCopy(r.buf, p, int64(start)&r.mask)
 
 	this.pseq.set(start + int64(len(p)))
 	this.ccond.L.Lock()
@@ -310,7 +489,7 @@ func (this *buffer) Write(p []byte) (int, error) {
 // If there's not enough data to peek, error is ErrBufferInsufficientData.
 // If n < 0, error is bufio.ErrNegativeCount
 func (this *buffer) ReadPeek(n int) ([]byte, error) {
-	if int64(n) > this.size {
+	if int64(n) > this.max {
 		return nil, bufio.ErrBufferFull
 	}
 
@@ -346,20 +525,21 @@ func (this *buffer) ReadPeek(n int) ([]byte, error) {
 
 	// There's data to peek. The size of the data could be <= n.
 	if cpos+m <= ppos {
-		cindex := cpos & this.mask
+		r := this.ring()
+		cindex := cpos & r.mask
 
 		// If cindex (index relative to buffer) + n is more than buffer size, that means
 		// the data wrapped
-		if cindex+m > this.size {
+		if cindex+m > r.size {
 			// reset the tmp buffer
 			this.tmp = this.tmp[0:0]
 
-			l := len(this.buf[cindex:])
-			this.tmp = append(this.tmp, this.buf[cindex:]...)
-			this.tmp = append(this.tmp, this.buf[0:m-int64(l)]...)
+			l := len(r.buf[cindex:])
+			this.tmp = append(this.tmp, r.buf[cindex:]...)
+			this.tmp = append(this.tmp, r.buf[0:m-int64(l)]...)
 			return this.tmp, err
 		} else {
-			return this.buf[cindex : cindex+m], err
+			return r.buf[cindex : cindex+m], err
 		}
 	}
 
@@ -370,7 +550,7 @@ func (this *buffer) ReadPeek(n int) ([]byte, error) {
 // wait until there's enough. This differs from ReadPeek or Readin that Peek will
 // return whatever is available and won't wait for full count.
 func (this *buffer) ReadWait(n int) ([]byte, error) {
-	if int64(n) > this.size {
+	if int64(n) > this.max {
 		return nil, bufio.ErrBufferFull
 	}
 
@@ -397,21 +577,22 @@ func (this *buffer) ReadWait(n int) ([]byte, error) {
 	this.ccond.L.Unlock()
 
 	// If we are here that means we have at least n bytes of data available.
-	cindex := cpos & this.mask
+	r := this.ring()
+	cindex := cpos & r.mask
 
 	// If cindex (index relative to buffer) + n is more than buffer size, that means
 	// the data wrapped
-	if cindex+int64(n) > this.size {
+	if cindex+int64(n) > r.size {
 		// reset the tmp buffer
 		this.tmp = this.tmp[0:0]
 
-		l := len(this.buf[cindex:])
-		this.tmp = append(this.tmp, this.buf[cindex:]...)
-		this.tmp = append(this.tmp, this.buf[0:n-l]...)
+		l := len(r.buf[cindex:])
+		this.tmp = append(this.tmp, r.buf[cindex:]...)
+		this.tmp = append(this.tmp, r.buf[0:n-l]...)
 		return this.tmp[:n], nil
 	}
 
-	return this.buf[cindex : cindex+int64(n)], nil
+	return r.buf[cindex : cindex+int64(n)], nil
 }
 
 // Commit moves the cursor forward by n bytes. It behaves like Read() except it doesn't
@@ -419,7 +600,7 @@ func (this *buffer) ReadWait(n int) ([]byte, error) {
 // n will be returned. If there's not enough data, then the cursor will move forward
 // as much as possible, then return the number of positions (bytes) moved.
 func (this *buffer) ReadCommit(n int) (int, error) {
-	if int64(n) > this.size {
+	if int64(n) > this.max {
 		return 0, bufio.ErrBufferFull
 	}
 
@@ -444,6 +625,7 @@ func (this *buffer) ReadCommit(n int) (int, error) {
 		this.pcond.L.Lock()
 		this.pcond.Broadcast()
 		this.pcond.L.Unlock()
+		this.release()
 		return n, nil
 	}
 
@@ -460,12 +642,13 @@ func (this *buffer) WriteWait(n int) ([]byte, bool, error) {
 		return nil, false, err
 	}
 
-	pstart := start & this.mask
-	if pstart+int64(cnt) > this.size {
-		return this.buf[pstart:], true, nil
+	r := this.ring()
+	pstart := start & r.mask
+	if pstart+int64(cnt) > r.size {
+		return r.buf[pstart:], true, nil
 	}
 
-	return this.buf[pstart : pstart+int64(cnt)], false, nil
+	return r.buf[pstart : pstart+int64(cnt)], false, nil
 }
 
 func (this *buffer) WriteCommit(n int) (int, error) {
@@ -489,6 +672,17 @@ func (this *buffer) waitForWriteSpace(n int) (int64, int, error) {
 		return 0, 0, io.EOF
 	}
 
+	if int64(n) > this.max {
+		return 0, 0, bufio.ErrBufferFull
+	}
+
+	// If the buffer has let go of its ring, start again with the smallest one
+	r := this.ring()
+	if r == nil {
+		r = newRing(this.min)
+		this.r.Store(r)
+	}
+
 	// The current producer position, remember it's a forever inreasing int64,
 	// NOT the position relative to the buffer
 	ppos := this.pseq.get()
@@ -499,7 +693,7 @@ func (this *buffer) waitForWriteSpace(n int) (int64, int, error) {
 	// For the producer, gate is the previous consumer sequence.
 	gate := this.pseq.gate
 
-	wrap := next - this.size
+	wrap := next - r.size
 
 	// If wrap point is greater than gate, that means the consumer hasn't read
 	// some of the data in the buffer, and if we read in additional data and put
@@ -539,6 +733,12 @@ func (this *buffer) waitForWriteSpace(n int) (int64, int, error) {
 	// that are currently unread.
 	//
 	if wrap > gate || gate > ppos {
+		// Rather than waiting for the consumer, switch to a larger ring if possible
+		if cpos := this.cseq.get(); wrap > cpos && r.size < this.max {
+			r = this.grow(r, next-cpos)
+			wrap = next - r.size
+		}
+
 		var cpos int64
 		this.pcond.L.Lock()
 		for cpos = this.cseq.get(); wrap > cpos; cpos = this.cseq.get() {
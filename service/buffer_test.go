@@ -15,6 +15,7 @@
 package service
 
 import (
+	"bufio"
 	"bytes"
 	"io"
 	"testing"
@@ -82,11 +83,92 @@ func TestBufferPeek(t *testing.T) {
 	peekBuffer(t, buf, 1000)
 }
 
+func TestBufferGrow(t *testing.T) {
+	buf, err := newAdaptiveBuffer(16384, 65536)
+	require.NoError(t, err)
+
+	// Nothing is consumed, so the buffer has to grow to take it all
+	p := make([]byte, 40000)
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	n, err := buf.Write(p[:10000])
+	require.NoError(t, err)
+	require.Equal(t, 10000, n)
+	require.Equal(t, 16384, buf.Cap())
+
+	// Move the consumer a bit, so the data wraps around in the old ring
+	_, err = buf.ReadCommit(1000)
+	require.NoError(t, err)
+
+	n, err = buf.Write(p[10000:])
+	require.NoError(t, err)
+	require.Equal(t, 30000, n)
+	require.Equal(t, 65536, buf.Cap())
+
+	b, err := buf.ReadWait(39000)
+	require.NoError(t, err)
+	require.Equal(t, p[1000:], b)
+
+	// Can't grow past the maximum
+	_, err = buf.ReadPeek(65537)
+	require.Equal(t, bufio.ErrBufferFull, err)
+}
+
+func TestBufferRelease(t *testing.T) {
+	buf, err := newAdaptiveBuffer(16384, 65536)
+	require.NoError(t, err)
+
+	p := make([]byte, 100)
+
+	_, err = buf.Write(p)
+	require.NoError(t, err)
+	require.Equal(t, 16384, buf.Cap())
+
+	_, err = buf.ReadCommit(50)
+	require.NoError(t, err)
+	require.Equal(t, 16384, buf.Cap())
+
+	// Once everything is consumed, the ring is given back
+	_, err = buf.ReadCommit(50)
+	require.NoError(t, err)
+	require.Equal(t, 0, buf.Cap())
+
+	// And the next write gets a new one
+	_, err = buf.Write(p)
+	require.NoError(t, err)
+	require.Equal(t, 16384, buf.Cap())
+
+	// Not while the producer is writing though
+	buf.plock.Lock()
+	_, err = buf.Read(make([]byte, 100))
+	require.NoError(t, err)
+	require.Equal(t, 16384, buf.Cap())
+	buf.plock.Unlock()
+
+	// A fixed size buffer keeps its ring
+	fixed, err := newBuffer(16384)
+	require.NoError(t, err)
+
+	_, err = fixed.Write(p)
+	require.NoError(t, err)
+
+	_, err = fixed.ReadCommit(100)
+	require.NoError(t, err)
+	require.Equal(t, 16384, fixed.Cap())
+}
+
 func BenchmarkBufferConsumerProducerRead(b *testing.B) {
 	buf, _ := newBuffer(0)
 	benchmarkRead(b, buf)
 }
 
+func BenchmarkBufferAdaptiveConsumerProducerRead(b *testing.B) {
+	buf, _ := newAdaptiveBuffer(defaultMinBufferSize, defaultBufferSize)
+	benchmarkRead(b, buf)
+}
+
 func testFillBuffer(t *testing.T, bufsize, ringsize int64) *buffer {
 	buf, err := newBuffer(ringsize)
 
@@ -21,9 +21,10 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/surge/glog"
 	"github.com/surgemq/message"
 	"github.com/surgemq/surgemq/sessions"
-	"github.com/surgemq/surgemq/topics"
+	"github.com/surgemq/surgemq/store"
 )
 
 const (
@@ -49,7 +50,49 @@ type Client struct {
 	// If no set then default to 3 retries.
 	TimeoutRetries int
 
+	// MaxPacketSize is the maximum size, in bytes, of a packet sent by the server. If
+	// the server sends a larger packet, the client disconnects. If not set then
+	// there's no limit other than the MQTT maximum of 256MB.
+	MaxPacketSize int
+
+	// MaxInflightOut is the maximum number of QoS 1 and 2 messages published that can
+	// be waiting for acks. Further messages are queued until acks come back. If not
+	// set then there's no limit.
+	MaxInflightOut int
+
+	// MaxInflightIn is the maximum number of QoS 2 messages received from the server
+	// that can be waiting for PUBREL. If the server goes over, the client disconnects.
+	// If not set then there's no limit.
+	MaxInflightIn int
+
+	// MinBufferSize and MaxBufferSize are the sizes, in bytes, of the buffers for the
+	// data received from and sent to the server. The buffers start at MinBufferSize
+	// and grow up to MaxBufferSize as needed. While the connection is idle, the
+	// buffers are released, unless both sizes are the same. If not set then default
+	// to 16KB and 256KB.
+	MinBufferSize int
+	MaxBufferSize int
+
+	// MessageStore is the name of the store provider that keeps outgoing QoS 1 and 2
+	// messages until they are acked. If set, Publish does not fail while the client
+	// is disconnected. Instead the messages are saved and sent, in order, after the
+	// next successful Connect. Messages that were in flight when the connection was
+	// lost are sent again. If not set then messages are not saved.
+	MessageStore string
+
+	// DefaultOnPublish handles the messages received from the server that match no
+	// active subscription. It must be set before Connect is called. If not set then
+	// such messages are dropped.
+	DefaultOnPublish OnPublishFunc
+
 	svc *service
+
+	// outbox is created on the first Connect and is kept across connections
+	outbox *outbox
+
+	// router is created on the first Connect and is kept across connections, unless
+	// the connection starts a clean session
+	router *router
 }
 
 // Connect is for MQTT clients to open a connection to a remote server. It needs to
@@ -62,6 +105,10 @@ func (this *Client) Connect(uri string, msg *message.ConnectMessage) (err error)
 		return fmt.Errorf("msg is nil")
 	}
 
+	if err = this.checkOutbox(msg); err != nil {
+		return err
+	}
+
 	u, err := url.Parse(uri)
 	if err != nil {
 		return err
@@ -110,6 +157,13 @@ func (this *Client) Connect(uri string, msg *message.ConnectMessage) (err error)
 		connectTimeout: this.ConnectTimeout,
 		ackTimeout:     this.AckTimeout,
 		timeoutRetries: this.TimeoutRetries,
+		maxPacketSize:  this.MaxPacketSize,
+		maxInflightOut: this.MaxInflightOut,
+		maxInflightIn:  this.MaxInflightIn,
+		minBufferSize:  this.MinBufferSize,
+		maxBufferSize:  this.MaxBufferSize,
+
+		outbox: this.outbox,
 	}
 
 	err = this.getSession(this.svc, msg, resp)
@@ -117,14 +171,14 @@ func (this *Client) Connect(uri string, msg *message.ConnectMessage) (err error)
 		return err
 	}
 
-	p := topics.NewMemProvider()
-	topics.Register(this.svc.sess.ID(), p)
-
-	this.svc.topicsMgr, err = topics.NewManager(this.svc.sess.ID())
-	if err != nil {
-		return err
+	if this.router == nil {
+		this.router = newRouter(this.DefaultOnPublish)
+	} else if msg.CleanSession() {
+		this.router.reset()
 	}
 
+	this.svc.router = this.router
+
 	if err := this.svc.start(); err != nil {
 		this.svc.stop()
 		return err
@@ -133,6 +187,12 @@ func (this *Client) Connect(uri string, msg *message.ConnectMessage) (err error)
 	this.svc.inStat.increment(int64(msg.Len()))
 	this.svc.outStat.increment(int64(resp.Len()))
 
+	if this.outbox != nil {
+		if err := this.outbox.drain(this.svc); err != nil {
+			glog.Errorf("(%s) Error sending saved messages: %v", this.svc.cid(), err)
+		}
+	}
+
 	return nil
 }
 
@@ -141,7 +201,14 @@ func (this *Client) Connect(uri string, msg *message.ConnectMessage) (err error)
 // immediately after the message is sent to the outgoing buffer. For QOS 1 messages,
 // onComplete is called when PUBACK is received. For QOS 2 messages, onComplete is
 // called after the PUBCOMP message is received.
+//
+// If MessageStore is set, QoS 1 and 2 messages are saved before they are sent, and
+// Publish succeeds even if the client is not connected.
 func (this *Client) Publish(msg *message.PublishMessage, onComplete OnCompleteFunc) error {
+	if this.outbox != nil && msg.QoS() != message.QosAtMostOnce {
+		return this.outbox.publish(this.svc, msg, onComplete)
+	}
+
 	return this.svc.publish(msg, onComplete)
 }
 
@@ -158,6 +225,24 @@ func (this *Client) Subscribe(msg *message.SubscribeMessage, onComplete OnComple
 	return this.svc.subscribe(msg, onComplete, onPublish)
 }
 
+// SubscribeChan is like Subscribe, except that messages sent to the client for the
+// subscribed topics are delivered on the channel of the returned Subscription rather
+// than to an OnPublishFunc. This way a slow consumer does not hold up the processing
+// of acks on the connection, unless the overflow policy is OverflowBlock.
+//
+// The PUBACK (QoS 1) or PUBCOMP (QoS 2) for a delivered message is sent once the
+// message is handed off to the channel, or, if opts.ManualAck is set, once the
+// consumer calls Subscription.Ack.
+func (this *Client) SubscribeChan(msg *message.SubscribeMessage, onComplete OnCompleteFunc, opts ChanOptions) (*Subscription, error) {
+	sub := newSubscription(this, opts)
+
+	if err := this.svc.subscribe(msg, onComplete, sub.onpub); err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
 // Unsubscribe sends a single UNSUBSCRIBE message to the server. The UNSUBSCRIBE
 // message can contain multiple topics that the client wants to unsubscribe. On
 // completion, which is when the client receives a UNSUBACK message from the server,
@@ -187,6 +272,21 @@ func (this *Client) getSession(svc *service, req *message.ConnectMessage, resp *
 	return svc.sess.Init(req)
 }
 
+// checkOutbox() creates the outbox on the first Connect, if there's a MessageStore.
+func (this *Client) checkOutbox(msg *message.ConnectMessage) error {
+	if this.outbox != nil || this.MessageStore == "" {
+		return nil
+	}
+
+	storeMgr, err := store.NewManager(this.MessageStore)
+	if err != nil {
+		return err
+	}
+
+	this.outbox, err = newOutbox(string(msg.ClientId()), storeMgr)
+	return err
+}
+
 func (this *Client) checkConfiguration() {
 	if this.KeepAlive == 0 {
 		this.KeepAlive = DefaultKeepAlive
@@ -0,0 +1,101 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// pollState is the state of a connection that's handled by an event loop.
+type pollState struct {
+	// Held by the event loop while it reads from or writes to fd, and by stop()
+	// while it takes the connection off the loop, so fd is never used after it's
+	// closed.
+	mu sync.Mutex
+
+	// The file descriptor of the connection, -1 once it's off the loop
+	fd int
+
+	// The events the loop is waiting for
+	events uint32
+
+	// Set when the loop stops reading because the incoming buffer is full. The
+	// processor resumes reading once it makes room.
+	paused int32
+
+	// Set while the service is waiting for the loop to send its outgoing buffer
+	flushing int32
+
+	// The last time, in Unix nanoseconds, data was read from the connection
+	last int64
+}
+
+// spawn() runs f in a new goroutine, unless the service is stopping. It's used to
+// start the processor and deliverer on demand in the event loop mode.
+func (this *service) spawn(f func()) bool {
+	this.kmu.Lock()
+	defer this.kmu.Unlock()
+
+	if this.stopping {
+		return false
+	}
+
+	this.wgStarted.Add(1)
+	this.wgStopped.Add(1)
+	go f()
+
+	return true
+}
+
+// kickProcessor() starts the processor if it's not running already. In the event
+// loop mode, the processor only runs while there's data in the incoming buffer.
+func (this *service) kickProcessor() {
+	if atomic.CompareAndSwapInt32(&this.processing, 0, 1) && !this.spawn(this.processor) {
+		atomic.StoreInt32(&this.processing, 0)
+	}
+}
+
+// kickDeliverer() starts the deliverer if it's not running already. In the event
+// loop mode, the deliverer only runs while there are queued messages.
+func (this *service) kickDeliverer() {
+	if atomic.CompareAndSwapInt32(&this.delivering, 0, 1) && !this.spawn(this.deliverer) {
+		atomic.StoreInt32(&this.delivering, 0)
+	}
+}
+
+// nothingToProcess() returns true if the incoming buffer is empty, and more data
+// may still come in. Once the buffer is closed, the processor keeps going so that it
+// stops the service.
+func (this *service) nothingToProcess() bool {
+	return this.in.Len() == 0 && !this.in.isDone()
+}
+
+// idle() returns true if the goroutine that flag stands for has nothing more to do,
+// in which case it must return. The flag is cleared first, so that work that comes
+// in at the same time is either seen here, or starts a new goroutine.
+func idle(flag *int32, empty func() bool) bool {
+	if !empty() {
+		return false
+	}
+
+	atomic.StoreInt32(flag, 0)
+
+	if empty() || !atomic.CompareAndSwapInt32(flag, 0, 1) {
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,450 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/surge/glog"
+)
+
+const (
+	// How long epoll waits for events, which is also how often keepalives are checked
+	loopWaitMillis = 1000
+
+	// The maximum number of bytes written to a connection at once
+	loopWriteSize = 8 * defaultWriteBlockSize
+)
+
+// eventLoop does the network I/O for a set of connections with epoll. Data read is
+// put in the incoming buffer of the service, and the processor is started if it's
+// not running. The outgoing buffer is sent when the service asks for it with
+// flush(). Connections that have been idle for longer than their keepalive are
+// stopped.
+type eventLoop struct {
+	epfd int
+
+	// Pipe that wakes up the loop, when there are services to flush or it's closed
+	wake [2]int
+
+	// Services by file descriptor, and the ones waiting to be flushed
+	mu      sync.Mutex
+	svcs    map[int]*service
+	pending []*service
+
+	woken  int32
+	closed int32
+	done   chan struct{}
+}
+
+func newEventLoops(n int) ([]*eventLoop, error) {
+	loops := make([]*eventLoop, 0, n)
+
+	for i := 0; i < n; i++ {
+		l, err := newEventLoop()
+		if err != nil {
+			for _, l := range loops {
+				l.close()
+			}
+
+			return nil, err
+		}
+
+		loops = append(loops, l)
+	}
+
+	return loops, nil
+}
+
+func newEventLoop() (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &eventLoop{
+		epfd: epfd,
+		svcs: make(map[int]*service),
+		done: make(chan struct{}),
+	}
+
+	if err := syscall.Pipe2(this.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(this.wake[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, this.wake[0], &ev); err != nil {
+		syscall.Close(this.wake[0])
+		syscall.Close(this.wake[1])
+		syscall.Close(epfd)
+		return nil, err
+	}
+
+	go this.run()
+
+	return this, nil
+}
+
+// add() starts polling the connection of the service.
+func (this *eventLoop) add(svc *service) error {
+	conn, ok := svc.conn.(syscall.Conn)
+	if !ok {
+		return ErrInvalidConnectionType
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	fd := -1
+	if err := raw.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return err
+	}
+
+	svc.poll.mu.Lock()
+	defer svc.poll.mu.Unlock()
+
+	svc.poll.fd = fd
+	svc.poll.events = syscall.EPOLLIN
+	atomic.StoreInt64(&svc.poll.last, time.Now().UnixNano())
+
+	this.mu.Lock()
+	this.svcs[fd] = svc
+	this.mu.Unlock()
+
+	ev := syscall.EpollEvent{Events: svc.poll.events, Fd: int32(fd)}
+	if err := syscall.EpollCtl(this.epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		this.mu.Lock()
+		delete(this.svcs, fd)
+		this.mu.Unlock()
+
+		svc.poll.fd = -1
+		return err
+	}
+
+	return nil
+}
+
+// remove() stops polling the connection of the service. It must be called before
+// the connection is closed.
+func (this *eventLoop) remove(svc *service) {
+	svc.poll.mu.Lock()
+	defer svc.poll.mu.Unlock()
+
+	this.del(svc)
+}
+
+// flush() asks the loop to send the outgoing buffer of the service.
+func (this *eventLoop) flush(svc *service) {
+	if !atomic.CompareAndSwapInt32(&svc.poll.flushing, 0, 1) {
+		return
+	}
+
+	this.mu.Lock()
+	this.pending = append(this.pending, svc)
+	this.mu.Unlock()
+
+	this.wakeup()
+}
+
+// resume() starts reading from the connection again, if it was paused because the
+// incoming buffer was full, or the client went over its rate limits.
+func (this *eventLoop) resume(svc *service) {
+	if !atomic.CompareAndSwapInt32(&svc.poll.paused, 1, 0) {
+		return
+	}
+
+	svc.poll.mu.Lock()
+	defer svc.poll.mu.Unlock()
+
+	this.modify(svc, svc.poll.events|syscall.EPOLLIN)
+}
+
+// close() stops the loop. The connections must have been removed already.
+func (this *eventLoop) close() {
+	if !atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		return
+	}
+
+	this.wakeup()
+	<-this.done
+
+	syscall.Close(this.wake[0])
+	syscall.Close(this.wake[1])
+	syscall.Close(this.epfd)
+}
+
+func (this *eventLoop) run() {
+	defer close(this.done)
+
+	var (
+		events = make([]syscall.EpollEvent, 256)
+		block  = make([]byte, defaultReadBlockSize)
+		swept  = time.Now()
+	)
+
+	for atomic.LoadInt32(&this.closed) == 0 {
+		n, err := syscall.EpollWait(this.epfd, events, loopWaitMillis)
+		if err != nil && err != syscall.EINTR {
+			glog.Errorf("service/eventLoop: Error waiting for events: %v", err)
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+
+			if fd == this.wake[0] {
+				this.drainWakeup()
+				continue
+			}
+
+			this.mu.Lock()
+			svc := this.svcs[fd]
+			this.mu.Unlock()
+
+			if svc == nil {
+				continue
+			}
+
+			switch e := events[i].Events; {
+			case e&syscall.EPOLLIN != 0:
+				this.read(svc, block)
+
+			case e&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0:
+				this.hangup(svc)
+			}
+
+			if events[i].Events&syscall.EPOLLOUT != 0 {
+				this.write(svc)
+			}
+		}
+
+		this.flushPending()
+
+		if now := time.Now(); now.Sub(swept) >= time.Millisecond*loopWaitMillis {
+			this.sweep(now)
+			swept = now
+		}
+	}
+}
+
+// read() reads what's available from the connection into the incoming buffer, and
+// starts the processor.
+func (this *eventLoop) read(svc *service, block []byte) {
+	svc.poll.mu.Lock()
+	defer svc.poll.mu.Unlock()
+
+	if svc.poll.fd < 0 {
+		return
+	}
+
+	// Never wait for the processor. If there's no room, stop reading until the
+	// processor catches up, see resume().
+	in := svc.in
+	if int64(in.Len()+len(block)) > in.max {
+		atomic.StoreInt32(&svc.poll.paused, 1)
+		this.modify(svc, svc.poll.events&^syscall.EPOLLIN)
+		svc.kickProcessor()
+		return
+	}
+
+	// Stop reading while the client is paused for going over its rate limits
+	if svc.rate != nil {
+		if d := svc.rate.delay(); d > 0 {
+			atomic.StoreInt32(&svc.poll.paused, 1)
+			this.modify(svc, svc.poll.events&^syscall.EPOLLIN)
+			time.AfterFunc(d, func() { this.resume(svc) })
+			return
+		}
+	}
+
+	n, err := syscall.Read(svc.poll.fd, block)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return
+	}
+
+	if n <= 0 {
+		if err != nil {
+			glog.Errorf("(%s) error reading from connection: %v", svc.cid(), err)
+			svc.setCause(err)
+		}
+
+		this.eof(svc)
+		return
+	}
+
+	atomic.StoreInt64(&svc.poll.last, time.Now().UnixNano())
+
+	in.plock.Lock()
+	_, err = in.Write(block[:n])
+	in.plock.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	svc.kickProcessor()
+}
+
+// write() sends as much of the outgoing buffer as the connection takes. If there's
+// more, the loop waits until the connection is writable again.
+func (this *eventLoop) write(svc *service) {
+	svc.poll.mu.Lock()
+	defer svc.poll.mu.Unlock()
+
+	if svc.poll.fd < 0 {
+		return
+	}
+
+	out := svc.out
+
+	for out.Len() > 0 {
+		l := out.Len()
+		if l > loopWriteSize {
+			l = loopWriteSize
+		}
+
+		p, err := out.ReadPeek(l)
+		if err != nil && err != ErrBufferInsufficientData {
+			return
+		}
+
+		n, err := syscall.Write(svc.poll.fd, p)
+		if n > 0 {
+			out.ReadCommit(n)
+		}
+
+		if err == syscall.EAGAIN {
+			this.modify(svc, svc.poll.events|syscall.EPOLLOUT)
+			return
+		}
+
+		if err != nil && err != syscall.EINTR {
+			glog.Errorf("(%s) error writing data: %v", svc.cid(), err)
+			this.del(svc)
+			svc.setCause(err)
+			go svc.stop()
+			return
+		}
+	}
+
+	this.modify(svc, svc.poll.events&^syscall.EPOLLOUT)
+}
+
+func (this *eventLoop) hangup(svc *service) {
+	svc.poll.mu.Lock()
+	defer svc.poll.mu.Unlock()
+
+	if svc.poll.fd >= 0 {
+		this.eof(svc)
+	}
+}
+
+// eof() takes the service off the loop once there's nothing more to read. The
+// processor still processes what's left in the incoming buffer, and then stops the
+// service. svc.poll.mu must be held.
+func (this *eventLoop) eof(svc *service) {
+	this.del(svc)
+	svc.in.Close()
+	svc.kickProcessor()
+}
+
+// flushPending() writes out the services that asked for it since the last time.
+func (this *eventLoop) flushPending() {
+	atomic.StoreInt32(&this.woken, 0)
+
+	this.mu.Lock()
+	pending := this.pending
+	this.pending = nil
+	this.mu.Unlock()
+
+	for _, svc := range pending {
+		atomic.StoreInt32(&svc.poll.flushing, 0)
+		this.write(svc)
+	}
+}
+
+// sweep() stops the connections that haven't sent anything for 1.5 times their
+// keepalive.
+func (this *eventLoop) sweep(now time.Time) {
+	var expired []*service
+
+	this.mu.Lock()
+	for _, svc := range this.svcs {
+		keepAlive := time.Second * time.Duration(svc.keepAlive)
+		if keepAlive > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&svc.poll.last))) > keepAlive+keepAlive/2 {
+			expired = append(expired, svc)
+		}
+	}
+	this.mu.Unlock()
+
+	for _, svc := range expired {
+		glog.Errorf("(%s) error reading from connection: keepalive expired", svc.cid())
+		this.remove(svc)
+		svc.setCause(ErrKeepAliveExpired)
+		go svc.stop()
+	}
+}
+
+// del() takes the service off the loop. svc.poll.mu must be held.
+func (this *eventLoop) del(svc *service) {
+	if svc.poll.fd < 0 {
+		return
+	}
+
+	syscall.EpollCtl(this.epfd, syscall.EPOLL_CTL_DEL, svc.poll.fd, nil)
+
+	this.mu.Lock()
+	delete(this.svcs, svc.poll.fd)
+	this.mu.Unlock()
+
+	svc.poll.fd = -1
+}
+
+// modify() changes the events the loop waits for on the connection. svc.poll.mu must
+// be held.
+func (this *eventLoop) modify(svc *service, events uint32) {
+	if svc.poll.fd < 0 || svc.poll.events == events {
+		return
+	}
+
+	svc.poll.events = events
+
+	ev := syscall.EpollEvent{Events: events, Fd: int32(svc.poll.fd)}
+	if err := syscall.EpollCtl(this.epfd, syscall.EPOLL_CTL_MOD, svc.poll.fd, &ev); err != nil {
+		glog.Errorf("(%s) error changing polled events: %v", svc.cid(), err)
+	}
+}
+
+func (this *eventLoop) wakeup() {
+	if atomic.CompareAndSwapInt32(&this.woken, 0, 1) {
+		syscall.Write(this.wake[1], []byte{1})
+	}
+}
+
+func (this *eventLoop) drainWakeup() {
+	var b [64]byte
+
+	for {
+		if n, _ := syscall.Read(this.wake[0], b[:]); n <= 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerEventLoop(t *testing.T) {
+	svr, done := startServer(t, &Server{Authenticator: authenticator, EventLoops: 2})
+
+	c := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c)
+
+	waitForServices(t, svr, 1)
+
+	var (
+		subacked = make(chan struct{})
+		received = make(chan *message.PublishMessage, 100)
+		acked    int64
+	)
+
+	err := c.Subscribe(newSubscribeMessage(1),
+		func(msg, ack message.Message, err error) error {
+			close(subacked)
+			return nil
+		},
+		func(msg *message.PublishMessage) error {
+			received <- msg
+			return nil
+		})
+	require.NoError(t, err)
+
+	select {
+	case <-subacked:
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for subscribe response")
+	}
+
+	// Larger than the smallest buffers, so the loop has to let them grow
+	large := newPublishMessage(0, 1)
+	large.SetPayload(make([]byte, 100*1024))
+
+	msgs := []*message.PublishMessage{large}
+	for i := uint16(1); i <= 50; i++ {
+		msgs = append(msgs, newPublishMessageLarge(i, 1))
+	}
+
+	for _, msg := range msgs {
+		err := c.Publish(msg, func(msg, ack message.Message, err error) error {
+			atomic.AddInt64(&acked, 1)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	for _, msg := range msgs {
+		select {
+		case rcvd := <-received:
+			require.Equal(t, len(msg.Payload()), len(rcvd.Payload()))
+
+		case <-time.After(time.Second):
+			require.FailNow(t, "Timed out waiting for publish messages")
+		}
+	}
+
+	// Once there's nothing left to do, the server side goroutines are gone
+	svc := svr.services()[0]
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt64(&acked) == int64(len(msgs)) &&
+			atomic.LoadInt32(&svc.processing) == 0 && atomic.LoadInt32(&svc.delivering) == 0 {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.Equal(t, int64(len(msgs)), atomic.LoadInt64(&acked))
+	require.Equal(t, int32(0), atomic.LoadInt32(&svc.processing))
+	require.Equal(t, int32(0), atomic.LoadInt32(&svc.delivering))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, svr.Shutdown(ctx))
+	require.NoError(t, <-done)
+}
+
+func TestServerEventLoopDisconnect(t *testing.T) {
+	svr, done := startServer(t, &Server{Authenticator: authenticator, EventLoops: 1})
+
+	c := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c)
+
+	waitForServices(t, svr, 1)
+
+	svc := svr.services()[0]
+
+	c.Disconnect()
+
+	// The loop sees the connection closed, and the service is stopped
+	waitForServices(t, svr, 0)
+	require.True(t, svc.isClosed())
+	require.Equal(t, -1, svc.poll.fd)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, svr.Shutdown(ctx))
+	require.NoError(t, <-done)
+}
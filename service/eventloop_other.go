@@ -0,0 +1,38 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package service
+
+// eventLoop is only implemented on Linux. Elsewhere, setting Server.EventLoops
+// fails with ErrEventLoopUnsupported.
+type eventLoop struct{}
+
+func newEventLoops(n int) ([]*eventLoop, error) {
+	return nil, ErrEventLoopUnsupported
+}
+
+func (this *eventLoop) add(svc *service) error {
+	return ErrEventLoopUnsupported
+}
+
+func (this *eventLoop) remove(svc *service) {}
+
+func (this *eventLoop) flush(svc *service) {}
+
+func (this *eventLoop) resume(svc *service) {}
+
+func (this *eventLoop) close() {}
@@ -0,0 +1,174 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/surge/glog"
+	"github.com/surgemq/message"
+)
+
+// sharedPool keeps the buffers of the released shared messages for reuse.
+var sharedPool sync.Pool
+
+// sharedPublish is a PUBLISH message encoded once and shared by all the subscribers
+// it's delivered to. When the message is written out to a subscriber, only the flags
+// in the fixed header and the packet ID are patched, in the subscriber's own buffer.
+//
+// Every queue and pending list that holds the message holds a reference to it. When
+// the last reference is released, the buffer goes back to the pool.
+type sharedPublish struct {
+	buf []byte
+	qos byte
+
+	// The offset of the packet ID in buf, or 0 for QoS 0 messages
+	pktidOff int
+
+	// When the message expires, in Unix nanoseconds, or 0 if it never does. See
+	// Server.MessageExpiry.
+	expire int64
+
+	refs int32
+}
+
+// newSharedPublish() encodes msg into a shared message, with one reference held by
+// the caller.
+func newSharedPublish(msg *message.PublishMessage) (*sharedPublish, error) {
+	buf := getSharedBuffer(msg.Len())
+
+	n, err := msg.Encode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSharedPublishBuffer(buf[:n])
+}
+
+// newSharedPublishBuffer() creates a shared message from an encoded PUBLISH message,
+// with one reference held by the caller. The buffer is owned by the shared message
+// from then on.
+func newSharedPublishBuffer(buf []byte) (*sharedPublish, error) {
+	if len(buf) < 2 || message.MessageType(buf[0]>>4) != message.PUBLISH {
+		return nil, fmt.Errorf("fanout/newSharedPublishBuffer: Invalid PUBLISH message")
+	}
+
+	this := &sharedPublish{
+		buf:  buf,
+		qos:  (buf[0] >> 1) & 0x3,
+		refs: 1,
+	}
+
+	// Skip over the remaining length and the topic to find the packet ID
+	_, m := binary.Uvarint(buf[1:])
+	if m <= 0 || len(buf) < 1+m+2 {
+		return nil, fmt.Errorf("fanout/newSharedPublishBuffer: Invalid remaining length")
+	}
+
+	off := 1 + m
+	off += 2 + int(binary.BigEndian.Uint16(buf[off:]))
+
+	if this.qos != message.QosAtMostOnce {
+		if len(buf) < off+2 {
+			return nil, fmt.Errorf("fanout/newSharedPublishBuffer: Missing packet ID")
+		}
+
+		this.pktidOff = off
+	}
+
+	return this, nil
+}
+
+func (this *sharedPublish) retain() {
+	atomic.AddInt32(&this.refs, 1)
+}
+
+func (this *sharedPublish) release() {
+	if n := atomic.AddInt32(&this.refs, -1); n == 0 {
+		buf := this.buf[:cap(this.buf)]
+		this.buf = nil
+		sharedPool.Put(&buf)
+	} else if n < 0 {
+		panic("fanout/release: shared message released too many times")
+	}
+}
+
+// copyTo() copies the message into dst, which must be len(this.buf) long, with the
+// DUP and RETAIN flags cleared and the packet ID set to pktid.
+func (this *sharedPublish) copyTo(dst []byte, pktid uint16) {
+	copy(dst, this.buf)
+
+	dst[0] = byte(message.PUBLISH)<<4 | this.qos<<1
+
+	if this.pktidOff > 0 {
+		binary.BigEndian.PutUint16(dst[this.pktidOff:], pktid)
+	}
+}
+
+// expired() returns true if the message expired at now.
+func (this *sharedPublish) expired(now int64) bool {
+	return this.expire != 0 && this.expire <= now
+}
+
+func getSharedBuffer(n int) []byte {
+	if bp, ok := sharedPool.Get().(*[]byte); ok && cap(*bp) >= n {
+		return (*bp)[:n]
+	}
+
+	return make([]byte, n)
+}
+
+// fanout() hands msg to each of the subscribers. The services subscribed get the
+// message encoded once and shared among them, while the OnPublishFuncs get msg. The
+// shared message expires at expire, unless it's 0.
+func fanout(msg *message.PublishMessage, subs []interface{}, expire int64) error {
+	var sp *sharedPublish
+
+	defer func() {
+		if sp != nil {
+			sp.release()
+		}
+	}()
+
+	for _, s := range subs {
+		switch s := s.(type) {
+		case nil:
+
+		case *service:
+			if sp == nil {
+				var err error
+				if sp, err = newSharedPublish(msg); err != nil {
+					return err
+				}
+
+				sp.expire = expire
+			}
+
+			s.enqueue(sp)
+
+		case *OnPublishFunc:
+			(*s)(msg)
+
+		default:
+			glog.Errorf("Invalid onPublish Function")
+			return fmt.Errorf("Invalid onPublish Function")
+		}
+	}
+
+	return nil
+}
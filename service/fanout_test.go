@@ -0,0 +1,145 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestSharedPublishCopyTo(t *testing.T) {
+	for _, qos := range []byte{0, 1, 2} {
+		msg := newPublishMessage(7, qos)
+		msg.SetDup(true)
+
+		sp, err := newSharedPublish(msg)
+		require.NoError(t, err)
+		require.Equal(t, qos, sp.qos)
+
+		buf := make([]byte, len(sp.buf))
+		sp.copyTo(buf, 1234)
+
+		cp := message.NewPublishMessage()
+		_, err = cp.Decode(buf)
+		require.NoError(t, err)
+
+		require.Equal(t, qos, cp.QoS())
+		require.False(t, cp.Dup())
+		require.False(t, cp.Retain())
+		require.Equal(t, msg.Topic(), cp.Topic())
+		require.Equal(t, msg.Payload(), cp.Payload())
+
+		if qos == message.QosAtMostOnce {
+			require.Equal(t, 0, sp.pktidOff)
+		} else {
+			require.Equal(t, uint16(1234), cp.PacketId())
+		}
+
+		// The shared buffer itself is not changed
+		require.Equal(t, byte(message.PUBLISH)<<4|qos<<1|0x8, sp.buf[0])
+
+		sp.release()
+	}
+}
+
+func TestSharedPublishRelease(t *testing.T) {
+	sp := newSharedMessage(t, 1, 1)
+
+	sp.retain()
+	sp.release()
+	require.NotNil(t, sp.buf)
+
+	sp.release()
+	require.Nil(t, sp.buf)
+
+	require.Panics(t, func() { sp.release() })
+}
+
+func TestFanout(t *testing.T) {
+	var (
+		err  error
+		svcs []*service
+		subs []interface{}
+		cnt  int
+	)
+
+	for i := 0; i < 3; i++ {
+		svc := &service{queue: newDeliveryQueue(10, SlowDropQoS0, nil, "", nil)}
+		svcs = append(svcs, svc)
+		subs = append(subs, svc)
+	}
+
+	onpub := OnPublishFunc(func(msg *message.PublishMessage) error {
+		cnt++
+		return nil
+	})
+	subs = append(subs, &onpub, nil)
+
+	require.NoError(t, fanout(newPublishMessage(1, 1), subs, 0))
+	require.Equal(t, 1, cnt)
+
+	// All the services get the same shared message, with one reference each
+	sp, err := svcs[0].queue.pop()
+	require.NoError(t, err)
+	require.Equal(t, int32(3), sp.refs)
+
+	for _, svc := range svcs[1:] {
+		msg, err := svc.queue.pop()
+		require.NoError(t, err)
+		require.True(t, sp == msg)
+	}
+
+	require.Error(t, fanout(newPublishMessage(1, 1), []interface{}{"invalid"}, 0))
+}
+
+func BenchmarkFanoutEncode(b *testing.B) {
+	msg := newPublishMessage(1, 1)
+	buf := make([]byte, msg.Len())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 1000; j++ {
+			msg.SetPacketId(uint16(j + 1))
+			msg.Encode(buf)
+		}
+	}
+}
+
+func BenchmarkFanoutShared(b *testing.B) {
+	msg := newPublishMessage(1, 1)
+	buf := make([]byte, msg.Len())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		sp, _ := newSharedPublish(msg)
+		for j := 0; j < 1000; j++ {
+			sp.copyTo(buf, uint16(j+1))
+		}
+		sp.release()
+	}
+}
+
+func newSharedMessage(t testing.TB, pktid uint16, qos byte) *sharedPublish {
+	sp, err := newSharedPublish(newPublishMessage(pktid, qos))
+	require.NoError(t, err)
+
+	return sp
+}
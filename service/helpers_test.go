@@ -56,8 +56,6 @@ func runClientServerTests(t testing.TB, f func(*Client)) {
 		return
 	}
 
-	defer topics.Unregister(c.svc.sess.ID())
-
 	if f != nil {
 		f(c)
 	}
@@ -105,7 +103,7 @@ func startServiceN(t testing.TB, u *url.URL, wg *sync.WaitGroup, ready1, ready2
 
 	<-ready2
 
-	for _, svc := range svr.svcs {
+	for _, svc := range svr.services() {
 		glog.Infof("Stopping service %d", svc.id)
 		svc.stop()
 	}
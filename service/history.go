@@ -0,0 +1,83 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"strconv"
+
+	"github.com/surgemq/surgemq/topics"
+)
+
+const (
+	// The auth attribute that, when "true", sends the history of the topics for all
+	// the subscriptions of a user, as if the filters had the topics.HistoryPrefix.
+	AttrHistory = "history"
+)
+
+// historyAttr() returns true if the auth attributes of the user ask for the history
+// of all the subscriptions.
+func (this *Server) historyAttr(attrs map[string]string) bool {
+	if this.history == nil {
+		return false
+	}
+
+	v, err := strconv.ParseBool(attrs[AttrHistory])
+	return err == nil && v
+}
+
+// trimHistory() removes the topics.HistoryPrefix from the filter, returning false
+// if it doesn't have one.
+func trimHistory(filter []byte) ([]byte, bool) {
+	return topics.TrimHistory(filter)
+}
+
+// retained() appends the messages sent to a new subscription of the filter to
+// rmsgs. Those are the retained messages of the matching topics, unless the history
+// is asked for. Then the history of the topics that have one comes first, and
+// replaces their retained messages, which are usually the last of the history. The
+// topics whose history is empty, e.g. expired, keep their retained message.
+func (this *service) retained(filter []byte, history bool) {
+	// yeah I am not checking errors here. If there's an error we don't want the
+	// subscription to stop, just let it go.
+	if !history || this.history == nil {
+		this.topicsMgr.Retained(filter, &this.rmsgs)
+		return
+	}
+
+	m := len(this.rmsgs)
+	this.history.Messages(filter, &this.rmsgs)
+
+	n := len(this.rmsgs)
+	if n == m {
+		this.topicsMgr.Retained(filter, &this.rmsgs)
+		return
+	}
+
+	sent := make(map[string]struct{})
+	for _, hm := range this.rmsgs[m:n] {
+		sent[string(hm.Topic())] = struct{}{}
+	}
+
+	this.topicsMgr.Retained(filter, &this.rmsgs)
+
+	i := n
+	for _, rm := range this.rmsgs[n:] {
+		if _, ok := sent[string(rm.Topic())]; !ok {
+			this.rmsgs[i] = rm
+			i++
+		}
+	}
+	this.rmsgs = this.rmsgs[:i]
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+
+	"github.com/surgemq/message"
+)
+
+// ClientInfo describes the client of a connection to the hooks.
+type ClientInfo struct {
+	// The client ID. It's empty in OnConnect if the server is to assign one.
+	ClientId string
+
+	Username string
+
+	// The tenant of the client, if the server has tenants. See Server.TenantMode.
+	Tenant string
+
+	RemoteAddr net.Addr
+}
+
+// Hook lets applications follow, and change, what the clients of a server do. The
+// hooks registered on a server are called in order, from the goroutines of the
+// connections, so they must be safe for concurrent use. The client waits while a
+// hook runs, so hooks should return quickly. Embed NopHook to implement only some of
+// the methods.
+//
+// The messages passed to the hooks may point into buffers that are reused once the
+// hook returns, so they must not be kept.
+type Hook interface {
+	// OnConnect is called once a client is authenticated, before its session is set
+	// up. Returning an error refuses the connection. If the error is a
+	// message.ConnackCode, it's the return code sent to the client, otherwise the
+	// client gets message.ErrNotAuthorized.
+	OnConnect(client ClientInfo, msg *message.ConnectMessage) error
+
+	// OnConnected is called once the connection is accepted.
+	OnConnected(client ClientInfo)
+
+	// OnDisconnect is called once the connection of a client that OnConnected was
+	// called for is closed, after its will message, if any, is published. The error
+	// says why the connection was closed, e.g. ErrKeepAliveExpired. It's nil if the
+	// client sent a DISCONNECT message.
+	OnDisconnect(client ClientInfo, err error)
+
+	// OnSubscribe is called for each topic filter in the SUBSCRIBE messages. It
+	// returns the filter and the QoS to subscribe with, which may differ from the ones
+	// asked for, e.g. to keep a client under a topic prefix. Returning an error
+	// refuses the subscription with a failure return code. An UNSUBSCRIBE of the
+	// filter asked for removes the subscription to the filter returned.
+	OnSubscribe(client ClientInfo, filter []byte, qos byte) ([]byte, byte, error)
+
+	// OnSubscribed is called once a client is subscribed to a topic filter, with the
+	// filter returned by OnSubscribe and the QoS granted. It's not called for the
+	// subscriptions refused by a hook, or by the server.
+	OnSubscribed(client ClientInfo, filter []byte, qos byte)
+
+	// OnPublish is called for each message published by a client, including its will
+	// message, before it's retained and sent to the subscribers. The hook may change
+	// the message, e.g. its payload, or its topic to redirect it. Returning an error
+	// drops the message. The messages sent with Server.Publish don't go through the
+	// hooks.
+	OnPublish(client ClientInfo, msg *message.PublishMessage) error
+
+	// OnDeliver is called for each message sent to a client.
+	OnDeliver(client ClientInfo, msg *message.PublishMessage)
+
+	// OnAck is called when a client acks a QoS 1 or 2 message sent to it, with the
+	// message acked.
+	OnAck(client ClientInfo, msg *message.PublishMessage)
+}
+
+// NopHook implements Hook with methods that do nothing.
+type NopHook struct{}
+
+var _ Hook = NopHook{}
+
+func (NopHook) OnConnect(client ClientInfo, msg *message.ConnectMessage) error { return nil }
+func (NopHook) OnConnected(client ClientInfo)                                  {}
+func (NopHook) OnDisconnect(client ClientInfo, err error)                      {}
+
+func (NopHook) OnSubscribe(client ClientInfo, filter []byte, qos byte) ([]byte, byte, error) {
+	return filter, qos, nil
+}
+
+func (NopHook) OnSubscribed(client ClientInfo, filter []byte, qos byte)        {}
+func (NopHook) OnPublish(client ClientInfo, msg *message.PublishMessage) error { return nil }
+func (NopHook) OnDeliver(client ClientInfo, msg *message.PublishMessage)       {}
+func (NopHook) OnAck(client ClientInfo, msg *message.PublishMessage)           {}
+
+// hookList calls the hooks registered on a server in order. The methods that can
+// refuse or drop something stop at the first hook that does.
+type hookList []Hook
+
+func (this hookList) onConnect(client ClientInfo, msg *message.ConnectMessage) error {
+	for _, h := range this {
+		if err := h.OnConnect(client, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this hookList) onConnected(client ClientInfo) {
+	for _, h := range this {
+		h.OnConnected(client)
+	}
+}
+
+func (this hookList) onDisconnect(client ClientInfo, err error) {
+	for _, h := range this {
+		h.OnDisconnect(client, err)
+	}
+}
+
+func (this hookList) onSubscribe(client ClientInfo, filter []byte, qos byte) ([]byte, byte, error) {
+	var err error
+
+	for _, h := range this {
+		if filter, qos, err = h.OnSubscribe(client, filter, qos); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return filter, qos, nil
+}
+
+func (this hookList) onSubscribed(client ClientInfo, filter []byte, qos byte) {
+	for _, h := range this {
+		h.OnSubscribed(client, filter, qos)
+	}
+}
+
+func (this hookList) onPublish(client ClientInfo, msg *message.PublishMessage) error {
+	for _, h := range this {
+		if err := h.OnPublish(client, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this hookList) onDeliver(client ClientInfo, msg *message.PublishMessage) {
+	for _, h := range this {
+		h.OnDeliver(client, msg)
+	}
+}
+
+func (this hookList) onAck(client ClientInfo, msg *message.PublishMessage) {
+	for _, h := range this {
+		h.OnAck(client, msg)
+	}
+}
+
+// connackCode() returns the CONNACK return code for the error returned by OnConnect.
+func connackCode(err error) message.ConnackCode {
+	if code, ok := err.(message.ConnackCode); ok && code != message.ConnectionAccepted {
+		return code
+	}
+
+	return message.ErrNotAuthorized
+}
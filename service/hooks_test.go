@@ -0,0 +1,229 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+// testHook refuses the clients "banned" and "denied", narrows the subscriptions to
+// "#" down to "users/<client ID>/#", drops the messages to "drop", and redirects the
+// ones to "redirect" to the client "sub".
+type testHook struct {
+	NopHook
+
+	mu     sync.Mutex
+	events []string
+}
+
+func (this *testHook) record(event string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.events = append(this.events, event)
+}
+
+func (this *testHook) count(event string) int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	n := 0
+	for _, e := range this.events {
+		if e == event {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (this *testHook) OnConnect(client ClientInfo, msg *message.ConnectMessage) error {
+	switch client.ClientId {
+	case "banned":
+		return message.ErrIdentifierRejected
+
+	case "denied":
+		return errors.New("denied")
+	}
+
+	return nil
+}
+
+func (this *testHook) OnConnected(client ClientInfo) {
+	this.record("connected " + client.ClientId)
+}
+
+func (this *testHook) OnDisconnect(client ClientInfo, err error) {
+	this.record(fmt.Sprintf("disconnected %s %v", client.ClientId, err))
+}
+
+func (this *testHook) OnSubscribe(client ClientInfo, filter []byte, qos byte) ([]byte, byte, error) {
+	if string(filter) == "secret/#" {
+		return nil, 0, errors.New("secret")
+	}
+
+	if string(filter) == "#" {
+		filter = []byte("users/" + client.ClientId + "/#")
+	}
+
+	return filter, qos, nil
+}
+
+func (this *testHook) OnSubscribed(client ClientInfo, filter []byte, qos byte) {
+	this.record(fmt.Sprintf("subscribed %s %s %d", client.ClientId, filter, qos))
+}
+
+func (this *testHook) OnPublish(client ClientInfo, msg *message.PublishMessage) error {
+	switch string(msg.Topic()) {
+	case "drop":
+		return errors.New("dropped")
+
+	case "redirect":
+		msg.SetTopic([]byte("users/sub/" + client.ClientId))
+		msg.SetPayload([]byte("hooked"))
+	}
+
+	return nil
+}
+
+func (this *testHook) OnDeliver(client ClientInfo, msg *message.PublishMessage) {
+	this.record("deliver " + client.ClientId + " " + string(msg.Topic()))
+}
+
+func (this *testHook) OnAck(client ClientInfo, msg *message.PublishMessage) {
+	this.record("ack " + client.ClientId + " " + string(msg.Topic()))
+}
+
+func TestServerHooks(t *testing.T) {
+	hook := &testHook{}
+
+	svr, done := startServer(t, &Server{
+		Authenticator: authenticator,
+		Hooks:         []Hook{hook},
+	})
+
+	var (
+		errs  []error
+		codes []byte
+		rcvd  = make(chan string, 10)
+	)
+
+	_, err := connectTenantClient("banned", true)
+	errs = append(errs, err)
+
+	_, err = connectTenantClient("denied", true)
+	errs = append(errs, err)
+
+	sub, err := connectTenantClient("sub", true)
+	errs = append(errs, err)
+
+	pub, err := connectTenantClient("pub", true)
+	errs = append(errs, err)
+
+	if sub != nil && pub != nil {
+		msg := message.NewSubscribeMessage()
+		msg.AddTopic([]byte("#"), 1)
+		msg.AddTopic([]byte("secret/#"), 1)
+
+		acked := make(chan []byte, 1)
+		sub.Subscribe(msg, func(msg, ack message.Message, err error) error {
+			acked <- ack.(*message.SubackMessage).ReturnCodes()
+			return nil
+		}, func(msg *message.PublishMessage) error {
+			rcvd <- string(msg.Topic()) + " " + string(msg.Payload())
+			return nil
+		})
+
+		select {
+		case codes = <-acked:
+		case <-time.After(time.Second):
+		}
+
+		for _, topic := range []string{"drop", "users/other", "redirect"} {
+			m := newPublishMessage(1, 1)
+			m.SetTopic([]byte(topic))
+			pub.Publish(m, nil)
+		}
+
+		for i := 0; i < 100 && hook.count("ack sub users/sub/pub") == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// The UNSUBSCRIBE of the filter asked for removes the one the hook returned
+		unsub := message.NewUnsubscribeMessage()
+		unsub.AddTopic([]byte("#"))
+
+		unacked := make(chan struct{})
+		sub.Unsubscribe(unsub, func(msg, ack message.Message, err error) error {
+			close(unacked)
+			return nil
+		})
+
+		select {
+		case <-unacked:
+		case <-time.After(time.Second):
+		}
+
+		m := newPublishMessage(2, 1)
+		m.SetTopic([]byte("redirect"))
+		pub.Publish(m, nil)
+
+		// Give the message some time to reach the subscriber, if it's going to
+		time.Sleep(50 * time.Millisecond)
+
+		sub.Disconnect()
+		pub.Disconnect()
+
+		for i := 0; i < 100 && hook.count(lost("sub"))+hook.count(lost("pub")) < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+	close(rcvd)
+
+	var msgs []string
+	for m := range rcvd {
+		msgs = append(msgs, m)
+	}
+
+	require.Equal(t, []error{message.ErrIdentifierRejected, message.ErrNotAuthorized, nil, nil}, errs)
+	require.Equal(t, []byte{1, message.QosFailure}, codes)
+	require.Equal(t, []string{"users/sub/pub hooked"}, msgs)
+
+	require.Equal(t, 1, hook.count("connected sub"))
+	require.Equal(t, 1, hook.count(lost("sub")))
+	require.Equal(t, 1, hook.count("connected pub"))
+	require.Equal(t, 1, hook.count(lost("pub")))
+	require.Equal(t, 1, hook.count("subscribed sub users/sub/# 1"))
+	require.Equal(t, 0, hook.count("subscribed sub secret/# 1"))
+	require.Equal(t, 1, hook.count("deliver sub users/sub/pub"))
+	require.Equal(t, 1, hook.count("ack sub users/sub/pub"))
+	require.Equal(t, 0, hook.count("connected banned"))
+}
+
+// lost() is the event recorded when the client closes its connection. Client.Disconnect
+// closes the connection without a DISCONNECT message.
+func lost(cid string) string {
+	return fmt.Sprintf("disconnected %s %v", cid, ErrConnectionLost)
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The auth attributes that restrict the connections of a user. "clientids" is a
+	// comma separated list of the patterns of the client IDs the user may connect
+	// with, e.g. "sensor-*", in the syntax of path.Match. "maxconns" overrides
+	// MaxConnectionsPerUser for the user.
+	AttrClientIds      = "clientids"
+	AttrMaxConnections = "maxconns"
+)
+
+// connLimiter keeps track of the connections held by each IP address and username,
+// and refuses new ones once the limits configured on the Server are reached. A limit
+// of 0 means no limit.
+type connLimiter struct {
+	maxConns   int
+	maxPerIP   int
+	ratePerIP  int
+	maxPerUser int
+
+	mu sync.Mutex
+
+	conns int
+	ips   map[string]*ipState
+	users map[string]int
+
+	// The last time the idle ipState entries were removed
+	swept time.Time
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+type ipState struct {
+	// Number of connections currently held by the IP address
+	conns int
+
+	// Token bucket for the connection rate. It holds up to ratePerIP tokens, and
+	// refills at ratePerIP tokens per second.
+	tokens float64
+	last   time.Time
+}
+
+func newConnLimiter(maxConns, maxPerIP, ratePerIP, maxPerUser int) *connLimiter {
+	return &connLimiter{
+		maxConns:   maxConns,
+		maxPerIP:   maxPerIP,
+		ratePerIP:  ratePerIP,
+		maxPerUser: maxPerUser,
+		ips:        make(map[string]*ipState),
+		users:      make(map[string]int),
+		now:        time.Now,
+	}
+}
+
+// acquire() takes a connection slot for the IP address. It returns ErrConnectionRate
+// if the IP address connects too often, or ErrConnectionLimit if either the server
+// or the IP address has too many connections.
+func (this *connLimiter) acquire(ip string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := this.now()
+	this.sweep(now)
+
+	st, ok := this.ips[ip]
+	if !ok {
+		st = &ipState{tokens: float64(this.ratePerIP), last: now}
+		this.ips[ip] = st
+	}
+
+	if this.ratePerIP > 0 {
+		st.tokens += now.Sub(st.last).Seconds() * float64(this.ratePerIP)
+		if st.tokens > float64(this.ratePerIP) {
+			st.tokens = float64(this.ratePerIP)
+		}
+		st.last = now
+
+		if st.tokens < 1 {
+			return ErrConnectionRate
+		}
+	}
+
+	if this.maxConns > 0 && this.conns >= this.maxConns {
+		return ErrConnectionLimit
+	}
+
+	if this.maxPerIP > 0 && st.conns >= this.maxPerIP {
+		return ErrConnectionLimit
+	}
+
+	// The token is only spent on connections that are let in
+	if this.ratePerIP > 0 {
+		st.tokens--
+	}
+
+	this.conns++
+	st.conns++
+
+	return nil
+}
+
+// acquireUser() takes a connection slot for the username. Connections without a
+// username are not counted. If max is set, it overrides the maximum number of
+// connections per user.
+func (this *connLimiter) acquireUser(user string, max int) error {
+	if user == "" {
+		return nil
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if max == 0 {
+		max = this.maxPerUser
+	}
+
+	if max > 0 && this.users[user] >= max {
+		return ErrConnectionLimit
+	}
+
+	this.users[user]++
+
+	return nil
+}
+
+// release() gives back the slots taken by acquire() and, if user is not empty,
+// acquireUser().
+func (this *connLimiter) release(ip, user string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if st, ok := this.ips[ip]; ok && st.conns > 0 {
+		st.conns--
+		this.conns--
+	}
+
+	if user != "" {
+		if this.users[user] <= 1 {
+			delete(this.users, user)
+		} else {
+			this.users[user]--
+		}
+	}
+}
+
+// sweep() removes, at most once a second, the IP addresses that hold no connections
+// and whose token bucket is full again.
+func (this *connLimiter) sweep(now time.Time) {
+	if now.Sub(this.swept) < time.Second {
+		return
+	}
+
+	this.swept = now
+
+	for ip, st := range this.ips {
+		if st.conns == 0 && now.Sub(st.last) >= time.Second {
+			delete(this.ips, ip)
+		}
+	}
+}
+
+// remoteIP() returns the IP address of the remote end of the connection, without
+// the port.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// clientIdAllowed() returns true if the client ID matches one of the patterns of the
+// "clientids" auth attribute, or if the attribute is not set.
+func clientIdAllowed(attrs map[string]string, cid string) bool {
+	patterns, ok := attrs[AttrClientIds]
+	if !ok {
+		return true
+	}
+
+	for _, p := range strings.Split(patterns, ",") {
+		if ok, _ := path.Match(strings.TrimSpace(p), cid); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maxConnections() returns the maximum number of connections set by the "maxconns"
+// auth attribute, or 0 if it's not set.
+func maxConnections(attrs map[string]string) int {
+	n, err := strconv.Atoi(attrs[AttrMaxConnections])
+	if err != nil || n < 0 {
+		return 0
+	}
+
+	return n
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimiterMaxConns(t *testing.T) {
+	l := newConnLimiter(2, 0, 0, 0)
+
+	require.NoError(t, l.acquire("10.0.0.1"))
+	require.NoError(t, l.acquire("10.0.0.2"))
+	require.Equal(t, ErrConnectionLimit, l.acquire("10.0.0.3"))
+
+	l.release("10.0.0.1", "")
+	require.NoError(t, l.acquire("10.0.0.3"))
+}
+
+func TestConnLimiterMaxPerIP(t *testing.T) {
+	l := newConnLimiter(0, 2, 0, 0)
+
+	require.NoError(t, l.acquire("10.0.0.1"))
+	require.NoError(t, l.acquire("10.0.0.1"))
+	require.Equal(t, ErrConnectionLimit, l.acquire("10.0.0.1"))
+	require.NoError(t, l.acquire("10.0.0.2"))
+
+	l.release("10.0.0.1", "")
+	require.NoError(t, l.acquire("10.0.0.1"))
+}
+
+func TestConnLimiterRatePerIP(t *testing.T) {
+	now := time.Now()
+
+	l := newConnLimiter(0, 0, 2, 0)
+	l.now = func() time.Time { return now }
+
+	require.NoError(t, l.acquire("10.0.0.1"))
+	require.NoError(t, l.acquire("10.0.0.1"))
+	require.Equal(t, ErrConnectionRate, l.acquire("10.0.0.1"))
+	require.NoError(t, l.acquire("10.0.0.2"))
+
+	// Half a second refills one token
+	now = now.Add(time.Millisecond * 500)
+	require.NoError(t, l.acquire("10.0.0.1"))
+	require.Equal(t, ErrConnectionRate, l.acquire("10.0.0.1"))
+}
+
+func TestConnLimiterRateRefused(t *testing.T) {
+	now := time.Now()
+
+	l := newConnLimiter(0, 1, 2, 0)
+	l.now = func() time.Time { return now }
+
+	require.NoError(t, l.acquire("10.0.0.1"))
+
+	// Connections refused for the limits don't use up the rate
+	for i := 0; i < 3; i++ {
+		require.Equal(t, ErrConnectionLimit, l.acquire("10.0.0.1"))
+	}
+
+	l.release("10.0.0.1", "")
+	require.NoError(t, l.acquire("10.0.0.1"))
+
+	l.release("10.0.0.1", "")
+	require.Equal(t, ErrConnectionRate, l.acquire("10.0.0.1"))
+}
+
+func TestConnLimiterMaxPerUser(t *testing.T) {
+	l := newConnLimiter(0, 0, 0, 1)
+
+	require.NoError(t, l.acquireUser("surgemq", 0))
+	require.Equal(t, ErrConnectionLimit, l.acquireUser("surgemq", 0))
+	require.NoError(t, l.acquireUser("other", 0))
+
+	// Connections without username are not counted
+	require.NoError(t, l.acquireUser("", 0))
+	require.NoError(t, l.acquireUser("", 0))
+
+	l.release("", "surgemq")
+	require.NoError(t, l.acquireUser("surgemq", 0))
+
+	// The limit of the user overrides the default one
+	require.NoError(t, l.acquireUser("surgemq", 2))
+	require.Equal(t, ErrConnectionLimit, l.acquireUser("surgemq", 2))
+}
+
+func TestUserAttributes(t *testing.T) {
+	require.True(t, clientIdAllowed(nil, "sensor-1"))
+	require.True(t, clientIdAllowed(map[string]string{AttrClientIds: "sensor-*, gateway"}, "sensor-1"))
+	require.True(t, clientIdAllowed(map[string]string{AttrClientIds: "sensor-*, gateway"}, "gateway"))
+	require.False(t, clientIdAllowed(map[string]string{AttrClientIds: "sensor-*, gateway"}, "gateway-1"))
+	require.False(t, clientIdAllowed(map[string]string{AttrClientIds: ""}, "sensor-1"))
+
+	require.Equal(t, 0, maxConnections(nil))
+	require.Equal(t, 3, maxConnections(map[string]string{AttrMaxConnections: "3"}))
+	require.Equal(t, 0, maxConnections(map[string]string{AttrMaxConnections: "-1"}))
+	require.Equal(t, 0, maxConnections(map[string]string{AttrMaxConnections: "many"}))
+}
+
+func TestConnLimiterSweep(t *testing.T) {
+	now := time.Now()
+
+	l := newConnLimiter(0, 0, 1, 0)
+	l.now = func() time.Time { return now }
+
+	require.NoError(t, l.acquire("10.0.0.1"))
+	l.release("10.0.0.1", "")
+
+	now = now.Add(time.Second * 2)
+	require.NoError(t, l.acquire("10.0.0.2"))
+
+	require.Len(t, l.ips, 1)
+}
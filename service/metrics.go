@@ -0,0 +1,83 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a snapshot of the counters kept by the server, as returned by
+// Server.Metrics.
+type Metrics struct {
+	// The number of PUBLISH messages delayed because the client went over its rate
+	// limits.
+	Throttled int64
+
+	// The total time the clients were paused for going over their rate limits.
+	ThrottledTime time.Duration
+
+	// The number of clients disconnected for going over their rate limits.
+	ThrottleDisconnects int64
+
+	// The number of QoS 0 messages dropped because the subscriber's delivery queue
+	// was full.
+	Dropped int64
+
+	// The number of messages saved to the spill store because the subscriber's
+	// delivery queue was full.
+	Spilled int64
+
+	// The number of subscribers disconnected because their delivery queue was full.
+	SlowDisconnects int64
+
+	// The number of messages dropped because they expired before they could be sent
+	// to the subscriber. See Server.MessageExpiry.
+	Expired int64
+
+	// The number of messages whose payloads didn't match the schemas bound to their
+	// topics, and of those, the number published to the QuarantineTopic. See
+	// Server.Schemas.
+	Invalid     int64
+	Quarantined int64
+}
+
+// metrics holds the counters shared by all the services of a server. All fields are
+// updated atomically.
+type metrics struct {
+	throttled           int64
+	throttledTime       int64
+	throttleDisconnects int64
+	dropped             int64
+	spilled             int64
+	slowDisconnects     int64
+	expired             int64
+	invalid             int64
+	quarantined         int64
+}
+
+func (this *metrics) snapshot() Metrics {
+	return Metrics{
+		Throttled:           atomic.LoadInt64(&this.throttled),
+		ThrottledTime:       time.Duration(atomic.LoadInt64(&this.throttledTime)),
+		ThrottleDisconnects: atomic.LoadInt64(&this.throttleDisconnects),
+		Dropped:             atomic.LoadInt64(&this.dropped),
+		Spilled:             atomic.LoadInt64(&this.spilled),
+		SlowDisconnects:     atomic.LoadInt64(&this.slowDisconnects),
+		Expired:             atomic.LoadInt64(&this.expired),
+		Invalid:             atomic.LoadInt64(&this.invalid),
+		Quarantined:         atomic.LoadInt64(&this.quarantined),
+	}
+}
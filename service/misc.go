@@ -23,8 +23,8 @@ import (
 	"github.com/surgemq/message"
 )
 
-func getConnectMessage(conn io.Closer) (*message.ConnectMessage, error) {
-	buf, err := getMessageBuffer(conn)
+func getConnectMessage(conn io.Closer, max int) (*message.ConnectMessage, error) {
+	buf, err := getMessageBuffer(conn, max)
 	if err != nil {
 		//glog.Debugf("Receive error: %v", err)
 		return nil, err
@@ -38,7 +38,7 @@ func getConnectMessage(conn io.Closer) (*message.ConnectMessage, error) {
 }
 
 func getConnackMessage(conn io.Closer) (*message.ConnackMessage, error) {
-	buf, err := getMessageBuffer(conn)
+	buf, err := getMessageBuffer(conn, 0)
 	if err != nil {
 		//glog.Debugf("Receive error: %v", err)
 		return nil, err
@@ -63,7 +63,10 @@ func writeMessage(conn io.Closer, msg message.Message) error {
 	return writeMessageBuffer(conn, buf)
 }
 
-func getMessageBuffer(c io.Closer) ([]byte, error) {
+// getMessageBuffer() reads a whole message from the connection. If max is not 0,
+// messages larger than max bytes are refused with ErrPacketTooLarge before the
+// buffer for them is allocated.
+func getMessageBuffer(c io.Closer, max int) ([]byte, error) {
 	if c == nil {
 		return nil, ErrInvalidConnectionType
 	}
@@ -114,6 +117,10 @@ func getMessageBuffer(c io.Closer) ([]byte, error) {
 
 	// Get the remaining length of the message
 	remlen, _ := binary.Uvarint(buf[1:])
+	if max > 0 && len(buf)+int(remlen) > max {
+		return nil, ErrPacketTooLarge
+	}
+
 	buf = append(buf, make([]byte, remlen)...)
 
 	for l < len(buf) {
@@ -0,0 +1,304 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/surge/glog"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/store"
+)
+
+// outbox keeps the outgoing QoS 1 and 2 PUBLISH messages of a Client in a store
+// until they complete the ack cycle. Messages published while the client is not
+// connected are only saved, and are sent in order once the client reconnects. The
+// outbox lives as long as the Client, across connections.
+type outbox struct {
+	// Client ID that the entries are saved under
+	id string
+
+	storeMgr *store.Manager
+
+	// smu serializes sending, so messages published while the outbox is being
+	// drained go out after the drained ones.
+	smu sync.Mutex
+
+	// Service that the outbox was last drained to, protected by smu. Messages are
+	// only sent right away on this service, otherwise they would be sent again by a
+	// drain that has yet to run.
+	drained *service
+
+	// mu protects the fields below
+	mu sync.Mutex
+
+	// Next sequence number to assign
+	seq uint64
+
+	// Entries not yet completed, keyed by sequence number
+	entries map[uint64]*store.Entry
+
+	// Sequence numbers of the messages that have been sent, keyed by packet ID
+	pktids map[uint16]uint64
+
+	// onComplete functions supplied to Publish. These don't survive restarts.
+	oncs map[uint64]OnCompleteFunc
+}
+
+func newOutbox(id string, storeMgr *store.Manager) (*outbox, error) {
+	this := &outbox{
+		id:       id,
+		storeMgr: storeMgr,
+		seq:      1,
+		entries:  make(map[uint64]*store.Entry),
+		pktids:   make(map[uint16]uint64),
+		oncs:     make(map[uint64]OnCompleteFunc),
+	}
+
+	// Pick up the entries left over from a previous process
+	entries, err := storeMgr.All(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		this.entries[e.Seq] = e
+
+		if e.Seq >= this.seq {
+			this.seq = e.Seq + 1
+		}
+	}
+
+	return this, nil
+}
+
+// publish() saves the message and, if svc is running and the outbox has been drained
+// to it, sends it.
+func (this *outbox) publish(svc *service, msg *message.PublishMessage, onComplete OnCompleteFunc) error {
+	this.smu.Lock()
+	defer this.smu.Unlock()
+
+	e, err := this.add(msg, onComplete)
+	if err != nil {
+		return err
+	}
+
+	if svc == nil || svc != this.drained || svc.isClosed() {
+		glog.Debugf("service/outbox: Not connected, queued message %d", e.Seq)
+		return nil
+	}
+
+	this.send(svc, e)
+
+	return nil
+}
+
+// drain() sends all the saved messages in order. Messages that were already sent on
+// a previous connection are sent again with the DUP flag set, and messages that got
+// a PUBREC are released again with a PUBREL. Once all of them are sent, publish()
+// sends new messages on svc right away.
+func (this *outbox) drain(svc *service) error {
+	this.smu.Lock()
+	defer this.smu.Unlock()
+
+	this.drained = nil
+
+	this.mu.Lock()
+	entries := make([]*store.Entry, 0, len(this.entries))
+	for _, e := range this.entries {
+		entries = append(entries, e)
+	}
+	this.pktids = make(map[uint16]uint64)
+	this.mu.Unlock()
+
+	sort.Sort(entriesBySeq(entries))
+
+	for _, e := range entries {
+		if svc.isClosed() {
+			return ErrBufferNotReady
+		}
+
+		if e.State == message.PUBREC {
+			if err := this.release(svc, e); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := this.send(svc, e); err != nil {
+			return err
+		}
+	}
+
+	this.drained = svc
+
+	return nil
+}
+
+func (this *outbox) add(msg *message.PublishMessage, onComplete OnCompleteFunc) (*store.Entry, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	e := &store.Entry{
+		Seq:    this.seq,
+		State:  message.RESERVED,
+		Msgbuf: make([]byte, msg.Len()),
+	}
+
+	if _, err := msg.Encode(e.Msgbuf); err != nil {
+		return nil, err
+	}
+
+	if err := this.storeMgr.Put(this.id, e); err != nil {
+		return nil, err
+	}
+
+	this.seq++
+	this.entries[e.Seq] = e
+
+	if onComplete != nil {
+		this.oncs[e.Seq] = onComplete
+	}
+
+	return e, nil
+}
+
+// send() sends the message in e. If sending fails, the message stays in the outbox
+// and will be sent again on the next drain().
+func (this *outbox) send(svc *service, e *store.Entry) error {
+	msg := message.NewPublishMessage()
+	if _, err := msg.Decode(e.Msgbuf); err != nil {
+		return err
+	}
+
+	if e.State != message.RESERVED {
+		msg.SetDup(true)
+	}
+
+	if err := this.update(e, message.PUBLISH, msg.PacketId()); err != nil {
+		return err
+	}
+
+	if err := svc.publish(msg, this.complete(e.Seq)); err != nil {
+		glog.Errorf("service/outbox: Error sending message %d, will retry on reconnect: %v", e.Seq, err)
+		return err
+	}
+
+	return nil
+}
+
+// release() resumes the QoS 2 ack cycle of a message that already got a PUBREC on a
+// previous connection by sending PUBREL and waiting for the PUBCOMP.
+func (this *outbox) release(svc *service, e *store.Entry) error {
+	msg := message.NewPublishMessage()
+	if _, err := msg.Decode(e.Msgbuf); err != nil {
+		return err
+	}
+
+	if err := this.update(e, message.PUBREC, msg.PacketId()); err != nil {
+		return err
+	}
+
+	if err := svc.sess.Pub2out.Wait(msg, this.complete(e.Seq)); err != nil {
+		return err
+	}
+
+	ack := message.NewPubrecMessage()
+	ack.SetPacketId(msg.PacketId())
+
+	if err := svc.sess.Pub2out.Ack(ack); err != nil {
+		return err
+	}
+
+	resp := message.NewPubrelMessage()
+	resp.SetPacketId(msg.PacketId())
+
+	_, err := svc.writeMessage(resp)
+	return err
+}
+
+// pubrec() is called by the service when a PUBREC is received, so the state of the
+// QoS 2 message is saved.
+func (this *outbox) pubrec(pktid uint16) error {
+	this.mu.Lock()
+	e, ok := this.entries[this.pktids[pktid]]
+	this.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return this.update(e, message.PUBREC, pktid)
+}
+
+func (this *outbox) update(e *store.Entry, state message.MessageType, pktid uint16) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.pktids[pktid] = e.Seq
+
+	if e.State == state {
+		return nil
+	}
+
+	e.State = state
+	return this.storeMgr.Put(this.id, e)
+}
+
+// complete() returns the OnCompleteFunc that removes the message from the outbox
+// once the ack cycle is done, and calls the onComplete supplied to Publish.
+func (this *outbox) complete(seq uint64) OnCompleteFunc {
+	return func(msg, ack message.Message, err error) error {
+		this.mu.Lock()
+		onComplete := this.oncs[seq]
+
+		if err == nil {
+			if e, ok := this.entries[seq]; ok {
+				if pm, ok := msg.(*message.PublishMessage); ok && this.pktids[pm.PacketId()] == seq {
+					delete(this.pktids, pm.PacketId())
+				}
+
+				delete(this.entries, e.Seq)
+				delete(this.oncs, seq)
+
+				if err := this.storeMgr.Del(this.id, seq); err != nil {
+					glog.Errorf("service/outbox: Error removing message %d: %v", seq, err)
+				}
+			}
+		}
+		this.mu.Unlock()
+
+		if onComplete != nil {
+			return onComplete(msg, ack, err)
+		}
+
+		return err
+	}
+}
+
+// len() returns the number of messages that have not completed the ack cycle.
+func (this *outbox) len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.entries)
+}
+
+type entriesBySeq []*store.Entry
+
+func (this entriesBySeq) Len() int           { return len(this) }
+func (this entriesBySeq) Less(i, j int) bool { return this[i].Seq < this[j].Seq }
+func (this entriesBySeq) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
@@ -0,0 +1,143 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/store"
+)
+
+func TestOutboxPublishOffline(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	// Start listener, the client connects twice
+	wg.Add(1)
+	go startServiceN(t, u, &wg, ready1, ready2, 2)
+
+	<-ready1
+
+	c := &Client{MessageStore: "mem"}
+	cmsg := newConnectMessage()
+
+	require.NoError(t, c.Connect(uri, cmsg))
+	c.Disconnect()
+
+	done := make(chan struct{})
+	acked := int64(0)
+
+	for i := uint16(1); i <= 5; i++ {
+		err := c.Publish(newPublishMessage(i, 1), func(msg, ack message.Message, err error) error {
+			require.NoError(t, err)
+
+			if atomic.AddInt64(&acked, 1) == 5 {
+				close(done)
+			}
+
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 5, c.outbox.len())
+
+	require.NoError(t, c.Connect(uri, cmsg))
+	select {
+	case <-done:
+		require.Equal(t, 0, c.outbox.len())
+
+	case <-time.After(time.Millisecond * 100):
+		require.FailNow(t, "Timed out waiting for saved messages to be acked")
+	}
+
+	c.Disconnect()
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+func TestOutboxRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq-outbox")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := store.NewFileProvider(dir)
+	require.NoError(t, err)
+
+	store.Register("outbox-test", p)
+	defer store.Unregister("outbox-test")
+
+	storeMgr, err := store.NewManager("outbox-test")
+	require.NoError(t, err)
+
+	ob, err := newOutbox("surgemq", storeMgr)
+	require.NoError(t, err)
+
+	for i := uint16(1); i <= 3; i++ {
+		require.NoError(t, ob.publish(nil, newPublishMessage(i, 2), nil))
+	}
+
+	// Pretend the second message got a PUBREC before the process went away
+	require.NoError(t, ob.update(ob.entries[2], message.PUBREC, 2))
+
+	ob2, err := newOutbox("surgemq", storeMgr)
+	require.NoError(t, err)
+	require.Equal(t, 3, ob2.len())
+	require.Equal(t, uint64(4), ob2.seq)
+	require.Equal(t, message.RESERVED, ob2.entries[1].State)
+	require.Equal(t, message.PUBREC, ob2.entries[2].State)
+}
+
+func TestOutboxPublishBeforeDrain(t *testing.T) {
+	store.Register("outbox-test", store.NewMemProvider())
+	defer store.Unregister("outbox-test")
+
+	storeMgr, err := store.NewManager("outbox-test")
+	require.NoError(t, err)
+
+	ob, err := newOutbox("surgemq", storeMgr)
+	require.NoError(t, err)
+
+	svc := newInflightService(t)
+
+	// The client is connected but the outbox has not been drained yet, so the
+	// message is only queued and drain() sends it once.
+	require.NoError(t, ob.publish(svc, newPublishMessage(1, 1), nil))
+	require.Equal(t, message.RESERVED, ob.entries[1].State)
+
+	require.NoError(t, ob.drain(svc))
+	require.Equal(t, message.PUBLISH, ob.entries[1].State)
+	require.Equal(t, 1, svc.sess.Pub1ack.Len())
+
+	require.NoError(t, ob.publish(svc, newPublishMessage(2, 1), nil))
+	require.Equal(t, message.PUBLISH, ob.entries[2].State)
+	require.Equal(t, 2, svc.sess.Pub1ack.Len())
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"time"
 
 	"github.com/surge/glog"
 	"github.com/surgemq/message"
@@ -31,6 +32,9 @@ var (
 
 // processor() reads messages from the incoming buffer and processes them
 func (this *service) processor() {
+	// Whether the processor returns only because there's nothing to process
+	parked := false
+
 	defer func() {
 		// Let's recover from panic
 		if r := recover(); r != nil {
@@ -38,7 +42,10 @@ func (this *service) processor() {
 		}
 
 		this.wgStopped.Done()
-		this.stop()
+
+		if !parked {
+			this.stop()
+		}
 
 		//glog.Debugf("(%s) Stopping processor", this.cid())
 	}()
@@ -48,12 +55,19 @@ func (this *service) processor() {
 	this.wgStarted.Done()
 
 	for {
+		// In the event loop mode, the processor only runs while there's data
+		if this.loop != nil && idle(&this.processing, this.nothingToProcess) {
+			parked = true
+			return
+		}
+
 		// 1. Find out what message is next and the size of the message
 		mtype, total, err := this.peekMessageSize()
 		if err != nil {
 			//if err != io.EOF {
 			glog.Errorf("(%s) Error peeking next message size: %v", this.cid(), err)
 			//}
+			this.setCause(ioCause(err))
 			return
 		}
 
@@ -62,6 +76,7 @@ func (this *service) processor() {
 			//if err != io.EOF {
 			glog.Errorf("(%s) Error peeking next message: %v", this.cid(), err)
 			//}
+			this.setCause(ioCause(err))
 			return
 		}
 
@@ -69,12 +84,26 @@ func (this *service) processor() {
 
 		this.inStat.increment(int64(n))
 
+		// Account for the PUBLISH message against the rate limits of the client. If
+		// the client is over its limits, this pauses the receiver for a while, or
+		// disconnects the client, depending on the policy.
+		if this.rate != nil && mtype == message.PUBLISH {
+			if err = this.rate.take(n); err != nil {
+				glog.Errorf("(%s) Disconnecting: %v", this.cid(), err)
+				this.setCause(err)
+				return
+			}
+		}
+
 		// 5. Process the read message
 		err = this.processIncoming(msg)
 		if err != nil {
 			if err != errDisconnect {
 				glog.Errorf("(%s) Error processing %s: %v", this.cid(), msg.Name(), err)
 			} else {
+				if msg.Type() == message.DISCONNECT {
+					this.setCause(nil)
+				}
 				return
 			}
 		}
@@ -88,6 +117,11 @@ func (this *service) processor() {
 			return
 		}
 
+		// There's room in the buffer again, in case the event loop stopped reading
+		if this.loop != nil {
+			this.loop.resume(this)
+		}
+
 		// 7. Check to see if done is closed, if so, exit
 		if this.isDone() && this.in.Len() == 0 {
 			return
@@ -114,6 +148,7 @@ func (this *service) processIncoming(msg message.Message) error {
 		// For PUBACK message, it means QoS 1, we should send to ack queue
 		this.sess.Pub1ack.Ack(msg)
 		this.processAcked(this.sess.Pub1ack)
+		this.sendPending()
 
 	case *message.PubrecMessage:
 		// For PUBREC message, it means QoS 2, we should send to ack queue, and send back PUBREL
@@ -121,6 +156,12 @@ func (this *service) processIncoming(msg message.Message) error {
 			break
 		}
 
+		if this.outbox != nil {
+			if err = this.outbox.pubrec(msg.PacketId()); err != nil {
+				break
+			}
+		}
+
 		resp := message.NewPubrelMessage()
 		resp.SetPacketId(msg.PacketId())
 		_, err = this.writeMessage(resp)
@@ -131,10 +172,19 @@ func (this *service) processIncoming(msg message.Message) error {
 			break
 		}
 
-		this.processAcked(this.sess.Pub2in)
-
 		resp := message.NewPubcompMessage()
 		resp.SetPacketId(msg.PacketId())
+
+		// On the client side, the PUBCOMP is sent after the released message is handed
+		// off to the subscribers, or later if a subscriber holds the ack.
+		if this.client {
+			this.openAck(resp)
+			this.processAcked(this.sess.Pub2in)
+			err = this.releaseAck(resp.PacketId())
+			break
+		}
+
+		this.processAcked(this.sess.Pub2in)
 		_, err = this.writeMessage(resp)
 
 	case *message.PubcompMessage:
@@ -144,6 +194,7 @@ func (this *service) processIncoming(msg message.Message) error {
 		}
 
 		this.processAcked(this.sess.Pub2out)
+		this.sendPending()
 
 	case *message.SubscribeMessage:
 		// For SUBSCRIBE message, we should add subscriber, then send back SUBACK
@@ -230,6 +281,12 @@ func (this *service) processAcked(ackq *sessions.Ackqueue) {
 
 		case message.PUBACK, message.PUBCOMP, message.SUBACK, message.UNSUBACK, message.PINGRESP:
 			glog.Debugf("process/processAcked: %s", ack)
+			// The messages delivered to a client on the server side are acked with
+			// PUBACK or PUBCOMP.
+			if pm, ok := msg.(*message.PublishMessage); ok && len(this.hooks) > 0 {
+				this.hooks.onAck(this.info, pm)
+			}
+
 			// If ack is PUBACK, that means the QoS 1 message sent by this service got
 			// ack'ed. There's nothing to do other than calling onComplete() below.
 
@@ -271,8 +328,27 @@ func (this *service) processAcked(ackq *sessions.Ackqueue) {
 // If QoS == 1, we should send back PUBACK, then take the next step
 // If QoS == 2, we need to put it in the ack queue, send back PUBREC
 func (this *service) processPublish(msg *message.PublishMessage) error {
+	// The server must close the connection of clients that publish to an invalid
+	// topic.
+	if !this.client {
+		if err := this.validator.ValidateName(msg.Topic()); err != nil {
+			glog.Errorf("(%s) Disconnecting: %v %q", this.cid(), err, msg.Topic())
+			this.setCause(err)
+			return errDisconnect
+		}
+	}
+
 	switch msg.QoS() {
 	case message.QosExactlyOnce:
+		// Retransmitted messages are already in the ack queue, so they don't count
+		// against the inflight window. The DUP flag is not trusted for that, as a
+		// client could set it on every message to get around the window.
+		if this.maxInflightIn > 0 && this.sess.Pub2in.Len() >= this.maxInflightIn && !this.sess.Pub2in.Has(msg.PacketId()) {
+			glog.Errorf("(%s) Disconnecting: %v", this.cid(), ErrInflightExceeded)
+			this.setCause(ErrInflightExceeded)
+			return errDisconnect
+		}
+
 		this.sess.Pub2in.Wait(msg, nil)
 
 		resp := message.NewPubrecMessage()
@@ -285,6 +361,17 @@ func (this *service) processPublish(msg *message.PublishMessage) error {
 		resp := message.NewPubackMessage()
 		resp.SetPacketId(msg.PacketId())
 
+		// On the client side, the PUBACK is sent after the message is handed off to the
+		// subscribers, or later if a subscriber holds the ack.
+		if this.client {
+			this.openAck(resp)
+			err := this.onPublish(msg)
+			if err2 := this.releaseAck(resp.PacketId()); err == nil {
+				err = err2
+			}
+			return err
+		}
+
 		if _, err := this.writeMessage(resp); err != nil {
 			return err
 		}
@@ -298,6 +385,58 @@ func (this *service) processPublish(msg *message.PublishMessage) error {
 	return fmt.Errorf("(%s) invalid message QoS %d.", this.cid(), msg.QoS())
 }
 
+// openAck() starts holding the ack for a received PUBLISH message while the message
+// is being handed off to the subscribers. The ack is written out by the releaseAck()
+// call that brings the reference count back to zero.
+func (this *service) openAck(ack message.Message) {
+	this.hmu.Lock()
+	defer this.hmu.Unlock()
+
+	if this.held == nil {
+		this.held = make(map[uint16]*heldAck)
+	}
+
+	this.held[ack.PacketId()] = &heldAck{refs: 1, ack: ack}
+}
+
+// holdAck() adds a reference to the ack held for pktid. It returns false if there's
+// no ack being held for the packet ID, e.g., it has already been sent.
+func (this *service) holdAck(pktid uint16) bool {
+	this.hmu.Lock()
+	defer this.hmu.Unlock()
+
+	h, ok := this.held[pktid]
+	if !ok {
+		return false
+	}
+
+	h.refs++
+	return true
+}
+
+// releaseAck() removes a reference to the ack held for pktid, and sends the ack if
+// that was the last reference.
+func (this *service) releaseAck(pktid uint16) error {
+	this.hmu.Lock()
+	h, ok := this.held[pktid]
+	if !ok {
+		this.hmu.Unlock()
+		return nil
+	}
+
+	h.refs--
+	if h.refs > 0 {
+		this.hmu.Unlock()
+		return nil
+	}
+
+	delete(this.held, pktid)
+	this.hmu.Unlock()
+
+	_, err := this.writeMessage(h.ack)
+	return err
+}
+
 // For SUBSCRIBE message, we should add subscriber, then send back SUBACK
 func (this *service) processSubscribe(msg *message.SubscribeMessage) error {
 	resp := message.NewSubackMessage()
@@ -312,17 +451,53 @@ func (this *service) processSubscribe(msg *message.SubscribeMessage) error {
 	this.rmsgs = this.rmsgs[0:0]
 
 	for i, t := range topics {
-		rqos, err := this.topicsMgr.Subscribe(t, qos[i], &this.onpub)
+		// Filters starting with "$history/" also get the history of the topics, if
+		// the server keeps any. The prefix is not part of the subscription.
+		asked, tqos := t, qos[i]
+
+		t, history := trimHistory(t)
+		history = history || this.allHistory
+
+		// The hooks may change the filter and the QoS, or refuse the subscription.
+		if len(this.hooks) > 0 {
+			var err error
+			if t, tqos, err = this.hooks.onSubscribe(this.info, t, tqos); err != nil {
+				glog.Debugf("(%s) Subscription refused by hook: %v %q", this.cid(), err, asked)
+				retcodes = append(retcodes, message.QosFailure)
+				continue
+			}
+		}
+
+		// Invalid filters, and new filters beyond the limit, are refused with a
+		// failure return code, while the others in the same message go through.
+		if err := this.validator.ValidateFilter(t); err != nil {
+			glog.Errorf("(%s) Refusing subscription: %v %q", this.cid(), err, t)
+			retcodes = append(retcodes, message.QosFailure)
+			continue
+		}
+
+		if this.maxSubscriptions > 0 && !this.sess.HasTopic(string(t)) && this.sess.TopicCount() >= this.maxSubscriptions {
+			glog.Errorf("(%s) Refusing subscription: %v %q", this.cid(), ErrTooManySubscriptions, t)
+			retcodes = append(retcodes, message.QosFailure)
+			continue
+		}
+
+		rqos, err := this.topicsMgr.Subscribe(t, tqos, this)
 		if err != nil {
-			return err
+			glog.Errorf("(%s) Refusing subscription: %v %q", this.cid(), err, t)
+			retcodes = append(retcodes, message.QosFailure)
+			continue
 		}
-		this.sess.AddTopic(string(t), qos[i])
+		this.sess.AddTopic(string(t), tqos)
+		this.sess.SetTopicAlias(string(asked), string(t))
 
 		retcodes = append(retcodes, rqos)
 
-		// yeah I am not checking errors here. If there's an error we don't want the
-		// subscription to stop, just let it go.
-		this.topicsMgr.Retained(t, &this.rmsgs)
+		if len(this.hooks) > 0 {
+			this.hooks.onSubscribed(this.info, t, rqos)
+		}
+
+		this.retained(t, history)
 		glog.Debugf("(%s) topic = %s, retained count = %d", this.cid(), string(t), len(this.rmsgs))
 	}
 
@@ -349,8 +524,18 @@ func (this *service) processUnsubscribe(msg *message.UnsubscribeMessage) error {
 	topics := msg.Topics()
 
 	for _, t := range topics {
-		this.topicsMgr.Unsubscribe(t, &this.onpub)
-		this.sess.RemoveTopic(string(t))
+		if err := this.validator.ValidateFilter(t); err != nil {
+			glog.Errorf("(%s) Disconnecting: %v %q", this.cid(), err, t)
+			this.setCause(err)
+			return errDisconnect
+		}
+	}
+
+	for _, t := range topics {
+		topic := this.sess.TopicAlias(string(t))
+		this.topicsMgr.Unsubscribe([]byte(topic), this)
+		this.sess.RemoveTopic(topic)
+		this.sess.SetTopicAlias(string(t), string(t))
 	}
 
 	resp := message.NewUnsubackMessage()
@@ -364,12 +549,69 @@ func (this *service) processUnsubscribe(msg *message.UnsubscribeMessage) error {
 // the ack cycle. This method will get the list of subscribers based on the publish
 // topic, and publishes the message to the list of subscribers.
 func (this *service) onPublish(msg *message.PublishMessage) error {
+	// On the client side, the message is handed to the handlers of the matching
+	// subscriptions instead.
+	if this.client {
+		return this.router.route(msg)
+	}
+
+	// The hooks may change the message, redirect it to another topic, or drop it.
+	if len(this.hooks) > 0 {
+		if err := this.hooks.onPublish(this.info, msg); err != nil {
+			glog.Debugf("(%s) Message to %q dropped by hook: %v", this.cid(), msg.Topic(), err)
+			return nil
+		}
+
+		if err := this.validator.ValidateName(msg.Topic()); err != nil {
+			glog.Errorf("(%s) Dropping message redirected by hook: %v %q", this.cid(), err, msg.Topic())
+			return nil
+		}
+	}
+
+	if !this.checkSchema(msg) {
+		return nil
+	}
+
+	if err := this.distribute(msg); err != nil {
+		return err
+	}
+
+	// The messages republished by the rules don't go through the rules again
+	if this.server != nil && this.server.Rules != nil {
+		for _, rm := range this.server.Rules.Apply(this.info.ClientId, msg.Topic(), msg.Payload()) {
+			if err := this.validator.ValidateName(rm.Topic); err != nil {
+				glog.Errorf("(%s) Dropping message republished by rule %q: %v %q", this.cid(), rm.Rule, err, rm.Topic)
+				continue
+			}
+
+			pm := message.NewPublishMessage()
+			pm.SetTopic(rm.Topic)
+			pm.SetPayload(rm.Payload)
+			pm.SetQoS(rm.QoS)
+			pm.SetRetain(rm.Retain)
+
+			if err := this.distribute(pm); err != nil {
+				glog.Errorf("(%s) Error republishing message for rule %q: %v", this.cid(), rm.Rule, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// distribute() retains the message if needed, and publishes it to the subscribers of
+// its topic.
+func (this *service) distribute(msg *message.PublishMessage) error {
 	if msg.Retain() {
 		if err := this.topicsMgr.Retain(msg); err != nil {
 			glog.Errorf("(%s) Error retaining message: %v", this.cid(), err)
 		}
 	}
 
+	if this.history != nil {
+		this.history.Add(msg)
+	}
+
 	err := this.topicsMgr.Subscribers(msg.Topic(), msg.QoS(), &this.subs, &this.qoss)
 	if err != nil {
 		glog.Errorf("(%s) Error retrieving subscribers list: %v", this.cid(), err)
@@ -378,18 +620,11 @@ func (this *service) onPublish(msg *message.PublishMessage) error {
 
 	msg.SetRetain(false)
 
-	//glog.Debugf("(%s) Publishing to topic %q and %d subscribers", this.cid(), string(msg.Topic()), len(this.subs))
-	for _, s := range this.subs {
-		if s != nil {
-			fn, ok := s.(*OnPublishFunc)
-			if !ok {
-				glog.Errorf("Invalid onPublish Function")
-				return fmt.Errorf("Invalid onPublish Function")
-			} else {
-				(*fn)(msg)
-			}
-		}
+	var expire int64
+	if this.server != nil {
+		expire = expireAt(this.server.expiry, msg.Topic(), time.Now())
 	}
 
-	return nil
+	//glog.Debugf("(%s) Publishing to topic %q and %d subscribers", this.cid(), string(msg.Topic()), len(this.subs))
+	return fanout(msg, this.subs, expire)
 }
@@ -0,0 +1,281 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/store"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// The number of times the queue size QoS 1 and 2 messages may go past the limit with
+// the SlowDropQoS0 policy, before the subscriber is disconnected anyway.
+const queueHardLimitFactor = 10
+
+// SlowConsumerPolicy determines what the server does with the messages for a
+// subscriber whose delivery queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// SlowDropQoS0 drops the QoS 0 messages that don't fit in the queue. QoS 1 and 2
+	// messages are queued anyway, since they must be delivered, up to 10 times the
+	// queue size. Past that the subscriber is disconnected.
+	SlowDropQoS0 SlowConsumerPolicy = iota
+
+	// SlowDisconnect closes the connection to the subscriber.
+	SlowDisconnect
+
+	// SlowSpill saves the messages that don't fit in the queue to the SpillStore,
+	// and reads them back, in order, once the queue drains.
+	SlowSpill
+)
+
+// deliveryQueue holds the messages waiting to be sent to a single subscriber. The
+// publishers push messages into the queue without ever blocking, and the deliverer
+// goroutine of the subscriber's service pops them and writes them out.
+type deliveryQueue struct {
+	max    int
+	policy SlowConsumerPolicy
+
+	// The store and key used to spill messages, for the SlowSpill policy
+	spill   *store.Manager
+	spillId string
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	msgs []*sharedPublish
+
+	// The number of messages in the spill store, and the sequence number of the next
+	// one. As long as there are spilled messages, new messages are spilled as well
+	// so the order is kept.
+	spilled int
+	seq     uint64
+
+	closed bool
+
+	metrics *metrics
+}
+
+func newDeliveryQueue(max int, policy SlowConsumerPolicy, spill *store.Manager, spillId string, m *metrics) *deliveryQueue {
+	if m == nil {
+		m = &metrics{}
+	}
+
+	this := &deliveryQueue{
+		max:     max,
+		policy:  policy,
+		spill:   spill,
+		spillId: spillId,
+		metrics: m,
+	}
+
+	this.cond = sync.NewCond(&this.mu)
+
+	return this
+}
+
+// push() adds msg to the queue, taking a reference to it. It returns ErrSlowConsumer
+// if the queue is full and the policy is SlowDisconnect, or if the queue is past its
+// hard limit.
+func (this *deliveryQueue) push(msg *sharedPublish) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return nil
+	}
+
+	if this.spilled == 0 && len(this.msgs) < this.max {
+		this.append(msg)
+		return nil
+	}
+
+	switch this.policy {
+	case SlowDisconnect:
+		atomic.AddInt64(&this.metrics.slowDisconnects, 1)
+		return ErrSlowConsumer
+
+	case SlowSpill:
+		if this.spill != nil {
+			return this.spillMessage(msg)
+		}
+	}
+
+	if msg.qos == message.QosAtMostOnce {
+		atomic.AddInt64(&this.metrics.dropped, 1)
+		return nil
+	}
+
+	if len(this.msgs) >= this.max*queueHardLimitFactor {
+		atomic.AddInt64(&this.metrics.slowDisconnects, 1)
+		return ErrSlowConsumer
+	}
+
+	this.append(msg)
+	return nil
+}
+
+// pop() waits for the next message to send. It returns nil once the queue is closed.
+// The reference held by the queue is handed over to the caller. Expired messages are
+// dropped.
+func (this *deliveryQueue) pop() (*sharedPublish, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for {
+		for !this.closed && len(this.msgs) == 0 && this.spilled == 0 {
+			this.cond.Wait()
+		}
+
+		if this.closed {
+			return nil, nil
+		}
+
+		if len(this.msgs) == 0 {
+			if err := this.unspill(); err != nil {
+				return nil, err
+			}
+		}
+
+		msg := this.msgs[0]
+		this.msgs[0] = nil
+		this.msgs = this.msgs[1:]
+
+		if msg.expire == 0 || !msg.expired(time.Now().UnixNano()) {
+			return msg, nil
+		}
+
+		msg.release()
+		atomic.AddInt64(&this.metrics.expired, 1)
+	}
+}
+
+// len() returns the number of messages waiting, including the spilled ones.
+func (this *deliveryQueue) len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.msgs) + this.spilled
+}
+
+func (this *deliveryQueue) empty() bool {
+	return this.len() == 0
+}
+
+// close() drops all the messages waiting and wakes up the deliverer.
+func (this *deliveryQueue) close() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return
+	}
+
+	this.closed = true
+
+	for _, msg := range this.msgs {
+		msg.release()
+	}
+	this.msgs = nil
+	this.cond.Broadcast()
+
+	if this.spilled > 0 {
+		this.spill.Reset(this.spillId)
+		this.spilled = 0
+	}
+}
+
+func (this *deliveryQueue) append(msg *sharedPublish) {
+	msg.retain()
+	this.msgs = append(this.msgs, msg)
+	this.cond.Signal()
+}
+
+// spillMessage() saves msg to the spill store. The store keeps its own copy, so no
+// reference is taken.
+func (this *deliveryQueue) spillMessage(msg *sharedPublish) error {
+	e := &store.Entry{
+		Seq:    this.seq,
+		State:  message.RESERVED,
+		Msgbuf: msg.buf,
+		Expire: msg.expire,
+	}
+
+	if err := this.spill.Put(this.spillId, e); err != nil {
+		return err
+	}
+
+	this.seq++
+	this.spilled++
+	atomic.AddInt64(&this.metrics.spilled, 1)
+	this.cond.Signal()
+
+	return nil
+}
+
+// unspill() reads up to max of the oldest spilled messages back into the queue.
+func (this *deliveryQueue) unspill() error {
+	entries, err := this.spill.All(this.spillId)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) > this.max {
+		entries = entries[:this.max]
+	}
+
+	for _, e := range entries {
+		msg, err := newSharedPublishBuffer(e.Msgbuf)
+		if err != nil {
+			return err
+		}
+
+		if err := this.spill.Del(this.spillId, e.Seq); err != nil {
+			return err
+		}
+
+		msg.expire = e.Expire
+
+		this.msgs = append(this.msgs, msg)
+		this.spilled--
+	}
+
+	if len(this.msgs) == 0 {
+		// The store lost the messages, there's no point waiting for them
+		this.spilled = 0
+		return store.ErrEntryNotFound
+	}
+
+	return nil
+}
+
+// expireAt() returns when a message published to topic at now expires, according to
+// the TTLs set for the topic filters, or 0 if it never does.
+func expireAt(ttls *topics.TTLs, topic []byte, now time.Time) int64 {
+	if ttls == nil {
+		return 0
+	}
+
+	if ttl, ok := ttls.TTL(topic); ok && ttl > 0 {
+		return now.Add(ttl).UnixNano()
+	}
+
+	return 0
+}
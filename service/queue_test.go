@@ -0,0 +1,241 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/store"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestDeliveryQueueDropQoS0(t *testing.T) {
+	m := &metrics{}
+	q := newDeliveryQueue(2, SlowDropQoS0, nil, "", m)
+
+	require.NoError(t, q.push(newSharedMessage(t, 1, 0)))
+	require.NoError(t, q.push(newSharedMessage(t, 2, 1)))
+	require.NoError(t, q.push(newSharedMessage(t, 3, 0)))
+	require.NoError(t, q.push(newSharedMessage(t, 4, 1)))
+
+	// The QoS 0 message is dropped, the QoS 1 message is queued anyway
+	require.Equal(t, 3, q.len())
+	require.Equal(t, int64(1), m.snapshot().Dropped)
+
+	for _, qos := range []byte{0, 1, 1} {
+		msg, err := q.pop()
+		require.NoError(t, err)
+		require.Equal(t, qos, msg.qos)
+	}
+}
+
+func TestDeliveryQueueHardLimit(t *testing.T) {
+	m := &metrics{}
+	q := newDeliveryQueue(1, SlowDropQoS0, nil, "", m)
+
+	for i := uint16(1); i <= queueHardLimitFactor; i++ {
+		require.NoError(t, q.push(newSharedMessage(t, i, 1)))
+	}
+
+	// QoS 1 and 2 messages past the hard limit disconnect the subscriber
+	require.Equal(t, ErrSlowConsumer, q.push(newSharedMessage(t, 11, 1)))
+	require.Equal(t, queueHardLimitFactor, q.len())
+	require.Equal(t, int64(1), m.snapshot().SlowDisconnects)
+}
+
+func TestDeliveryQueueDisconnect(t *testing.T) {
+	m := &metrics{}
+	q := newDeliveryQueue(1, SlowDisconnect, nil, "", m)
+
+	require.NoError(t, q.push(newSharedMessage(t, 1, 1)))
+	require.Equal(t, ErrSlowConsumer, q.push(newSharedMessage(t, 2, 1)))
+	require.Equal(t, int64(1), m.snapshot().SlowDisconnects)
+}
+
+func TestDeliveryQueueSpill(t *testing.T) {
+	store.Register("spilltest", store.NewMemProvider())
+	defer store.Unregister("spilltest")
+
+	mgr, err := store.NewManager("spilltest")
+	require.NoError(t, err)
+
+	m := &metrics{}
+	q := newDeliveryQueue(2, SlowSpill, mgr, "surgemq/1", m)
+
+	for i := uint16(1); i <= 5; i++ {
+		require.NoError(t, q.push(newSharedMessage(t, i, 1)))
+	}
+
+	require.Equal(t, 5, q.len())
+	require.Equal(t, int64(3), m.snapshot().Spilled)
+
+	entries, err := mgr.All("surgemq/1")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	// Messages come out in the order they were pushed, spilled or not
+	for i := uint16(1); i <= 3; i++ {
+		msg, err := q.pop()
+		require.NoError(t, err)
+		require.Equal(t, i, binary.BigEndian.Uint16(msg.buf[msg.pktidOff:]))
+	}
+
+	// There are still spilled messages, so new messages are spilled too
+	require.NoError(t, q.push(newSharedMessage(t, 6, 1)))
+
+	for i := uint16(4); i <= 6; i++ {
+		msg, err := q.pop()
+		require.NoError(t, err)
+		require.Equal(t, i, binary.BigEndian.Uint16(msg.buf[msg.pktidOff:]))
+	}
+
+	require.Equal(t, 0, q.len())
+
+	entries, err = mgr.All("surgemq/1")
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+}
+
+func TestDeliveryQueueExpiry(t *testing.T) {
+	store.Register("expirytest", store.NewMemProvider())
+	defer store.Unregister("expirytest")
+
+	mgr, err := store.NewManager("expirytest")
+	require.NoError(t, err)
+
+	m := &metrics{}
+	q := newDeliveryQueue(2, SlowSpill, mgr, "surgemq/1", m)
+
+	now := time.Now()
+
+	// Every other message has expired, including some of the spilled ones
+	for i := uint16(1); i <= 6; i++ {
+		msg := newSharedMessage(t, i, 1)
+		if i%2 == 0 {
+			msg.expire = now.Add(-time.Second).UnixNano()
+		} else {
+			msg.expire = now.Add(time.Hour).UnixNano()
+		}
+
+		require.NoError(t, q.push(msg))
+	}
+
+	require.Equal(t, int64(4), m.snapshot().Spilled)
+
+	for i := uint16(1); i <= 5; i += 2 {
+		msg, err := q.pop()
+		require.NoError(t, err)
+		require.Equal(t, i, binary.BigEndian.Uint16(msg.buf[msg.pktidOff:]))
+	}
+
+	// Expired messages are only dropped when they come up
+	require.Equal(t, 1, q.len())
+	require.Equal(t, int64(2), m.snapshot().Expired)
+
+	require.NoError(t, q.push(newSharedMessage(t, 7, 1)))
+
+	msg, err := q.pop()
+	require.NoError(t, err)
+	require.Equal(t, uint16(7), binary.BigEndian.Uint16(msg.buf[msg.pktidOff:]))
+
+	require.Equal(t, 0, q.len())
+	require.Equal(t, int64(3), m.snapshot().Expired)
+}
+
+func TestExpireAt(t *testing.T) {
+	ttls, err := topics.NewTTLs(map[string]time.Duration{
+		"devices/#":          time.Minute,
+		"devices/+/commands": time.Second,
+		"devices/1/commands": 0,
+	})
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	require.Equal(t, now.Add(time.Minute).UnixNano(), expireAt(ttls, []byte("devices/1/status"), now))
+	require.Equal(t, now.Add(time.Second).UnixNano(), expireAt(ttls, []byte("devices/2/commands"), now))
+	require.Equal(t, int64(0), expireAt(ttls, []byte("devices/1/commands"), now))
+	require.Equal(t, int64(0), expireAt(ttls, []byte("sport/tennis"), now))
+	require.Equal(t, int64(0), expireAt(nil, []byte("devices/1/status"), now))
+}
+
+func TestDeliveryQueueClose(t *testing.T) {
+	q := newDeliveryQueue(2, SlowDropQoS0, nil, "", nil)
+
+	done := make(chan *sharedPublish)
+	go func() {
+		msg, _ := q.pop()
+		done <- msg
+	}()
+
+	q.close()
+
+	select {
+	case msg := <-done:
+		require.Nil(t, msg)
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the queue to close")
+	}
+
+	// Pushing to a closed queue does nothing
+	require.NoError(t, q.push(newSharedMessage(t, 1, 1)))
+	require.Equal(t, 0, q.len())
+}
+
+func TestDelivererSpillError(t *testing.T) {
+	store.Register("spillerror", brokenStore{store.NewMemProvider()})
+	defer store.Unregister("spillerror")
+
+	mgr, err := store.NewManager("spillerror")
+	require.NoError(t, err)
+
+	q := newDeliveryQueue(1, SlowSpill, mgr, "surgemq/1", nil)
+	require.NoError(t, q.push(newSharedMessage(t, 1, 1)))
+	require.NoError(t, q.push(newSharedMessage(t, 2, 1)))
+
+	msg, err := q.pop()
+	require.NoError(t, err)
+	msg.release()
+
+	// The spilled message can't be read back, so the client is disconnected
+	svc := newInflightService(t)
+	svc.queue = q
+	svc.wgStarted.Add(1)
+	svc.wgStopped.Add(1)
+	go svc.deliverer()
+
+	for i := 0; i < 100 && !svc.isClosed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.True(t, svc.isClosed())
+	require.Equal(t, errBrokenStore, svc.cause)
+}
+
+var errBrokenStore = errors.New("broken store")
+
+// brokenStore saves the entries, but can't read them back.
+type brokenStore struct {
+	store.StoreProvider
+}
+
+func (this brokenStore) All(id string) ([]*store.Entry, error) {
+	return nil, errBrokenStore
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The auth attributes that set the rate limits of a user. They override the
+	// limits configured on the Server.
+	AttrMsgRate  = "msgrate"
+	AttrByteRate = "byterate"
+)
+
+// RatePolicy determines what the server does with a client that publishes faster
+// than its rate limits allow.
+type RatePolicy int
+
+const (
+	// RateDelay stops reading from the client until it's back within its limits.
+	RateDelay RatePolicy = iota
+
+	// RateDisconnect closes the connection to the client.
+	RateDisconnect
+)
+
+// RateLimit is the number of PUBLISH messages, and bytes of PUBLISH messages, a
+// client may send per second. A client may send bursts of up to one second worth of
+// traffic. A limit of 0 means no limit.
+type RateLimit struct {
+	Msgs  int
+	Bytes int
+}
+
+// tokenBucket holds up to rate tokens and refills at rate tokens per second. Tokens
+// can be taken even if the bucket doesn't have enough, in which case it goes into
+// debt and take() returns how long it takes to pay it off.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   now,
+	}
+}
+
+func (this *tokenBucket) take(n int, now time.Time) time.Duration {
+	if now.After(this.last) {
+		this.tokens += now.Sub(this.last).Seconds() * this.rate
+		if this.tokens > this.rate {
+			this.tokens = this.rate
+		}
+		this.last = now
+	}
+
+	this.tokens -= float64(n)
+	if this.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-this.tokens / this.rate * float64(time.Second))
+}
+
+// rateLimiter enforces the rate limits of a single client. The processor accounts
+// for every PUBLISH message it receives, and the receiver stops reading while the
+// client is paused. The processor never waits, so the acks and PINGREQs already
+// received are still handled.
+type rateLimiter struct {
+	policy RatePolicy
+
+	mu    sync.Mutex
+	msgs  *tokenBucket
+	bytes *tokenBucket
+
+	// The time until which the client is paused
+	until time.Time
+
+	// Closed when the service stops, to wake up the waiting goroutines
+	quit  chan struct{}
+	qonce sync.Once
+
+	// The number of messages delayed for this client, and the server wide counters
+	throttled int64
+	metrics   *metrics
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+func newRateLimiter(limit RateLimit, policy RatePolicy, m *metrics) *rateLimiter {
+	if limit.Msgs <= 0 && limit.Bytes <= 0 {
+		return nil
+	}
+
+	if m == nil {
+		m = &metrics{}
+	}
+
+	now := time.Now()
+
+	return &rateLimiter{
+		policy:  policy,
+		msgs:    newTokenBucket(limit.Msgs, now),
+		bytes:   newTokenBucket(limit.Bytes, now),
+		quit:    make(chan struct{}),
+		metrics: m,
+		now:     time.Now,
+	}
+}
+
+// take() accounts for a PUBLISH message of n bytes. If the client is over its
+// limits, it returns ErrRateExceeded with the RateDisconnect policy, or pauses the
+// client long enough to get back within the limits with the RateDelay policy.
+func (this *rateLimiter) take(n int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := this.now()
+
+	var d time.Duration
+
+	if this.msgs != nil {
+		d = this.msgs.take(1, now)
+	}
+
+	if this.bytes != nil {
+		if bd := this.bytes.take(n, now); bd > d {
+			d = bd
+		}
+	}
+
+	if d == 0 {
+		return nil
+	}
+
+	if this.policy == RateDisconnect {
+		atomic.AddInt64(&this.metrics.throttleDisconnects, 1)
+		return ErrRateExceeded
+	}
+
+	atomic.AddInt64(&this.throttled, 1)
+	atomic.AddInt64(&this.metrics.throttled, 1)
+
+	if until := now.Add(d); until.After(this.until) {
+		if this.until.After(now) {
+			atomic.AddInt64(&this.metrics.throttledTime, int64(until.Sub(this.until)))
+		} else {
+			atomic.AddInt64(&this.metrics.throttledTime, int64(d))
+		}
+
+		this.until = until
+	}
+
+	return nil
+}
+
+// delay() returns how long the client is still paused for.
+func (this *rateLimiter) delay() time.Duration {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.until.Sub(this.now())
+}
+
+// wait() blocks while the client is paused, or until the limiter is closed.
+func (this *rateLimiter) wait() {
+	d := this.delay()
+	if d <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-this.quit:
+	}
+}
+
+func (this *rateLimiter) close() {
+	this.qonce.Do(func() {
+		close(this.quit)
+	})
+}
+
+// rateLimit() returns the rate limits for the user, whose auth attributes are attrs.
+// The attributes take precedence over RateLimits, which take precedence over MsgRate
+// and ByteRate.
+func (this *Server) rateLimit(user string, attrs map[string]string) RateLimit {
+	limit := RateLimit{Msgs: this.MsgRate, Bytes: this.ByteRate}
+
+	if l, ok := this.RateLimits[user]; ok {
+		limit = l
+	}
+
+	if v, ok := attrs[AttrMsgRate]; ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			limit.Msgs = n
+		}
+	}
+
+	if v, ok := attrs[AttrByteRate]; ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			limit.Bytes = n
+		}
+	}
+
+	return limit
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(10, now)
+
+	for i := 0; i < 10; i++ {
+		require.Equal(t, time.Duration(0), tb.take(1, now))
+	}
+
+	// Going into debt by 1 token takes 1/10 sec to pay off
+	require.Equal(t, time.Millisecond*100, tb.take(1, now))
+
+	// After a second, the bucket is full again, but never more than full
+	now = now.Add(time.Second * 10)
+	require.Equal(t, time.Duration(0), tb.take(10, now))
+	require.NotEqual(t, time.Duration(0), tb.take(1, now))
+}
+
+func TestRateLimiterDelay(t *testing.T) {
+	now := time.Now()
+
+	m := &metrics{}
+	rl := newRateLimiter(RateLimit{Msgs: 2, Bytes: 100}, RateDelay, m)
+	rl.now = func() time.Time { return now }
+
+	require.NoError(t, rl.take(10))
+	require.NoError(t, rl.take(10))
+	require.Equal(t, Metrics{}, m.snapshot())
+
+	// Over the message rate
+	require.NoError(t, rl.take(10))
+	require.Equal(t, now.Add(time.Millisecond*500), rl.until)
+
+	// Over the byte rate, which needs a longer pause
+	require.NoError(t, rl.take(250))
+	require.Equal(t, now.Add(time.Millisecond*1800), rl.until)
+
+	require.Equal(t, Metrics{Throttled: 2, ThrottledTime: time.Millisecond * 1800}, m.snapshot())
+}
+
+func TestRateLimiterDisconnect(t *testing.T) {
+	m := &metrics{}
+	rl := newRateLimiter(RateLimit{Msgs: 1}, RateDisconnect, m)
+
+	require.NoError(t, rl.take(10))
+	require.Equal(t, ErrRateExceeded, rl.take(10))
+	require.Equal(t, int64(1), m.snapshot().ThrottleDisconnects)
+}
+
+func TestRateLimiterClose(t *testing.T) {
+	rl := newRateLimiter(RateLimit{Msgs: 1}, RateDelay, nil)
+	rl.until = time.Now().Add(time.Hour)
+
+	go rl.close()
+
+	done := make(chan struct{})
+	go func() {
+		rl.wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the rate limiter to close")
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	svr := &Server{
+		Authenticator: authenticator,
+		MsgRate:       1,
+		ByteRate:      1000,
+		RateLimits:    map[string]RateLimit{"medium": {Msgs: 10}},
+	}
+	require.NoError(t, svr.checkConfiguration())
+
+	require.Equal(t, RateLimit{Msgs: 1, Bytes: 1000}, svr.rateLimit("slow", nil))
+	require.Equal(t, RateLimit{Msgs: 10}, svr.rateLimit("medium", nil))
+	require.Equal(t, RateLimit{Msgs: 100, Bytes: 1000}, svr.rateLimit("fast", map[string]string{AttrMsgRate: "100"}))
+}
+
+func TestServerRateDelay(t *testing.T) {
+	svr, done := startServer(t, &Server{
+		Authenticator: authenticator,
+		MsgRate:       20,
+	})
+
+	c := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c)
+
+	var cnt int64
+	received := make(chan struct{})
+	last := make(chan struct{})
+
+	subdone := make(chan struct{})
+	c.Subscribe(newSubscribeMessage(0),
+		func(msg, ack message.Message, err error) error {
+			close(subdone)
+			return nil
+		},
+		func(msg *message.PublishMessage) error {
+			switch atomic.AddInt64(&cnt, 1) {
+			case 30:
+				close(received)
+			case 31:
+				close(last)
+			}
+			return nil
+		})
+	<-subdone
+
+	start := time.Now()
+
+	for i := 0; i < 30; i++ {
+		require.NoError(t, c.Publish(newPublishMessage(0, 0), nil))
+	}
+
+	select {
+	case <-received:
+	case <-time.After(time.Second * 3):
+		require.FailNow(t, "Timed out waiting for publish messages")
+	}
+
+	// The messages already read are processed, but the receiver holds the next ones
+	// for the half a second the 10 messages over the limit take
+	require.NoError(t, c.Publish(newPublishMessage(0, 0), nil))
+
+	select {
+	case <-last:
+	case <-time.After(time.Second * 3):
+		require.FailNow(t, "Timed out waiting for the last publish message")
+	}
+
+	require.True(t, time.Since(start) >= time.Millisecond*400)
+	require.True(t, svr.Metrics().Throttled > 0)
+
+	c.Disconnect()
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+}
+
+func TestServerRateDisconnect(t *testing.T) {
+	svr, done := startServer(t, &Server{
+		Authenticator: authenticator,
+		MsgRate:       1,
+		RatePolicy:    RateDisconnect,
+	})
+
+	c := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c)
+
+	waitForServices(t, svr, 1)
+
+	for i := 0; i < 3; i++ {
+		c.Publish(newPublishMessage(0, 0), nil)
+	}
+
+	waitForServices(t, svr, 0)
+	require.Equal(t, int64(1), svr.Metrics().ThrottleDisconnects)
+
+	c.Disconnect()
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+}
+
+type attrAuthenticator map[string]map[string]string
+
+func (this attrAuthenticator) Authenticate(id string, cred interface{}) error {
+	return nil
+}
+
+func (this attrAuthenticator) Attributes(id string) (map[string]string, error) {
+	return this[id], nil
+}
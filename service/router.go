@@ -0,0 +1,110 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+
+	"github.com/surge/glog"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// router dispatches the PUBLISH messages received by a Client to the OnPublishFuncs of
+// the matching subscriptions. Each Client has its own router, which is not registered
+// with the topics package, so any number of clients, even with the same client ID,
+// can live in the same process.
+//
+// Subscriptions are matched with wildcards, and a message is handed to every matching
+// OnPublishFunc. Messages that match no subscription are handed to the default
+// OnPublishFunc, if there is one.
+type router struct {
+	// Subscription tree, private to this router
+	tp topics.TopicsProvider
+
+	// onDefault is called for messages that match no subscription
+	onDefault OnPublishFunc
+
+	// mu protects tp, and serializes route() so subs and qoss can be reused
+	mu   sync.Mutex
+	subs []interface{}
+	qoss []byte
+}
+
+func newRouter(onDefault OnPublishFunc) *router {
+	return &router{
+		tp:        topics.NewMemProvider(),
+		onDefault: onDefault,
+	}
+}
+
+// add() adds onPublish as a handler for the topic filter.
+func (this *router) add(topic []byte, qos byte, onPublish *OnPublishFunc) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	_, err := this.tp.Subscribe(topic, qos, onPublish)
+	return err
+}
+
+// remove() removes all the handlers for the topic filter.
+func (this *router) remove(topic []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.tp.Unsubscribe(topic, nil)
+}
+
+// route() hands msg to the handlers of all the matching subscriptions.
+func (this *router) route(msg *message.PublishMessage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// The server decides the QoS of the messages it sends, so all the matching
+	// handlers get the message regardless of the QoS they subscribed with.
+	if err := this.tp.Subscribers(msg.Topic(), message.QosAtMostOnce, &this.subs, &this.qoss); err != nil {
+		return err
+	}
+
+	n := 0
+
+	for _, s := range this.subs {
+		fn, ok := s.(*OnPublishFunc)
+		if !ok || fn == nil || *fn == nil {
+			glog.Errorf("service/router: Invalid onPublish Function")
+			continue
+		}
+
+		if err := (*fn)(msg); err != nil {
+			glog.Errorf("service/router: Error handling message for topic %q: %v", string(msg.Topic()), err)
+		}
+
+		n++
+	}
+
+	if n == 0 && this.onDefault != nil {
+		return this.onDefault(msg)
+	}
+
+	return nil
+}
+
+// reset() removes all the subscriptions, e.g., when the client starts a clean session.
+func (this *router) reset() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.tp = topics.NewMemProvider()
+}
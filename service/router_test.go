@@ -0,0 +1,109 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestRouterWildcards(t *testing.T) {
+	var got []string
+
+	r := newRouter(func(msg *message.PublishMessage) error {
+		got = append(got, "default:"+string(msg.Topic()))
+		return nil
+	})
+
+	var h1 OnPublishFunc = func(msg *message.PublishMessage) error {
+		got = append(got, "h1:"+string(msg.Topic()))
+		return nil
+	}
+
+	var h2 OnPublishFunc = func(msg *message.PublishMessage) error {
+		got = append(got, "h2:"+string(msg.Topic()))
+		return nil
+	}
+
+	require.NoError(t, r.add([]byte("sport/+/player1"), 1, &h1))
+	require.NoError(t, r.add([]byte("sport/#"), 0, &h2))
+
+	require.NoError(t, r.route(newTopicMessage("sport/tennis/player1", 1)))
+	require.Equal(t, 2, len(got))
+	require.Contains(t, got, "h1:sport/tennis/player1")
+	require.Contains(t, got, "h2:sport/tennis/player1")
+
+	got = got[0:0]
+	require.NoError(t, r.route(newTopicMessage("finance/stock", 0)))
+	require.Equal(t, []string{"default:finance/stock"}, got)
+
+	require.NoError(t, r.remove([]byte("sport/#")))
+
+	got = got[0:0]
+	require.NoError(t, r.route(newTopicMessage("sport/tennis/player2", 0)))
+	require.Equal(t, []string{"default:sport/tennis/player2"}, got)
+
+	r.reset()
+
+	got = got[0:0]
+	require.NoError(t, r.route(newTopicMessage("sport/tennis/player1", 0)))
+	require.Equal(t, []string{"default:sport/tennis/player1"}, got)
+}
+
+func TestRouterSameClientId(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	wg.Add(1)
+	go startServiceN(t, u, &wg, ready1, ready2, 2)
+
+	<-ready1
+
+	// Two clients with the same client ID must not step on each other
+	c1 := &Client{}
+	c2 := &Client{}
+
+	cmsg := newConnectMessage()
+
+	require.NoError(t, c1.Connect(uri, cmsg))
+	require.NoError(t, c2.Connect(uri, cmsg))
+	require.True(t, c1.router != c2.router)
+
+	c1.Disconnect()
+	c2.Disconnect()
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+func newTopicMessage(topic string, qos byte) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	msg.SetPayload([]byte("abc"))
+	msg.SetQoS(qos)
+
+	return msg
+}
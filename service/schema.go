@@ -0,0 +1,82 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync/atomic"
+
+	"github.com/surge/glog"
+	"github.com/surgemq/message"
+)
+
+// SchemaPolicy determines what the server does with the messages whose payloads
+// don't match the schemas bound to their topics. See Server.Schemas.
+type SchemaPolicy int
+
+const (
+	// SchemaReject drops the messages. Since MQTT 3.1.1 has no negative acks, QoS 1
+	// and 2 messages are still acked to the publisher.
+	SchemaReject SchemaPolicy = iota
+
+	// SchemaQuarantine publishes the messages to the QuarantineTopic followed by
+	// their topic, e.g. "quarantine/sensors/1", instead of their topic.
+	SchemaQuarantine
+)
+
+// checkSchema() checks the payload of a message published by the client against the
+// schemas of the server. It returns false if the message must not be published to
+// its topic, after quarantining it if the policy says so.
+func (this *service) checkSchema(msg *message.PublishMessage) bool {
+	if this.server == nil || this.server.Schemas == nil {
+		return true
+	}
+
+	err := this.server.Schemas.Validate(msg.Topic(), msg.Payload())
+	if err == nil {
+		return true
+	}
+
+	atomic.AddInt64(&this.server.metrics.invalid, 1)
+
+	if this.server.SchemaPolicy != SchemaQuarantine {
+		glog.Debugf("(%s) Dropping message to %q: %v", this.cid(), msg.Topic(), err)
+		return false
+	}
+
+	topic := make([]byte, 0, len(this.server.QuarantineTopic)+1+len(msg.Topic()))
+	topic = append(topic, this.server.QuarantineTopic...)
+	topic = append(topic, '/')
+	topic = append(topic, msg.Topic()...)
+
+	if err := this.validator.ValidateName(topic); err != nil {
+		glog.Errorf("(%s) Dropping message to %q, can't be quarantined: %v", this.cid(), msg.Topic(), err)
+		return false
+	}
+
+	glog.Debugf("(%s) Quarantining message to %q: %v", this.cid(), msg.Topic(), err)
+
+	// Invalid messages are never retained
+	msg.SetTopic(topic)
+	msg.SetRetain(false)
+
+	if err := this.distribute(msg); err != nil {
+		glog.Errorf("(%s) Error quarantining message: %v", this.cid(), err)
+		return false
+	}
+
+	atomic.AddInt64(&this.server.metrics.quarantined, 1)
+
+	return false
+}
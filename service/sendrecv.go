@@ -33,13 +33,41 @@ type netReader interface {
 type timeoutReader struct {
 	d    time.Duration
 	conn netReader
+
+	// If set, the data read is held while the client is paused for going over its
+	// rate limits, so the processor doesn't see the PUBLISH messages in it until the
+	// pause is over, and the client is pushed back by TCP flow control.
+	rate *rateLimiter
 }
 
 func (r timeoutReader) Read(b []byte) (int, error) {
 	if err := r.conn.SetReadDeadline(time.Now().Add(r.d)); err != nil {
 		return 0, err
 	}
-	return r.conn.Read(b)
+
+	n, err := r.conn.Read(b)
+
+	// The processor accounts for the messages already in the incoming buffer while
+	// we are blocked in Read, so the pause is checked once the data is in
+	if r.rate != nil {
+		r.rate.wait()
+	}
+
+	return n, err
+}
+
+// ioCause() turns an error reading from or writing to the connection into the cause
+// of the disconnection.
+func ioCause(err error) error {
+	if err == io.EOF {
+		return ErrConnectionLost
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrKeepAliveExpired
+	}
+
+	return err
 }
 
 // receiver() reads data from the network, and writes the data into the incoming buffer
@@ -66,6 +94,7 @@ func (this *service) receiver() {
 		r := timeoutReader{
 			d:    keepAlive + (keepAlive / 2),
 			conn: conn,
+			rate: this.rate,
 		}
 
 		for {
@@ -75,6 +104,7 @@ func (this *service) receiver() {
 				if err != io.EOF {
 					glog.Errorf("(%s) error reading from connection: %v", this.cid(), err)
 				}
+				this.setCause(ioCause(err))
 				return
 			}
 		}
@@ -87,6 +117,51 @@ func (this *service) receiver() {
 	}
 }
 
+// deliverer() sends the messages queued for this client, one at a time. It's the
+// only goroutine that waits when the client is slow to read.
+func (this *service) deliverer() {
+	defer func() {
+		// Let's recover from panic
+		if r := recover(); r != nil {
+			glog.Errorf("(%s) Recovering from panic: %v", this.cid(), r)
+		}
+
+		this.wgStopped.Done()
+
+		glog.Debugf("(%s) Stopping deliverer", this.cid())
+	}()
+
+	glog.Debugf("(%s) Starting deliverer", this.cid())
+
+	this.wgStarted.Done()
+
+	for {
+		// In the event loop mode, the deliverer only runs while there are messages
+		if this.loop != nil && idle(&this.delivering, this.queue.empty) {
+			return
+		}
+
+		// The messages can't be delivered in order anymore, e.g., the spill store is
+		// broken, so the client is disconnected rather than retrying forever
+		msg, err := this.queue.pop()
+		if err != nil {
+			glog.Errorf("(%s) Disconnecting: error reading queued message: %v", this.cid(), err)
+			this.setCause(err)
+			go this.stop()
+			return
+		}
+
+		if msg == nil {
+			return
+		}
+
+		if err := this.deliver(msg); err != nil {
+			glog.Errorf("(%s) Error sending queued message: %v", this.cid(), err)
+			return
+		}
+	}
+}
+
 // sender() writes data from the outgoing buffer to the network
 func (this *service) sender() {
 	defer func() {
@@ -113,6 +188,7 @@ func (this *service) sender() {
 				if err != io.EOF {
 					glog.Errorf("(%s) error writing data: %v", this.cid(), err)
 				}
+				this.setCause(ioCause(err))
 				return
 			}
 		}
@@ -172,6 +248,11 @@ func (this *service) peekMessageSize() (message.MessageType, int, error) {
 	// Total message length is remlen + 1 (msg type) + m (remlen bytes)
 	total := int(remlen) + 1 + m
 
+	// Refuse to wait for a message larger than allowed
+	if this.maxPacketSize > 0 && total > this.maxPacketSize {
+		return 0, 0, ErrPacketTooLarge
+	}
+
 	mtype := message.MessageType(b[0] >> 4)
 
 	return mtype, total, err
@@ -317,5 +398,62 @@ func (this *service) writeMessage(msg message.Message) (int, error) {
 
 	this.outStat.increment(int64(m))
 
+	if this.loop != nil {
+		this.loop.flush(this)
+	}
+
+	return m, nil
+}
+
+// writeShared() writes a shared message to the outgoing buffer with the packet ID
+// patched in. The message is copied straight into the buffer, without encoding it
+// again.
+func (this *service) writeShared(msg *sharedPublish, pktid uint16) (int, error) {
+	var (
+		l    int = len(msg.buf)
+		m    int
+		err  error
+		buf  []byte
+		wrap bool
+	)
+
+	if this.out == nil {
+		return 0, ErrBufferNotReady
+	}
+
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	buf, wrap, err = this.out.WriteWait(l)
+	if err != nil {
+		return 0, err
+	}
+
+	if wrap {
+		if len(this.outtmp) < l {
+			this.outtmp = make([]byte, l)
+		}
+
+		msg.copyTo(this.outtmp[:l], pktid)
+
+		m, err = this.out.Write(this.outtmp[:l])
+		if err != nil {
+			return m, err
+		}
+	} else {
+		msg.copyTo(buf[:l], pktid)
+
+		m, err = this.out.WriteCommit(l)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	this.outStat.increment(int64(m))
+
+	if this.loop != nil {
+		this.loop.flush(this)
+	}
+
 	return m, nil
 }
@@ -198,6 +198,27 @@ func TestWriteMessage(t *testing.T) {
 	require.Equal(t, msgBytes, dst, "error decoding message.")
 }
 
+func TestPeekMessageSizeTooLarge(t *testing.T) {
+	msgBytes := []byte{
+		byte(message.PUBLISH << 4),
+		0x80, // Remaining length 16384, only the header is sent
+		0x80,
+		1,
+	}
+
+	svc := newTestBuffer(t, msgBytes)
+
+	mtype, total, err := svc.peekMessageSize()
+	require.NoError(t, err)
+	require.Equal(t, message.PUBLISH, mtype)
+	require.Equal(t, 16388, total)
+
+	svc.maxPacketSize = 1024
+
+	_, _, err = svc.peekMessageSize()
+	require.Equal(t, ErrPacketTooLarge, err)
+}
+
 func newTestBuffer(t *testing.T, msgBytes []byte) *service {
 	buf := bytes.NewBuffer(msgBytes)
 	svc := &service{}
@@ -15,6 +15,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -27,7 +28,10 @@ import (
 	"github.com/surge/glog"
 	"github.com/surgemq/message"
 	"github.com/surgemq/surgemq/auth"
+	"github.com/surgemq/surgemq/rules"
+	"github.com/surgemq/surgemq/schema"
 	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/store"
 	"github.com/surgemq/surgemq/topics"
 )
 
@@ -36,6 +40,21 @@ var (
 	ErrInvalidSubscriber      error = errors.New("service: Invalid subscriber")
 	ErrBufferNotReady         error = errors.New("service: buffer is not ready")
 	ErrBufferInsufficientData error = errors.New("service: buffer has insufficient data.")
+	ErrServerClosed           error = errors.New("service: Server closed")
+	ErrConnectionLimit        error = errors.New("service: Connection limit reached")
+	ErrConnectionRate         error = errors.New("service: Connection rate limit exceeded")
+	ErrRateExceeded           error = errors.New("service: Publish rate limit exceeded")
+	ErrPacketTooLarge         error = errors.New("service: Packet exceeds maximum size")
+	ErrInflightExceeded       error = errors.New("service: Too many messages in flight")
+	ErrSlowConsumer           error = errors.New("service: Subscriber delivery queue is full")
+	ErrNoPacketId             error = errors.New("service: No packet ID available")
+	ErrTooManySubscriptions   error = errors.New("service: Too many subscriptions")
+	ErrNoTenant               error = errors.New("service: Client has no tenant")
+	ErrTenantQuota            error = errors.New("service: Tenant quota exceeded")
+	ErrEventLoopUnsupported   error = errors.New("service: Event loops are only supported on Linux")
+	ErrConnectionLost         error = errors.New("service: Connection lost")
+	ErrKeepAliveExpired       error = errors.New("service: Keep alive expired")
+	ErrClientIdNotAllowed     error = errors.New("service: Client ID not allowed for user")
 )
 
 const (
@@ -46,8 +65,17 @@ const (
 	DefaultSessionsProvider = "mem"
 	DefaultAuthenticator    = "mockSuccess"
 	DefaultTopicsProvider   = "mem"
+	DefaultMaxQueued        = 1000
+	DefaultSpillStore       = "mem"
+	DefaultTenantSeparator  = ":"
+	DefaultQuarantineTopic  = "quarantine"
+	DefaultMinBufferSize    = defaultMinBufferSize
+	DefaultMaxBufferSize    = defaultBufferSize
 )
 
+// How often Shutdown checks whether the in-flight messages have been acked.
+var shutdownPollInterval = 10 * time.Millisecond
+
 // Server is a library implementation of the MQTT server that, as best it can, complies
 // with the MQTT 3.1 and 3.1.1 specs.
 type Server struct {
@@ -80,6 +108,168 @@ type Server struct {
 	// If not set then default to "mem".
 	TopicsProvider string
 
+	// MaxConnections is the maximum number of connections the server handles at the
+	// same time, including the ones that have not sent the CONNECT message yet. New
+	// connections beyond that are closed right away. If not set then there's no limit.
+	MaxConnections int
+
+	// MaxConnectionsPerIP is the maximum number of connections from a single IP
+	// address. New connections beyond that are closed right away. If not set then
+	// there's no limit.
+	MaxConnectionsPerIP int
+
+	// ConnectRatePerIP is the number of new connections per second accepted from a
+	// single IP address, in bursts of up to the same number. Connections that come in
+	// faster are closed right away. If not set then there's no limit.
+	ConnectRatePerIP int
+
+	// MaxConnectionsPerUser is the maximum number of connections with the same
+	// username. Connections beyond that are refused with a CONNACK of "server
+	// unavailable". Connections without a username are not counted. The limit can
+	// also be set for each user by the authenticator, through the "maxconns"
+	// attribute, which takes precedence. If not set then there's no limit.
+	MaxConnectionsPerUser int
+
+	// MsgRate is the number of PUBLISH messages per second each client may send. If
+	// not set then there's no limit.
+	MsgRate int
+
+	// ByteRate is the number of bytes of PUBLISH messages per second each client may
+	// send. If not set then there's no limit.
+	ByteRate int
+
+	// RateLimits overrides MsgRate and ByteRate for the usernames listed. The limits
+	// can also be set for each user by the authenticator, through the "msgrate" and
+	// "byterate" attributes, which take precedence.
+	RateLimits map[string]RateLimit
+
+	// RatePolicy is what to do with the clients that go over their rate limits. If
+	// not set then default to RateDelay.
+	RatePolicy RatePolicy
+
+	// MaxPacketSize is the maximum size, in bytes, of a packet sent by a client.
+	// Clients that send larger packets are disconnected. If not set then there's no
+	// limit other than the MQTT maximum of 256MB.
+	MaxPacketSize int
+
+	// MaxInflightOut is the maximum number of QoS 1 and 2 messages sent to each
+	// client that can be waiting for acks. Further messages are queued until acks come
+	// back. If not set then there's no limit.
+	MaxInflightOut int
+
+	// MaxInflightIn is the maximum number of QoS 2 messages received from each client
+	// that can be waiting for PUBREL. Clients that go over are disconnected. If not
+	// set then there's no limit.
+	MaxInflightIn int
+
+	// MaxQueuedMessages is the maximum number of messages waiting to be sent to each
+	// subscriber. Publishers never wait for subscribers. Instead the messages are
+	// queued, and what happens to the ones beyond this limit depends on the
+	// SlowConsumerPolicy. If not set then default to 1000.
+	MaxQueuedMessages int
+
+	// SlowConsumerPolicy is what to do with the messages for a subscriber whose queue
+	// is full. If not set then default to SlowDropQoS0, which still disconnects the
+	// subscribers with 10 times MaxQueuedMessages QoS 1 and 2 messages queued.
+	SlowConsumerPolicy SlowConsumerPolicy
+
+	// SpillStore is the name of the store provider that keeps the messages that don't
+	// fit in the queue with the SlowSpill policy. To spill to disk, register a
+	// provider created with store.NewFileProvider. If not set then default to "mem".
+	SpillStore string
+
+	// MaxTopicLength is the maximum length, in bytes, of the topic names and topic
+	// filters sent by clients. Beside the limits, topics are checked against the
+	// rules of the spec. Clients that publish to an invalid topic name, or send an
+	// invalid filter in UNSUBSCRIBE, are disconnected. Invalid filters in SUBSCRIBE
+	// get a failure return code in the SUBACK. If not set then default to 65535.
+	MaxTopicLength int
+
+	// MaxTopicLevels is the maximum number of levels in the topic names and topic
+	// filters sent by clients. If not set then there's no limit.
+	MaxTopicLevels int
+
+	// MaxSubscriptions is the maximum number of topic filters each client can be
+	// subscribed to. Filters beyond that get a failure return code in the SUBACK. If
+	// not set then there's no limit.
+	MaxSubscriptions int
+
+	// TenantMode determines how the clients are split into tenants. Each tenant has
+	// its own namespace, with its own subscriptions, retained messages and client
+	// IDs, which requires a TopicsProvider that implements topics.Namespacer. Clients
+	// without a tenant are refused. Messages published with Server.Publish go to the
+	// clients without a tenant only. If not set then default to TenantNone, where all
+	// the clients share one namespace.
+	TenantMode TenantMode
+
+	// TenantSeparator separates the tenant from the rest of the username or client
+	// ID, e.g. "acme:alice". If not set then default to ":".
+	TenantSeparator string
+
+	// TenantQuota is the quota of each tenant, unless it's listed in TenantQuotas,
+	// which is keyed by tenant. If not set then there are no limits.
+	TenantQuota  TenantQuota
+	TenantQuotas map[string]TenantQuota
+
+	// MessageExpiry sets how long the messages published to the topics matching the
+	// topic filters listed, e.g. "devices/+/commands", may wait to be sent to each
+	// subscriber. Messages that expire while queued for a subscriber, including the
+	// ones spilled to the SpillStore or waiting for room in the inflight window, are
+	// dropped. If a topic matches several filters, the most specific one applies. A
+	// duration of 0 means the messages never expire. If not set then messages never
+	// expire.
+	MessageExpiry map[string]time.Duration
+
+	// MinBufferSize and MaxBufferSize are the sizes, in bytes, of the buffers for the
+	// data received from and sent to each client. The buffers start at MinBufferSize
+	// and grow up to MaxBufferSize as needed. While a client is idle, its buffers are
+	// released, unless both sizes are the same. Both must be powers of two of at
+	// least 16KB. If not set then default to 16KB and 256KB.
+	MinBufferSize int
+	MaxBufferSize int
+
+	// EventLoops is the number of epoll event loops that read from and write to the
+	// client connections, on Linux only. Instead of three goroutines per connection,
+	// the goroutines processing the messages of a client are only started when there
+	// is data to process, which suits a large number of mostly idle clients. If not
+	// set then each connection has its own goroutines.
+	EventLoops int
+
+	// Hooks are called, in order, as clients connect, subscribe, publish and receive
+	// messages, and may refuse or change what they do. See Hook. If not set then
+	// there are no hooks.
+	Hooks []Hook
+
+	// Rules republish the messages published by clients, after the messages are
+	// published, to other topics and with other payloads. The rules can be replaced
+	// while the server runs, see rules.Engine. Messages published with Server.Publish
+	// don't go through the rules. If not set then there are no rules.
+	Rules *rules.Engine
+
+	// Schemas check the payloads of the messages published by clients against the
+	// schemas bound to their topics, before the messages are published. Schemas can
+	// be bound and unbound while the server runs. Messages published with
+	// Server.Publish are not checked. If not set then payloads are not checked.
+	Schemas *schema.Set
+
+	// SchemaPolicy determines what happens to the messages that fail the Schemas. If
+	// not set then default to SchemaReject.
+	SchemaPolicy SchemaPolicy
+
+	// QuarantineTopic is the topic prefix of the invalid messages, with the
+	// SchemaQuarantine policy. The quarantined messages are not checked again. If not
+	// set then default to "quarantine".
+	QuarantineTopic string
+
+	// History keeps the last messages published to the topics matching the topic
+	// filters listed, e.g. "sensors/#", bounded by count and age. Clients get the
+	// history of the topics matching a subscription, before the live messages, if
+	// the filter starts with topics.HistoryPrefix, e.g. "$history/sensors/+/temp",
+	// or for all their subscriptions if the "history" auth attribute of the user is
+	// "true". The history replaces the retained messages of the topics. Each tenant
+	// has its own history. If not set then no history is kept.
+	History map[string]topics.HistoryLimit
+
 	// authMgr is the authentication manager that we are going to use for authenticating
 	// incoming connections
 	authMgr *auth.Manager
@@ -90,6 +280,32 @@ type Server struct {
 	// topicsMgr is the topics manager for keeping track of subscriptions
 	topicsMgr *topics.Manager
 
+	// limits keeps track of the connections held by each IP address and username
+	limits *connLimiter
+
+	// spillMgr is the store for the messages spilled by slow subscribers. Only set
+	// with the SlowSpill policy.
+	spillMgr *store.Manager
+
+	// The tenants, created as their first client connects
+	tmu     sync.Mutex
+	tenants map[string]*tenant
+
+	// validator checks the topics sent by clients
+	validator *topics.Validator
+
+	// expiry is the TTLs from MessageExpiry
+	expiry *topics.TTLs
+
+	// history is the History of the clients without a tenant
+	history *topics.History
+
+	// metrics holds the counters shared by all the services
+	metrics metrics
+
+	// loops are the event loops the connections are spread over, if EventLoops is set
+	loops []*eventLoop
+
 	// The quit channel for the server. If the server detects that this channel
 	// is closed, then it's a signal for it to shutdown as well.
 	quit chan struct{}
@@ -100,9 +316,13 @@ type Server struct {
 	// gracefully shut them down if they are still alive when the server goes down.
 	svcs []*service
 
-	// Mutex for updating svcs
+	// Mutex for updating svcs and closing
 	mu sync.Mutex
 
+	// Whether Shutdown or Close has been called. Once set, new connections are
+	// refused.
+	closing bool
+
 	// A indicator on whether this server is running
 	running int32
 
@@ -125,30 +345,47 @@ func (this *Server) ListenAndServe(uri string) error {
 		return fmt.Errorf("server/ListenAndServe: Server is already running")
 	}
 
-	this.quit = make(chan struct{})
+	// Shutdown reads quit and ln from another goroutine
+	this.mu.Lock()
+	if this.closing {
+		this.mu.Unlock()
+		return ErrServerClosed
+	}
+	quit := make(chan struct{})
+	this.quit = quit
+	this.mu.Unlock()
 
 	u, err := url.Parse(uri)
 	if err != nil {
 		return err
 	}
 
-	this.ln, err = net.Listen(u.Scheme, u.Host)
+	ln, err := net.Listen(u.Scheme, u.Host)
 	if err != nil {
 		return err
 	}
-	defer this.ln.Close()
+	defer ln.Close()
+
+	// If Shutdown ran while we were listening, it could not close ln
+	this.mu.Lock()
+	if this.closing {
+		this.mu.Unlock()
+		return nil
+	}
+	this.ln = ln
+	this.mu.Unlock()
 
 	glog.Infof("server/ListenAndServe: server is ready...")
 
 	var tempDelay time.Duration // how long to sleep on accept failure
 
 	for {
-		conn, err := this.ln.Accept()
+		conn, err := ln.Accept()
 
 		if err != nil {
 			// http://zhen.org/blog/graceful-shutdown-of-go-net-dot-listeners/
 			select {
-			case <-this.quit:
+			case <-quit:
 				return nil
 
 			default:
@@ -185,12 +422,20 @@ func (this *Server) Publish(msg *message.PublishMessage, onComplete OnCompleteFu
 		return err
 	}
 
+	if err := this.validator.ValidateName(msg.Topic()); err != nil {
+		return err
+	}
+
 	if msg.Retain() {
 		if err := this.topicsMgr.Retain(msg); err != nil {
 			glog.Errorf("Error retaining message: %v", err)
 		}
 	}
 
+	if this.history != nil {
+		this.history.Add(msg)
+	}
+
 	if err := this.topicsMgr.Subscribers(msg.Topic(), msg.QoS(), &this.subs, &this.qoss); err != nil {
 		return err
 	}
@@ -198,36 +443,53 @@ func (this *Server) Publish(msg *message.PublishMessage, onComplete OnCompleteFu
 	msg.SetRetain(false)
 
 	//glog.Debugf("(server) Publishing to topic %q and %d subscribers", string(msg.Topic()), len(this.subs))
-	for _, s := range this.subs {
-		if s != nil {
-			fn, ok := s.(*OnPublishFunc)
-			if !ok {
-				glog.Errorf("Invalid onPublish Function")
-			} else {
-				(*fn)(msg)
-			}
-		}
-	}
-
-	return nil
+	return fanout(msg, this.subs, expireAt(this.expiry, msg.Topic(), time.Now()))
 }
 
-// Close terminates the server by shutting down all the client connections and closing
-// the listener. It will, as best it can, clean up after itself.
-func (this *Server) Close() error {
+// Shutdown gracefully shuts down the server. It first stops accepting new
+// connections. It then waits for the QoS 1 and 2 messages in flight on every
+// connection to be acked, closes the connections, and saves the sessions that are
+// not clean to the SessionsProvider. MQTT 3.1.1 has no way for the server to ask
+// a client to disconnect, so the clients are told by closing the connection. Will
+// messages are not published for the connections closed this way.
+//
+// If ctx expires before all the in-flight messages are acked, the connections are
+// closed anyway and ctx.Err() is returned.
+func (this *Server) Shutdown(ctx context.Context) error {
+	this.mu.Lock()
+	if this.closing {
+		this.mu.Unlock()
+		return ErrServerClosed
+	}
+	this.closing = true
+	ln, quit := this.ln, this.quit
+	this.mu.Unlock()
+
 	// By closing the quit channel, we are telling the server to stop accepting new
 	// connection.
-	close(this.quit)
+	if quit != nil {
+		close(quit)
+	}
 
 	// We then close the net.Listener, which will force Accept() to return if it's
 	// blocked waiting for new connections.
-	this.ln.Close()
+	if ln != nil {
+		ln.Close()
+	}
 
-	for _, svc := range this.svcs {
+	err := this.drain(ctx)
+
+	for _, svc := range this.services() {
 		glog.Infof("Stopping service %d", svc.id)
+		atomic.StoreInt64(&svc.nowill, 1)
+		svc.setCause(ErrServerClosed)
 		svc.stop()
 	}
 
+	for _, l := range this.loops {
+		l.close()
+	}
+
 	if this.sessMgr != nil {
 		this.sessMgr.Close()
 	}
@@ -236,9 +498,73 @@ func (this *Server) Close() error {
 		this.topicsMgr.Close()
 	}
 
+	return err
+}
+
+// Close terminates the server by shutting down all the client connections and closing
+// the listener. It will, as best it can, clean up after itself. Unlike Shutdown, it
+// does not wait for the messages in flight to be acked.
+func (this *Server) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := this.Shutdown(ctx); err != nil && err != context.Canceled {
+		return err
+	}
+
 	return nil
 }
 
+// drain() waits until there are no more messages waiting for acks on any of the
+// connections, or until ctx expires.
+func (this *Server) drain(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		n := 0
+		for _, svc := range this.services() {
+			n += svc.inflight()
+		}
+
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			glog.Errorf("server/Shutdown: %d messages still in flight: %v", n, ctx.Err())
+			return ctx.Err()
+
+		case <-ticker.C:
+		}
+	}
+}
+
+// services() returns a snapshot of the services that are currently running.
+func (this *Server) services() []*service {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	svcs := make([]*service, len(this.svcs))
+	copy(svcs, this.svcs)
+
+	return svcs
+}
+
+// removeService() is called by a service when it stops.
+func (this *Server) removeService(svc *service) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for i, s := range this.svcs {
+		if s == svc {
+			this.svcs = append(this.svcs[:i:i], this.svcs[i+1:]...)
+			return
+		}
+	}
+}
+
 // HandleConnection is for the broker to handle an incoming connection from a client
 func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 	if c == nil {
@@ -261,6 +587,29 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 		return nil, ErrInvalidConnectionType
 	}
 
+	// Check the connection limits before doing anything else, so connections over
+	// the limits cost as little as possible.
+	ip := remoteIP(conn)
+	if err = this.limits.acquire(ip); err != nil {
+		glog.Errorf("server/handleConnection: Refusing connection from %s: %v", ip, err)
+		return nil, err
+	}
+
+	// The slots taken are given back when the service stops. Until the service is
+	// started, they are given back here on error.
+	var (
+		user  string
+		ten   *tenant
+		owned bool
+	)
+
+	defer func() {
+		if err != nil && !owned {
+			this.limits.release(ip, user)
+			this.releaseTenant(ten)
+		}
+	}()
+
 	// To establish a connection, we must
 	// 1. Read and decode the message.ConnectMessage from the wire
 	// 2. If no decoding errors, then authenticate using username and password.
@@ -278,7 +627,7 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 
 	resp := message.NewConnackMessage()
 
-	req, err := getConnectMessage(conn)
+	req, err := getConnectMessage(conn, this.MaxPacketSize)
 	if err != nil {
 		if cerr, ok := err.(message.ConnackCode); ok {
 			//glog.Debugf("request   message: %s\nresponse message: %s\nerror           : %v", mreq, resp, err)
@@ -289,6 +638,26 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 		return nil, err
 	}
 
+	// Refuse new connections once the server is shutting down
+	if this.isClosing() {
+		resp.SetReturnCode(message.ErrServerUnavailable)
+		resp.SetSessionPresent(false)
+		writeMessage(conn, resp)
+		return nil, ErrServerClosed
+	}
+
+	// The will message is published like any other message, so its topic must be a
+	// valid topic name. There's no return code for it, the client is just refused.
+	if req.WillFlag() {
+		if err = this.validator.ValidateName(req.WillTopic()); err != nil {
+			glog.Errorf("server/handleConnection: Invalid will topic %q: %v", req.WillTopic(), err)
+			resp.SetReturnCode(message.ErrNotAuthorized)
+			resp.SetSessionPresent(false)
+			writeMessage(conn, resp)
+			return nil, err
+		}
+	}
+
 	// Authenticate the user, if error, return error and exit
 	if err = this.authMgr.Authenticate(string(req.Username()), string(req.Password())); err != nil {
 		resp.SetReturnCode(message.ErrBadUsernameOrPassword)
@@ -297,6 +666,55 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 		return nil, err
 	}
 
+	// The authenticator may restrict the client IDs and the connections of the user,
+	// and set its tenant, rate limits and history
+	attrs, err := this.authMgr.Attributes(string(req.Username()))
+	if err != nil {
+		resp.SetReturnCode(message.ErrServerUnavailable)
+		resp.SetSessionPresent(false)
+		writeMessage(conn, resp)
+		return nil, err
+	}
+
+	if !clientIdAllowed(attrs, string(req.ClientId())) {
+		err = ErrClientIdNotAllowed
+		resp.SetReturnCode(message.ErrIdentifierRejected)
+		resp.SetSessionPresent(false)
+		writeMessage(conn, resp)
+		return nil, err
+	}
+
+	if err = this.limits.acquireUser(string(req.Username()), maxConnections(attrs)); err != nil {
+		resp.SetReturnCode(message.ErrServerUnavailable)
+		resp.SetSessionPresent(false)
+		writeMessage(conn, resp)
+		return nil, err
+	}
+
+	user = string(req.Username())
+
+	if ten, err = this.connectTenant(req, resp, attrs); err != nil {
+		writeMessage(conn, resp)
+		return nil, err
+	}
+
+	info := ClientInfo{
+		ClientId:   string(req.ClientId()),
+		Username:   user,
+		RemoteAddr: conn.RemoteAddr(),
+	}
+	if ten != nil {
+		info.Tenant = ten.name
+	}
+
+	if err = hookList(this.Hooks).onConnect(info, req); err != nil {
+		glog.Errorf("server/handleConnection: Connection refused by hook: %v", err)
+		resp.SetReturnCode(connackCode(err))
+		resp.SetSessionPresent(false)
+		writeMessage(conn, resp)
+		return nil, err
+	}
+
 	if req.KeepAlive() == 0 {
 		req.SetKeepAlive(minKeepAlive)
 	}
@@ -309,17 +727,54 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 		connectTimeout: this.ConnectTimeout,
 		ackTimeout:     this.AckTimeout,
 		timeoutRetries: this.TimeoutRetries,
+		maxPacketSize:  this.MaxPacketSize,
+		maxInflightOut: this.MaxInflightOut,
+		maxInflightIn:  this.MaxInflightIn,
+		minBufferSize:  this.MinBufferSize,
+		maxBufferSize:  this.MaxBufferSize,
+
+		validator:        this.validator,
+		maxSubscriptions: this.MaxSubscriptions,
 
 		conn:      conn,
 		sessMgr:   this.sessMgr,
 		topicsMgr: this.topicsMgr,
+		server:    this,
+		hooks:     this.Hooks,
+		tenant:    ten,
+		release: func() {
+			this.limits.release(ip, user)
+			this.releaseTenant(ten)
+		},
+		rate: newRateLimiter(this.rateLimit(user, attrs), this.RatePolicy, &this.metrics),
+
+		history:    this.history,
+		allHistory: this.historyAttr(attrs),
+	}
+
+	if ten != nil {
+		svc.topicsMgr = ten.topicsMgr
+		svc.history = ten.history
+	}
+
+	if len(this.loops) > 0 {
+		svc.loop = this.loops[svc.id%uint64(len(this.loops))]
 	}
 
 	err = this.getSession(svc, req, resp)
 	if err != nil {
+		if err == ErrTenantQuota {
+			writeMessage(conn, resp)
+		}
 		return nil, err
 	}
 
+	svc.info = info
+	svc.info.ClientId = string(req.ClientId())
+
+	svc.queue = newDeliveryQueue(this.MaxQueuedMessages, this.SlowConsumerPolicy, this.spillMgr,
+		fmt.Sprintf("%s/%d", req.ClientId(), svc.id), &this.metrics)
+
 	resp.SetReturnCode(message.ConnectionAccepted)
 
 	if err = writeMessage(c, resp); err != nil {
@@ -329,20 +784,50 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 	svc.inStat.increment(int64(req.Len()))
 	svc.outStat.increment(int64(resp.Len()))
 
+	owned = true
+
+	if len(svc.hooks) > 0 {
+		svc.hooks.onConnected(svc.info)
+	}
+
 	if err := svc.start(); err != nil {
 		svc.stop()
 		return nil, err
 	}
 
-	//this.mu.Lock()
-	//this.svcs = append(this.svcs, svc)
-	//this.mu.Unlock()
+	// Keep track of the service so it can be shut down with the server. If the
+	// server started shutting down in the meantime, the connection is closed right
+	// away. If the service has already stopped, it's not added.
+	this.mu.Lock()
+	if this.closing {
+		this.mu.Unlock()
+		atomic.StoreInt64(&svc.nowill, 1)
+		svc.setCause(ErrServerClosed)
+		svc.stop()
+		return nil, ErrServerClosed
+	}
+	if !svc.isClosed() {
+		this.svcs = append(this.svcs, svc)
+	}
+	this.mu.Unlock()
 
 	glog.Infof("(%s) server/handleConnection: Connection established.", svc.cid())
 
 	return svc, nil
 }
 
+// Metrics returns a snapshot of the server counters.
+func (this *Server) Metrics() Metrics {
+	return this.metrics.snapshot()
+}
+
+func (this *Server) isClosing() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.closing
+}
+
 func (this *Server) checkConfiguration() error {
 	var err error
 
@@ -386,6 +871,67 @@ func (this *Server) checkConfiguration() error {
 		}
 
 		this.topicsMgr, err = topics.NewManager(this.TopicsProvider)
+		if err != nil {
+			return
+		}
+
+		if this.TenantSeparator == "" {
+			this.TenantSeparator = DefaultTenantSeparator
+		}
+
+		this.tenants = make(map[string]*tenant)
+
+		this.validator = &topics.Validator{
+			MaxLength: this.MaxTopicLength,
+			MaxLevels: this.MaxTopicLevels,
+		}
+
+		if len(this.MessageExpiry) > 0 {
+			this.expiry, err = topics.NewTTLs(this.MessageExpiry)
+			if err != nil {
+				return
+			}
+		}
+
+		if len(this.History) > 0 {
+			this.history, err = topics.NewHistory(this.History)
+			if err != nil {
+				return
+			}
+		}
+
+		if this.QuarantineTopic == "" {
+			this.QuarantineTopic = DefaultQuarantineTopic
+		}
+
+		if err = this.validator.ValidateName([]byte(this.QuarantineTopic)); err != nil {
+			return
+		}
+
+		if this.MaxQueuedMessages == 0 {
+			this.MaxQueuedMessages = DefaultMaxQueued
+		}
+
+		if this.SlowConsumerPolicy == SlowSpill {
+			if this.SpillStore == "" {
+				this.SpillStore = DefaultSpillStore
+			}
+
+			this.spillMgr, err = store.NewManager(this.SpillStore)
+			if err != nil {
+				return
+			}
+		}
+
+		this.limits = newConnLimiter(this.MaxConnections, this.MaxConnectionsPerIP,
+			this.ConnectRatePerIP, this.MaxConnectionsPerUser)
+
+		if this.EventLoops > 0 {
+			this.loops, err = newEventLoops(this.EventLoops)
+			if err != nil {
+				return
+			}
+		}
 
 		return
 	})
@@ -413,12 +959,22 @@ func (this *Server) getSession(svc *service, req *message.ConnectMessage, resp *
 		req.SetCleanSession(true)
 	}
 
-	cid := string(req.ClientId())
+	// The sessions of the tenants are kept apart, since different tenants may use
+	// the same client IDs.
+	svc.sessId = string(req.ClientId())
+	if svc.tenant != nil {
+		svc.sessId = svc.tenant.name + "/" + svc.sessId
+
+		if err := this.acquireSession(svc.tenant, svc.sessId, req.CleanSession()); err != nil {
+			resp.SetReturnCode(message.ErrServerUnavailable)
+			return err
+		}
+	}
 
 	// If CleanSession is NOT set, check the session store for existing session.
 	// If found, return it.
 	if !req.CleanSession() {
-		if svc.sess, err = this.sessMgr.Get(cid); err == nil {
+		if svc.sess, err = this.sessMgr.Get(svc.sessId); err == nil {
 			resp.SetSessionPresent(true)
 
 			if err := svc.sess.Update(req); err != nil {
@@ -429,7 +985,7 @@ func (this *Server) getSession(svc *service, req *message.ConnectMessage, resp *
 
 	// If CleanSession, or no existing session found, then create a new one
 	if svc.sess == nil {
-		if svc.sess, err = this.sessMgr.New(cid); err != nil {
+		if svc.sess, err = this.sessMgr.New(svc.sessId); err != nil {
 			return err
 		}
 
@@ -0,0 +1,547 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/auth"
+	"github.com/surgemq/surgemq/rules"
+	"github.com/surgemq/surgemq/schema"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestServerShutdown(t *testing.T) {
+	svr, done := startServer(t, &Server{Authenticator: authenticator})
+
+	c := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c)
+
+	var wills int64
+	onWill := OnPublishFunc(func(msg *message.PublishMessage) error {
+		atomic.AddInt64(&wills, 1)
+		return nil
+	})
+	_, err := svr.topicsMgr.Subscribe([]byte("will"), 1, &onWill)
+	require.NoError(t, err)
+
+	waitForServices(t, svr, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, svr.Shutdown(ctx))
+	require.NoError(t, <-done)
+
+	require.Empty(t, svr.services())
+	require.Equal(t, int64(0), atomic.LoadInt64(&wills))
+
+	require.Equal(t, ErrServerClosed, svr.Shutdown(ctx))
+
+	_, err = net.Dial("tcp", "127.0.0.1:1883")
+	require.Error(t, err)
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	svr, done := startServer(t, &Server{Authenticator: authenticator})
+
+	c := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c)
+
+	waitForServices(t, svr, 1)
+
+	// Pretend a QoS 1 message sent to the client is never acked
+	svc := svr.services()[0]
+	require.NoError(t, svc.sess.Pub1ack.Wait(newPublishMessage(1, 1), nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	require.Equal(t, context.DeadlineExceeded, svr.Shutdown(ctx))
+	require.NoError(t, <-done)
+
+	require.True(t, svc.isClosed())
+	require.Empty(t, svr.services())
+}
+
+func TestServerShutdownDrain(t *testing.T) {
+	svr, done := startServer(t, &Server{Authenticator: authenticator})
+
+	c := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c)
+
+	waitForServices(t, svr, 1)
+
+	svc := svr.services()[0]
+	require.NoError(t, svc.sess.Pub1ack.Wait(newPublishMessage(1, 1), nil))
+
+	// Ack the message a little later, Shutdown should wait for it
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+
+		ack := message.NewPubackMessage()
+		ack.SetPacketId(1)
+		svc.sess.Pub1ack.Ack(ack)
+		svc.sess.Pub1ack.Acked()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, svr.Shutdown(ctx))
+	require.NoError(t, <-done)
+}
+
+// startServer() runs svr on tcp://127.0.0.1:1883 with fresh memory providers. The
+// returned channel receives the result of ListenAndServe.
+func startServer(t testing.TB, svr *Server) (*Server, chan error) {
+	topics.Unregister("mem")
+	topics.Register("mem", topics.NewMemProvider())
+
+	sessions.Unregister("mem")
+	sessions.Register("mem", sessions.NewMemProvider())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- svr.ListenAndServe("tcp://127.0.0.1:1883")
+	}()
+
+	for i := 0; i < 100; i++ {
+		svr.mu.Lock()
+		ln := svr.ln
+		svr.mu.Unlock()
+
+		if atomic.LoadInt32(&svr.running) == 1 && ln != nil {
+			return svr, done
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.FailNow(t, "Timed out waiting for server to start")
+	return nil, nil
+}
+
+func waitForServices(t testing.TB, svr *Server, n int) {
+	for i := 0; i < 100; i++ {
+		if len(svr.services()) == n {
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.FailNow(t, "Timed out waiting for services")
+}
+
+func TestServerMaxConnectionsPerUser(t *testing.T) {
+	svr, done := startServer(t, &Server{
+		Authenticator:         authenticator,
+		MaxConnectionsPerUser: 1,
+	})
+
+	c1 := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c1)
+
+	c2 := &Client{}
+	err := c2.Connect("tcp://127.0.0.1:1883", newConnectMessage())
+	require.Equal(t, message.ErrServerUnavailable, err)
+
+	// The slot is given back once the first connection goes away
+	waitForServices(t, svr, 1)
+	c1.Disconnect()
+	waitForServices(t, svr, 0)
+
+	c3 := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c3)
+	c3.Disconnect()
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+}
+
+func TestServerUserAttributes(t *testing.T) {
+	auth.Register("userattrs", attrAuthenticator{"surgemq": {AttrClientIds: "sensor-*", AttrMaxConnections: "1"}})
+	defer auth.Unregister("userattrs")
+
+	svr, done := startServer(t, &Server{
+		Authenticator:         "userattrs",
+		MaxConnectionsPerUser: 5,
+	})
+
+	connect := func(cid string) (*Client, error) {
+		msg := newConnectMessage()
+		msg.SetClientId([]byte(cid))
+
+		c := &Client{}
+		return c, c.Connect("tcp://127.0.0.1:1883", msg)
+	}
+
+	_, err := connect("gateway-1")
+	require.Equal(t, message.ErrIdentifierRejected, err)
+
+	c1, err := connect("sensor-1")
+	require.NoError(t, err)
+
+	_, err = connect("sensor-2")
+	require.Equal(t, message.ErrServerUnavailable, err)
+
+	waitForServices(t, svr, 1)
+	c1.Disconnect()
+	waitForServices(t, svr, 0)
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+}
+
+func TestServerSubscriptionLimits(t *testing.T) {
+	svr, done := startServer(t, &Server{
+		Authenticator:    authenticator,
+		MaxTopicLevels:   3,
+		MaxSubscriptions: 2,
+	})
+
+	c := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c)
+
+	// The filter with too many levels is refused, and so is the third filter, but
+	// subscribing again to the same filter is fine
+	rc1 := subscribeCodes(c, "a/+", "a/b/c/d", "b", "c")
+	rc2 := subscribeCodes(c, "a/+")
+
+	c.Disconnect()
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+
+	require.Equal(t, []byte{1, message.QosFailure, 1, message.QosFailure}, rc1)
+	require.Equal(t, []byte{1}, rc2)
+}
+
+func TestServerRules(t *testing.T) {
+	engine, err := rules.New([]rules.Rule{{
+		Name:      "relay",
+		Topic:     "in/+",
+		Where:     []rules.Condition{{Field: "v", Op: ">", Value: 1}},
+		Republish: rules.Republish{Topic: "out/{{topic.1}}", QoS: 1, Payload: `{{payload.v}}`},
+	}})
+	require.NoError(t, err)
+
+	svr, done := startServer(t, &Server{
+		Authenticator: authenticator,
+		Rules:         engine,
+	})
+
+	c := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c)
+
+	rcvd := make(chan string, 10)
+
+	sub := message.NewSubscribeMessage()
+	sub.AddTopic([]byte("out/#"), 1)
+
+	acked := make(chan struct{})
+	c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+		close(acked)
+		return nil
+	}, func(msg *message.PublishMessage) error {
+		rcvd <- string(msg.Topic()) + " " + string(msg.Payload())
+		return nil
+	})
+
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+	}
+
+	for _, payload := range []string{`{"v": 1}`, `{"v": 2}`} {
+		msg := newPublishMessage(0, 0)
+		msg.SetTopic([]byte("in/a"))
+		msg.SetPayload([]byte(payload))
+		c.Publish(msg, nil)
+	}
+
+	var got string
+	select {
+	case got = <-rcvd:
+	case <-time.After(time.Second):
+	}
+
+	// Give the other message some time to arrive, if it's going to
+	time.Sleep(50 * time.Millisecond)
+
+	c.Disconnect()
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+
+	require.Equal(t, "out/a 2", got)
+	require.Len(t, rcvd, 0)
+}
+
+func TestServerSchemas(t *testing.T) {
+	v, err := schema.NewJSONSchema([]byte(`{"type": "object", "required": ["v"]}`))
+	require.NoError(t, err)
+
+	schemas := schema.NewSet()
+	require.NoError(t, schemas.Bind("sensors/+", v))
+
+	svr, done := startServer(t, &Server{
+		Authenticator: authenticator,
+		Schemas:       schemas,
+		SchemaPolicy:  SchemaQuarantine,
+	})
+
+	c := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c)
+
+	rcvd := make(chan string, 10)
+
+	sub := message.NewSubscribeMessage()
+	sub.AddTopic([]byte("sensors/#"), 1)
+	sub.AddTopic([]byte("quarantine/#"), 1)
+
+	acked := make(chan struct{})
+	c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+		close(acked)
+		return nil
+	}, func(msg *message.PublishMessage) error {
+		rcvd <- string(msg.Topic()) + " " + string(msg.Payload())
+		return nil
+	})
+
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+	}
+
+	for _, payload := range []string{`{"v": 1}`, `garbage`} {
+		msg := newPublishMessage(0, 0)
+		msg.SetTopic([]byte("sensors/1"))
+		msg.SetPayload([]byte(payload))
+		c.Publish(msg, nil)
+	}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-rcvd:
+			got = append(got, m)
+		case <-time.After(time.Second):
+		}
+	}
+
+	c.Disconnect()
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+
+	require.Equal(t, []string{`sensors/1 {"v": 1}`, "quarantine/sensors/1 garbage"}, got)
+	require.Equal(t, int64(1), svr.Metrics().Invalid)
+	require.Equal(t, int64(1), svr.Metrics().Quarantined)
+}
+
+func TestServerHistory(t *testing.T) {
+	svr, done := startServer(t, &Server{
+		Authenticator: authenticator,
+		History:       map[string]topics.HistoryLimit{"sensors/#": {Count: 3}},
+	})
+
+	c1 := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c1)
+
+	publish := func(topic, payload string, retain bool) {
+		msg := newPublishMessage(0, 1)
+		msg.SetTopic([]byte(topic))
+		msg.SetPayload([]byte(payload))
+		msg.SetRetain(retain)
+
+		acked := make(chan struct{})
+		require.NoError(t, c1.Publish(msg, func(msg, ack message.Message, err error) error {
+			close(acked)
+			return nil
+		}))
+
+		select {
+		case <-acked:
+		case <-time.After(time.Second):
+		}
+	}
+
+	for _, payload := range []string{"1", "2", "3", "4"} {
+		publish("sensors/1", payload, true)
+	}
+	publish("other/1", "1", true)
+
+	// subscribe() returns the first n messages received for the filter
+	subscribe := func(filter string, n int, live func()) []string {
+		c := connectToServer(t, "tcp://127.0.0.1:1883")
+		require.NotNil(t, c)
+		defer c.Disconnect()
+
+		rcvd := make(chan string, 10)
+
+		sub := message.NewSubscribeMessage()
+		sub.AddTopic([]byte(filter), 1)
+
+		acked := make(chan struct{})
+		c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+			close(acked)
+			return nil
+		}, func(msg *message.PublishMessage) error {
+			rcvd <- string(msg.Topic()) + " " + string(msg.Payload())
+			return nil
+		})
+
+		select {
+		case <-acked:
+		case <-time.After(time.Second):
+		}
+
+		if live != nil {
+			live()
+		}
+
+		var got []string
+		for i := 0; i < n; i++ {
+			select {
+			case m := <-rcvd:
+				got = append(got, m)
+			case <-time.After(time.Second):
+			}
+		}
+
+		return got
+	}
+
+	plain := subscribe("#", 2, nil)
+	history := subscribe("$history/#", 5, func() {
+		publish("sensors/1", "5", false)
+	})
+
+	c1.Disconnect()
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+
+	require.ElementsMatch(t, []string{"sensors/1 4", "other/1 1"}, plain)
+	require.Equal(t, []string{"sensors/1 2", "sensors/1 3", "sensors/1 4", "other/1 1", "sensors/1 5"}, history)
+}
+
+func TestServerHistoryExpired(t *testing.T) {
+	svr, done := startServer(t, &Server{
+		Authenticator: authenticator,
+		History:       map[string]topics.HistoryLimit{"sensors/#": {MaxAge: 50 * time.Millisecond}},
+	})
+
+	c := connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c)
+
+	msg := newPublishMessage(0, 1)
+	msg.SetTopic([]byte("sensors/1"))
+	msg.SetPayload([]byte("1"))
+	msg.SetRetain(true)
+
+	acked := make(chan struct{})
+	require.NoError(t, c.Publish(msg, func(msg, ack message.Message, err error) error {
+		close(acked)
+		return nil
+	}))
+
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+	}
+
+	// Once the history expired, the retained message is sent instead
+	time.Sleep(100 * time.Millisecond)
+
+	rcvd := make(chan string, 10)
+
+	sub := message.NewSubscribeMessage()
+	sub.AddTopic([]byte("$history/sensors/#"), 1)
+
+	require.NoError(t, c.Subscribe(sub, nil, func(msg *message.PublishMessage) error {
+		rcvd <- string(msg.Topic()) + " " + string(msg.Payload())
+		return nil
+	}))
+
+	var got string
+
+	select {
+	case got = <-rcvd:
+	case <-time.After(time.Second):
+	}
+
+	c.Disconnect()
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+
+	require.Equal(t, "sensors/1 1", got)
+}
+
+func TestServerInvalidWillTopic(t *testing.T) {
+	svr, done := startServer(t, &Server{Authenticator: authenticator})
+
+	msg := newConnectMessage()
+	msg.SetWillTopic([]byte("will/#"))
+
+	c := &Client{}
+	require.Equal(t, message.ErrNotAuthorized, c.Connect("tcp://127.0.0.1:1883", msg))
+
+	c = connectToServer(t, "tcp://127.0.0.1:1883")
+	require.NotNil(t, c)
+	c.Disconnect()
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+}
+
+// subscribeCodes() subscribes to the filters with QoS 1, and returns the return codes
+// of the SUBACK, or nil if there's none.
+func subscribeCodes(c *Client, filters ...string) []byte {
+	sub := message.NewSubscribeMessage()
+	for _, filter := range filters {
+		sub.AddTopic([]byte(filter), 1)
+	}
+
+	codes := make(chan []byte, 1)
+
+	err := c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+		codes <- ack.(*message.SubackMessage).ReturnCodes()
+		return nil
+	}, func(msg *message.PublishMessage) error {
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+
+	select {
+	case rc := <-codes:
+		return rc
+
+	case <-time.After(time.Second):
+		return nil
+	}
+}
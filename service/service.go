@@ -19,6 +19,7 @@ import (
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/surge/glog"
 	"github.com/surgemq/message"
@@ -70,15 +71,85 @@ type service struct {
 	// If no set then default to 3 retries.
 	timeoutRetries int
 
+	// The maximum size of a packet received. If not set then there's no limit.
+	maxPacketSize int
+
+	// The maximum number of QoS 1 and 2 messages sent, and QoS 2 messages received,
+	// that can be waiting for acks. If not set then there's no limit.
+	maxInflightOut int
+	maxInflightIn  int
+
+	// The checks for the topics received, and the maximum number of subscriptions.
+	// Server side only.
+	validator        *topics.Validator
+	maxSubscriptions int
+
+	// The sizes of the incoming and outgoing buffers. If not set then default to 16KB
+	// and 256KB.
+	minBufferSize int
+	maxBufferSize int
+
 	// Network connection for this service
 	conn io.Closer
 
 	// Session manager for tracking all the clients
 	sessMgr *sessions.Manager
 
-	// Topics manager for all the client subscriptions
+	// Topics manager for all the client subscriptions. Server side only.
 	topicsMgr *topics.Manager
 
+	// The history of the topics, if the server keeps any, and whether the client
+	// gets it for all its subscriptions. Server side only.
+	history    *topics.History
+	allHistory bool
+
+	// The tenant of the client, if the server has tenants, and the key of the
+	// session in the session manager. Server side only.
+	tenant *tenant
+	sessId string
+
+	// The server that accepted this connection. Server side only.
+	server *Server
+
+	// The hooks registered on the server, and the client as they see it. Server side
+	// only.
+	hooks hookList
+	info  ClientInfo
+
+	// release gives back the connection slots held by this service to the server.
+	// Server side only.
+	release func()
+
+	// rate enforces the rate limits on the PUBLISH messages received. Server side
+	// only, and only if the client has rate limits.
+	rate *rateLimiter
+
+	// queue holds the messages published to this client until the deliverer sends
+	// them, so publishers never block on this connection. Server side only.
+	queue *deliveryQueue
+
+	// router dispatches the messages received to the subscription handlers. Client
+	// side only.
+	router *router
+
+	// loop does the network I/O for this service, if the server runs in the event
+	// loop mode. Server side only. See Server.EventLoops.
+	loop *eventLoop
+	poll pollState
+
+	// Set while the processor and the deliverer run, in the event loop mode
+	processing int32
+	delivering int32
+
+	// Once stopping is set, no more goroutines are started on demand
+	kmu      sync.Mutex
+	stopping bool
+
+	// Why the connection was closed, see setCause()
+	cmu    sync.Mutex
+	cause  error
+	caused bool
+
 	// sess is the session object for this MQTT session. It keeps track session variables
 	// such as ClientId, KeepAlive, Username, etc
 	sess *sessions.Session
@@ -93,6 +164,10 @@ type service struct {
 	// Whether this is service is closed or not.
 	closed int64
 
+	// Set when the server closes the connection on purpose, e.g., during shutdown,
+	// so the will message is not published.
+	nowill int64
+
 	// Quit signal for determining when this service should end. If channel is closed,
 	// then exit.
 	done chan struct{}
@@ -103,15 +178,6 @@ type service struct {
 	// Outgoing data buffer. Bytes written here are in turn written out to the connection.
 	out *buffer
 
-	// onpub is the method that gets added to the topic subscribers list by the
-	// processSubscribe() method. When the server finishes the ack cycle for a
-	// PUBLISH message, it will call the subscriber, which is this method.
-	//
-	// For the server, when this method is called, it means there's a message that
-	// should be published to the client on the other end of this connection. So we
-	// will call publish() to send the message.
-	onpub OnPublishFunc
-
 	inStat  stat
 	outStat stat
 
@@ -121,46 +187,86 @@ type service struct {
 	subs  []interface{}
 	qoss  []byte
 	rmsgs []*message.PublishMessage
+
+	// outbox keeps the outgoing QoS 1 and 2 messages until they are acked. Client side
+	// only, and only if the Client has a MessageStore.
+	outbox *outbox
+
+	// Acks (PUBACK or PUBCOMP) for received PUBLISH messages that are held back until
+	// every channel subscriber with ManualAck set has acknowledged the message. Client
+	// side only.
+	hmu  sync.Mutex
+	held map[uint16]*heldAck
+
+	// Outgoing QoS 1 and 2 PUBLISH messages waiting for room in the inflight window.
+	// pmu also serializes the sending of messages when there's an inflight window.
+	pmu     sync.Mutex
+	pending []pendingPublish
+
+	// The last packet ID used for the messages delivered to the client. Server side
+	// only.
+	pktid uint32
+}
+
+// pendingPublish is either a message published by this service, or a shared message
+// delivered to the client.
+type pendingPublish struct {
+	msg        *message.PublishMessage
+	onComplete OnCompleteFunc
+	shared     *sharedPublish
+}
+
+type heldAck struct {
+	refs int
+	ack  message.Message
 }
 
 func (this *service) start() error {
 	var err error
 
+	if this.minBufferSize == 0 {
+		this.minBufferSize = DefaultMinBufferSize
+	}
+
+	if this.maxBufferSize == 0 {
+		this.maxBufferSize = DefaultMaxBufferSize
+	}
+
 	// Create the incoming ring buffer
-	this.in, err = newBuffer(defaultBufferSize)
+	this.in, err = newAdaptiveBuffer(int64(this.minBufferSize), int64(this.maxBufferSize))
 	if err != nil {
 		return err
 	}
 
 	// Create the outgoing ring buffer
-	this.out, err = newBuffer(defaultBufferSize)
+	this.out, err = newAdaptiveBuffer(int64(this.minBufferSize), int64(this.maxBufferSize))
 	if err != nil {
 		return err
 	}
 
+	// All the writes to the outgoing buffer are done under wmu
+	this.out.plock = &this.wmu
+
 	// If this is a server
 	if !this.client {
-		// Creat the onPublishFunc so it can be used for published messages
-		this.onpub = func(msg *message.PublishMessage) error {
-			if err := this.publish(msg, nil); err != nil {
-				glog.Errorf("service/onPublish: Error publishing message: %v", err)
-				return err
-			}
-
-			return nil
-		}
-
-		// If this is a recovered session, then add any topics it subscribed before
+		// If this is a recovered session, then add any topics it subscribed before.
+		// The service itself is the subscriber, see enqueue().
 		topics, qoss, err := this.sess.Topics()
 		if err != nil {
 			return err
 		} else {
 			for i, t := range topics {
-				this.topicsMgr.Subscribe([]byte(t), qoss[i], &this.onpub)
+				this.topicsMgr.Subscribe([]byte(t), qoss[i], this)
 			}
 		}
 	}
 
+	// In the event loop mode, the loop reads from and writes to the connection, and
+	// the processor and deliverer are only started when there's something to do.
+	if this.loop != nil {
+		return this.loop.add(this)
+	}
+
 	// Processor is responsible for reading messages out of the buffer and processing
 	// them accordingly.
 	this.wgStarted.Add(1)
@@ -178,6 +284,13 @@ func (this *service) start() error {
 	this.wgStopped.Add(1)
 	go this.sender()
 
+	// Deliverer is responsible for sending the messages queued for this client.
+	if this.queue != nil {
+		this.wgStarted.Add(1)
+		this.wgStopped.Add(1)
+		go this.deliverer()
+	}
+
 	// Wait for all the goroutines to start before returning
 	this.wgStarted.Wait()
 
@@ -205,20 +318,64 @@ func (this *service) stop() {
 		close(this.done)
 	}
 
+	// Wake up the goroutines paused by the rate limiter
+	if this.rate != nil {
+		this.rate.close()
+	}
+
+	// Drop the messages still queued, and wake up the deliverer
+	if this.queue != nil {
+		this.queue.close()
+	}
+
+	// No more goroutines are started on demand from now on
+	this.kmu.Lock()
+	this.stopping = true
+	this.kmu.Unlock()
+
+	// The connection must be off the event loop before it's closed
+	if this.loop != nil {
+		this.loop.remove(this)
+	}
+
 	// Close the network connection
 	if this.conn != nil {
 		glog.Debugf("(%s) closing this.conn", this.cid())
 		this.conn.Close()
 	}
 
-	this.in.Close()
-	this.out.Close()
+	// The buffers are not there if start() failed to create them
+	if this.in != nil {
+		this.in.Close()
+	}
+
+	if this.out != nil {
+		this.out.Close()
+	}
 
 	// Wait for all the goroutines to stop.
 	this.wgStopped.Wait()
 
-	glog.Debugf("(%s) Received %d bytes in %d messages.", this.cid(), this.inStat.bytes, this.inStat.msgs)
-	glog.Debugf("(%s) Sent %d bytes in %d messages.", this.cid(), this.outStat.bytes, this.outStat.msgs)
+	// Give the buffers back to the pool. A late writer may still hold the outgoing
+	// buffer, see writeMessage().
+	if this.in != nil {
+		this.in.free()
+	}
+
+	if this.out != nil {
+		this.wmu.Lock()
+		this.out.free()
+		this.wmu.Unlock()
+	}
+
+	// The connection goroutines may still be counting, e.g. when the server closed
+	// the connection under a client
+	glog.Debugf("(%s) Received %d bytes in %d messages.", this.cid(), atomic.LoadInt64(&this.inStat.bytes), atomic.LoadInt64(&this.inStat.msgs))
+	glog.Debugf("(%s) Sent %d bytes in %d messages.", this.cid(), atomic.LoadInt64(&this.outStat.bytes), atomic.LoadInt64(&this.outStat.msgs))
+
+	if this.rate != nil {
+		glog.Debugf("(%s) Throttled %d messages.", this.cid(), atomic.LoadInt64(&this.rate.throttled))
+	}
 
 	// Unsubscribe from all the topics for this client, only for the server side though
 	if !this.client && this.sess != nil {
@@ -227,7 +384,7 @@ func (this *service) stop() {
 			glog.Errorf("(%s/%d): %v", this.cid(), this.id, err)
 		} else {
 			for _, t := range topics {
-				if err := this.topicsMgr.Unsubscribe([]byte(t), &this.onpub); err != nil {
+				if err := this.topicsMgr.Unsubscribe([]byte(t), this); err != nil {
 					glog.Errorf("(%s): Error unsubscribing topic %q: %v", this.cid(), t, err)
 				}
 			}
@@ -235,19 +392,36 @@ func (this *service) stop() {
 	}
 
 	// Publish will message if WillFlag is set. Server side only.
-	if !this.client && this.sess.Cmsg.WillFlag() {
+	if !this.client && this.sess.Cmsg.WillFlag() && atomic.LoadInt64(&this.nowill) == 0 {
 		glog.Infof("(%s) service/stop: connection unexpectedly closed. Sending Will.", this.cid())
 		this.onPublish(this.sess.Will)
 	}
 
-	// Remove the client topics manager
-	if this.client {
-		topics.Unregister(this.cid())
+	if len(this.hooks) > 0 {
+		this.cmu.Lock()
+		cause := this.cause
+		this.cmu.Unlock()
+
+		this.hooks.onDisconnect(this.info, cause)
 	}
 
-	// Remove the session from session store if it's suppose to be clean session
+	// Remove the session from session store if it's suppose to be clean session.
+	// Otherwise save it, so the client can reconnect to any of the servers sharing
+	// the SessionsProvider.
 	if this.sess.Cmsg.CleanSession() && this.sessMgr != nil {
-		this.sessMgr.Del(this.cid())
+		this.sessMgr.Del(this.sessId)
+	} else if !this.client && this.sessMgr != nil {
+		if err := this.sessMgr.Save(this.sessId); err != nil {
+			glog.Errorf("(%s) Error saving session: %v", this.cid(), err)
+		}
+	}
+
+	if this.server != nil {
+		this.server.removeService(this)
+	}
+
+	if this.release != nil {
+		this.release()
 	}
 
 	this.conn = nil
@@ -255,13 +429,213 @@ func (this *service) stop() {
 	this.out = nil
 }
 
+// setCause() records why the connection is being closed, unless it's already known.
+// A nil error means the client sent a DISCONNECT message.
+func (this *service) setCause(err error) {
+	this.cmu.Lock()
+	defer this.cmu.Unlock()
+
+	if !this.caused {
+		this.cause = err
+		this.caused = true
+	}
+}
+
+// publish() sends a PUBLISH message, unless the inflight window is full, in which
+// case QoS 1 and 2 messages are queued and sent as acks come back.
 func (this *service) publish(msg *message.PublishMessage, onComplete OnCompleteFunc) error {
+	if this.maxInflightOut <= 0 || msg.QoS() == message.QosAtMostOnce {
+		return this.sendPublish(msg, onComplete)
+	}
+
+	this.pmu.Lock()
+	defer this.pmu.Unlock()
+
+	if len(this.pending) > 0 || this.outflight() >= this.maxInflightOut {
+		// The message may be pointing into a buffer that's reused once we return,
+		// so a copy is queued.
+		cp, err := copyPublishMessage(msg)
+		if err != nil {
+			return err
+		}
+
+		this.pending = append(this.pending, pendingPublish{msg: cp, onComplete: onComplete})
+		return nil
+	}
+
+	return this.sendPublish(msg, onComplete)
+}
+
+// sendPending() sends the queued PUBLISH messages that fit in the inflight window.
+// It's called after acks for sent messages are processed.
+func (this *service) sendPending() {
+	if this.maxInflightOut <= 0 {
+		return
+	}
+
+	this.pmu.Lock()
+	defer this.pmu.Unlock()
+
+	for len(this.pending) > 0 && this.outflight() < this.maxInflightOut {
+		p := this.pending[0]
+		this.pending[0] = pendingPublish{}
+		this.pending = this.pending[1:]
+
+		if p.shared != nil && p.shared.expired(time.Now().UnixNano()) {
+			p.shared.release()
+			if this.server != nil {
+				atomic.AddInt64(&this.server.metrics.expired, 1)
+			}
+			continue
+		}
+
+		var err error
+		if p.shared != nil {
+			err = this.sendShared(p.shared)
+		} else {
+			err = this.sendPublish(p.msg, p.onComplete)
+		}
+
+		if err != nil {
+			glog.Errorf("(%s) Error sending queued message: %v", this.cid(), err)
+		}
+	}
+}
+
+// enqueue() is called for every message published to a topic this client subscribed
+// to. For the server, it means the message should be sent to the client on the other
+// end of this connection. The message is queued for the deliverer, so the publisher
+// never waits for this client.
+func (this *service) enqueue(msg *sharedPublish) error {
+	if this.queue == nil {
+		msg.retain()
+		return this.deliver(msg)
+	}
+
+	if err := this.queue.push(msg); err != nil {
+		glog.Errorf("(%s) Disconnecting: %v", this.cid(), err)
+		this.setCause(err)
+		go this.stop()
+		return err
+	}
+
+	if this.loop != nil {
+		this.kickDeliverer()
+	}
+
+	return nil
+}
+
+// deliver() sends a shared message to the client, unless the inflight window is full,
+// in which case QoS 1 and 2 messages are queued like in publish(). The reference to
+// the message held by the caller is handed over.
+func (this *service) deliver(msg *sharedPublish) error {
+	if this.maxInflightOut <= 0 || msg.qos == message.QosAtMostOnce {
+		return this.sendShared(msg)
+	}
+
+	this.pmu.Lock()
+	defer this.pmu.Unlock()
+
+	if len(this.pending) > 0 || this.outflight() >= this.maxInflightOut {
+		this.pending = append(this.pending, pendingPublish{shared: msg})
+		return nil
+	}
+
+	return this.sendShared(msg)
+}
+
+// sendShared() writes a shared message out with a new packet ID. For QoS 1 and 2,
+// a copy with that packet ID waits in the ack queue until the ack comes back.
+func (this *service) sendShared(msg *sharedPublish) error {
+	var (
+		pktid uint16
+		err   error
+	)
+
+	if msg.qos != message.QosAtMostOnce {
+		if pktid, err = this.nextPacketId(); err != nil {
+			msg.release()
+			return fmt.Errorf("(%s) Error sending PUBLISH message: %v", this.cid(), err)
+		}
+	}
+
+	if _, err := this.writeShared(msg, pktid); err != nil {
+		msg.release()
+		return fmt.Errorf("(%s) Error sending PUBLISH message: %v", this.cid(), err)
+	}
+
+	if len(this.hooks) > 0 {
+		this.onDeliver(msg, pktid)
+	}
+
+	if msg.qos == message.QosAtMostOnce {
+		msg.release()
+		return nil
+	}
+
+	// The ack queue keeps its own copy of the message as it was sent, with pktid,
+	// so the shared message can go back to the pool right away.
+	buf := make([]byte, len(msg.buf))
+	msg.copyTo(buf, pktid)
+	msg.release()
+
+	if msg.qos == message.QosAtLeastOnce {
+		return this.sess.Pub1ack.WaitBuffer(pktid, buf, nil)
+	}
+
+	return this.sess.Pub2out.WaitBuffer(pktid, buf, nil)
+}
+
+// onDeliver() calls the OnDeliver hooks for a shared message sent with pktid.
+func (this *service) onDeliver(msg *sharedPublish, pktid uint16) {
+	pm := message.NewPublishMessage()
+	if _, err := pm.Decode(msg.buf); err != nil {
+		glog.Errorf("(%s) Unable to decode delivered message: %v", this.cid(), err)
+		return
+	}
+
+	pm.SetPacketId(pktid)
+	pm.SetRetain(false)
+	pm.SetDup(false)
+
+	this.hooks.onDeliver(this.info, pm)
+}
+
+// nextPacketId() returns the packet ID for the next message delivered to the client.
+// The IDs of the messages still waiting for acks are skipped, since the client would
+// take a new message with one of them for a duplicate. It returns ErrNoPacketId if
+// all of them are in use.
+func (this *service) nextPacketId() (uint16, error) {
+	for i := 0; i < 1<<16; i++ {
+		id := uint16(atomic.AddUint32(&this.pktid, 1))
+		if id == 0 || this.sess.Pub1ack.Has(id) || this.sess.Pub2out.Has(id) {
+			continue
+		}
+
+		return id, nil
+	}
+
+	return 0, ErrNoPacketId
+}
+
+// outflight() returns the number of QoS 1 and 2 messages sent that are waiting for
+// acks.
+func (this *service) outflight() int {
+	return this.sess.Pub1ack.Len() + this.sess.Pub2out.Len()
+}
+
+func (this *service) sendPublish(msg *message.PublishMessage, onComplete OnCompleteFunc) error {
 	//glog.Debugf("service/publish: Publishing %s", msg)
 	_, err := this.writeMessage(msg)
 	if err != nil {
 		return fmt.Errorf("(%s) Error sending %s message: %v", this.cid(), msg.Name(), err)
 	}
 
+	if len(this.hooks) > 0 {
+		this.hooks.onDeliver(this.info, msg)
+	}
+
 	switch msg.QoS() {
 	case message.QosAtMostOnce:
 		if onComplete != nil {
@@ -343,8 +717,10 @@ func (this *service) subscribe(msg *message.SubscribeMessage, onComplete OnCompl
 				err2 = fmt.Errorf("Failed to subscribe to '%s'\n%v", string(t), err2)
 			} else {
 				this.sess.AddTopic(string(t), c)
-				_, err := this.topicsMgr.Subscribe(t, c, &onPublish)
-				if err != nil {
+				// The server sends the messages to the topics of the filter, without the
+				// history prefix.
+				f, _ := trimHistory(t)
+				if err := this.router.add(f, c, &onPublish); err != nil {
 					err2 = fmt.Errorf("Failed to subscribe to '%s' (%v)\n%v", string(t), err, err2)
 				}
 			}
@@ -402,9 +778,10 @@ func (this *service) unsubscribe(msg *message.UnsubscribeMessage, onComplete OnC
 		var err2 error = nil
 
 		for _, tb := range unsub.Topics() {
-			// Remove all subscribers, which basically it's just this client, since
-			// each client has it's own topic tree.
-			err := this.topicsMgr.Unsubscribe(tb, nil)
+			// Remove all the handlers for the topic filter. Each client has its own
+			// router so this doesn't affect anyone else.
+			tb, _ = trimHistory(tb)
+			err := this.router.remove(tb)
 			if err != nil {
 				err2 = fmt.Errorf("%v\n%v", err2, err)
 			}
@@ -433,6 +810,18 @@ func (this *service) ping(onComplete OnCompleteFunc) error {
 	return this.sess.Pingack.Wait(msg, onComplete)
 }
 
+// inflight() returns the number of QoS 1 and 2 messages that are waiting for acks,
+// plus the number of messages still queued for delivery.
+func (this *service) inflight() int {
+	n := this.sess.Pub1ack.Len() + this.sess.Pub2in.Len() + this.sess.Pub2out.Len()
+
+	if this.queue != nil {
+		n += this.queue.len()
+	}
+
+	return n
+}
+
 func (this *service) isDone() bool {
 	select {
 	case <-this.done:
@@ -444,6 +833,10 @@ func (this *service) isDone() bool {
 	return false
 }
 
+func (this *service) isClosed() bool {
+	return atomic.LoadInt64(&this.closed) == 1
+}
+
 func (this *service) cid() string {
 	return fmt.Sprintf("%d/%s", this.id, this.sess.ID())
 }
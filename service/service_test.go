@@ -25,6 +25,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/surge/glog"
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
 	"github.com/surgemq/surgemq/topics"
 )
 
@@ -61,15 +62,12 @@ func TestServiceWillDelivery(t *testing.T) {
 
 	c1 := connectToServer(t, uri)
 	require.NotNil(t, c1)
-	defer topics.Unregister(c1.svc.sess.ID())
 
 	c2 := connectToServer(t, uri)
 	require.NotNil(t, c2)
-	defer topics.Unregister(c2.svc.sess.ID())
 
 	c3 := connectToServer(t, uri)
 	require.NotNil(t, c3)
-	defer topics.Unregister(c3.svc.sess.ID())
 
 	sub := message.NewSubscribeMessage()
 	sub.AddTopic([]byte("will"), 1)
@@ -667,3 +665,140 @@ func assertPublishMessage(t *testing.T, msg *message.PublishMessage, qos byte) {
 	require.Equal(t, "abc", string(msg.Payload()))
 	require.Equal(t, qos, msg.QoS())
 }
+
+func TestServiceInflightOut(t *testing.T) {
+	svc := newInflightService(t)
+	svc.maxInflightOut = 2
+
+	for i := uint16(1); i <= 4; i++ {
+		require.NoError(t, svc.publish(newPublishMessage(i, 1), nil))
+	}
+
+	require.Equal(t, 2, svc.outflight())
+	require.Len(t, svc.pending, 2)
+
+	ack := message.NewPubackMessage()
+	ack.SetPacketId(1)
+	require.NoError(t, svc.processIncoming(ack))
+
+	// The first queued message takes the place of the acked one
+	require.Equal(t, 2, svc.outflight())
+	require.Len(t, svc.pending, 1)
+	require.Equal(t, uint16(4), svc.pending[0].msg.PacketId())
+}
+
+func TestServiceInflightIn(t *testing.T) {
+	svc := newInflightService(t)
+	svc.maxInflightIn = 2
+
+	require.NoError(t, svc.processPublish(newPublishMessage(1, 2)))
+	require.NoError(t, svc.processPublish(newPublishMessage(2, 2)))
+
+	// Retransmissions don't count against the window
+	msg := newPublishMessage(2, 2)
+	msg.SetDup(true)
+	require.NoError(t, svc.processPublish(msg))
+
+	require.Equal(t, errDisconnect, svc.processPublish(newPublishMessage(3, 2)))
+}
+
+func TestServiceInflightInDup(t *testing.T) {
+	svc := newInflightService(t)
+	svc.maxInflightIn = 2
+
+	// Setting DUP on new packet IDs doesn't get around the window
+	for i := uint16(1); i <= 2; i++ {
+		msg := newPublishMessage(i, 2)
+		msg.SetDup(true)
+		require.NoError(t, svc.processPublish(msg))
+	}
+
+	msg := newPublishMessage(3, 2)
+	msg.SetDup(true)
+	require.Equal(t, errDisconnect, svc.processPublish(msg))
+	require.Equal(t, ErrInflightExceeded, svc.cause)
+}
+
+func TestServiceSharedPacketIds(t *testing.T) {
+	svc := newInflightService(t)
+
+	// The packet ID 1 is still waiting for an ack when the counter wraps around
+	require.NoError(t, svc.sess.Pub1ack.Wait(newPublishMessage(1, 1), nil))
+	svc.pktid = 0xfffe
+
+	require.NoError(t, svc.sendShared(newSharedMessage(t, 42, 1)))
+	require.NoError(t, svc.sendShared(newSharedMessage(t, 42, 1)))
+
+	for _, pktid := range []uint16{1, 0xffff, 2} {
+		ack := message.NewPubackMessage()
+		ack.SetPacketId(pktid)
+		require.NoError(t, svc.sess.Pub1ack.Ack(ack))
+	}
+
+	// The ack queue has the messages as they were sent
+	acked := svc.sess.Pub1ack.Acked()
+	require.Len(t, acked, 3)
+
+	for i, pktid := range []uint16{0xffff, 2} {
+		msg := message.NewPublishMessage()
+		_, err := msg.Decode(acked[i+1].Msgbuf)
+		require.NoError(t, err)
+		require.Equal(t, pktid, msg.PacketId())
+	}
+}
+
+func TestServiceInvalidTopics(t *testing.T) {
+	svc := newInflightService(t)
+	svc.client = false
+	svc.validator = &topics.Validator{MaxLevels: 2}
+
+	msg := newPublishMessage(1, 0)
+	msg.SetTopic([]byte("a/b/c"))
+	require.Equal(t, errDisconnect, svc.processPublish(msg))
+
+	unsub := message.NewUnsubscribeMessage()
+	unsub.SetPacketId(1)
+	unsub.AddTopic([]byte("a/b/c"))
+	require.Equal(t, errDisconnect, svc.processUnsubscribe(unsub))
+}
+
+func TestServiceIdleBuffers(t *testing.T) {
+	runClientServerTests(t, func(c *Client) {
+		done := make(chan struct{})
+
+		require.NoError(t, c.Subscribe(newSubscribeMessage(1), func(msg, ack message.Message, err error) error {
+			close(done)
+			return nil
+		}, func(msg *message.PublishMessage) error {
+			return nil
+		}))
+
+		select {
+		case <-done:
+		case <-time.After(time.Millisecond * 100):
+			require.FailNow(t, "Timed out waiting for subscribe response")
+		}
+
+		// Nothing is left to read or send, so both buffers should be given back
+		deadline := time.Now().Add(time.Second)
+		for c.svc.in.Cap() != 0 || c.svc.out.Cap() != 0 {
+			if time.Now().After(deadline) {
+				require.FailNow(t, "Buffers of idle connection not released")
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+func newInflightService(t *testing.T) *service {
+	var err error
+
+	svc := &service{client: true, sess: &sessions.Session{}}
+	require.NoError(t, svc.sess.Init(newConnectMessage()))
+
+	svc.out, err = newBuffer(16384)
+	require.NoError(t, err)
+
+	return svc
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/surgemq/message"
+)
+
+const (
+	DefaultChanSize = 256
+)
+
+// OverflowPolicy determines what a channel subscription does with a newly received
+// message when its channel is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until the consumer makes room in the channel. Note that this
+	// stalls the processing of every other message on the same connection.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest discards the oldest message in the channel to make room for
+	// the new one.
+	OverflowDropOldest
+
+	// OverflowDropNewest discards the new message and keeps the channel as is.
+	OverflowDropNewest
+)
+
+// ChanOptions configures a channel subscription created by Client.SubscribeChan.
+type ChanOptions struct {
+	// The capacity of the delivery channel. If not set then default to 256.
+	Size int
+
+	// What to do when the delivery channel is full. If not set then default to
+	// OverflowBlock.
+	Overflow OverflowPolicy
+
+	// If set, the PUBACK (QoS 1) or PUBCOMP (QoS 2) for a delivered message is held
+	// back until the consumer calls Subscription.Ack for it. Otherwise the ack is sent
+	// as soon as the message is handed off to the channel.
+	ManualAck bool
+}
+
+// Subscription delivers the PUBLISH messages received for a set of topics on a
+// buffered channel, instead of calling an OnPublishFunc on the processor goroutine.
+type Subscription struct {
+	// C is the channel on which the messages are delivered. Messages on this channel
+	// are copies and stay valid after they are received.
+	C <-chan *message.PublishMessage
+
+	c chan *message.PublishMessage
+
+	opts ChanOptions
+
+	// The client that this subscription was created on. Messages are delivered on
+	// the service the client is connected on, which changes on every Connect.
+	client *Client
+
+	// onpub is the function added to the topic subscribers list. It pushes messages
+	// into c according to the overflow policy.
+	onpub OnPublishFunc
+
+	// The messages on c whose ack is held by this subscription, with the service
+	// the ack is held on. An ack is only released for the messages in here, as
+	// holdAck() can fail, and the packet ID can be reused once the ack is sent.
+	hmu   sync.Mutex
+	holds map[*message.PublishMessage]*service
+
+	dropped int64
+}
+
+func newSubscription(client *Client, opts ChanOptions) *Subscription {
+	if opts.Size <= 0 {
+		opts.Size = DefaultChanSize
+	}
+
+	this := &Subscription{
+		c:      make(chan *message.PublishMessage, opts.Size),
+		opts:   opts,
+		client: client,
+	}
+
+	this.C = this.c
+	this.onpub = this.deliver
+
+	return this
+}
+
+// Ack acknowledges a message received from C. It's only needed if the subscription
+// was created with ManualAck set, and must be called exactly once for each QoS 1
+// and QoS 2 message received. Otherwise it does nothing.
+func (this *Subscription) Ack(msg *message.PublishMessage) error {
+	if !this.opts.ManualAck || msg.QoS() == message.QosAtMostOnce {
+		return nil
+	}
+
+	return this.release(msg)
+}
+
+// Dropped returns the number of messages discarded because the channel was full.
+func (this *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&this.dropped)
+}
+
+// deliver() is called by the processor goroutine for every message that matches the
+// subscription. The message handed in is only valid for the duration of the call,
+// so a copy is made before it's put on the channel.
+func (this *Subscription) deliver(msg *message.PublishMessage) error {
+	cp, err := copyPublishMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	// deliver() runs on the processor of the service the client is connected on
+	svc := this.client.svc
+
+	if this.opts.ManualAck && cp.QoS() != message.QosAtMostOnce && svc.holdAck(cp.PacketId()) {
+		this.hmu.Lock()
+		if this.holds == nil {
+			this.holds = make(map[*message.PublishMessage]*service)
+		}
+		this.holds[cp] = svc
+		this.hmu.Unlock()
+	}
+
+	switch this.opts.Overflow {
+	case OverflowDropNewest:
+		select {
+		case this.c <- cp:
+			return nil
+
+		default:
+			this.drop(cp)
+			return nil
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case this.c <- cp:
+				return nil
+
+			default:
+			}
+
+			select {
+			case old := <-this.c:
+				this.drop(old)
+
+			default:
+			}
+		}
+	}
+
+	this.c <- cp
+
+	return nil
+}
+
+// drop() discards a message, and releases the ack held for it so the remote end
+// is not left waiting for an ack that will never come.
+func (this *Subscription) drop(msg *message.PublishMessage) {
+	atomic.AddInt64(&this.dropped, 1)
+	this.release(msg)
+}
+
+// release() releases the ack held for msg, if this subscription holds one.
+func (this *Subscription) release(msg *message.PublishMessage) error {
+	this.hmu.Lock()
+	svc, ok := this.holds[msg]
+	delete(this.holds, msg)
+	this.hmu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return svc.releaseAck(msg.PacketId())
+}
+
+func copyPublishMessage(msg *message.PublishMessage) (*message.PublishMessage, error) {
+	buf := make([]byte, msg.Len())
+	if _, err := msg.Encode(buf); err != nil {
+		return nil, err
+	}
+
+	cp := message.NewPublishMessage()
+	if _, err := cp.Decode(buf); err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
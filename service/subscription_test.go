@@ -0,0 +1,195 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestSubscriptionChanSub1Pub1(t *testing.T) {
+	runClientServerTests(t, func(svc *Client) {
+		done := make(chan struct{})
+
+		sub, err := svc.SubscribeChan(newSubscribeMessage(1),
+			func(msg, ack message.Message, err error) error {
+				close(done)
+				return nil
+			},
+			ChanOptions{Size: 16})
+		require.NoError(t, err)
+
+		select {
+		case <-done:
+		case <-time.After(time.Millisecond * 100):
+			require.FailNow(t, "Timed out waiting for subscribe response")
+		}
+
+		for i := uint16(1); i <= 10; i++ {
+			svc.Publish(newPublishMessage(i, 1), nil)
+		}
+
+		for i := 0; i < 10; i++ {
+			select {
+			case msg := <-sub.C:
+				assertPublishMessage(t, msg, 1)
+
+			case <-time.After(time.Millisecond * 100):
+				require.FailNow(t, "Timed out waiting for publish messages")
+			}
+		}
+
+		require.Equal(t, int64(0), sub.Dropped())
+	})
+}
+
+func TestSubscriptionDropNewest(t *testing.T) {
+	sub := newSubscription(&Client{svc: &service{client: true}}, ChanOptions{Size: 2, Overflow: OverflowDropNewest})
+
+	for i := uint16(1); i <= 3; i++ {
+		require.NoError(t, sub.deliver(newPublishMessage(i, 1)))
+	}
+
+	require.Equal(t, int64(1), sub.Dropped())
+	require.Equal(t, uint16(1), (<-sub.C).PacketId())
+	require.Equal(t, uint16(2), (<-sub.C).PacketId())
+}
+
+func TestSubscriptionDropOldest(t *testing.T) {
+	sub := newSubscription(&Client{svc: &service{client: true}}, ChanOptions{Size: 2, Overflow: OverflowDropOldest})
+
+	for i := uint16(1); i <= 3; i++ {
+		require.NoError(t, sub.deliver(newPublishMessage(i, 1)))
+	}
+
+	require.Equal(t, int64(1), sub.Dropped())
+	require.Equal(t, uint16(2), (<-sub.C).PacketId())
+	require.Equal(t, uint16(3), (<-sub.C).PacketId())
+}
+
+func TestSubscriptionManualAck(t *testing.T) {
+	var err error
+
+	svc := &service{client: true}
+	svc.out, err = newBuffer(16384)
+	require.NoError(t, err)
+
+	sub := newSubscription(&Client{svc: svc}, ChanOptions{Size: 2, ManualAck: true})
+
+	ack := message.NewPubackMessage()
+	ack.SetPacketId(1)
+
+	svc.openAck(ack)
+	require.NoError(t, sub.deliver(newPublishMessage(1, 1)))
+	require.NoError(t, svc.releaseAck(1))
+
+	// The ack should be held until the consumer acks the message
+	require.Equal(t, 0, svc.out.Len())
+
+	msg := <-sub.C
+	require.NoError(t, sub.Ack(msg))
+	require.Equal(t, ack.Len(), svc.out.Len())
+}
+
+func TestSubscriptionDropOldestNotHeld(t *testing.T) {
+	var err error
+
+	svc := &service{client: true}
+	svc.out, err = newBuffer(16384)
+	require.NoError(t, err)
+
+	sub := newSubscription(&Client{svc: svc}, ChanOptions{Size: 1, Overflow: OverflowDropOldest, ManualAck: true})
+
+	// No ack is open for the first message, so it doesn't hold one
+	require.NoError(t, sub.deliver(newPublishMessage(1, 1)))
+
+	// The packet ID is reused by a message whose ack is being held elsewhere
+	ack := message.NewPubackMessage()
+	ack.SetPacketId(1)
+	svc.openAck(ack)
+
+	// Dropping the first message must not release the ack held for the new one
+	require.NoError(t, sub.deliver(newPublishMessage(2, 1)))
+	require.Equal(t, int64(1), sub.Dropped())
+	require.Equal(t, 0, svc.out.Len())
+
+	require.NoError(t, svc.releaseAck(1))
+	require.Equal(t, ack.Len(), svc.out.Len())
+}
+
+func TestSubscriptionManualAckReconnect(t *testing.T) {
+	svr, done := startServer(t, &Server{Authenticator: authenticator})
+
+	c := &Client{}
+	cmsg := newConnectMessage()
+	cmsg.SetCleanSession(false)
+
+	require.NoError(t, c.Connect("tcp://127.0.0.1:1883", cmsg))
+
+	subscribed := make(chan struct{})
+
+	sub, err := c.SubscribeChan(newSubscribeMessage(1),
+		func(msg, ack message.Message, err error) error {
+			close(subscribed)
+			return nil
+		},
+		ChanOptions{Size: 16, ManualAck: true})
+	require.NoError(t, err)
+
+	select {
+	case <-subscribed:
+	case <-time.After(time.Millisecond * 100):
+		require.FailNow(t, "Timed out waiting for subscribe response")
+	}
+
+	waitForServices(t, svr, 1)
+	c.Disconnect()
+	waitForServices(t, svr, 0)
+
+	// The server resumes the session, and the messages come in on a new service
+	require.NoError(t, c.Connect("tcp://127.0.0.1:1883", cmsg))
+	require.NoError(t, c.Publish(newPublishMessage(1, 1), nil))
+
+	var msg *message.PublishMessage
+
+	select {
+	case msg = <-sub.C:
+	case <-time.After(time.Millisecond * 100):
+		require.FailNow(t, "Timed out waiting for publish message")
+	}
+
+	// The ack is held on the current service until the consumer acks the message
+	sub.hmu.Lock()
+	require.True(t, sub.holds[msg] == c.svc)
+	sub.hmu.Unlock()
+
+	require.NoError(t, sub.Ack(msg))
+
+	sub.hmu.Lock()
+	require.Empty(t, sub.holds)
+	sub.hmu.Unlock()
+
+	c.svc.hmu.Lock()
+	require.Empty(t, c.svc.held)
+	c.svc.hmu.Unlock()
+
+	c.Disconnect()
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"strings"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+const (
+	// The auth attribute that sets the tenant of a user, with TenantAttribute.
+	AttrTenant = "tenant"
+)
+
+// TenantMode determines how the server finds the tenant of a client. Each tenant
+// has its own namespace, with its own subscriptions, retained messages and client
+// IDs, so clients never see the messages of other tenants.
+type TenantMode int
+
+const (
+	// TenantNone puts all the clients in the same namespace.
+	TenantNone TenantMode = iota
+
+	// TenantUsername takes the tenant from the username, up to the
+	// TenantSeparator, e.g. "acme" for "acme:alice".
+	TenantUsername
+
+	// TenantClientId takes the tenant from the client ID, up to the
+	// TenantSeparator.
+	TenantClientId
+
+	// TenantAttribute takes the tenant from the "tenant" auth attribute of the
+	// user.
+	TenantAttribute
+)
+
+// TenantQuota limits what the clients of a tenant can use all together. A limit of
+// 0 means no limit.
+type TenantQuota struct {
+	// The maximum number of connections. Connections beyond that are refused with a
+	// CONNACK of "server unavailable".
+	MaxConnections int
+
+	// The maximum number of sessions kept for the clients that connect with
+	// CleanSession set to 0. New sessions beyond that are refused like connections.
+	MaxSessions int
+
+	// The maximum number, and total size in bytes, of the retained messages. What
+	// happens to the retained messages beyond the limits depends on the retain
+	// config of the TopicsProvider, see topics.RetainConfig.
+	MaxRetained      int
+	MaxRetainedBytes int64
+}
+
+// tenant keeps the namespace and the usage of a tenant.
+type tenant struct {
+	name      string
+	quota     TenantQuota
+	topicsMgr *topics.Manager
+	history   *topics.History
+
+	// The number of connections, and the keys of the sessions that are not clean.
+	// Protected by the Server's tmu.
+	conns    int
+	sessions map[string]bool
+}
+
+// connectTenant() finds the tenant of the client, whose user has the auth attributes
+// attrs, and takes a connection slot for it. It returns nil with TenantNone. On
+// error, resp has the return code to send to the client.
+func (this *Server) connectTenant(req *message.ConnectMessage, resp *message.ConnackMessage, attrs map[string]string) (*tenant, error) {
+	name, err := this.tenantName(req, attrs)
+	if err != nil {
+		if this.TenantMode == TenantClientId {
+			resp.SetReturnCode(message.ErrIdentifierRejected)
+		} else {
+			resp.SetReturnCode(message.ErrNotAuthorized)
+		}
+		return nil, err
+	}
+
+	if name == "" {
+		return nil, nil
+	}
+
+	t, err := this.acquireTenant(name)
+	if err != nil {
+		resp.SetReturnCode(message.ErrServerUnavailable)
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// tenantName() returns the name of the tenant of the client, or "" with TenantNone.
+// It returns ErrNoTenant if the client has no tenant.
+func (this *Server) tenantName(req *message.ConnectMessage, attrs map[string]string) (string, error) {
+	var name string
+
+	switch this.TenantMode {
+	case TenantNone:
+		return "", nil
+
+	case TenantUsername:
+		name = this.tenantPrefix(string(req.Username()))
+
+	case TenantClientId:
+		name = this.tenantPrefix(string(req.ClientId()))
+
+	case TenantAttribute:
+		name = attrs[AttrTenant]
+	}
+
+	if name == "" {
+		return "", ErrNoTenant
+	}
+
+	return name, nil
+}
+
+// tenantPrefix() returns the part of s before the TenantSeparator, or "" if there's
+// no separator.
+func (this *Server) tenantPrefix(s string) string {
+	if i := strings.Index(s, this.TenantSeparator); i > 0 {
+		return s[:i]
+	}
+
+	return ""
+}
+
+// acquireTenant() takes a connection slot for the tenant, which is created the
+// first time. It returns ErrTenantQuota if the tenant has too many connections.
+func (this *Server) acquireTenant(name string) (*tenant, error) {
+	this.tmu.Lock()
+	defer this.tmu.Unlock()
+
+	t, ok := this.tenants[name]
+	if !ok {
+		quota, ok := this.TenantQuotas[name]
+		if !ok {
+			quota = this.TenantQuota
+		}
+
+		mgr, err := this.topicsMgr.Namespace(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if quota.MaxRetained > 0 || quota.MaxRetainedBytes > 0 {
+			config, _ := mgr.RetainConfig()
+
+			if quota.MaxRetained > 0 {
+				config.MaxRetained = quota.MaxRetained
+			}
+
+			if quota.MaxRetainedBytes > 0 {
+				config.MaxRetainedBytes = quota.MaxRetainedBytes
+			}
+
+			if err := mgr.SetRetainConfig(config); err != nil {
+				return nil, err
+			}
+		}
+
+		var history *topics.History
+		if len(this.History) > 0 {
+			if history, err = topics.NewHistory(this.History); err != nil {
+				return nil, err
+			}
+		}
+
+		t = &tenant{
+			name:      name,
+			quota:     quota,
+			topicsMgr: mgr,
+			history:   history,
+			sessions:  make(map[string]bool),
+		}
+
+		this.tenants[name] = t
+	}
+
+	if t.quota.MaxConnections > 0 && t.conns >= t.quota.MaxConnections {
+		return nil, ErrTenantQuota
+	}
+
+	t.conns++
+
+	return t, nil
+}
+
+// releaseTenant() gives back the connection slot taken by acquireTenant(). t may be
+// nil.
+func (this *Server) releaseTenant(t *tenant) {
+	if t == nil {
+		return
+	}
+
+	this.tmu.Lock()
+	defer this.tmu.Unlock()
+
+	t.conns--
+}
+
+// acquireSession() keeps track of the sessions of the tenant that are not clean. It
+// returns ErrTenantQuota if a new session would go over the quota. A clean session
+// replaces the session with the same key, if any.
+func (this *Server) acquireSession(t *tenant, key string, clean bool) error {
+	this.tmu.Lock()
+	defer this.tmu.Unlock()
+
+	if clean {
+		delete(t.sessions, key)
+		return nil
+	}
+
+	if t.sessions[key] {
+		return nil
+	}
+
+	if t.quota.MaxSessions > 0 && len(t.sessions) >= t.quota.MaxSessions {
+		return ErrTenantQuota
+	}
+
+	t.sessions[key] = true
+
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerTenants(t *testing.T) {
+	svr, done := startServer(t, &Server{
+		Authenticator: authenticator,
+		TenantMode:    TenantClientId,
+		TenantQuota:   TenantQuota{MaxConnections: 1},
+		TenantQuotas: map[string]TenantQuota{
+			"globex": TenantQuota{MaxConnections: 2, MaxSessions: 1},
+		},
+	})
+
+	var errs []error
+
+	acme, err := connectTenantClient("acme:1", true)
+	errs = append(errs, err)
+
+	_, err = connectTenantClient("acme:2", true)
+	errs = append(errs, err)
+
+	globex, err := connectTenantClient("globex:1", false)
+	errs = append(errs, err)
+
+	_, err = connectTenantClient("globex:2", false)
+	errs = append(errs, err)
+
+	_, err = connectTenantClient("nobody", true)
+	errs = append(errs, err)
+
+	// Both tenants subscribe to everything, but only get their own messages
+	var acmeRcvd, globexRcvd int64
+
+	if acme != nil && globex != nil {
+		subscribeAll(acme, &acmeRcvd)
+		subscribeAll(globex, &globexRcvd)
+
+		globex.Publish(newPublishMessage(1, 1), nil)
+
+		for i := 0; i < 100 && atomic.LoadInt64(&globexRcvd) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// Give the message some time to reach the other tenant, if it's going to
+		time.Sleep(50 * time.Millisecond)
+
+		acme.Disconnect()
+		globex.Disconnect()
+	}
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+
+	require.Equal(t, []error{nil, message.ErrServerUnavailable, nil, message.ErrServerUnavailable, message.ErrIdentifierRejected}, errs)
+	require.Equal(t, int64(1), atomic.LoadInt64(&globexRcvd))
+	require.Equal(t, int64(0), atomic.LoadInt64(&acmeRcvd))
+}
+
+func connectTenantClient(cid string, clean bool) (*Client, error) {
+	msg := newConnectMessage()
+	msg.SetClientId([]byte(cid))
+	msg.SetCleanSession(clean)
+
+	c := &Client{}
+	if err := c.Connect("tcp://127.0.0.1:1883", msg); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// subscribeAll() subscribes the client to "#", and waits for the SUBACK.
+func subscribeAll(c *Client, rcvd *int64) {
+	sub := message.NewSubscribeMessage()
+	sub.AddTopic([]byte("#"), 1)
+
+	acked := make(chan struct{})
+
+	c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+		close(acked)
+		return nil
+	}, func(msg *message.PublishMessage) error {
+		atomic.AddInt64(rcvd, 1)
+		return nil
+	})
+
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+	}
+}
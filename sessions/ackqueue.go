@@ -51,6 +51,16 @@ type ackmsg struct {
 	OnComplete interface{}
 }
 
+// ackState is an ackmsg as it's saved with the session, without the OnComplete
+// function.
+type ackState struct {
+	Mtype  message.MessageType
+	State  message.MessageType
+	Pktid  uint16
+	Msgbuf []byte
+	Ackbuf []byte
+}
+
 // Ackqueue is a growing queue implemented based on a ring buffer. As the buffer
 // gets full, it will auto-grow.
 //
@@ -136,6 +146,35 @@ func (this *Ackqueue) Wait(msg message.Message, onComplete interface{}) error {
 	return nil
 }
 
+// WaitBuffer() is like Wait(), but for a PUBLISH message that's already encoded with
+// pktid. The buffer is kept as is rather than copied, so it must not be changed
+// afterwards.
+func (this *Ackqueue) WaitBuffer(pktid uint16, buf []byte, onComplete interface{}) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if _, ok := this.emap[pktid]; ok {
+		return fmt.Errorf("ack/WaitBuffer: duplicate packet ID %d", pktid)
+	}
+
+	if this.full() {
+		this.grow()
+	}
+
+	this.ring[this.tail] = ackmsg{
+		Mtype:      message.PUBLISH,
+		State:      message.RESERVED,
+		Pktid:      pktid,
+		Msgbuf:     buf,
+		OnComplete: onComplete,
+	}
+	this.emap[pktid] = this.tail
+	this.tail = this.increment(this.tail)
+	this.count++
+
+	return nil
+}
+
 // Ack() takes the ack message supplied and updates the status of messages waiting.
 func (this *Ackqueue) Ack(msg message.Message) error {
 	this.mu.Lock()
@@ -201,6 +240,72 @@ FORNOTEMPTY:
 	return this.ackdone
 }
 
+// Len() returns the number of messages that are waiting for acks.
+func (this *Ackqueue) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.len()
+}
+
+// Has() returns true if a message with pktid is waiting for an ack.
+func (this *Ackqueue) Has(pktid uint16) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	_, ok := this.emap[pktid]
+	return ok
+}
+
+// snapshot() returns the messages waiting for acks, oldest first.
+func (this *Ackqueue) snapshot() []ackState {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	states := make([]ackState, 0, this.count)
+
+	for i := int64(0); i < this.count; i++ {
+		am := this.ring[this.index(this.head+i)]
+
+		states = append(states, ackState{
+			Mtype:  am.Mtype,
+			State:  am.State,
+			Pktid:  am.Pktid,
+			Msgbuf: am.Msgbuf,
+			Ackbuf: am.Ackbuf,
+		})
+	}
+
+	return states
+}
+
+// restore() adds the messages of a snapshot to the queue.
+func (this *Ackqueue) restore(states []ackState) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, s := range states {
+		if _, ok := this.emap[s.Pktid]; ok {
+			continue
+		}
+
+		if this.full() {
+			this.grow()
+		}
+
+		this.ring[this.tail] = ackmsg{
+			Mtype:  s.Mtype,
+			State:  s.State,
+			Pktid:  s.Pktid,
+			Msgbuf: s.Msgbuf,
+			Ackbuf: s.Ackbuf,
+		}
+		this.emap[s.Pktid] = this.tail
+		this.tail = this.increment(this.tail)
+		this.count++
+	}
+}
+
 func (this *Ackqueue) insert(pktid uint16, msg message.Message, onComplete interface{}) error {
 	if this.full() {
 		this.grow()
@@ -0,0 +1,230 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var _ SessionsProvider = (*redisProvider)(nil)
+
+const (
+	// DefaultRedisPrefix is the prefix of the Redis keys if none is given to
+	// NewRedisProvider.
+	DefaultRedisPrefix = "surgemq:"
+)
+
+// redisProvider keeps the sessions in Redis, so the clients can reconnect to any of
+// the servers sharing the Redis server. The sessions of the connected clients are
+// kept in memory, and written to Redis by Save, once the client is gone. Each
+// session is a key holding the encoded Session, see Session.MarshalBinary, and a
+// set holds the IDs of all the sessions.
+//
+// Several connections may share a session in memory, e.g. while a client takes over
+// its session from a connection that has yet to close. Each New and Get takes a
+// reference that Save gives back, and the session is only dropped from memory with
+// the last one.
+type redisProvider struct {
+	pool   *redis.Pool
+	prefix string
+
+	// The sessions of the clients connected to this server. The ones read from
+	// Redis are also in stored. refs counts the connections using each session.
+	mu     sync.Mutex
+	st     map[string]*Session
+	stored map[string]bool
+	refs   map[string]int
+}
+
+// NewRedisProvider returns a sessions provider that keeps the sessions in the Redis
+// server of the pool, under keys starting with prefix. The pool is not closed by
+// the provider. If prefix is empty then default to "surgemq:". Register the provider
+// to use it, e.g. sessions.Register("redis", sessions.NewRedisProvider(pool, "")).
+func NewRedisProvider(pool *redis.Pool, prefix string) *redisProvider {
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+
+	return &redisProvider{
+		pool:   pool,
+		prefix: prefix,
+		st:     make(map[string]*Session),
+		stored: make(map[string]bool),
+		refs:   make(map[string]int),
+	}
+}
+
+// New creates a session in memory, replacing the one kept in Redis if any.
+func (this *redisProvider) New(id string) (*Session, error) {
+	c := this.pool.Get()
+	defer c.Close()
+
+	if err := this.del(c, id); err != nil {
+		return nil, err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.st[id] = &Session{id: id}
+	delete(this.stored, id)
+	this.refs[id]++
+	return this.st[id], nil
+}
+
+// Get returns the session from memory if the client is connected to this server,
+// or from Redis otherwise.
+func (this *redisProvider) Get(id string) (*Session, error) {
+	this.mu.Lock()
+	sess, ok := this.st[id]
+	if ok {
+		this.refs[id]++
+	}
+	this.mu.Unlock()
+
+	if ok {
+		return sess, nil
+	}
+
+	c := this.pool.Get()
+	defer c.Close()
+
+	data, err := redis.Bytes(c.Do("GET", this.key(id)))
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("store/Get: No session found for key %s", id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	sess = &Session{id: id}
+	if err := sess.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.refs[id]++
+
+	// Another connection may have read it in the meantime
+	if s, ok := this.st[id]; ok {
+		return s, nil
+	}
+
+	this.st[id] = sess
+	this.stored[id] = true
+	return sess, nil
+}
+
+func (this *redisProvider) Del(id string) {
+	this.mu.Lock()
+	delete(this.st, id)
+	delete(this.stored, id)
+	delete(this.refs, id)
+	this.mu.Unlock()
+
+	c := this.pool.Get()
+	defer c.Close()
+
+	this.del(c, id)
+}
+
+// Save writes the session to Redis and gives back the reference taken by New or Get.
+// The last one forgets the copy in memory, so the session is read again, by
+// whichever server the client reconnects to.
+func (this *redisProvider) Save(id string) error {
+	this.mu.Lock()
+	sess, ok := this.st[id]
+	this.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("store/Save: No session found for key %s", id)
+	}
+
+	// The session is written before it's forgotten, so a Get in the meantime either
+	// finds it in memory or reads the saved one.
+	defer this.release(id)
+
+	data, err := sess.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	c := this.pool.Get()
+	defer c.Close()
+
+	c.Send("MULTI")
+	c.Send("SET", this.key(id), data)
+	c.Send("SADD", this.prefix+"sessions", id)
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// Count returns the number of sessions in Redis, plus the new sessions of the clients
+// connected to this server.
+func (this *redisProvider) Count() int {
+	c := this.pool.Get()
+	defer c.Close()
+
+	n, err := redis.Int(c.Do("SCARD", this.prefix+"sessions"))
+	if err != nil {
+		return 0
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return n + len(this.st) - len(this.stored)
+}
+
+// Close forgets the sessions in memory. The sessions in Redis are kept.
+func (this *redisProvider) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.st = make(map[string]*Session)
+	this.stored = make(map[string]bool)
+	this.refs = make(map[string]int)
+	return nil
+}
+
+// release() gives back a reference to the session, and forgets the session once
+// there are none left.
+func (this *redisProvider) release(id string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.refs[id]--; this.refs[id] <= 0 {
+		delete(this.st, id)
+		delete(this.stored, id)
+		delete(this.refs, id)
+	}
+}
+
+func (this *redisProvider) key(id string) string {
+	return this.prefix + "session:" + id
+}
+
+// del() removes the session from Redis.
+func (this *redisProvider) del(c redis.Conn, id string) error {
+	c.Send("MULTI")
+	c.Send("DEL", this.key(id))
+	c.Send("SREM", this.prefix+"sessions", id)
+	_, err := c.Do("EXEC")
+	return err
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func newRedisPool(t *testing.T) (*redis.Pool, *miniredis.Miniredis) {
+	s := miniredis.RunT(t)
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", s.Addr())
+		},
+	}
+	t.Cleanup(func() { pool.Close() })
+
+	return pool, s
+}
+
+func TestSessionMarshalBinary(t *testing.T) {
+	sess := &Session{}
+	require.NoError(t, sess.Init(newConnectMessage()))
+	require.NoError(t, sess.RetainMessage(newPublishMessage(1, 1)))
+	sess.AddTopic("sensors/#", 1)
+	sess.AddTopic("alarms", 2)
+	sess.SetTopicAlias("$history/sensors/#", "sensors/#")
+
+	data, err := sess.MarshalBinary()
+	require.NoError(t, err)
+
+	sess2 := &Session{}
+	require.NoError(t, sess2.UnmarshalBinary(data))
+	require.Equal(t, sess.cbuf, sess2.cbuf)
+	require.Equal(t, []byte("surgemq"), sess2.Cmsg.ClientId())
+	require.Equal(t, []byte("will"), sess2.Will.Topic())
+	require.Equal(t, []byte("abc"), sess2.Retained.Topic())
+	require.Equal(t, map[string]byte{"sensors/#": 1, "alarms": 2}, sess2.topics)
+	require.Equal(t, "sensors/#", sess2.TopicAlias("$history/sensors/#"))
+	require.Equal(t, 0, sess2.Pub1ack.Len())
+
+	require.Error(t, sess2.UnmarshalBinary(data))
+	require.Error(t, (&Session{}).UnmarshalBinary([]byte("garbage")))
+
+	_, err = (&Session{}).MarshalBinary()
+	require.Error(t, err)
+}
+
+func TestSessionMarshalBinaryInflight(t *testing.T) {
+	sess := &Session{}
+	require.NoError(t, sess.Init(newConnectMessage()))
+
+	// Two QoS 1 messages sent, the second one acked already
+	require.NoError(t, sess.Pub1ack.Wait(newPublishMessage(1, 1), nil))
+	require.NoError(t, sess.Pub1ack.Wait(newPublishMessage(2, 1), nil))
+	require.NoError(t, sess.Pub1ack.Ack(newAckMessage(message.NewPubackMessage(), 2)))
+
+	// A QoS 2 message received, and one sent that got PUBREC
+	require.NoError(t, sess.Pub2in.Wait(newPublishMessage(3, 2), nil))
+	require.NoError(t, sess.Pub2out.Wait(newPublishMessage(4, 2), nil))
+	require.NoError(t, sess.Pub2out.Ack(newAckMessage(message.NewPubrecMessage(), 4)))
+
+	data, err := sess.MarshalBinary()
+	require.NoError(t, err)
+
+	sess2 := &Session{}
+	require.NoError(t, sess2.UnmarshalBinary(data))
+	require.Equal(t, 2, sess2.Pub1ack.Len())
+	require.Equal(t, 1, sess2.Pub2in.Len())
+	require.Equal(t, 1, sess2.Pub2out.Len())
+
+	// The acks received after reconnecting complete the ack cycles
+	require.NoError(t, sess2.Pub1ack.Ack(newAckMessage(message.NewPubackMessage(), 1)))
+	acked := sess2.Pub1ack.Acked()
+	require.Len(t, acked, 2)
+
+	for i, pktid := range []uint16{1, 2} {
+		msg := message.NewPublishMessage()
+		_, err := msg.Decode(acked[i].Msgbuf)
+		require.NoError(t, err)
+		require.Equal(t, pktid, msg.PacketId())
+		require.Equal(t, []byte("abc"), msg.Payload())
+	}
+
+	require.NoError(t, sess2.Pub2in.Ack(newAckMessage(message.NewPubrelMessage(), 3)))
+	acked = sess2.Pub2in.Acked()
+	require.Len(t, acked, 1)
+	require.Equal(t, uint16(3), acked[0].Pktid)
+
+	require.True(t, sess2.Pub2out.Has(4))
+	require.NoError(t, sess2.Pub2out.Ack(newAckMessage(message.NewPubcompMessage(), 4)))
+	require.Len(t, sess2.Pub2out.Acked(), 1)
+}
+
+func newAckMessage(msg interface {
+	message.Message
+	SetPacketId(uint16)
+}, pktid uint16) message.Message {
+	msg.SetPacketId(pktid)
+	return msg
+}
+
+func TestRedisProvider(t *testing.T) {
+	pool, s := newRedisPool(t)
+
+	// Two servers sharing the same Redis
+	p1 := NewRedisProvider(pool, "")
+	p2 := NewRedisProvider(pool, "")
+
+	sess, err := p1.New("c1")
+	require.NoError(t, err)
+	require.NoError(t, sess.Init(newConnectMessage()))
+	sess.AddTopic("sensors/#", 1)
+
+	_, err = p2.Get("c1")
+	require.Error(t, err)
+	require.Equal(t, 1, p1.Count())
+	require.Equal(t, 0, p2.Count())
+
+	// Once saved, the session is read from Redis by the other server
+	require.NoError(t, p1.Save("c1"))
+	require.True(t, s.Exists("surgemq:session:c1"))
+	require.Equal(t, 1, p1.Count())
+	require.Equal(t, 1, p2.Count())
+
+	sess2, err := p2.Get("c1")
+	require.NoError(t, err)
+	require.True(t, sess2.HasTopic("sensors/#"))
+	require.Equal(t, []byte("surgemq"), sess2.Cmsg.ClientId())
+	require.Equal(t, 1, p2.Count())
+
+	// Getting it again returns the one in memory
+	sess3, err := p2.Get("c1")
+	require.NoError(t, err)
+	require.True(t, sess2 == sess3)
+
+	sess2.RemoveTopic("sensors/#")
+	sess2.AddTopic("alarms", 2)
+	require.NoError(t, p2.Save("c1"))
+
+	sess, err = p1.Get("c1")
+	require.NoError(t, err)
+	require.False(t, sess.HasTopic("sensors/#"))
+	require.True(t, sess.HasTopic("alarms"))
+
+	// A new session replaces the one in Redis
+	_, err = p2.New("c1")
+	require.NoError(t, err)
+	require.False(t, s.Exists("surgemq:session:c1"))
+	require.Equal(t, 1, p2.Count())
+
+	p1.Del("c1")
+	p2.Del("c1")
+	require.Equal(t, 0, p1.Count())
+	require.Equal(t, 0, p2.Count())
+
+	require.Error(t, p1.Save("c1"))
+
+	// The prefix keeps the sessions apart
+	p3 := NewRedisProvider(pool, "other:")
+	sess, err = p3.New("c1")
+	require.NoError(t, err)
+	require.NoError(t, sess.Init(newConnectMessage()))
+	require.NoError(t, p3.Save("c1"))
+	require.True(t, s.Exists("other:session:c1"))
+
+	_, err = p1.Get("c1")
+	require.Error(t, err)
+	require.NoError(t, p3.Close())
+}
+
+func TestRedisProviderShared(t *testing.T) {
+	pool, s := newRedisPool(t)
+
+	p := NewRedisProvider(pool, "")
+
+	sess, err := p.New("c1")
+	require.NoError(t, err)
+	require.NoError(t, sess.Init(newConnectMessage()))
+
+	// A second connection takes over the session before the first one is gone
+	sess2, err := p.Get("c1")
+	require.NoError(t, err)
+	require.True(t, sess == sess2)
+
+	// Saving the first connection keeps the session in memory for the second one
+	require.NoError(t, p.Save("c1"))
+	require.True(t, s.Exists("surgemq:session:c1"))
+
+	sess2.AddTopic("sensors/#", 1)
+
+	sess3, err := p.Get("c1")
+	require.NoError(t, err)
+	require.True(t, sess == sess3)
+
+	require.NoError(t, p.Save("c1"))
+	require.NoError(t, p.Save("c1"))
+
+	// Once the last one is saved, the session is read again from Redis
+	sess4, err := p.Get("c1")
+	require.NoError(t, err)
+	require.False(t, sess == sess4)
+	require.True(t, sess4.HasTopic("sensors/#"))
+}
@@ -15,6 +15,8 @@
 package sessions
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"sync"
 
@@ -63,6 +65,10 @@ type Session struct {
 	// topics stores all the topis for this session/client
 	topics map[string]byte
 
+	// aliases maps the topic filters asked for by the client to the ones subscribed
+	// to, when they differ
+	aliases map[string]string
+
 	// Initialized?
 	initted bool
 
@@ -91,6 +97,14 @@ func (this *Session) Init(msg *message.ConnectMessage) error {
 		return err
 	}
 
+	this.setup()
+
+	return nil
+}
+
+// setup() initializes the session from the CONNECT message in Cmsg. Must be called
+// with mu held.
+func (this *Session) setup() {
 	if this.Cmsg.WillFlag() {
 		this.Will = message.NewPublishMessage()
 		this.Will.SetQoS(this.Cmsg.WillQos())
@@ -101,7 +115,7 @@ func (this *Session) Init(msg *message.ConnectMessage) error {
 
 	this.topics = make(map[string]byte, 1)
 
-	this.id = string(msg.ClientId())
+	this.id = string(this.Cmsg.ClientId())
 
 	this.Pub1ack = newAckqueue(defaultQueueSize)
 	this.Pub2in = newAckqueue(defaultQueueSize)
@@ -111,8 +125,6 @@ func (this *Session) Init(msg *message.ConnectMessage) error {
 	this.Pingack = newAckqueue(defaultQueueSize)
 
 	this.initted = true
-
-	return nil
 }
 
 func (this *Session) Update(msg *message.ConnectMessage) error {
@@ -177,6 +189,54 @@ func (this *Session) RemoveTopic(topic string) error {
 	return nil
 }
 
+// HasTopic returns true if the session is subscribed to the topic filter.
+func (this *Session) HasTopic(topic string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	_, ok := this.topics[topic]
+	return ok
+}
+
+// TopicCount returns the number of topic filters the session is subscribed to.
+func (this *Session) TopicCount() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.topics)
+}
+
+// SetTopicAlias records that the client asked for the topic filter alias, which was
+// subscribed to as topic. If both are the same, the alias is removed.
+func (this *Session) SetTopicAlias(alias, topic string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if alias == topic {
+		delete(this.aliases, alias)
+		return
+	}
+
+	if this.aliases == nil {
+		this.aliases = make(map[string]string)
+	}
+
+	this.aliases[alias] = topic
+}
+
+// TopicAlias returns the topic filter subscribed to for the one the client asked
+// for, which is the same unless set with SetTopicAlias.
+func (this *Session) TopicAlias(alias string) string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if topic, ok := this.aliases[alias]; ok {
+		return topic
+	}
+
+	return alias
+}
+
 func (this *Session) Topics() ([]string, []byte, error) {
 	this.mu.Lock()
 	defer this.mu.Unlock()
@@ -198,6 +258,97 @@ func (this *Session) Topics() ([]string, []byte, error) {
 	return topics, qoss, nil
 }
 
+// sessionState is the part of a Session that's encoded by MarshalBinary. The QoS 1
+// and 2 messages in flight are kept, so the acks the client sends after reconnecting
+// complete their ack cycles, and the QoS 2 messages it published are released on
+// PUBREL. The OnComplete functions of the messages are not kept.
+type sessionState struct {
+	Connect  []byte
+	Retained []byte
+	Topics   map[string]byte
+	Aliases  map[string]string
+
+	Pub1ack []ackState
+	Pub2in  []ackState
+	Pub2out []ackState
+}
+
+// MarshalBinary encodes the session, so it can be kept outside of the process, e.g.
+// by the Redis provider.
+func (this *Session) MarshalBinary() ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if !this.initted {
+		return nil, fmt.Errorf("Session not yet initialized")
+	}
+
+	state := sessionState{
+		Connect:  this.cbuf,
+		Retained: this.rbuf,
+		Topics:   this.topics,
+		Aliases:  this.aliases,
+
+		Pub1ack: this.Pub1ack.snapshot(),
+		Pub2in:  this.Pub2in.snapshot(),
+		Pub2out: this.Pub2out.snapshot(),
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&state); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a session encoded by MarshalBinary into this session,
+// which must not be initialized yet.
+func (this *Session) UnmarshalBinary(data []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.initted {
+		return fmt.Errorf("Session already initialized")
+	}
+
+	var state sessionState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return err
+	}
+
+	this.cbuf = state.Connect
+	this.Cmsg = message.NewConnectMessage()
+
+	if _, err := this.Cmsg.Decode(this.cbuf); err != nil {
+		return err
+	}
+
+	if len(state.Retained) > 0 {
+		this.rbuf = state.Retained
+		this.Retained = message.NewPublishMessage()
+
+		if _, err := this.Retained.Decode(this.rbuf); err != nil {
+			return err
+		}
+	}
+
+	this.setup()
+
+	if state.Topics != nil {
+		this.topics = state.Topics
+	}
+	this.aliases = state.Aliases
+
+	this.Pub1ack.restore(state.Pub1ack)
+	this.Pub2in.restore(state.Pub2in)
+	this.Pub2out.restore(state.Pub2out)
+
+	return nil
+}
+
+// ID() returns the client ID. Cmsg is replaced by Update when the client resumes
+// the session, while the previous connection may still be logging with its ID.
 func (this *Session) ID() string {
-	return string(this.Cmsg.ClientId())
+	return this.id
 }
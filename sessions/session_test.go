@@ -42,6 +42,9 @@ func TestSessionInit(t *testing.T) {
 
 	sess.AddTopic("test", 1)
 	require.Equal(t, 1, len(sess.topics))
+	require.Equal(t, 1, sess.TopicCount())
+	require.True(t, sess.HasTopic("test"))
+	require.False(t, sess.HasTopic("test/#"))
 
 	topics, qoss, err := sess.Topics()
 	require.NoError(t, err)
@@ -52,6 +55,7 @@ func TestSessionInit(t *testing.T) {
 
 	sess.RemoveTopic("test")
 	require.Equal(t, 0, len(sess.topics))
+	require.False(t, sess.HasTopic("test"))
 }
 
 func TestSessionPublishAckqueue(t *testing.T) {
@@ -0,0 +1,207 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/surgemq/message"
+)
+
+const (
+	entrySuffix = ".msg"
+	tmpSuffix   = ".tmp"
+
+	// Set in the state byte if the expiry time follows it
+	expireFlag = 0x80
+)
+
+var _ StoreProvider = (*fileProvider)(nil)
+
+// fileProvider keeps each entry in its own file, under a directory per client. An
+// entry file contains the state byte, the expiry time if the entry has one, and the
+// encoded PUBLISH message. Files are written to a temporary name, synced and renamed,
+// so a crash never leaves a partially written entry behind.
+type fileProvider struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileProvider returns a StoreProvider that keeps the entries in files under dir,
+// so they survive process restarts. The directory is created if it doesn't exist.
+func NewFileProvider(dir string) (*fileProvider, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &fileProvider{dir: dir}, nil
+}
+
+func (this *fileProvider) Put(id string, e *Entry) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	cdir := this.clientDir(id)
+	if err := os.MkdirAll(cdir, 0700); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1, 9+len(e.Msgbuf))
+	buf[0] = byte(e.State)
+
+	if e.Expire != 0 {
+		buf[0] |= expireFlag
+		buf = buf[:9]
+		binary.BigEndian.PutUint64(buf[1:], uint64(e.Expire))
+	}
+
+	buf = append(buf, e.Msgbuf...)
+
+	name := this.entryPath(id, e.Seq)
+	tmp := name + tmpSuffix
+
+	if err := writeFileSync(tmp, buf); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+func (this *fileProvider) Del(id string, seq uint64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if err := os.Remove(this.entryPath(id, seq)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrEntryNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (this *fileProvider) All(id string) ([]*Entry, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	cdir := this.clientDir(id)
+
+	fis, err := ioutil.ReadDir(cdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []*Entry
+
+	for _, fi := range fis {
+		name := fi.Name()
+
+		// Leftovers from an interrupted Put() are ignored, the previous version of
+		// the entry, if any, is still in place.
+		if !strings.HasSuffix(name, entrySuffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, entrySuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(cdir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(buf) < 1 {
+			return nil, fmt.Errorf("store/All: Entry file %s is empty", name)
+		}
+
+		e := &Entry{
+			Seq:    seq,
+			State:  message.MessageType(buf[0] &^ expireFlag),
+			Msgbuf: buf[1:],
+		}
+
+		if buf[0]&expireFlag != 0 {
+			if len(buf) < 9 {
+				return nil, fmt.Errorf("store/All: Entry file %s is truncated", name)
+			}
+
+			e.Expire = int64(binary.BigEndian.Uint64(buf[1:]))
+			e.Msgbuf = buf[9:]
+		}
+
+		entries = append(entries, e)
+	}
+
+	sort.Sort(bySeq(entries))
+
+	return entries, nil
+}
+
+func (this *fileProvider) Reset(id string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return os.RemoveAll(this.clientDir(id))
+}
+
+func (this *fileProvider) Close() error {
+	return nil
+}
+
+func (this *fileProvider) clientDir(id string) string {
+	return filepath.Join(this.dir, url.QueryEscape(id))
+}
+
+func (this *fileProvider) entryPath(id string, seq uint64) string {
+	return filepath.Join(this.clientDir(id), fmt.Sprintf("%020d%s", seq, entrySuffix))
+}
+
+// writeFileSync() writes buf to the file name, and syncs it to the disk before
+// returning. Otherwise the rename that follows could reach the disk first, and a
+// crash would leave an empty entry behind.
+func writeFileSync(name string, buf []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+var _ StoreProvider = (*memProvider)(nil)
+
+func init() {
+	Register("mem", NewMemProvider())
+}
+
+type memProvider struct {
+	st map[string]map[uint64]*Entry
+	mu sync.RWMutex
+}
+
+// NewMemProvider returns a StoreProvider that keeps the entries in memory. The entries
+// survive reconnects, but not process restarts.
+func NewMemProvider() *memProvider {
+	return &memProvider{
+		st: make(map[string]map[uint64]*Entry),
+	}
+}
+
+func (this *memProvider) Put(id string, e *Entry) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	m, ok := this.st[id]
+	if !ok {
+		m = make(map[uint64]*Entry)
+		this.st[id] = m
+	}
+
+	m[e.Seq] = &Entry{
+		Seq:    e.Seq,
+		State:  e.State,
+		Msgbuf: append([]byte(nil), e.Msgbuf...),
+		Expire: e.Expire,
+	}
+
+	return nil
+}
+
+func (this *memProvider) Del(id string, seq uint64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	m, ok := this.st[id]
+	if !ok {
+		return ErrEntryNotFound
+	}
+
+	if _, ok := m[seq]; !ok {
+		return ErrEntryNotFound
+	}
+
+	delete(m, seq)
+
+	if len(m) == 0 {
+		delete(this.st, id)
+	}
+
+	return nil
+}
+
+func (this *memProvider) All(id string) ([]*Entry, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	var entries []*Entry
+
+	for _, e := range this.st[id] {
+		entries = append(entries, &Entry{
+			Seq:    e.Seq,
+			State:  e.State,
+			Msgbuf: append([]byte(nil), e.Msgbuf...),
+			Expire: e.Expire,
+		})
+	}
+
+	sort.Sort(bySeq(entries))
+
+	return entries, nil
+}
+
+func (this *memProvider) Reset(id string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.st, id)
+	return nil
+}
+
+func (this *memProvider) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.st = make(map[string]map[uint64]*Entry)
+	return nil
+}
+
+type bySeq []*Entry
+
+func (this bySeq) Len() int           { return len(this) }
+func (this bySeq) Less(i, j int) bool { return this[i].Seq < this[j].Seq }
+func (this bySeq) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
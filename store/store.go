@@ -0,0 +1,121 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package store keeps PUBLISH messages outside of the connection buffers. The client
+// uses it to keep its outgoing QoS 1 and 2 messages until they are acknowledged by
+// the server, so they can be sent, or sent again, after the client reconnects or the
+// process restarts. The server uses it to spill the messages for slow subscribers.
+package store
+
+import (
+	"errors"
+
+	"github.com/surgemq/message"
+)
+
+var (
+	ErrStoreProviderNotFound = errors.New("store: Store provider not found")
+	ErrEntryNotFound         = errors.New("store: No entry found for sequence number")
+
+	providers = make(map[string]StoreProvider)
+)
+
+// Entry is a single outgoing PUBLISH message saved for a client.
+type Entry struct {
+	// Seq is the sequence number of the message. It's assigned by the client and is
+	// increasing, so entries are drained in the order they were published.
+	Seq uint64
+
+	// State is where the message is in the ack cycle:
+	//   - message.RESERVED if the message has not been sent yet
+	//   - message.PUBLISH if the message was sent and is waiting for PUBACK or PUBREC
+	//   - message.PUBREC if PUBREC was received and the message is waiting for PUBCOMP
+	State message.MessageType
+
+	// Msgbuf is the encoded PUBLISH message
+	Msgbuf []byte
+
+	// Expire is when the message expires, in Unix nanoseconds, or 0 if it never
+	// does.
+	Expire int64
+}
+
+// StoreProvider saves the entries for any number of clients, keyed by client ID.
+type StoreProvider interface {
+	// Put adds the entry for client id, or replaces the one with the same Seq.
+	Put(id string, e *Entry) error
+
+	// Del removes the entry with sequence number seq for client id.
+	Del(id string, seq uint64) error
+
+	// All returns all the entries for client id, sorted by Seq.
+	All(id string) ([]*Entry, error)
+
+	// Reset removes all the entries for client id.
+	Reset(id string) error
+
+	Close() error
+}
+
+// Register makes a store provider available by the provided name.
+// If a Register is called twice with the same name or if the provider is nil,
+// it panics.
+func Register(name string, provider StoreProvider) {
+	if provider == nil {
+		panic("store: Register provide is nil")
+	}
+
+	if _, dup := providers[name]; dup {
+		panic("store: Register called twice for provider " + name)
+	}
+
+	providers[name] = provider
+}
+
+func Unregister(name string) {
+	delete(providers, name)
+}
+
+type Manager struct {
+	p StoreProvider
+}
+
+func NewManager(providerName string) (*Manager, error) {
+	p, ok := providers[providerName]
+	if !ok {
+		return nil, ErrStoreProviderNotFound
+	}
+
+	return &Manager{p: p}, nil
+}
+
+func (this *Manager) Put(id string, e *Entry) error {
+	return this.p.Put(id, e)
+}
+
+func (this *Manager) Del(id string, seq uint64) error {
+	return this.p.Del(id, seq)
+}
+
+func (this *Manager) All(id string) ([]*Entry, error) {
+	return this.p.All(id)
+}
+
+func (this *Manager) Reset(id string) error {
+	return this.p.Reset(id)
+}
+
+func (this *Manager) Close() error {
+	return this.p.Close()
+}
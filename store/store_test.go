@@ -0,0 +1,137 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestMemProvider(t *testing.T) {
+	testProvider(t, NewMemProvider())
+}
+
+func TestManagerProviderNotFound(t *testing.T) {
+	_, err := NewManager("unknown")
+	require.Equal(t, ErrStoreProviderNotFound, err)
+}
+
+func TestFileProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewFileProvider(dir)
+	require.NoError(t, err)
+
+	testProvider(t, p)
+}
+
+func TestFileProviderRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewFileProvider(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, p.Put("surgemq/1", newEntry(t, 7, message.PUBREC)))
+
+	// A new provider on the same directory should see the entries of the old one
+	p2, err := NewFileProvider(dir)
+	require.NoError(t, err)
+
+	entries, err := p2.All("surgemq/1")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, uint64(7), entries[0].Seq)
+	require.Equal(t, message.PUBREC, entries[0].State)
+
+	msg := message.NewPublishMessage()
+	_, err = msg.Decode(entries[0].Msgbuf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("abc"), msg.Topic())
+}
+
+func testProvider(t *testing.T, p StoreProvider) {
+	for _, seq := range []uint64{3, 1, 2} {
+		require.NoError(t, p.Put("surgemq", newEntry(t, seq, message.RESERVED)))
+	}
+
+	entries, err := p.All("surgemq")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(entries))
+
+	for i, e := range entries {
+		require.Equal(t, uint64(i+1), e.Seq)
+		require.Equal(t, message.RESERVED, e.State)
+	}
+
+	// Put with an existing sequence number replaces the entry
+	require.NoError(t, p.Put("surgemq", newEntry(t, 2, message.PUBLISH)))
+
+	entries, err = p.All("surgemq")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(entries))
+	require.Equal(t, message.PUBLISH, entries[1].State)
+
+	// The expiry time is kept along with the state
+	e := newEntry(t, 3, message.PUBLISH)
+	e.Expire = 1234567890123456789
+	require.NoError(t, p.Put("surgemq", e))
+
+	entries, err = p.All("surgemq")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), entries[1].Expire)
+	require.Equal(t, e.Expire, entries[2].Expire)
+	require.Equal(t, message.PUBLISH, entries[2].State)
+	require.Equal(t, e.Msgbuf, entries[2].Msgbuf)
+
+	require.NoError(t, p.Del("surgemq", 1))
+	require.Equal(t, ErrEntryNotFound, p.Del("surgemq", 1))
+
+	entries, err = p.All("surgemq")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, uint64(2), entries[0].Seq)
+
+	entries, err = p.All("other")
+	require.NoError(t, err)
+	require.Equal(t, 0, len(entries))
+
+	require.NoError(t, p.Reset("surgemq"))
+
+	entries, err = p.All("surgemq")
+	require.NoError(t, err)
+	require.Equal(t, 0, len(entries))
+}
+
+func newEntry(t *testing.T, seq uint64, state message.MessageType) *Entry {
+	msg := message.NewPublishMessage()
+	msg.SetPacketId(uint16(seq))
+	msg.SetTopic([]byte("abc"))
+	msg.SetPayload([]byte("abc"))
+	msg.SetQoS(1)
+
+	buf := make([]byte, msg.Len())
+	_, err := msg.Encode(buf)
+	require.NoError(t, err)
+
+	return &Entry{Seq: seq, State: state, Msgbuf: buf}
+}
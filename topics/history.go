@@ -0,0 +1,234 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/surgemq/message"
+)
+
+const (
+	// HistoryPrefix is the prefix of the topic filters that ask for the history of
+	// the matching topics, e.g. "$history/sensors/#".
+	HistoryPrefix = "$history/"
+)
+
+// HistoryLimit bounds the messages kept in the history of each topic.
+type HistoryLimit struct {
+	// The number of messages kept. 0 means no limit other than MaxAge.
+	Count int
+
+	// How long the messages are kept. 0 means no limit other than Count.
+	MaxAge time.Duration
+}
+
+// History keeps the last messages published to the topics matching a set of topic
+// filters, so they can be sent to new subscribers before the live messages. Unlike
+// retained messages, there may be several messages for each topic. If a topic
+// matches several filters, the limit of the most specific one applies, see TTLs.
+type History struct {
+	root *snode
+
+	mu     sync.Mutex
+	topics map[string]*historyTopic
+
+	// now returns the current time, replaced by tests
+	now func() time.Time
+}
+
+// historyRule is the limit for the topics matching a filter. It's stored as the
+// subscriber of the filter in a subscription tree.
+type historyRule struct {
+	filter []byte
+	limit  HistoryLimit
+}
+
+// historyTopic holds the messages of a topic, oldest first.
+type historyTopic struct {
+	limit HistoryLimit
+	msgs  []historyEntry
+}
+
+type historyEntry struct {
+	time    time.Time
+	topic   []byte
+	payload []byte
+	qos     byte
+}
+
+// NewHistory returns the History for the topic filters, which are the keys of
+// limits.
+func NewHistory(limits map[string]HistoryLimit) (*History, error) {
+	this := &History{
+		root:   newSNode(),
+		topics: make(map[string]*historyTopic),
+		now:    time.Now,
+	}
+
+	for filter, limit := range limits {
+		if limit.Count < 0 || limit.MaxAge < 0 || (limit.Count == 0 && limit.MaxAge == 0) {
+			return nil, fmt.Errorf("topics: Invalid history limit %+v for topic %q", limit, filter)
+		}
+
+		rule := &historyRule{filter: []byte(filter), limit: limit}
+		if err := this.root.sinsert(rule.filter, message.QosAtMostOnce, rule); err != nil {
+			return nil, err
+		}
+	}
+
+	return this, nil
+}
+
+// TrimHistory removes the HistoryPrefix from the topic filter. It returns false if
+// the filter doesn't have the prefix.
+func TrimHistory(filter []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(filter, []byte(HistoryPrefix)) {
+		return filter, false
+	}
+
+	return filter[len(HistoryPrefix):], true
+}
+
+// Tracks returns true if the history of the topic is kept.
+func (this *History) Tracks(topic []byte) bool {
+	_, ok := this.limit(topic)
+	return ok
+}
+
+// Add adds a copy of the message to the history of its topic, if the history of the
+// topic is kept.
+func (this *History) Add(msg *message.PublishMessage) {
+	limit, ok := this.limit(msg.Topic())
+	if !ok {
+		return
+	}
+
+	e := historyEntry{
+		topic:   append([]byte(nil), msg.Topic()...),
+		payload: append([]byte(nil), msg.Payload()...),
+		qos:     msg.QoS(),
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	e.time = this.now()
+
+	t, ok := this.topics[string(e.topic)]
+	if !ok {
+		t = &historyTopic{limit: limit}
+		this.topics[string(e.topic)] = t
+	}
+
+	t.msgs = append(t.msgs, e)
+	t.trim(e.time)
+}
+
+// Messages appends the history of the topics matching the topic filter to msgs,
+// oldest first. The messages are new copies, which are not retained.
+func (this *History) Messages(filter []byte, msgs *[]*message.PublishMessage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.expire(this.now())
+
+	var entries []historyEntry
+
+	for _, t := range this.topics {
+		if len(t.msgs) > 0 && Match(filter, t.msgs[0].topic) {
+			entries = append(entries, t.msgs...)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].time.Before(entries[j].time)
+	})
+
+	for _, e := range entries {
+		msg := message.NewPublishMessage()
+		if err := msg.SetTopic(e.topic); err != nil {
+			return err
+		}
+		if err := msg.SetQoS(e.qos); err != nil {
+			return err
+		}
+		msg.SetPayload(e.payload)
+
+		*msgs = append(*msgs, msg)
+	}
+
+	return nil
+}
+
+// limit() returns the limit for the topic, and false if the topic doesn't match any
+// of the filters.
+func (this *History) limit(topic []byte) (HistoryLimit, bool) {
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	if err := this.root.smatch(topic, message.QosAtMostOnce, &subs, &qoss); err != nil || len(subs) == 0 {
+		return HistoryLimit{}, false
+	}
+
+	rule := subs[0].(*historyRule)
+	for _, sub := range subs[1:] {
+		if r := sub.(*historyRule); moreSpecific(r.filter, rule.filter) {
+			rule = r
+		}
+	}
+
+	return rule.limit, true
+}
+
+// expire() drops the messages older than the MaxAge of their topics, and the topics
+// left without messages. Must be called with mu held.
+func (this *History) expire(now time.Time) {
+	for k, t := range this.topics {
+		if t.trim(now); len(t.msgs) == 0 {
+			delete(this.topics, k)
+		}
+	}
+}
+
+// trim() drops the messages beyond the limit of the topic.
+func (this *historyTopic) trim(now time.Time) {
+	i := 0
+
+	if this.limit.Count > 0 && len(this.msgs) > this.limit.Count {
+		i = len(this.msgs) - this.limit.Count
+	}
+
+	if this.limit.MaxAge > 0 {
+		for i < len(this.msgs) && now.Sub(this.msgs[i].time) > this.limit.MaxAge {
+			i++
+		}
+	}
+
+	if i > 0 {
+		// Clear the tail so the payloads dropped can be collected
+		n := copy(this.msgs, this.msgs[i:])
+		for j := n; j < len(this.msgs); j++ {
+			this.msgs[j] = historyEntry{}
+		}
+		this.msgs = this.msgs[:n]
+	}
+}
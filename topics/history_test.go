@@ -0,0 +1,103 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestHistory(t *testing.T) {
+	h, err := NewHistory(map[string]HistoryLimit{
+		"sensors/#":         {Count: 3},
+		"sensors/+/alarms":  {MaxAge: time.Minute},
+		"sensors/gateway/+": {Count: 1, MaxAge: time.Minute},
+	})
+	require.NoError(t, err)
+
+	now := time.Unix(1400000000, 0)
+	h.now = func() time.Time { return now }
+
+	publish := func(topic, payload string) {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(topic))
+		msg.SetQoS(message.QosAtLeastOnce)
+		msg.SetRetain(true)
+		msg.SetPayload([]byte(payload))
+		h.Add(msg)
+		now = now.Add(time.Second)
+	}
+
+	history := func(filter string) []string {
+		var msgs []*message.PublishMessage
+		require.NoError(t, h.Messages([]byte(filter), &msgs))
+
+		var res []string
+		for _, msg := range msgs {
+			require.False(t, msg.Retain())
+			res = append(res, string(msg.Topic())+"="+string(msg.Payload()))
+		}
+		return res
+	}
+
+	for i, p := range []string{"1", "2", "3", "4", "5"} {
+		publish("sensors/1/temp", p)
+		publish("sensors/1/alarms", p)
+		if i < 2 {
+			publish("sensors/gateway/temp", p)
+		}
+	}
+	publish("sport/tennis", "1")
+
+	require.True(t, h.Tracks([]byte("sensors/2/temp")))
+	require.False(t, h.Tracks([]byte("sport/tennis")))
+
+	require.Equal(t, []string{"sensors/1/temp=3", "sensors/1/temp=4", "sensors/1/temp=5"}, history("sensors/1/temp"))
+	require.Equal(t, []string{"sensors/gateway/temp=2"}, history("sensors/gateway/#"))
+	require.Equal(t, []string{"sensors/1/alarms=1", "sensors/1/alarms=2", "sensors/1/alarms=3",
+		"sensors/1/alarms=4", "sensors/1/alarms=5"}, history("+/+/alarms"))
+	require.Empty(t, history("sport/#"))
+
+	// The messages are sorted by time across topics
+	require.Equal(t, []string{"sensors/1/alarms=1", "sensors/1/alarms=2", "sensors/gateway/temp=2",
+		"sensors/1/temp=3", "sensors/1/alarms=3", "sensors/1/temp=4", "sensors/1/alarms=4",
+		"sensors/1/temp=5", "sensors/1/alarms=5"}, history("sensors/+/+"))
+
+	// Only the topics limited by count are left after a minute
+	now = now.Add(time.Minute)
+	require.Equal(t, []string{"sensors/1/temp=3", "sensors/1/temp=4", "sensors/1/temp=5"}, history("sensors/#"))
+
+	h.mu.Lock()
+	require.Equal(t, 1, len(h.topics))
+	h.mu.Unlock()
+
+	for _, limit := range []HistoryLimit{{}, {Count: -1}, {MaxAge: -time.Second}} {
+		_, err := NewHistory(map[string]HistoryLimit{"sensors/#": limit})
+		require.Error(t, err)
+	}
+
+	_, err = NewHistory(map[string]HistoryLimit{"sensors/#/temp": {Count: 1}})
+	require.Error(t, err)
+
+	filter, ok := TrimHistory([]byte("$history/sensors/#"))
+	require.True(t, ok)
+	require.Equal(t, []byte("sensors/#"), filter)
+
+	_, ok = TrimHistory([]byte("sensors/#"))
+	require.False(t, ok)
+}
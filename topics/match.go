@@ -0,0 +1,61 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"bytes"
+)
+
+// Match returns true if the topic name matches the topic filter, following the
+// rules of the MQTT 3.1.1 spec. The wildcards of a filter don't match the first
+// level of the topics that start with '$'.
+func Match(filter, topic []byte) bool {
+	if len(topic) > 0 && topic[0] == '$' && len(filter) > 0 && (filter[0] == '+' || filter[0] == '#') {
+		return false
+	}
+
+	for {
+		var flevel []byte
+		if i := bytes.IndexByte(filter, '/'); i >= 0 {
+			flevel, filter = filter[:i], filter[i+1:]
+		} else {
+			flevel, filter = filter, nil
+		}
+
+		// '#' also matches the parent level, e.g. "a/#" matches "a"
+		if len(flevel) == 1 && flevel[0] == '#' {
+			return true
+		}
+
+		if topic == nil {
+			return false
+		}
+
+		var tlevel []byte
+		if i := bytes.IndexByte(topic, '/'); i >= 0 {
+			tlevel, topic = topic[:i], topic[i+1:]
+		} else {
+			tlevel, topic = topic, nil
+		}
+
+		if !(len(flevel) == 1 && flevel[0] == '+') && !bytes.Equal(flevel, tlevel) {
+			return false
+		}
+
+		if filter == nil {
+			return topic == nil
+		}
+	}
+}
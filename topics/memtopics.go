@@ -15,9 +15,11 @@
 package topics
 
 import (
+	"container/list"
 	"fmt"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/surgemq/message"
 )
@@ -25,28 +27,64 @@ import (
 var (
 	// MaxQosAllowed is the maximum QOS supported by this server
 	MaxQosAllowed = message.QosExactlyOnce
+
+	// MaxCachedTopics is the maximum number of topics for which the subscribers are
+	// cached. When the cache is full, it's emptied.
+	MaxCachedTopics = 4096
 )
 
-var _ TopicsProvider = (*memTopics)(nil)
+var (
+	_ TopicsProvider   = (*memTopics)(nil)
+	_ Namespacer       = (*memTopics)(nil)
+	_ RetainConfigurer = (*memTopics)(nil)
+)
 
 type memTopics struct {
-	// Sub/unsub mutex
-	smu sync.RWMutex
-	// Subscription tree
+	// Subscription tree. Each node has its own lock, so subscriptions to different
+	// topics, and publishes, don't wait for each other.
 	sroot *snode
 
+	// Cache of the subscribers matching a published topic and QoS. On every subscribe
+	// and unsubscribe, the topics matching the filter are removed from it. gen is
+	// incremented at the same time, so matches that were in progress are not cached.
+	cmu   sync.RWMutex
+	cache map[cacheKey]*cacheEntry
+	gen   uint64
+
 	// Retained message mutex
 	rmu sync.RWMutex
 	// Retained messages topic tree
 	rroot *rnode
+
+	// Retained messages expiry and limits. rlist has the nodes holding a retained
+	// message, in the order they were retained, and rbytes is the total size of the
+	// messages. rttls has the TTLs set for each topic filter. Closing rquit
+	// stops the sweeper.
+	rconfig RetainConfig
+	rttls   *TTLs
+	rlist   *list.List
+	rbytes  int64
+	rquit   chan struct{}
+
+	// Namespaces, each with its own memTopics
+	nmu sync.Mutex
+	ns  map[string]*memTopics
+}
+
+type cacheKey struct {
+	topic string
+	qos   byte
+}
+
+type cacheEntry struct {
+	subs []interface{}
+	qoss []byte
 }
 
 func init() {
 	Register("mem", NewMemProvider())
 }
 
-var _ TopicsProvider = (*memTopics)(nil)
-
 // NewMemProvider returns an new instance of the memTopics, which is implements the
 // TopicsProvider interface. memProvider is a hidden struct that stores the topic
 // subscriptions and retained messages in memory. The content is not persistend so
@@ -55,6 +93,8 @@ func NewMemProvider() *memTopics {
 	return &memTopics{
 		sroot: newSNode(),
 		rroot: newRNode(),
+		rlist: list.New(),
+		cache: make(map[cacheKey]*cacheEntry),
 	}
 }
 
@@ -67,13 +107,12 @@ func (this *memTopics) Subscribe(topic []byte, qos byte, sub interface{}) (byte,
 		return message.QosFailure, fmt.Errorf("Subscriber cannot be nil")
 	}
 
-	this.smu.Lock()
-	defer this.smu.Unlock()
-
 	if qos > MaxQosAllowed {
 		qos = MaxQosAllowed
 	}
 
+	defer this.invalidate(topic)
+
 	if err := this.sroot.sinsert(topic, qos, sub); err != nil {
 		return message.QosFailure, err
 	}
@@ -82,8 +121,7 @@ func (this *memTopics) Subscribe(topic []byte, qos byte, sub interface{}) (byte,
 }
 
 func (this *memTopics) Unsubscribe(topic []byte, sub interface{}) error {
-	this.smu.Lock()
-	defer this.smu.Unlock()
+	defer this.invalidate(topic)
 
 	return this.sroot.sremove(topic, sub)
 }
@@ -94,13 +132,60 @@ func (this *memTopics) Subscribers(topic []byte, qos byte, subs *[]interface{},
 		return fmt.Errorf("Invalid QoS %d", qos)
 	}
 
-	this.smu.RLock()
-	defer this.smu.RUnlock()
-
 	*subs = (*subs)[0:0]
 	*qoss = (*qoss)[0:0]
 
-	return this.sroot.smatch(topic, qos, subs, qoss)
+	key := cacheKey{topic: string(topic), qos: qos}
+
+	this.cmu.RLock()
+	e, ok := this.cache[key]
+	gen := this.gen
+	this.cmu.RUnlock()
+
+	if ok {
+		*subs = append(*subs, e.subs...)
+		*qoss = append(*qoss, e.qoss...)
+		return nil
+	}
+
+	if err := this.sroot.smatch(topic, qos, subs, qoss); err != nil {
+		return err
+	}
+
+	e = &cacheEntry{
+		subs: append([]interface{}(nil), *subs...),
+		qoss: append([]byte(nil), *qoss...),
+	}
+
+	this.cmu.Lock()
+	defer this.cmu.Unlock()
+
+	// If there was a subscribe or unsubscribe since the match started, the result
+	// may be stale already.
+	if this.gen == gen {
+		if len(this.cache) >= MaxCachedTopics {
+			this.cache = make(map[cacheKey]*cacheEntry)
+		}
+
+		this.cache[key] = e
+	}
+
+	return nil
+}
+
+// invalidate() removes the topics matching filter from the subscribers cache. It's
+// called after the subscriptions to filter change.
+func (this *memTopics) invalidate(filter []byte) {
+	this.cmu.Lock()
+	defer this.cmu.Unlock()
+
+	this.gen++
+
+	for key := range this.cache {
+		if Match(filter, []byte(key.topic)) {
+			delete(this.cache, key)
+		}
+	}
 }
 
 func (this *memTopics) Retain(msg *message.PublishMessage) error {
@@ -111,27 +196,136 @@ func (this *memTopics) Retain(msg *message.PublishMessage) error {
 	// Testing, that a payload of 0 means delete the retain message.
 	// https://eclipse.org/paho/clients/testing/
 	if len(msg.Payload()) == 0 {
-		return this.rroot.rremove(msg.Topic())
+		return this.rremove(msg.Topic())
+	}
+
+	now := time.Now().UnixNano()
+
+	if this.roverLimits(this.rdelta(msg)) {
+		this.rsweep(now)
+
+		if this.rconfig.MaxRetainedBytes > 0 && int64(msg.Len()) > this.rconfig.MaxRetainedBytes {
+			return ErrRetainLimit
+		}
+
+		for this.roverLimits(this.rdelta(msg)) {
+			if this.rconfig.Policy != RetainEvictOldest {
+				return ErrRetainLimit
+			}
+
+			this.rdelete(this.rlist.Front().Value.(*rnode))
+		}
 	}
 
-	return this.rroot.rinsert(msg.Topic(), msg)
+	var size int64
+	if n := this.rroot.rget(msg.Topic()); n != nil && n.msg != nil {
+		size = int64(len(n.buf))
+	}
+
+	if err := this.rroot.rinsert(msg.Topic(), msg); err != nil {
+		return err
+	}
+
+	n := this.rroot.rget(msg.Topic())
+	this.rbytes += int64(len(n.buf)) - size
+
+	if n.elem == nil {
+		n.elem = this.rlist.PushBack(n)
+	} else {
+		this.rlist.MoveToBack(n.elem)
+	}
+
+	n.expire = 0
+	if ttl := this.rttl(msg.Topic()); ttl > 0 {
+		n.expire = now + int64(ttl)
+	}
+
+	return nil
 }
 
 func (this *memTopics) Retained(topic []byte, msgs *[]*message.PublishMessage) error {
 	this.rmu.RLock()
 	defer this.rmu.RUnlock()
 
-	return this.rroot.rmatch(topic, msgs)
+	return this.rroot.rmatch(topic, time.Now().UnixNano(), msgs)
+}
+
+// Namespace returns the memTopics for the namespace. A new namespace starts with the
+// same retain config as this one.
+func (this *memTopics) Namespace(name string) (TopicsProvider, error) {
+	this.nmu.Lock()
+	defer this.nmu.Unlock()
+
+	if n, ok := this.ns[name]; ok {
+		return n, nil
+	}
+
+	n := NewMemProvider()
+
+	if config := this.RetainConfig(); !reflect.DeepEqual(config, RetainConfig{}) {
+		if err := n.SetRetainConfig(config); err != nil {
+			return nil, err
+		}
+	}
+
+	if this.ns == nil {
+		this.ns = make(map[string]*memTopics)
+	}
+	this.ns[name] = n
+
+	return n, nil
 }
 
 func (this *memTopics) Close() error {
+	this.nmu.Lock()
+	for _, n := range this.ns {
+		n.Close()
+	}
+	this.ns = nil
+	this.nmu.Unlock()
+
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	if this.rquit != nil {
+		close(this.rquit)
+		this.rquit = nil
+	}
+
 	this.sroot = nil
 	this.rroot = nil
 	return nil
 }
 
+// rdelta() returns the number of messages, and the number of bytes, the retained
+// messages would grow by if msg was retained. rmu must be held.
+func (this *memTopics) rdelta(msg *message.PublishMessage) (int, int64) {
+	if n := this.rroot.rget(msg.Topic()); n != nil && n.msg != nil {
+		return 0, int64(msg.Len() - len(n.buf))
+	}
+
+	return 1, int64(msg.Len())
+}
+
+// rremove() removes the retained message for the topic, and updates the counts.
+// rmu must be held.
+func (this *memTopics) rremove(topic []byte) error {
+	if n := this.rroot.rget(topic); n != nil && n.msg != nil {
+		this.rlist.Remove(n.elem)
+		this.rbytes -= int64(len(n.buf))
+		n.elem = nil
+	}
+
+	return this.rroot.rremove(topic)
+}
+
 // subscrition nodes
 type snode struct {
+	// Protects the fields below. Writers lock the nodes top down, and hold the lock
+	// of a node until the lock of the next level node is taken, so a node can't be
+	// removed while another writer is on its way down through it.
+	mu sync.RWMutex
+
 	// If this is the end of the topic string, then add subscribers here
 	subs []interface{}
 	qos  []byte
@@ -147,10 +341,19 @@ func newSNode() *snode {
 }
 
 func (this *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
+	this.mu.Lock()
+	return this.sinsertLocked(topic, qos, sub)
+}
+
+// sinsertLocked() is sinsert() with this.mu already locked. It unlocks this.mu before
+// returning.
+func (this *snode) sinsertLocked(topic []byte, qos byte, sub interface{}) error {
 	// If there's no more topic levels, that means we are at the matching snode
 	// to insert the subscriber. So let's see if there's such subscriber,
 	// if so, update it. Otherwise insert it.
 	if len(topic) == 0 {
+		defer this.mu.Unlock()
+
 		// Let's see if the subscriber is already on the list. If yes, update
 		// QoS and then return.
 		for i := range this.subs {
@@ -173,6 +376,7 @@ func (this *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
 	// ntl = next topic level
 	ntl, rem, err := nextTopicLevel(topic)
 	if err != nil {
+		this.mu.Unlock()
 		return err
 	}
 
@@ -185,7 +389,10 @@ func (this *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
 		this.snodes[level] = n
 	}
 
-	return n.sinsert(rem, qos, sub)
+	n.mu.Lock()
+	this.mu.Unlock()
+
+	return n.sinsertLocked(rem, qos, sub)
 }
 
 // This remove implementation ignores the QoS, as long as the subscriber
@@ -194,6 +401,9 @@ func (this *snode) sremove(topic []byte, sub interface{}) error {
 	// If the topic is empty, it means we are at the final matching snode. If so,
 	// let's find the matching subscribers and remove them.
 	if len(topic) == 0 {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+
 		// If subscriber == nil, then it's signal to remove ALL subscribers
 		if sub == nil {
 			this.subs = this.subs[0:0]
@@ -226,7 +436,10 @@ func (this *snode) sremove(topic []byte, sub interface{}) error {
 	level := string(ntl)
 
 	// Find the snode that matches the topic level
+	this.mu.RLock()
 	n, ok := this.snodes[level]
+	this.mu.RUnlock()
+
 	if !ok {
 		return fmt.Errorf("memtopics/remove: No topic found")
 	}
@@ -237,8 +450,14 @@ func (this *snode) sremove(topic []byte, sub interface{}) error {
 	}
 
 	// If there are no more subscribers and snodes to the next level we just visited
-	// let's remove it
-	if len(n.subs) == 0 && len(n.snodes) == 0 {
+	// let's remove it. Both locks are needed, so no insert is on its way through it.
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if len(n.subs) == 0 && len(n.snodes) == 0 && this.snodes[level] == n {
 		delete(this.snodes, level)
 	}
 
@@ -249,11 +468,16 @@ func (this *snode) sremove(topic []byte, sub interface{}) error {
 // with no wildcards (publish topic), it returns a list of subscribers that subscribes
 // to the topic. For each of the level names, it's a match
 // - if there are subscribers to '#', then all the subscribers are added to result set
+//
+// Only the '#', '+' and exact level nodes are looked up, and each node is only locked
+// while it's being read.
 func (this *snode) smatch(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
 	// If the topic is empty, it means we are at the final matching snode. If so,
 	// let's find the subscribers that match the qos and append them to the list.
 	if len(topic) == 0 {
+		this.mu.RLock()
 		this.matchQos(qos, subs, qoss)
+		this.mu.RUnlock()
 		return nil
 	}
 
@@ -263,16 +487,29 @@ func (this *snode) smatch(topic []byte, qos byte, subs *[]interface{}, qoss *[]b
 		return err
 	}
 
-	level := string(ntl)
+	this.mu.RLock()
+	mwc := this.snodes[MWC]
+	swc := this.snodes[SWC]
+	n := this.snodes[string(ntl)]
+	this.mu.RUnlock()
 
-	for k, n := range this.snodes {
-		// If the key is "#", then these subscribers are added to the result set
-		if k == MWC {
-			n.matchQos(qos, subs, qoss)
-		} else if k == SWC || k == level {
-			if err := n.smatch(rem, qos, subs, qoss); err != nil {
-				return err
-			}
+	// If the key is "#", then these subscribers are added to the result set
+	if mwc != nil {
+		mwc.mu.RLock()
+		mwc.matchQos(qos, subs, qoss)
+		mwc.mu.RUnlock()
+	}
+
+	if swc != nil {
+		if err := swc.smatch(rem, qos, subs, qoss); err != nil {
+			return err
+		}
+	}
+
+	// The level itself may be "+" or "#", which is already taken care of above
+	if n != nil && n != swc && n != mwc {
+		if err := n.smatch(rem, qos, subs, qoss); err != nil {
+			return err
 		}
 	}
 
@@ -285,6 +522,11 @@ type rnode struct {
 	msg *message.PublishMessage
 	buf []byte
 
+	// When the retained message expires, in Unix nanoseconds, or 0 if it never
+	// does, and its element in the list of retained messages.
+	expire int64
+	elem   *list.Element
+
 	// Otherwise add the next topic level here
 	rnodes map[string]*rnode
 }
@@ -376,8 +618,9 @@ func (this *rnode) rremove(topic []byte) error {
 		return err
 	}
 
-	// If there are no more rnodes to the next level we just visited let's remove it
-	if len(n.rnodes) == 0 {
+	// If there are no more rnodes to the next level we just visited, and it doesn't
+	// have a retained message itself, let's remove it
+	if len(n.rnodes) == 0 && n.msg == nil {
 		delete(this.rnodes, level)
 	}
 
@@ -387,11 +630,12 @@ func (this *rnode) rremove(topic []byte) error {
 // rmatch() finds the retained messages for the topic and qos provided. It's somewhat
 // of a reverse match compare to match() since the supplied topic can contain
 // wildcards, whereas the retained message topic is a full (no wildcard) topic.
-func (this *rnode) rmatch(topic []byte, msgs *[]*message.PublishMessage) error {
+// Messages that expired at now are skipped.
+func (this *rnode) rmatch(topic []byte, now int64, msgs *[]*message.PublishMessage) error {
 	// If the topic is empty, it means we are at the final matching rnode. If so,
 	// add the retained msg to the list.
 	if len(topic) == 0 {
-		if this.msg != nil {
+		if this.msg != nil && !this.expired(now) {
 			*msgs = append(*msgs, this.msg)
 		}
 		return nil
@@ -407,18 +651,18 @@ func (this *rnode) rmatch(topic []byte, msgs *[]*message.PublishMessage) error {
 
 	if level == MWC {
 		// If '#', add all retained messages starting this node
-		this.allRetained(msgs)
+		this.allRetained(now, msgs)
 	} else if level == SWC {
 		// If '+', check all nodes at this level. Next levels must be matched.
 		for _, n := range this.rnodes {
-			if err := n.rmatch(rem, msgs); err != nil {
+			if err := n.rmatch(rem, now, msgs); err != nil {
 				return err
 			}
 		}
 	} else {
 		// Otherwise, find the matching node, go to the next level
 		if n, ok := this.rnodes[level]; ok {
-			if err := n.rmatch(rem, msgs); err != nil {
+			if err := n.rmatch(rem, now, msgs); err != nil {
 				return err
 			}
 		}
@@ -427,14 +671,38 @@ func (this *rnode) rmatch(topic []byte, msgs *[]*message.PublishMessage) error {
 	return nil
 }
 
-func (this *rnode) allRetained(msgs *[]*message.PublishMessage) {
-	if this.msg != nil {
+func (this *rnode) allRetained(now int64, msgs *[]*message.PublishMessage) {
+	if this.msg != nil && !this.expired(now) {
 		*msgs = append(*msgs, this.msg)
 	}
 
 	for _, n := range this.rnodes {
-		n.allRetained(msgs)
+		n.allRetained(now, msgs)
+	}
+}
+
+// rget() returns the rnode for the topic, or nil if there's none.
+func (this *rnode) rget(topic []byte) *rnode {
+	n := this
+
+	for len(topic) > 0 {
+		ntl, rem, err := nextTopicLevel(topic)
+		if err != nil {
+			return nil
+		}
+
+		if n = n.rnodes[string(ntl)]; n == nil {
+			return nil
+		}
+
+		topic = rem
 	}
+
+	return n
+}
+
+func (this *rnode) expired(now int64) bool {
+	return this.expire != 0 && this.expire <= now
 }
 
 const (
@@ -456,10 +724,8 @@ func nextTopicLevel(topic []byte) ([]byte, []byte, error) {
 				return nil, nil, fmt.Errorf("memtopics/nextTopicLevel: Multi-level wildcard found in topic and it's not at the last level")
 			}
 
-			if i == 0 {
-				return []byte(SWC), topic[i+1:], nil
-			}
-
+			// A leading separator makes the first level empty, which is distinct
+			// from any other level
 			return topic[:i], topic[i+1:], nil
 
 		case '#':
@@ -15,7 +15,10 @@
 package topics
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/surgemq/message"
@@ -43,7 +46,7 @@ func TestNextTopicLevelSuccess(t *testing.T) {
 		[][]byte{[]byte("+")},
 		[][]byte{[]byte("+"), []byte("tennis"), []byte("#")},
 		[][]byte{[]byte("sport"), []byte("+"), []byte("player1")},
-		[][]byte{[]byte("+"), []byte("finance")},
+		[][]byte{[]byte(""), []byte("finance")},
 	}
 
 	for i, topic := range topics {
@@ -186,7 +189,7 @@ func TestSNodeInsert4(t *testing.T) {
 	require.Equal(t, 1, len(n.snodes))
 	require.Equal(t, 0, len(n.subs))
 
-	n2, ok := n.snodes["+"]
+	n2, ok := n.snodes[""]
 
 	require.True(t, ok)
 	require.Equal(t, 1, len(n2.snodes))
@@ -211,7 +214,7 @@ func TestSNodeInsertDup(t *testing.T) {
 	require.Equal(t, 1, len(n.snodes))
 	require.Equal(t, 0, len(n.subs))
 
-	n2, ok := n.snodes["+"]
+	n2, ok := n.snodes[""]
 
 	require.True(t, ok)
 	require.Equal(t, 1, len(n2.snodes))
@@ -470,7 +473,7 @@ func TestRNodeMatch(t *testing.T) {
 
 	// ---
 
-	err = n.rmatch(msg1.Topic(), &msglist)
+	err = n.rmatch(msg1.Topic(), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 1, len(msglist))
@@ -478,7 +481,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch(msg2.Topic(), &msglist)
+	err = n.rmatch(msg2.Topic(), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 1, len(msglist))
@@ -486,7 +489,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch(msg3.Topic(), &msglist)
+	err = n.rmatch(msg3.Topic(), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 1, len(msglist))
@@ -494,7 +497,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch([]byte("sport/tennis/andre/+"), &msglist)
+	err = n.rmatch([]byte("sport/tennis/andre/+"), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 2, len(msglist))
@@ -502,7 +505,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch([]byte("sport/tennis/andre/#"), &msglist)
+	err = n.rmatch([]byte("sport/tennis/andre/#"), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 2, len(msglist))
@@ -510,7 +513,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch([]byte("sport/tennis/+/stats"), &msglist)
+	err = n.rmatch([]byte("sport/tennis/+/stats"), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 2, len(msglist))
@@ -518,7 +521,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch([]byte("sport/tennis/#"), &msglist)
+	err = n.rmatch([]byte("sport/tennis/#"), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 3, len(msglist))
@@ -639,6 +642,345 @@ func TestMemTopicsRetained(t *testing.T) {
 	require.Equal(t, 3, len(msglist))
 }
 
+func TestMemTopicsRetainTTL(t *testing.T) {
+	p := NewMemProvider()
+	defer p.Close()
+
+	err := p.SetRetainConfig(RetainConfig{
+		TTL: time.Hour,
+		TopicTTLs: map[string]time.Duration{
+			"devices/#":             20 * time.Millisecond,
+			"devices/+/config":      0,
+			"devices/gateway/+":     time.Hour,
+			"devices/gateway/state": 20 * time.Millisecond,
+		},
+		SweepInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	for _, topic := range []string{"devices/1/status", "devices/1/config", "devices/gateway/status", "devices/gateway/state", "sport/tennis"} {
+		require.NoError(t, p.Retain(newPublishMessageLarge([]byte(topic), 1)))
+	}
+
+	var msglist []*message.PublishMessage
+
+	require.NoError(t, p.Retained([]byte("#"), &msglist))
+	require.Equal(t, 5, len(msglist))
+
+	time.Sleep(30 * time.Millisecond)
+
+	msglist = msglist[0:0]
+	require.NoError(t, p.Retained([]byte("#"), &msglist))
+	require.Equal(t, 3, len(msglist))
+
+	msglist = msglist[0:0]
+	require.NoError(t, p.Retained([]byte("devices/+/status"), &msglist))
+	require.Equal(t, 1, len(msglist))
+	require.Equal(t, []byte("devices/gateway/status"), msglist[0].Topic())
+
+	// The sweeper removes the expired messages from the tree
+	for i := 0; i < 100; i++ {
+		p.rmu.RLock()
+		l := p.rlist.Len()
+		p.rmu.RUnlock()
+
+		if l == 3 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p.rmu.RLock()
+	require.Equal(t, 3, p.rlist.Len())
+	require.Nil(t, p.rroot.rget([]byte("devices/1/status")))
+	var size int
+	for _, topic := range []string{"devices/1/config", "devices/gateway/status", "sport/tennis"} {
+		size += newPublishMessageLarge([]byte(topic), 1).Len()
+	}
+	require.Equal(t, int64(size), p.rbytes)
+	p.rmu.RUnlock()
+
+	require.Error(t, p.SetRetainConfig(RetainConfig{TopicTTLs: map[string]time.Duration{"devices/#/status": time.Second}}))
+}
+
+func TestMemTopicsRetainLimits(t *testing.T) {
+	p := NewMemProvider()
+	defer p.Close()
+
+	size := int64(newPublishMessageLarge([]byte("devices/1"), 1).Len())
+
+	err := p.SetRetainConfig(RetainConfig{MaxRetained: 3, MaxRetainedBytes: 4 * size})
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, p.Retain(newPublishMessageLarge([]byte(fmt.Sprintf("devices/%d", i)), 1)))
+	}
+
+	// Replacing a retained message doesn't count against MaxRetained
+	require.NoError(t, p.Retain(newPublishMessageLarge([]byte("devices/1"), 1)))
+	require.Equal(t, ErrRetainLimit, p.Retain(newPublishMessageLarge([]byte("devices/4"), 1)))
+
+	// Removing a message makes room for another
+	require.NoError(t, p.Retain(newPublishMessageEmpty([]byte("devices/2"))))
+	require.NoError(t, p.Retain(newPublishMessageLarge([]byte("devices/4"), 1)))
+
+	var msglist []*message.PublishMessage
+
+	require.NoError(t, p.Retained([]byte("devices/+"), &msglist))
+	require.Equal(t, 3, len(msglist))
+
+	// With RetainEvictOldest, the messages retained the longest go first. devices/1
+	// was retained again after devices/3.
+	err = p.SetRetainConfig(RetainConfig{MaxRetained: 3, MaxRetainedBytes: 4 * size, Policy: RetainEvictOldest})
+	require.NoError(t, err)
+
+	require.NoError(t, p.Retain(newPublishMessageLarge([]byte("devices/5"), 1)))
+
+	msglist = msglist[0:0]
+	require.NoError(t, p.Retained([]byte("devices/+"), &msglist))
+	require.Equal(t, 3, len(msglist))
+
+	msglist = msglist[0:0]
+	require.NoError(t, p.Retained([]byte("devices/3"), &msglist))
+	require.Equal(t, 0, len(msglist))
+
+	// Lowering the limits evicts the oldest messages right away
+	err = p.SetRetainConfig(RetainConfig{MaxRetainedBytes: size, Policy: RetainEvictOldest})
+	require.NoError(t, err)
+
+	msglist = msglist[0:0]
+	require.NoError(t, p.Retained([]byte("devices/+"), &msglist))
+	require.Equal(t, 1, len(msglist))
+	require.Equal(t, []byte("devices/5"), msglist[0].Topic())
+
+	// A message larger than MaxRetainedBytes is never retained
+	require.Equal(t, ErrRetainLimit, p.Retain(newPublishMessageLarge([]byte("devices/long"), 1)))
+	require.Equal(t, 1, p.rlist.Len())
+	require.Equal(t, size, p.rbytes)
+}
+
+func TestRNodeRemoveParent(t *testing.T) {
+	p := NewMemProvider()
+
+	require.NoError(t, p.Retain(newPublishMessageLarge([]byte("devices/1"), 1)))
+	require.NoError(t, p.Retain(newPublishMessageLarge([]byte("devices/1/status"), 1)))
+	require.NoError(t, p.Retain(newPublishMessageEmpty([]byte("devices/1/status"))))
+
+	var msglist []*message.PublishMessage
+
+	require.NoError(t, p.Retained([]byte("devices/#"), &msglist))
+	require.Equal(t, 1, len(msglist))
+	require.Equal(t, []byte("devices/1"), msglist[0].Topic())
+	require.Equal(t, 1, p.rlist.Len())
+}
+
+func TestMemTopicsNamespace(t *testing.T) {
+	p := NewMemProvider()
+	defer p.Close()
+
+	require.NoError(t, p.SetRetainConfig(RetainConfig{MaxRetained: 1}))
+
+	mgr := &Manager{p: p}
+
+	acme, err := mgr.Namespace("acme")
+	require.NoError(t, err)
+
+	globex, err := mgr.Namespace("globex")
+	require.NoError(t, err)
+
+	again, err := mgr.Namespace("acme")
+	require.NoError(t, err)
+	require.Equal(t, acme.p, again.p)
+
+	_, err = acme.Subscribe([]byte("#"), 1, "sub1")
+	require.NoError(t, err)
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	require.NoError(t, acme.Subscribers([]byte("sport/tennis"), 1, &subs, &qoss))
+	require.Equal(t, 1, len(subs))
+
+	require.NoError(t, globex.Subscribers([]byte("sport/tennis"), 1, &subs, &qoss))
+	require.Equal(t, 0, len(subs))
+
+	require.NoError(t, mgr.Subscribers([]byte("sport/tennis"), 1, &subs, &qoss))
+	require.Equal(t, 0, len(subs))
+
+	// The namespaces start with the retain config of the parent
+	config, ok := globex.RetainConfig()
+	require.True(t, ok)
+	require.Equal(t, 1, config.MaxRetained)
+
+	require.NoError(t, globex.Retain(newPublishMessageLarge([]byte("sport/tennis"), 1)))
+	require.Equal(t, ErrRetainLimit, globex.Retain(newPublishMessageLarge([]byte("sport/golf"), 1)))
+
+	var msglist []*message.PublishMessage
+
+	require.NoError(t, acme.Retained([]byte("#"), &msglist))
+	require.Equal(t, 0, len(msglist))
+
+	require.NoError(t, globex.Retained([]byte("#"), &msglist))
+	require.Equal(t, 1, len(msglist))
+}
+
+func TestMemTopicsCache(t *testing.T) {
+	mgr := NewMemProvider()
+	MaxQosAllowed = message.QosExactlyOnce
+
+	var subs []interface{}
+	var qoss []byte
+
+	_, err := mgr.Subscribe([]byte("sport/tennis/+"), 1, "sub1")
+	require.NoError(t, err)
+
+	err = mgr.Subscribers([]byte("sport/tennis/player1"), 1, &subs, &qoss)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"sub1"}, subs)
+	require.Equal(t, 1, len(mgr.cache))
+
+	// The cached result is returned, and changing it doesn't change the cache
+	subs[0] = "changed"
+	err = mgr.Subscribers([]byte("sport/tennis/player1"), 1, &subs, &qoss)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"sub1"}, subs)
+
+	// Only the topics matching the filter subscribed to are invalidated
+	err = mgr.Subscribers([]byte("news/today"), 1, &subs, &qoss)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(mgr.cache))
+
+	_, err = mgr.Subscribe([]byte("news/yesterday"), 1, "sub3")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(mgr.cache))
+
+	_, err = mgr.Subscribe([]byte("sport/#"), 1, "sub2")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(mgr.cache))
+
+	err = mgr.Subscribers([]byte("sport/tennis/player1"), 1, &subs, &qoss)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(subs))
+
+	err = mgr.Unsubscribe([]byte("sport/tennis/+"), "sub1")
+	require.NoError(t, err)
+
+	err = mgr.Subscribers([]byte("sport/tennis/player1"), 1, &subs, &qoss)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"sub2"}, subs)
+}
+
+func TestMemTopicsConcurrent(t *testing.T) {
+	mgr := NewMemProvider()
+	MaxQosAllowed = message.QosExactlyOnce
+
+	_, err := mgr.Subscribe([]byte("a/b/c"), 1, "fixed")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 200; j++ {
+				topic := []byte(fmt.Sprintf("a/+/%d", j%10))
+				sub := fmt.Sprintf("sub%d", i)
+
+				mgr.Subscribe(topic, 1, sub)
+				mgr.Unsubscribe(topic, sub)
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+
+			var subs []interface{}
+			var qoss []byte
+
+			for j := 0; j < 200; j++ {
+				if err := mgr.Subscribers([]byte("a/b/c"), 1, &subs, &qoss); err != nil || len(subs) == 0 || subs[0] != "fixed" {
+					t.Errorf("Expected fixed subscriber, got %v, %v", subs, err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// All the churned subscriptions are gone, and so are their nodes
+	var subs []interface{}
+	var qoss []byte
+
+	require.NoError(t, mgr.Subscribers([]byte("a/b/1"), 1, &subs, &qoss))
+	require.Equal(t, 0, len(subs))
+	require.Equal(t, 1, len(mgr.sroot.snodes["a"].snodes))
+}
+
+// BenchmarkMemTopicsFan matches a topic that has many subscribers.
+func BenchmarkMemTopicsFan(b *testing.B) {
+	mgr := NewMemProvider()
+
+	for i := 0; i < 1000; i++ {
+		mgr.Subscribe([]byte("fan/topic"), 1, fmt.Sprintf("sub%d", i))
+	}
+
+	topic := []byte("fan/topic")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		subs := make([]interface{}, 0, 1000)
+		qoss := make([]byte, 0, 1000)
+
+		for pb.Next() {
+			mgr.Subscribers(topic, 1, &subs, &qoss)
+		}
+	})
+}
+
+// BenchmarkMemTopicsMesh matches many topics with a few subscribers each, while the
+// subscriptions keep changing.
+func BenchmarkMemTopicsMesh(b *testing.B) {
+	mgr := NewMemProvider()
+
+	const n = 1000
+
+	topics := make([][]byte, n)
+
+	for i := range topics {
+		topics[i] = []byte(fmt.Sprintf("mesh/%d/%d", i/32, i%32))
+		mgr.Subscribe(topics[i], 1, fmt.Sprintf("sub%d", i))
+		mgr.Subscribe([]byte(fmt.Sprintf("mesh/%d/+", i/32)), 1, fmt.Sprintf("wc%d", i/32))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		var subs []interface{}
+		var qoss []byte
+
+		for i := 0; pb.Next(); i++ {
+			topic := topics[i%n]
+
+			if i%100 == 0 {
+				mgr.Subscribe(topic, 1, "churn")
+				mgr.Unsubscribe(topic, "churn")
+			}
+
+			mgr.Subscribers(topic, 1, &subs, &qoss)
+		}
+	})
+}
+
 func newPublishMessageLarge(topic []byte, qos byte) *message.PublishMessage {
 	msg := message.NewPublishMessage()
 	msg.SetTopic(topic)
@@ -647,3 +989,11 @@ func newPublishMessageLarge(topic []byte, qos byte) *message.PublishMessage {
 
 	return msg
 }
+
+func newPublishMessageEmpty(topic []byte) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	msg.SetTopic(topic)
+	msg.SetRetain(true)
+
+	return msg
+}
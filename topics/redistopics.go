@@ -0,0 +1,276 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/surgemq/message"
+)
+
+var (
+	_ TopicsProvider   = (*redisTopics)(nil)
+	_ Namespacer       = (*redisTopics)(nil)
+	_ RetainConfigurer = (*redisTopics)(nil)
+)
+
+const (
+	// DefaultRedisPrefix is the prefix of the Redis keys if none is given to
+	// NewRedisProvider.
+	DefaultRedisPrefix = "surgemq:"
+)
+
+// redisTopics keeps the retained messages in Redis, so they are shared by all the
+// servers using the same Redis server. Each retained message is a key holding the
+// encoded PUBLISH message, and a set holds the topics of all the messages. The
+// subscriptions are the ones of the clients connected to each server, so they are
+// kept in memory like with the "mem" provider.
+type redisTopics struct {
+	// The subscriptions
+	subs *memTopics
+
+	pool   *redis.Pool
+	prefix string
+
+	// Expiry of the retained messages, done by Redis
+	rmu     sync.RWMutex
+	rconfig RetainConfig
+	rttls   *TTLs
+
+	// Namespaces, each with its own keys
+	nmu sync.Mutex
+	ns  map[string]*redisTopics
+}
+
+// NewRedisProvider returns a topics provider that keeps the retained messages in the
+// Redis server of the pool, under keys starting with prefix. The pool is not closed
+// by the provider. If prefix is empty then default to "surgemq:". Register the
+// provider to use it, e.g. topics.Register("redis", topics.NewRedisProvider(pool, "")).
+func NewRedisProvider(pool *redis.Pool, prefix string) *redisTopics {
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+
+	return &redisTopics{
+		subs:   NewMemProvider(),
+		pool:   pool,
+		prefix: prefix,
+	}
+}
+
+func (this *redisTopics) Subscribe(topic []byte, qos byte, sub interface{}) (byte, error) {
+	return this.subs.Subscribe(topic, qos, sub)
+}
+
+func (this *redisTopics) Unsubscribe(topic []byte, sub interface{}) error {
+	return this.subs.Unsubscribe(topic, sub)
+}
+
+func (this *redisTopics) Subscribers(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
+	return this.subs.Subscribers(topic, qos, subs, qoss)
+}
+
+// Retain keeps the message as the retained message of its topic, or removes the
+// retained message if the payload is empty.
+func (this *redisTopics) Retain(msg *message.PublishMessage) error {
+	c := this.pool.Get()
+	defer c.Close()
+
+	topic := string(msg.Topic())
+
+	if len(msg.Payload()) == 0 {
+		c.Send("MULTI")
+		c.Send("DEL", this.key(topic))
+		c.Send("SREM", this.prefix+"retained", topic)
+		_, err := c.Do("EXEC")
+		return err
+	}
+
+	buf := make([]byte, msg.Len())
+	if _, err := msg.Encode(buf); err != nil {
+		return err
+	}
+
+	args := redis.Args{this.key(topic), buf}
+	if ttl := this.rttl(msg.Topic()); ttl > 0 {
+		// PX takes whole milliseconds, of which there must be at least one
+		ms := int64(ttl / time.Millisecond)
+		if ms == 0 {
+			ms = 1
+		}
+		args = args.Add("PX", ms)
+	}
+
+	c.Send("MULTI")
+	c.Send("SET", args...)
+	c.Send("SADD", this.prefix+"retained", topic)
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// Retained appends the retained messages of the topics matching the topic filter to
+// msgs. The topics of the expired messages are removed from the set as they are
+// found.
+func (this *redisTopics) Retained(topic []byte, msgs *[]*message.PublishMessage) error {
+	c := this.pool.Get()
+	defer c.Close()
+
+	var topics []string
+
+	if bytes.IndexAny(topic, _WC) < 0 {
+		topics = []string{string(topic)}
+	} else {
+		all, err := redis.Strings(c.Do("SMEMBERS", this.prefix+"retained"))
+		if err != nil {
+			return err
+		}
+
+		for _, t := range all {
+			if Match(topic, []byte(t)) {
+				topics = append(topics, t)
+			}
+		}
+	}
+
+	if len(topics) == 0 {
+		return nil
+	}
+
+	keys := make(redis.Args, 0, len(topics))
+	for _, t := range topics {
+		keys = keys.Add(this.key(t))
+	}
+
+	bufs, err := redis.ByteSlices(c.Do("MGET", keys...))
+	if err != nil {
+		return err
+	}
+
+	var expired redis.Args
+
+	for i, buf := range bufs {
+		if buf == nil {
+			expired = expired.Add(topics[i])
+			continue
+		}
+
+		msg := message.NewPublishMessage()
+		if _, err := msg.Decode(buf); err != nil {
+			return err
+		}
+
+		*msgs = append(*msgs, msg)
+	}
+
+	if len(expired) > 0 {
+		if _, err := c.Do("SREM", append(redis.Args{this.prefix + "retained"}, expired...)...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Namespace returns the provider for the namespace, whose keys have the namespace
+// added to the prefix.
+func (this *redisTopics) Namespace(name string) (TopicsProvider, error) {
+	this.nmu.Lock()
+	defer this.nmu.Unlock()
+
+	if n, ok := this.ns[name]; ok {
+		return n, nil
+	}
+
+	n := NewRedisProvider(this.pool, this.prefix+"ns:"+name+":")
+
+	if err := n.SetRetainConfig(this.RetainConfig()); err != nil {
+		return nil, err
+	}
+
+	if this.ns == nil {
+		this.ns = make(map[string]*redisTopics)
+	}
+
+	this.ns[name] = n
+	return n, nil
+}
+
+func (this *redisTopics) RetainConfig() RetainConfig {
+	this.rmu.RLock()
+	defer this.rmu.RUnlock()
+
+	return this.rconfig
+}
+
+// SetRetainConfig sets the expiry of the retained messages, which only applies to
+// the messages retained from then on. The limits are not supported, and
+// SweepInterval is ignored, since Redis removes the expired messages.
+func (this *redisTopics) SetRetainConfig(config RetainConfig) error {
+	ttls, err := NewTTLs(config.TopicTTLs)
+	if err != nil {
+		return err
+	}
+
+	if config.TTL < 0 {
+		return fmt.Errorf("topics: Invalid retain config %+v", config)
+	}
+
+	if config.MaxRetained != 0 || config.MaxRetainedBytes != 0 {
+		return ErrRetainLimitsUnsupported
+	}
+
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	this.rconfig = config
+	this.rttls = ttls
+
+	return nil
+}
+
+// Close closes the namespaces and removes the subscriptions. The retained messages
+// are kept in Redis.
+func (this *redisTopics) Close() error {
+	this.nmu.Lock()
+	for _, n := range this.ns {
+		n.Close()
+	}
+	this.ns = nil
+	this.nmu.Unlock()
+
+	return this.subs.Close()
+}
+
+func (this *redisTopics) key(topic string) string {
+	return this.prefix + "retained:" + topic
+}
+
+// rttl() returns the TTL of the retained messages of the topic.
+func (this *redisTopics) rttl(topic []byte) time.Duration {
+	this.rmu.RLock()
+	defer this.rmu.RUnlock()
+
+	if this.rttls != nil {
+		if ttl, ok := this.rttls.TTL(topic); ok {
+			return ttl
+		}
+	}
+
+	return this.rconfig.TTL
+}
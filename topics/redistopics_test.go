@@ -0,0 +1,121 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestRedisTopicsRetained(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", s.Addr())
+		},
+	}
+	defer pool.Close()
+
+	// Two servers sharing the same Redis
+	p1 := NewRedisProvider(pool, "")
+	defer p1.Close()
+	p2 := NewRedisProvider(pool, "")
+	defer p2.Close()
+
+	require.NoError(t, p1.SetRetainConfig(RetainConfig{
+		TopicTTLs: map[string]time.Duration{"sport/+/scores": time.Minute},
+	}))
+
+	for _, topic := range []string{"sport/tennis/ricardo/stats", "sport/tennis/andre/stats", "sport/tennis/andre/bio", "sport/golf/scores"} {
+		require.NoError(t, p1.Retain(newPublishMessageLarge([]byte(topic), 1)))
+	}
+
+	retained := func(p TopicsProvider, filter string) []string {
+		var msgs []*message.PublishMessage
+		require.NoError(t, p.Retained([]byte(filter), &msgs))
+
+		var topics []string
+		for _, msg := range msgs {
+			require.Equal(t, 1024, len(msg.Payload()))
+			topics = append(topics, string(msg.Topic()))
+		}
+		sort.Strings(topics)
+		return topics
+	}
+
+	require.Equal(t, []string{"sport/tennis/ricardo/stats"}, retained(p2, "sport/tennis/ricardo/stats"))
+	require.Equal(t, []string{"sport/tennis/andre/bio", "sport/tennis/andre/stats"}, retained(p2, "sport/tennis/andre/+"))
+	require.Equal(t, []string{"sport/tennis/andre/stats", "sport/tennis/ricardo/stats"}, retained(p2, "sport/+/+/stats"))
+	require.Equal(t, 4, len(retained(p2, "#")))
+	require.Empty(t, retained(p2, "sport/tennis"))
+
+	// An empty payload removes the retained message
+	require.NoError(t, p2.Retain(newPublishMessageEmpty([]byte("sport/tennis/andre/bio"))))
+	require.Equal(t, []string{"sport/tennis/andre/stats"}, retained(p1, "sport/tennis/andre/#"))
+
+	// The expired messages are gone, and so are their topics once looked up
+	s.FastForward(2 * time.Minute)
+	require.Empty(t, retained(p1, "sport/golf/scores"))
+	require.Equal(t, 2, len(retained(p1, "#")))
+
+	members, err := s.SMembers("surgemq:retained")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(members))
+
+	// The namespaces have their own retained messages
+	n, err := p1.Namespace("acme")
+	require.NoError(t, err)
+	require.Empty(t, retained(n, "#"))
+
+	require.NoError(t, n.Retain(newPublishMessageLarge([]byte("sport/golf/scores"), 1)))
+	require.Equal(t, []string{"sport/golf/scores"}, retained(n, "#"))
+	require.Equal(t, 2, len(retained(p1, "#")))
+	require.True(t, s.Exists("surgemq:ns:acme:retained:sport/golf/scores"))
+
+	// The namespace gets the TTLs of the provider
+	s.FastForward(2 * time.Minute)
+	require.Empty(t, retained(n, "#"))
+
+	require.Equal(t, ErrRetainLimitsUnsupported, p1.SetRetainConfig(RetainConfig{MaxRetained: 10}))
+}
+
+func TestRedisTopicsSubscription(t *testing.T) {
+	p := NewRedisProvider(&redis.Pool{}, "")
+	defer p.Close()
+
+	sub := "sub"
+	qos, err := p.Subscribe([]byte("sport/tennis/#"), 1, &sub)
+	require.NoError(t, err)
+	require.Equal(t, byte(1), qos)
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	require.NoError(t, p.Subscribers([]byte("sport/tennis/player1"), 1, &subs, &qoss))
+	require.Equal(t, 1, len(subs))
+
+	require.NoError(t, p.Unsubscribe([]byte("sport/tennis/#"), &sub))
+	require.NoError(t, p.Subscribers([]byte("sport/tennis/player1"), 1, &subs, &qoss))
+	require.Equal(t, 0, len(subs))
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/surge/glog"
+)
+
+// RetainPolicy is what the topics provider does with a new retained message when
+// the retained messages limits are reached.
+type RetainPolicy int
+
+const (
+	// RetainReject doesn't retain the new message, and Retain returns
+	// ErrRetainLimit. The message is still published.
+	RetainReject RetainPolicy = iota
+
+	// RetainEvictOldest removes the retained messages that have been retained the
+	// longest until the new message fits.
+	RetainEvictOldest
+)
+
+const (
+	// DefaultRetainSweepInterval is how often the expired retained messages are
+	// removed if RetainConfig.SweepInterval is not set.
+	DefaultRetainSweepInterval = time.Minute
+)
+
+var (
+	// ErrRetainLimit is returned by Retain when the message doesn't fit within the
+	// retained messages limits.
+	ErrRetainLimit = errors.New("topics: Retained messages limit reached")
+)
+
+// RetainConfig sets the expiry and the limits of the retained messages kept by a
+// topics provider.
+type RetainConfig struct {
+	// TTL is how long a retained message is kept after it's published. If not set
+	// then the retained messages never expire.
+	TTL time.Duration
+
+	// TopicTTLs overrides TTL for the topics that match the topic filters listed,
+	// e.g. "devices/+/status", as described in TTLs. A TTL of 0 means the messages
+	// never expire.
+	TopicTTLs map[string]time.Duration
+
+	// MaxRetained is the maximum number of retained messages. If not set then
+	// there's no limit.
+	MaxRetained int
+
+	// MaxRetainedBytes is the maximum total size, in bytes, of the retained
+	// messages. If not set then there's no limit.
+	MaxRetainedBytes int64
+
+	// Policy is what to do with new retained messages when one of the limits is
+	// reached. Expired messages are always removed first. If not set then default
+	// to RetainReject.
+	Policy RetainPolicy
+
+	// SweepInterval is how often the expired retained messages are removed. Expired
+	// messages are never returned by Retained, even before they are removed. If not
+	// set then default to 1 minute.
+	SweepInterval time.Duration
+}
+
+// RetainConfig returns the expiry and the limits of the retained messages.
+func (this *memTopics) RetainConfig() RetainConfig {
+	this.rmu.RLock()
+	defer this.rmu.RUnlock()
+
+	return this.rconfig
+}
+
+// SetRetainConfig sets the expiry and the limits of the retained messages. The
+// messages already retained keep their expiry time, but are removed if they go
+// over the new limits. The expired messages are swept in the background until
+// Close is called.
+func (this *memTopics) SetRetainConfig(config RetainConfig) error {
+	ttls, err := NewTTLs(config.TopicTTLs)
+	if err != nil {
+		return err
+	}
+
+	if config.TTL < 0 || config.MaxRetained < 0 || config.MaxRetainedBytes < 0 || config.SweepInterval < 0 {
+		return fmt.Errorf("topics: Invalid retain config %+v", config)
+	}
+
+	if config.SweepInterval == 0 {
+		config.SweepInterval = DefaultRetainSweepInterval
+	}
+
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	this.rconfig = config
+	this.rttls = ttls
+
+	now := time.Now().UnixNano()
+	this.rsweep(now)
+
+	for this.roverLimits(0, 0) {
+		this.rdelete(this.rlist.Front().Value.(*rnode))
+	}
+
+	if this.rquit != nil {
+		close(this.rquit)
+		this.rquit = nil
+	}
+
+	if config.TTL > 0 || len(config.TopicTTLs) > 0 {
+		this.rquit = make(chan struct{})
+		go this.sweeper(config.SweepInterval, this.rquit)
+	}
+
+	return nil
+}
+
+// sweeper() removes the expired retained messages every interval until quit is
+// closed.
+func (this *memTopics) sweeper(interval time.Duration, quit chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+
+		case now := <-ticker.C:
+			this.rmu.Lock()
+			// The provider may have been closed, or reconfigured, while waiting
+			if this.rquit != quit {
+				this.rmu.Unlock()
+				return
+			}
+
+			if n := this.rsweep(now.UnixNano()); n > 0 {
+				glog.Debugf("topics/sweeper: Removed %d expired retained messages", n)
+			}
+			this.rmu.Unlock()
+		}
+	}
+}
+
+// rttl() returns the TTL of the retained messages for the topic. rmu must be held.
+func (this *memTopics) rttl(topic []byte) time.Duration {
+	if this.rttls != nil {
+		if ttl, ok := this.rttls.TTL(topic); ok {
+			return ttl
+		}
+	}
+
+	return this.rconfig.TTL
+}
+
+// roverLimits() returns true if the retained messages would go over the limits
+// with count more messages of size bytes. rmu must be held.
+func (this *memTopics) roverLimits(count int, size int64) bool {
+	return (this.rconfig.MaxRetained > 0 && this.rlist.Len()+count > this.rconfig.MaxRetained) ||
+		(this.rconfig.MaxRetainedBytes > 0 && this.rbytes+size > this.rconfig.MaxRetainedBytes)
+}
+
+// rsweep() removes the retained messages that expired at now, and returns how many
+// were removed. rmu must be held.
+func (this *memTopics) rsweep(now int64) int {
+	removed := 0
+
+	for e := this.rlist.Front(); e != nil; {
+		n := e.Value.(*rnode)
+		e = e.Next()
+
+		if n.expired(now) {
+			this.rdelete(n)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// rdelete() removes the retained message of the node from the tree. rmu must be
+// held.
+func (this *memTopics) rdelete(n *rnode) {
+	if err := this.rremove(n.msg.Topic()); err != nil {
+		glog.Errorf("topics/rdelete: Error removing retained message: %v", err)
+	}
+}
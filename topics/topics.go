@@ -54,6 +54,18 @@ var (
 	// It probably hasn't been registered yet.
 	ErrAuthProviderNotFound = errors.New("auth: Authentication provider not found")
 
+	// ErrNamespacesUnsupported is returned by Manager.Namespace if the provider
+	// doesn't implement Namespacer.
+	ErrNamespacesUnsupported = errors.New("topics: Provider doesn't support namespaces")
+
+	// ErrRetainConfigUnsupported is returned by Manager.SetRetainConfig if the
+	// provider doesn't implement RetainConfigurer.
+	ErrRetainConfigUnsupported = errors.New("topics: Provider doesn't support retain config")
+
+	// ErrRetainLimitsUnsupported is returned by SetRetainConfig if the provider can
+	// expire the retained messages but not limit them.
+	ErrRetainLimitsUnsupported = errors.New("topics: Provider doesn't support retained messages limits")
+
 	providers = make(map[string]TopicsProvider)
 )
 
@@ -67,6 +79,22 @@ type TopicsProvider interface {
 	Close() error
 }
 
+// Namespacer is implemented by the topics providers that can keep separate
+// subscriptions and retained messages for each namespace, so the same topic in two
+// namespaces are two different topics.
+type Namespacer interface {
+	// Namespace returns the provider for the namespace, which is created the first
+	// time. It's closed along with this provider.
+	Namespace(name string) (TopicsProvider, error)
+}
+
+// RetainConfigurer is implemented by the topics providers that can expire and limit
+// the retained messages, see RetainConfig.
+type RetainConfigurer interface {
+	RetainConfig() RetainConfig
+	SetRetainConfig(config RetainConfig) error
+}
+
 func Register(name string, provider TopicsProvider) {
 	if provider == nil {
 		panic("topics: Register provide is nil")
@@ -116,6 +144,42 @@ func (this *Manager) Retained(topic []byte, msgs *[]*message.PublishMessage) err
 	return this.p.Retained(topic, msgs)
 }
 
+// Namespace returns the manager for the namespace, if the provider is a Namespacer.
+// Otherwise it returns ErrNamespacesUnsupported.
+func (this *Manager) Namespace(name string) (*Manager, error) {
+	n, ok := this.p.(Namespacer)
+	if !ok {
+		return nil, ErrNamespacesUnsupported
+	}
+
+	p, err := n.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manager{p: p}, nil
+}
+
+// RetainConfig returns the retain config of the provider, and false if the provider
+// is not a RetainConfigurer.
+func (this *Manager) RetainConfig() (RetainConfig, bool) {
+	if c, ok := this.p.(RetainConfigurer); ok {
+		return c.RetainConfig(), true
+	}
+
+	return RetainConfig{}, false
+}
+
+// SetRetainConfig sets the retain config of the provider, if it's a
+// RetainConfigurer. Otherwise it returns ErrRetainConfigUnsupported.
+func (this *Manager) SetRetainConfig(config RetainConfig) error {
+	if c, ok := this.p.(RetainConfigurer); ok {
+		return c.SetRetainConfig(config)
+	}
+
+	return ErrRetainConfigUnsupported
+}
+
 func (this *Manager) Close() error {
 	return this.p.Close()
 }
@@ -0,0 +1,111 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/surgemq/message"
+)
+
+// TTLs finds the TTL set for a topic name among the TTLs set for topic filters.
+// If a topic matches several filters, the most specific one applies, that is the
+// one with a literal level where the others have a wildcard.
+type TTLs struct {
+	root *snode
+}
+
+// ttlRule is the TTL for the topics matching a filter. It's stored as the
+// subscriber of the filter in a subscription tree.
+type ttlRule struct {
+	filter []byte
+	ttl    time.Duration
+}
+
+// NewTTLs returns the TTLs for the topic filters, which are the keys of ttls.
+func NewTTLs(ttls map[string]time.Duration) (*TTLs, error) {
+	this := &TTLs{root: newSNode()}
+
+	for filter, ttl := range ttls {
+		if ttl < 0 {
+			return nil, fmt.Errorf("topics: Invalid TTL %v for topic %q", ttl, filter)
+		}
+
+		rule := &ttlRule{filter: []byte(filter), ttl: ttl}
+		if err := this.root.sinsert(rule.filter, message.QosAtMostOnce, rule); err != nil {
+			return nil, err
+		}
+	}
+
+	return this, nil
+}
+
+// TTL returns the TTL for the topic, and false if the topic doesn't match any of
+// the filters.
+func (this *TTLs) TTL(topic []byte) (time.Duration, bool) {
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	if err := this.root.smatch(topic, message.QosAtMostOnce, &subs, &qoss); err != nil || len(subs) == 0 {
+		return 0, false
+	}
+
+	rule := subs[0].(*ttlRule)
+	for _, sub := range subs[1:] {
+		if r := sub.(*ttlRule); r.moreSpecific(rule) {
+			rule = r
+		}
+	}
+
+	return rule.ttl, true
+}
+
+// moreSpecific() returns true if the rule's filter matches fewer topics than the
+// other's. The levels are compared one by one, where a literal level is more
+// specific than '+', which is more specific than '#'.
+func (this *ttlRule) moreSpecific(other *ttlRule) bool {
+	return moreSpecific(this.filter, other.filter)
+}
+
+// moreSpecific() returns true if the filter t1 matches fewer topics than t2.
+func moreSpecific(t1, t2 []byte) bool {
+	for len(t1) > 0 && len(t2) > 0 {
+		l1, rem1, _ := nextTopicLevel(t1)
+		l2, rem2, _ := nextTopicLevel(t2)
+
+		if r1, r2 := levelRank(l1), levelRank(l2); r1 != r2 {
+			return r1 < r2
+		}
+
+		t1, t2 = rem1, rem2
+	}
+
+	// The longer filter has more levels to match
+	return len(t1) > len(t2)
+}
+
+func levelRank(level []byte) int {
+	switch string(level) {
+	case MWC:
+		return 2
+	case SWC:
+		return 1
+	}
+
+	return 0
+}
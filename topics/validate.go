@@ -0,0 +1,124 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+const (
+	// The longest UTF-8 string the MQTT encoding allows
+	maxTopicLength = 65535
+)
+
+var (
+	// ErrInvalidTopicName is returned for the topic names that are empty, are not
+	// valid UTF-8, or contain the null character or a wildcard.
+	ErrInvalidTopicName = errors.New("topics: Invalid topic name")
+
+	// ErrInvalidTopicFilter is returned for the topic filters that are empty, are
+	// not valid UTF-8, contain the null character, or have a wildcard that doesn't
+	// occupy an entire level, or a '#' that's not at the last level.
+	ErrInvalidTopicFilter = errors.New("topics: Invalid topic filter")
+
+	// ErrTopicTooLong is returned for the topic names and filters longer than
+	// Validator.MaxLength.
+	ErrTopicTooLong = errors.New("topics: Topic too long")
+
+	// ErrTooManyLevels is returned for the topic names and filters with more levels
+	// than Validator.MaxLevels.
+	ErrTooManyLevels = errors.New("topics: Too many topic levels")
+)
+
+// Validator checks that topic names and topic filters follow the rules of the MQTT
+// 3.1.1 spec, and are within the limits set. The zero value, as well as a nil
+// Validator, only checks the rules of the spec.
+type Validator struct {
+	// MaxLength is the maximum length of a topic, in bytes. If not set then default
+	// to 65535, the longest the MQTT encoding allows.
+	MaxLength int
+
+	// MaxLevels is the maximum number of levels in a topic. If not set then there's
+	// no limit.
+	MaxLevels int
+}
+
+// ValidateName checks a topic name, as found in PUBLISH messages.
+func (this *Validator) ValidateName(topic []byte) error {
+	return this.validate(topic, false)
+}
+
+// ValidateFilter checks a topic filter, as found in SUBSCRIBE and UNSUBSCRIBE
+// messages.
+func (this *Validator) ValidateFilter(filter []byte) error {
+	return this.validate(filter, true)
+}
+
+func (this *Validator) validate(topic []byte, filter bool) error {
+	invalid := ErrInvalidTopicName
+	if filter {
+		invalid = ErrInvalidTopicFilter
+	}
+
+	if len(topic) == 0 || !utf8.Valid(topic) {
+		return invalid
+	}
+
+	max, maxLevels := maxTopicLength, 0
+	if this != nil {
+		if this.MaxLength > 0 && this.MaxLength < max {
+			max = this.MaxLength
+		}
+
+		maxLevels = this.MaxLevels
+	}
+
+	if len(topic) > max {
+		return ErrTopicTooLong
+	}
+
+	levels := 1
+
+	// The start of the current level
+	start := 0
+
+	for i, c := range topic {
+		switch c {
+		case 0:
+			return invalid
+
+		case '/':
+			levels++
+			start = i + 1
+
+		case '+':
+			if !filter || i != start || (i+1 < len(topic) && topic[i+1] != '/') {
+				return invalid
+			}
+
+		case '#':
+			if !filter || i != start || i != len(topic)-1 {
+				return invalid
+			}
+		}
+	}
+
+	if maxLevels > 0 && levels > maxLevels {
+		return ErrTooManyLevels
+	}
+
+	return nil
+}
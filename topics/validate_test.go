@@ -0,0 +1,90 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateName(t *testing.T) {
+	var v *Validator
+
+	for _, topic := range []string{"sport/tennis", "/finance", "sport/", "/", "$SYS/uptime", "sport tennis", "日本/東京"} {
+		require.NoError(t, v.ValidateName([]byte(topic)), topic)
+	}
+
+	for _, topic := range []string{"", "sport/+", "sport/#", "#", "+", "sport/ten+nis", "sport\x00", "sport/\xff"} {
+		require.Equal(t, ErrInvalidTopicName, v.ValidateName([]byte(topic)), topic)
+	}
+
+	require.NoError(t, v.ValidateName([]byte(strings.Repeat("a", 65535))))
+	require.Equal(t, ErrTopicTooLong, v.ValidateName([]byte(strings.Repeat("a", 65536))))
+}
+
+func TestValidateFilter(t *testing.T) {
+	v := &Validator{}
+
+	for _, filter := range []string{"sport/tennis", "#", "+", "sport/#", "+/tennis/#", "sport/+/player1", "/+", "+/+", "/#", "sport/"} {
+		require.NoError(t, v.ValidateFilter([]byte(filter)), filter)
+	}
+
+	for _, filter := range []string{"", "sport/tennis#", "sport/#/ranking", "sport+", "sport/+tennis", "#/", "##", "sport\x00/#", "\xc3\x28"} {
+		require.Equal(t, ErrInvalidTopicFilter, v.ValidateFilter([]byte(filter)), filter)
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	v := &Validator{MaxLength: 12, MaxLevels: 3}
+
+	require.NoError(t, v.ValidateName([]byte("a/b/c")))
+	require.NoError(t, v.ValidateFilter([]byte("a/+/#")))
+	require.NoError(t, v.ValidateName([]byte("sport/tennis")))
+
+	require.Equal(t, ErrTooManyLevels, v.ValidateName([]byte("a/b/c/d")))
+	require.Equal(t, ErrTooManyLevels, v.ValidateFilter([]byte("a/+/c/#")))
+	require.Equal(t, ErrTopicTooLong, v.ValidateName([]byte("sport/tennis/")))
+}
+
+func TestMatch(t *testing.T) {
+	matches := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/+", "a/", true},
+		{"+/+", "/a", true},
+		{"+", "/a", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/c", false},
+		{"#", "a/b", true},
+		{"#", "$SYS/a", false},
+		{"+/a", "$SYS/a", false},
+		{"$SYS/#", "$SYS/a", true},
+		{"/a", "/a", true},
+		{"/a", "a", false},
+	}
+
+	for _, m := range matches {
+		require.Equal(t, m.match, Match([]byte(m.filter), []byte(m.topic)), "%s %s", m.filter, m.topic)
+	}
+}
@@ -0,0 +1,459 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhook POSTs the events of an MQTT server, such as clients connecting or
+// messages being published, to an HTTP endpoint as JSON. A Webhook is a service.Hook,
+// registered with Server.Hooks. The events are queued and sent in order by a single
+// goroutine, so the clients never wait for the endpoint.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surge/glog"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// The types of events.
+const (
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+	EventSubscribe  = "subscribe"
+	EventPublish    = "publish"
+)
+
+const (
+	DefaultQueueSize  = 1000
+	DefaultMaxRetries = 3
+	DefaultBackoff    = time.Second
+	DefaultMaxBackoff = 30 * time.Second
+	DefaultTimeout    = 5 * time.Second
+
+	// SignatureHeader is the HTTP header with the signature of the request body,
+	// when Config.Secret is set. See Sign.
+	SignatureHeader = "X-SurgeMQ-Signature"
+
+	// ReasonNormal is the reason of the disconnect events for the clients that sent a
+	// DISCONNECT message.
+	ReasonNormal = "normal"
+)
+
+var (
+	ErrNoURL          = errors.New("webhook: No URL")
+	ErrInvalidEvent   = errors.New("webhook: Invalid event type")
+	ErrQueueFull      = errors.New("webhook: Queue full")
+	ErrWebhookClosed  = errors.New("webhook: Webhook closed")
+	ErrRequestFailed  = errors.New("webhook: Request failed")
+	ErrRequestRefused = errors.New("webhook: Request refused")
+)
+
+// Config configures a Webhook.
+type Config struct {
+	// URL is where the events are POSTed.
+	URL string
+
+	// Events are the types of events sent. If not set then default to all of them.
+	Events []string
+
+	// Topics are the topic filters, e.g. "devices/+/alerts", of the publish events
+	// sent. If not set then there are no publish events.
+	Topics []string
+
+	// Secret is the key of the HMAC-SHA256 signature of the requests, sent in the
+	// SignatureHeader. If not set then the requests are not signed.
+	Secret string
+
+	// QueueSize is the maximum number of events waiting to be sent. Events beyond
+	// that are dropped. If not set then default to 1000.
+	QueueSize int
+
+	// MaxRetries is the number of times a request is sent again after it fails,
+	// i.e., if it gets no response, or a 5xx or 429 status. Other statuses outside
+	// of 2xx drop the event right away. If not set then default to 3 retries. A
+	// negative number means no retries.
+	MaxRetries int
+
+	// Backoff is the time waited before the first retry, doubled for every retry
+	// after that, up to MaxBackoff. If not set then default to 1 second and 30
+	// seconds.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Timeout is the time limit of each request. If not set then default to 5
+	// seconds.
+	Timeout time.Duration
+
+	// Client sends the requests. If not set then a client with Timeout is used.
+	Client *http.Client
+}
+
+// Event is the JSON body of the requests.
+type Event struct {
+	Type string `json:"event"`
+
+	// When the event happened, in Unix milliseconds
+	Timestamp int64 `json:"timestamp"`
+
+	ClientId   string `json:"client_id"`
+	Username   string `json:"username,omitempty"`
+	Tenant     string `json:"tenant,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Why the client disconnected, ReasonNormal if it sent a DISCONNECT message.
+	// Disconnect events only.
+	Reason string `json:"reason,omitempty"`
+
+	// The topic filter of subscribe events, and the topic of publish events.
+	Topic string `json:"topic,omitempty"`
+
+	// The QoS granted by subscribe events, and the QoS of publish events.
+	QoS byte `json:"qos"`
+
+	// The message of publish events, base64 encoded in the JSON.
+	Payload []byte `json:"payload,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+// Stats are the counters of a Webhook.
+type Stats struct {
+	// Events sent successfully
+	Sent int64
+
+	// Events dropped after the last retry, or refused by the endpoint
+	Failed int64
+
+	// Retries of failed requests
+	Retried int64
+
+	// Events dropped because the queue was full, or the webhook closed
+	Dropped int64
+}
+
+// Webhook sends the events of the clients of a server to Config.URL.
+type Webhook struct {
+	service.NopHook
+
+	config Config
+	client *http.Client
+	events map[string]bool
+	topics [][]byte
+
+	queue chan *Event
+	quit  chan struct{}
+	wg    sync.WaitGroup
+
+	closed int32
+
+	sent, failed, retried, dropped int64
+}
+
+var _ service.Hook = (*Webhook)(nil)
+
+// New creates a Webhook, and starts the goroutine that sends its events. Close stops
+// it.
+func New(config Config) (*Webhook, error) {
+	if config.URL == "" {
+		return nil, ErrNoURL
+	}
+
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultMaxRetries
+	}
+
+	if config.Backoff <= 0 {
+		config.Backoff = DefaultBackoff
+	}
+
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultMaxBackoff
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	this := &Webhook{
+		config: config,
+		client: config.Client,
+		events: make(map[string]bool),
+		queue:  make(chan *Event, config.QueueSize),
+		quit:   make(chan struct{}),
+	}
+
+	if this.client == nil {
+		this.client = &http.Client{Timeout: config.Timeout}
+	}
+
+	events := config.Events
+	if len(events) == 0 {
+		events = []string{EventConnect, EventDisconnect, EventSubscribe, EventPublish}
+	}
+
+	for _, e := range events {
+		switch e {
+		case EventConnect, EventDisconnect, EventSubscribe, EventPublish:
+			this.events[e] = true
+
+		default:
+			return nil, fmt.Errorf("%v: %q", ErrInvalidEvent, e)
+		}
+	}
+
+	var v topics.Validator
+	for _, t := range config.Topics {
+		if err := v.ValidateFilter([]byte(t)); err != nil {
+			return nil, fmt.Errorf("%v: %q", err, t)
+		}
+
+		this.topics = append(this.topics, []byte(t))
+	}
+
+	this.wg.Add(1)
+	go this.sender()
+
+	return this, nil
+}
+
+// Close stops sending events. The request being sent, if any, is finished, but its
+// retries and the events still queued are dropped.
+func (this *Webhook) Close() error {
+	if !atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		return nil
+	}
+
+	close(this.quit)
+	this.wg.Wait()
+
+	for {
+		select {
+		case <-this.queue:
+			atomic.AddInt64(&this.dropped, 1)
+
+		default:
+			return nil
+		}
+	}
+}
+
+// Stats returns a snapshot of the counters.
+func (this *Webhook) Stats() Stats {
+	return Stats{
+		Sent:    atomic.LoadInt64(&this.sent),
+		Failed:  atomic.LoadInt64(&this.failed),
+		Retried: atomic.LoadInt64(&this.retried),
+		Dropped: atomic.LoadInt64(&this.dropped),
+	}
+}
+
+func (this *Webhook) OnConnected(client service.ClientInfo) {
+	this.enqueue(newEvent(EventConnect, client))
+}
+
+func (this *Webhook) OnDisconnect(client service.ClientInfo, err error) {
+	e := newEvent(EventDisconnect, client)
+
+	e.Reason = ReasonNormal
+	if err != nil {
+		e.Reason = err.Error()
+	}
+
+	this.enqueue(e)
+}
+
+func (this *Webhook) OnSubscribed(client service.ClientInfo, filter []byte, qos byte) {
+	e := newEvent(EventSubscribe, client)
+	e.Topic = string(filter)
+	e.QoS = qos
+
+	this.enqueue(e)
+}
+
+func (this *Webhook) OnPublish(client service.ClientInfo, msg *message.PublishMessage) error {
+	if !this.events[EventPublish] || !this.matches(msg.Topic()) {
+		return nil
+	}
+
+	e := newEvent(EventPublish, client)
+	e.Topic = string(msg.Topic())
+	e.QoS = msg.QoS()
+	e.Retain = msg.Retain()
+
+	// The payload points into the buffer of the connection
+	e.Payload = append([]byte(nil), msg.Payload()...)
+
+	this.enqueue(e)
+
+	return nil
+}
+
+// Sign returns the value of the SignatureHeader for body, i.e., "sha256=" followed by
+// the hex encoded HMAC-SHA256 of body with secret as the key.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newEvent(typ string, client service.ClientInfo) *Event {
+	e := &Event{
+		Type:      typ,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		ClientId:  client.ClientId,
+		Username:  client.Username,
+		Tenant:    client.Tenant,
+	}
+
+	if client.RemoteAddr != nil {
+		e.RemoteAddr = client.RemoteAddr.String()
+	}
+
+	return e
+}
+
+// matches() returns true if the topic matches one of the filters in Config.Topics.
+func (this *Webhook) matches(topic []byte) bool {
+	for _, t := range this.topics {
+		if topics.Match(t, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// enqueue() queues the event for the sender, unless the event type isn't sent, or the
+// queue is full.
+func (this *Webhook) enqueue(e *Event) {
+	if !this.events[e.Type] {
+		return
+	}
+
+	if atomic.LoadInt32(&this.closed) != 0 {
+		atomic.AddInt64(&this.dropped, 1)
+		return
+	}
+
+	select {
+	case this.queue <- e:
+
+	default:
+		atomic.AddInt64(&this.dropped, 1)
+		glog.Errorf("webhook/enqueue: Dropping %s event of %s: %v", e.Type, e.ClientId, ErrQueueFull)
+	}
+}
+
+// sender() sends the queued events, one at a time.
+func (this *Webhook) sender() {
+	defer this.wg.Done()
+
+	for {
+		select {
+		case <-this.quit:
+			return
+
+		case e := <-this.queue:
+			if err := this.send(e); err != nil {
+				atomic.AddInt64(&this.failed, 1)
+				glog.Errorf("webhook/sender: Error sending %s event of %s to %s: %v", e.Type, e.ClientId, this.config.URL, err)
+			} else {
+				atomic.AddInt64(&this.sent, 1)
+			}
+		}
+	}
+}
+
+// send() POSTs the event, and retries with an exponential backoff if the request
+// fails.
+func (this *Webhook) send(e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	backoff := this.config.Backoff
+
+	for retry := 0; ; retry++ {
+		err = this.post(body)
+		if err != ErrRequestFailed || retry >= this.config.MaxRetries {
+			return err
+		}
+
+		atomic.AddInt64(&this.retried, 1)
+
+		select {
+		case <-this.quit:
+			return ErrWebhookClosed
+
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > this.config.MaxBackoff {
+			backoff = this.config.MaxBackoff
+		}
+	}
+}
+
+// post() sends one request. It returns ErrRequestFailed if the request is worth
+// retrying.
+func (this *Webhook) post(body []byte) error {
+	req, err := http.NewRequest("POST", this.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if this.config.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(this.config.Secret, body))
+	}
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		glog.Debugf("webhook/post: %v", err)
+		return ErrRequestFailed
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		glog.Debugf("webhook/post: %s", resp.Status)
+		return ErrRequestFailed
+	}
+
+	return fmt.Errorf("%v: %s", ErrRequestRefused, resp.Status)
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+)
+
+var client = service.ClientInfo{
+	ClientId:   "device1",
+	Username:   "alice",
+	RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000},
+}
+
+func TestWebhookEvents(t *testing.T) {
+	events := make(chan *Event, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.Header.Get(SignatureHeader) != Sign("secret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		e := &Event{}
+		if err := json.Unmarshal(body, e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		events <- e
+	}))
+	defer srv.Close()
+
+	hook, err := New(Config{
+		URL:    srv.URL,
+		Topics: []string{"alerts/#"},
+		Secret: "secret",
+	})
+	require.NoError(t, err)
+
+	hook.OnConnected(client)
+
+	hook.OnSubscribed(client, []byte("commands/+"), 1)
+
+	for _, topic := range []string{"alerts/fire", "readings/1"} {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(topic))
+		msg.SetPayload([]byte("hot"))
+		msg.SetQoS(1)
+		require.NoError(t, hook.OnPublish(client, msg))
+	}
+
+	hook.OnDisconnect(client, nil)
+	hook.OnDisconnect(client, service.ErrKeepAliveExpired)
+
+	var rcvd []*Event
+	for i := 0; i < 5; i++ {
+		select {
+		case e := <-events:
+			rcvd = append(rcvd, e)
+
+		case <-time.After(time.Second):
+		}
+	}
+
+	require.NoError(t, hook.Close())
+	require.Len(t, rcvd, 5)
+
+	for _, e := range rcvd {
+		require.Equal(t, "device1", e.ClientId)
+		require.Equal(t, "alice", e.Username)
+		require.Equal(t, "127.0.0.1:5000", e.RemoteAddr)
+		require.NotZero(t, e.Timestamp)
+	}
+
+	require.Equal(t, EventConnect, rcvd[0].Type)
+
+	require.Equal(t, EventSubscribe, rcvd[1].Type)
+	require.Equal(t, "commands/+", rcvd[1].Topic)
+	require.Equal(t, byte(1), rcvd[1].QoS)
+
+	require.Equal(t, EventPublish, rcvd[2].Type)
+	require.Equal(t, "alerts/fire", rcvd[2].Topic)
+	require.Equal(t, "hot", string(rcvd[2].Payload))
+
+	require.Equal(t, EventDisconnect, rcvd[3].Type)
+	require.Equal(t, ReasonNormal, rcvd[3].Reason)
+
+	require.Equal(t, EventDisconnect, rcvd[4].Type)
+	require.Equal(t, service.ErrKeepAliveExpired.Error(), rcvd[4].Reason)
+
+	require.Equal(t, Stats{Sent: 5}, hook.Stats())
+}
+
+func TestWebhookRetry(t *testing.T) {
+	var requests int64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt64(&requests, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+
+		case 3:
+			w.WriteHeader(http.StatusOK)
+
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	hook, err := New(Config{
+		URL:     srv.URL,
+		Events:  []string{EventConnect},
+		Backoff: time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	// The first event goes through on the third try, the second is refused
+	hook.OnConnected(client)
+	hook.OnConnected(client)
+
+	// Not sent
+	hook.OnDisconnect(client, nil)
+
+	for i := 0; i < 100 && hook.Stats().Failed == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.NoError(t, hook.Close())
+	require.Equal(t, int64(4), atomic.LoadInt64(&requests))
+	require.Equal(t, Stats{Sent: 1, Failed: 1, Retried: 2}, hook.Stats())
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	started := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+	}))
+	defer srv.Close()
+
+	hook, err := New(Config{
+		URL:       srv.URL,
+		QueueSize: 1,
+	})
+	require.NoError(t, err)
+
+	// The first event is being sent, the second waits in the queue, and the third
+	// doesn't fit.
+	hook.OnConnected(client)
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+	}
+
+	hook.OnConnected(client)
+	hook.OnConnected(client)
+
+	require.Equal(t, int64(1), hook.Stats().Dropped)
+
+	close(unblock)
+
+	for i := 0; i < 100 && hook.Stats().Sent < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.NoError(t, hook.Close())
+	require.Equal(t, Stats{Sent: 2, Dropped: 1}, hook.Stats())
+
+	// Events after Close are dropped
+	hook.OnConnected(client)
+	require.Equal(t, int64(2), hook.Stats().Dropped)
+}
+
+func TestWebhookConfig(t *testing.T) {
+	_, err := New(Config{})
+	require.Equal(t, ErrNoURL, err)
+
+	_, err = New(Config{URL: "http://localhost", Events: []string{"unknown"}})
+	require.Error(t, err)
+
+	_, err = New(Config{URL: "http://localhost", Topics: []string{"a/#/b"}})
+	require.Error(t, err)
+}